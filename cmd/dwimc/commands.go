@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rs/zerolog/log"
+
+	"dwimc/internal/database"
+	"dwimc/internal/encryption"
+	"dwimc/internal/migrations"
+	"dwimc/internal/repositories"
+	"dwimc/internal/services"
+)
+
+// runCommand runs a single maintenance command instead of the service
+func runCommand(config *Config, name string, args []string) error {
+	switch name {
+	case "migrate":
+		return migrate(config, args)
+
+	case "backup":
+		return backup(config, args)
+
+	case "restore":
+		return restore(config, args)
+
+	case "import":
+		return importHistory(config, args)
+
+	case "reencrypt":
+		return reencrypt(config, args)
+
+	default:
+		return fmt.Errorf("unknown command: %s", name)
+	}
+}
+
+// migrate applies pending migrations, usage: dwimc migrate [-dry-run]
+func migrate(config *Config, args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "list pending migrations without applying them")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := database.InitializeDatabase(config.DatabaseURI, config.DatabaseName)
+	if err != nil {
+		return err
+	}
+
+	defer db.Close(context.Background())
+
+	applied, err := migrations.Run(context.Background(), db, *dryRun)
+
+	for _, migration := range applied {
+		log.Info().
+			Int("version", migration.Version).
+			Str("description", migration.Description).
+			Bool("dryRun", *dryRun).
+			Msg("Migration")
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if len(applied) == 0 {
+		log.Info().Msg("Database is up to date")
+	}
+
+	return nil
+}
+
+// backup writes all devices and locations to an archive, usage: dwimc backup [-output file]
+func backup(config *Config, args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("output", "-", "archive file to write, - for stdout")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	backupService, closeDatabase, err := initializeBackupService(config)
+	if err != nil {
+		return err
+	}
+
+	defer closeDatabase()
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+		w = file
+	}
+
+	// the repositories decrypt the coordinates as they are read
+	if config.EncryptionKeys != "" || config.EncryptionKeysFile != "" {
+		log.Warn().
+			Str("output", *output).
+			Msg("The backup holds the coordinates unencrypted, store it as safely as the encryption keys")
+	}
+
+	stats, err := backupService.Backup(context.Background(), w)
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Int64("devices", stats.Devices).
+		Int64("locations", stats.Locations).
+		Str("output", *output).
+		Msg("Backup done")
+
+	return nil
+}
+
+// restore loads an archive written by backup, usage: dwimc restore [-mode merge|replace] [-input file]
+func restore(config *Config, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	input := flags.String("input", "-", "archive file to read, - for stdin")
+	mode := flags.String("mode", string(services.RestoreModeMerge), "merge keeps existing data, replace deletes it first")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	backupService, closeDatabase, err := initializeBackupService(config)
+	if err != nil {
+		return err
+	}
+
+	defer closeDatabase()
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+		r = file
+	}
+
+	stats, err := backupService.Restore(context.Background(), r, services.RestoreMode(*mode))
+	if err != nil {
+		return err
+	}
+
+	log.Info().
+		Int64("devices", stats.Devices).
+		Int64("locations", stats.Locations).
+		Int64("skipped", stats.Skipped).
+		Str("mode", *mode).
+		Msg("Restore done")
+
+	return nil
+}
+
+// initializeRepositories connects to an up to date database, returning its close function
+func initializeRepositories(config *Config) (*repositories.Repositories, func(), error) {
+	ctx := context.Background()
+
+	keyring, err := encryption.LoadKeyring(config.EncryptionKeys, config.EncryptionKeysFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := database.InitializeDatabase(config.DatabaseURI, config.DatabaseName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	closeDatabase := func() {
+		if err := db.Close(ctx); err != nil {
+			log.Warn().Err(err).Msg("Failed to close the database")
+		}
+	}
+
+	pending, err := migrations.Pending(ctx, db)
+	if err != nil {
+		closeDatabase()
+		return nil, nil, err
+	}
+
+	if len(pending) > 0 {
+		closeDatabase()
+		return nil, nil, fmt.Errorf("%d pending migrations, run `dwimc migrate` first", len(pending))
+	}
+
+	repos, err := repositories.InitializeRepositories(ctx, db, keyring)
+	if err != nil {
+		closeDatabase()
+		return nil, nil, err
+	}
+
+	return repos, closeDatabase, nil
+}
+
+func initializeBackupService(config *Config) (services.BackupService, func(), error) {
+	repos, closeDatabase, err := initializeRepositories(config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return services.NewDefaultBackupService(
+		repos.Device,
+		repos.Location,
+		repos.Transactor,
+	), closeDatabase, nil
+}
+
+// importHistory adds a Google Takeout location history to a device,
+// usage: dwimc import -device id [-input file]
+func importHistory(config *Config, args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	deviceID := flags.String("device", "", "id of the device to import the locations to")
+	input := flags.String("input", "-", "Records.json or Timeline.json file to read, - for stdin")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *deviceID == "" {
+		return fmt.Errorf("missing -device")
+	}
+
+	repos, closeDatabase, err := initializeRepositories(config)
+	if err != nil {
+		return err
+	}
+
+	defer closeDatabase()
+
+	var r io.Reader = os.Stdin
+	if *input != "-" {
+		file, err := os.Open(*input)
+		if err != nil {
+			return err
+		}
+
+		defer file.Close()
+		r = file
+	}
+
+	// nobody listens to the events of a one-off command
+	locationService := services.NewDefaultLocationService(
+		repos.Location,
+		repos.Device,
+		repos.Transactor,
+		services.NewDefaultEventBus(),
+		config.LocationHistoryLimit,
+		config.RecordedAtMaxSkew,
+		config.locationPolicy(),
+		config.StationaryRadius,
+	)
+
+	// the service logs the import stats
+	_, err = locationService.ImportHistory(context.Background(), *deviceID, r)
+	return err
+}
+
+// reencrypt encrypts the stored coordinates with the active key, or decrypts them all,
+// usage: dwimc reencrypt [-decrypt]
+func reencrypt(config *Config, args []string) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ExitOnError)
+	decrypt := flags.Bool("decrypt", false, "store all coordinates in plain, before disabling encryption")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	repos, closeDatabase, err := initializeRepositories(config)
+	if err != nil {
+		return err
+	}
+
+	defer closeDatabase()
+
+	if repos.Encryption == nil {
+		return repositories.ErrEncryptionNotSupported
+	}
+
+	rewritten, err := repos.Encryption.Reencrypt(context.Background(), *decrypt)
+
+	log.Info().
+		Int64("rewritten", rewritten).
+		Bool("decrypt", *decrypt).
+		Msg("Re-encrypted the stored coordinates")
+
+	return err
+}
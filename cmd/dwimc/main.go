@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/joho/godotenv"
@@ -15,6 +16,8 @@ import (
 	"github.com/spf13/viper"
 
 	service "dwimc/internal"
+	"dwimc/internal/encryption"
+	"dwimc/internal/services"
 	"dwimc/internal/utils"
 )
 
@@ -27,19 +30,43 @@ func main() {
 
 	initLogger(config)
 
+	if len(os.Args) > 1 {
+		if err := runCommand(config, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Msgf("Failed running command: %s", os.Args[1])
+		}
+		return
+	}
+
 	log.Info().Msg("Starting DWIMC app...")
 
+	keyring, err := encryption.LoadKeyring(config.EncryptionKeys, config.EncryptionKeysFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed loading encryption keys")
+	}
+
 	termChan := make(chan os.Signal, 1)
 	signal.Notify(termChan, syscall.SIGINT, syscall.SIGTERM)
 	isShutingDown := false
 
 	service := service.NewAPIService(service.APIServiceParams{
-		Port:                 config.Port,
-		DatabaseURI:          config.DatabaseURI,
-		DatabaseName:         config.DatabaseName,
-		SecretAPIKey:         config.SecretAPIKey,
-		DebugMode:            config.DebugMode,
-		LocationHistoryLimit: config.LocationHistoryLimit,
+		Port:                    config.Port,
+		DatabaseURI:             config.DatabaseURI,
+		DatabaseName:            config.DatabaseName,
+		SecretAPIKey:            config.SecretAPIKey,
+		DebugMode:               config.DebugMode,
+		RequestTimeout:          config.RequestTimeout,
+		ImportTimeout:           config.ImportTimeout,
+		ImportMaxSize:           config.ImportMaxSize,
+		MigrateOnStartup:        config.MigrateOnStartup,
+		LocationHistoryLimit:    config.LocationHistoryLimit,
+		LocationRetentionPeriod: config.LocationRetentionPeriod,
+		TrashGracePeriod:        config.TrashGracePeriod,
+		Keyring:                 keyring,
+		LocationSpoolDir:        config.LocationSpoolDir,
+		RecordedAtMaxSkew:       config.RecordedAtMaxSkew,
+		IdempotencyKeyTTL:       config.IdempotencyKeyTTL,
+		LocationPolicy:          config.locationPolicy(),
+		StationaryRadius:        config.StationaryRadius,
 	})
 
 	go func() {
@@ -64,14 +91,39 @@ func main() {
 }
 
 type Config struct {
-	Port                 int    `mapstructure:"PORT" validate:"gte=1,lte=65535"`
-	DatabaseURI          string `mapstructure:"DATABASE_URI" validate:"required,nonempty"`
-	DatabaseName         string `mapstructure:"DATABASE_NAME" validate:"required,nonempty"`
-	DebugMode            bool   `mapstructure:"DEBUG_MODE"`
-	LogOutputType        string `mapstructure:"LOG_OUTPUT_TYPE" validate:"oneof=console json"`
-	LogLevel             string `mapstructure:"LOG_LEVEL" validate:"oneof=debug info warn error"`
-	SecretAPIKey         string `mapstructure:"SECRET_API_KEY" validate:"omitempty,nonempty"`
-	LocationHistoryLimit int    `mapstructure:"LOCATION_HISTORY_LIMIT"`
+	Port                    int           `mapstructure:"PORT" validate:"gte=1,lte=65535"`
+	DatabaseURI             string        `mapstructure:"DATABASE_URI" validate:"required,nonempty"`
+	DatabaseName            string        `mapstructure:"DATABASE_NAME" validate:"required,nonempty"`
+	DebugMode               bool          `mapstructure:"DEBUG_MODE"`
+	LogOutputType           string        `mapstructure:"LOG_OUTPUT_TYPE" validate:"oneof=console json"`
+	LogLevel                string        `mapstructure:"LOG_LEVEL" validate:"oneof=debug info warn error"`
+	SecretAPIKey            string        `mapstructure:"SECRET_API_KEY" validate:"omitempty,nonempty"`
+	RequestTimeout          time.Duration `mapstructure:"REQUEST_TIMEOUT" validate:"gt=0s"`
+	ImportTimeout           time.Duration `mapstructure:"IMPORT_TIMEOUT" validate:"gt=0s"`
+	ImportMaxSize           int64         `mapstructure:"IMPORT_MAX_SIZE" validate:"gt=0"`
+	MigrateOnStartup        bool          `mapstructure:"MIGRATE_ON_STARTUP"`
+	LocationHistoryLimit    int           `mapstructure:"LOCATION_HISTORY_LIMIT"`
+	LocationRetentionPeriod time.Duration `mapstructure:"LOCATION_RETENTION_PERIOD" validate:"gte=0s"`
+	TrashGracePeriod        time.Duration `mapstructure:"TRASH_GRACE_PERIOD" validate:"gte=0s"`
+	EncryptionKeys          string        `mapstructure:"ENCRYPTION_KEYS"`
+	EncryptionKeysFile      string        `mapstructure:"ENCRYPTION_KEYS_FILE"`
+	LocationSpoolDir        string        `mapstructure:"LOCATION_SPOOL_DIR"`
+	RecordedAtMaxSkew       time.Duration `mapstructure:"RECORDED_AT_MAX_SKEW" validate:"gte=0s"`
+	IdempotencyKeyTTL       time.Duration `mapstructure:"IDEMPOTENCY_KEY_TTL" validate:"gte=0s"`
+	OutlierMaxAccuracy      float64       `mapstructure:"OUTLIER_MAX_ACCURACY" validate:"gte=0"`
+	OutlierMaxSpeed         float64       `mapstructure:"OUTLIER_MAX_SPEED" validate:"gte=0"`
+	OutlierNullIsland       bool          `mapstructure:"OUTLIER_NULL_ISLAND"`
+	OutlierAction           string        `mapstructure:"OUTLIER_ACTION" validate:"oneof=flag reject"`
+	StationaryRadius        float64       `mapstructure:"STATIONARY_RADIUS" validate:"gte=0"`
+}
+
+func (c *Config) locationPolicy() services.LocationPolicy {
+	return services.LocationPolicy{
+		MaxAccuracy: c.OutlierMaxAccuracy,
+		MaxSpeed:    c.OutlierMaxSpeed,
+		NullIsland:  c.OutlierNullIsland,
+		FlagOnly:    c.OutlierAction == "flag",
+	}
 }
 
 func loadConfig() (*Config, error) {
@@ -95,7 +147,23 @@ func loadConfig() (*Config, error) {
 	viper.SetDefault("LOG_OUTPUT_TYPE", "json")
 	viper.SetDefault("LOG_LEVEL", "info")
 	viper.SetDefault("SECRET_API_KEY", "")
+	viper.SetDefault("REQUEST_TIMEOUT", "10s")
+	viper.SetDefault("IMPORT_TIMEOUT", "10m")
+	viper.SetDefault("IMPORT_MAX_SIZE", 256<<20)
+	viper.SetDefault("MIGRATE_ON_STARTUP", true)
 	viper.SetDefault("LOCATION_HISTORY_LIMIT", 0)
+	viper.SetDefault("LOCATION_RETENTION_PERIOD", "0s")
+	viper.SetDefault("TRASH_GRACE_PERIOD", "720h")
+	viper.SetDefault("ENCRYPTION_KEYS", "")
+	viper.SetDefault("ENCRYPTION_KEYS_FILE", "")
+	viper.SetDefault("LOCATION_SPOOL_DIR", "")
+	viper.SetDefault("RECORDED_AT_MAX_SKEW", "24h")
+	viper.SetDefault("IDEMPOTENCY_KEY_TTL", "24h")
+	viper.SetDefault("OUTLIER_MAX_ACCURACY", 0)
+	viper.SetDefault("OUTLIER_MAX_SPEED", 0)
+	viper.SetDefault("OUTLIER_NULL_ISLAND", false)
+	viper.SetDefault("OUTLIER_ACTION", "reject")
+	viper.SetDefault("STATIONARY_RADIUS", 0)
 
 	var cfg Config
 	if err := viper.Unmarshal(&cfg); err != nil {
@@ -12,9 +12,18 @@ import (
 
 // Devices API
 // GET     /api/devices/ - get user's devices
-// GET     /api/devices/:device_id - get device
+// GET     /api/devices/:device_id - get device, its version as the ETag
 // POST    /api/devices/ - upsert device
-// DELETE  /api/devices/:device_id - delete device
+// PUT     /api/devices/:device_id/retention - set device locations retention period
+// DELETE  /api/devices/:device_id - move device along with its locations to the trash
+// GET     /api/devices/trash - get devices in the trash
+// POST    /api/devices/:device_id/restore - restore device along with the locations deleted with it
+//
+// All :device_id routes (including the locations ones) are also available by the device serial,
+// replacing /api/devices/:device_id with /api/devices/by-serial/:serial
+//
+// The upsert, retention and delete routes honour If-Match with the device ETag,
+// answering 412 once the device changed.
 
 type DeviceRouter struct {
 	service services.DeviceService
@@ -25,7 +34,7 @@ func NewDeviceRouter(service services.DeviceService) *DeviceRouter {
 }
 
 func (r *DeviceRouter) GetAll(c *gin.Context) {
-	devices, err := r.service.GetAll()
+	devices, err := r.service.GetAll(c.Request.Context())
 	if api_utils.HandleErrorResponse(c, err) {
 		return
 	}
@@ -39,11 +48,12 @@ func (r *DeviceRouter) GetAll(c *gin.Context) {
 func (r *DeviceRouter) Get(c *gin.Context) {
 	deviceID := c.Param("device_id")
 
-	device, err := r.service.Get(deviceID)
+	device, err := r.service.Get(c.Request.Context(), deviceID)
 	if api_utils.HandleErrorResponse(c, err) {
 		return
 	}
 
+	api_utils.SetETag(c, device.Version)
 	c.JSON(http.StatusOK, api_model.Response[*model.Device]{
 		Data:  device,
 		Error: nil,
@@ -57,11 +67,48 @@ func (r *DeviceRouter) Create(c *gin.Context) {
 		return
 	}
 
-	device, err := r.service.Create(createParams.Serial, createParams.Name)
+	version, err := api_utils.IfMatchVersion(c)
 	if api_utils.HandleErrorResponse(c, err) {
 		return
 	}
 
+	device, err := r.service.Create(c.Request.Context(), createParams.Serial, createParams.Name, version)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	api_utils.SetETag(c, device.Version)
+	c.JSON(http.StatusOK, api_model.Response[*model.Device]{
+		Data:  device,
+		Error: nil,
+	})
+}
+
+func (r *DeviceRouter) UpdateRetention(c *gin.Context) {
+	deviceID := c.Param("device_id")
+
+	var updateParams api_model.UpdateDeviceRetention
+
+	if api_utils.BindJsonOrErrorResponse(c, &updateParams) {
+		return
+	}
+
+	version, err := api_utils.IfMatchVersion(c)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	device, err := r.service.SetRetentionPeriod(
+		c.Request.Context(),
+		deviceID,
+		*updateParams.RetentionPeriod,
+		version,
+	)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	api_utils.SetETag(c, device.Version)
 	c.JSON(http.StatusOK, api_model.Response[*model.Device]{
 		Data:  device,
 		Error: nil,
@@ -71,13 +118,48 @@ func (r *DeviceRouter) Create(c *gin.Context) {
 func (r *DeviceRouter) Delete(c *gin.Context) {
 	deviceID := c.Param("device_id")
 
-	ok, err := r.service.Delete(deviceID)
+	version, err := api_utils.IfMatchVersion(c)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	ok, deletedLocations, err := r.service.Delete(c.Request.Context(), deviceID, version)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, api_model.Response[api_model.DeleteDeviceResult]{
+		Data: api_model.DeleteDeviceResult{
+			Success:          ok,
+			DeletedLocations: deletedLocations,
+		},
+		Error: nil,
+	})
+}
+
+func (r *DeviceRouter) GetTrash(c *gin.Context) {
+	devices, err := r.service.GetAllDeleted(c.Request.Context())
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, api_model.Response[[]model.Device]{
+		Data:  devices,
+		Error: nil,
+	})
+}
+
+func (r *DeviceRouter) Restore(c *gin.Context) {
+	deviceID := c.Param("device_id")
+
+	device, err := r.service.Restore(c.Request.Context(), deviceID)
 	if api_utils.HandleErrorResponse(c, err) {
 		return
 	}
 
-	c.JSON(http.StatusOK, api_model.Response[api_model.Operation]{
-		Data:  api_model.Operation{Success: ok},
+	api_utils.SetETag(c, device.Version)
+	c.JSON(http.StatusOK, api_model.Response[*model.Device]{
+		Data:  device,
 		Error: nil,
 	})
 }
@@ -1,34 +1,74 @@
 package api
 
 import (
+	"cmp"
 	api_model "dwimc/internal/api/model"
 	api_utils "dwimc/internal/api/utils"
 	"dwimc/internal/model"
 	"dwimc/internal/services"
+	"dwimc/internal/spool"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 // Locations API
-// GET     /api/devices/:device_id/locations - get all locations
-// GET     /api/devices/:device_id/locations/latest - get last known location
-// POST    /api/devices/:device_id/locations - creates new location reporting (there will be limitation for last X locations)
-// DELETE  /api/devices/:device_id/locations - delete all locations
-// DELETE  /api/devices/:device_id/locations/:id - delete specific location
+// GET     /api/devices/:device_id/locations - get all locations, fixes less accurate than ?max_accuracy= (meters) are skipped
+// GET     /api/devices/:device_id/locations/latest - get last known location, same filter
+// POST    /api/devices/:device_id/locations - creates new location reporting (there will be limitation for last X locations),
+//          answers 202 when buffered to the spool while the database is unavailable, unless posted by serial
+// POST    /api/devices/:device_id/locations/batch - creates up to 1000 locations at once, with a result per location
+// DELETE  /api/devices/:device_id/locations - move all locations to the trash
+// DELETE  /api/devices/:device_id/locations/:id - move specific location to the trash
+// GET     /api/devices/:device_id/locations/trash - get locations in the trash
+// POST    /api/devices/:device_id/locations/restore - restore all locations in the trash
+// POST    /api/devices/:device_id/locations/:id/restore - restore specific location
+// POST    /api/devices/:device_id/locations/import - import a Google Takeout location history (multipart file),
+//          answers 413 for a file over IMPORT_MAX_SIZE
+// POST    /api/ingest - upserts a device by its serial and creates a location for it
+// GET     /api/locations/near - get all devices locations near a point, nearest first
+// POST    /api/locations/within - get all devices locations within a polygon
+
+// batch_max_locations bounds the locations of a single batch post
+const batch_max_locations = 1000
+
+// spooled_content_type is the one of the 202 Accepted response, same as gin's JSON responses
+const spooled_content_type = "application/json; charset=utf-8"
 
 type LocationRouter struct {
 	service services.LocationService
+	spool   *spool.Spool
+	// importMaxSize bounds the body of a history import, in bytes
+	importMaxSize int64
 }
 
-func NewLocationRouter(service services.LocationService) *LocationRouter {
-	return &LocationRouter{service: service}
+// NewLocationRouter buffers location posts failing on an unavailable database to the spool, unless nil
+func NewLocationRouter(
+	service services.LocationService,
+	locationSpool *spool.Spool,
+	importMaxSize int64,
+) *LocationRouter {
+	return &LocationRouter{service: service, spool: locationSpool, importMaxSize: importMaxSize}
 }
 
 func (r *LocationRouter) GetAll(c *gin.Context) {
 	deviceID := c.Param("device_id")
 
-	locations, err := r.service.GetAllByDevice(deviceID)
+	var params api_model.FilterLocations
+
+	if api_utils.BindQueryOrErrorResponse(c, &params) {
+		return
+	}
+
+	locations, err := r.service.GetAllByDevice(c.Request.Context(), deviceID, params.Filter())
 	if api_utils.HandleErrorResponse(c, err) {
 		return
 	}
@@ -42,7 +82,13 @@ func (r *LocationRouter) GetAll(c *gin.Context) {
 func (r *LocationRouter) GetLatest(c *gin.Context) {
 	deviceID := c.Param("device_id")
 
-	location, err := r.service.GetLatestByDevice(deviceID)
+	var params api_model.FilterLocations
+
+	if api_utils.BindQueryOrErrorResponse(c, &params) {
+		return
+	}
+
+	location, err := r.service.GetLatestByDevice(c.Request.Context(), deviceID, params.Filter())
 	if api_utils.HandleErrorResponse(c, err) {
 		return
 	}
@@ -55,6 +101,7 @@ func (r *LocationRouter) GetLatest(c *gin.Context) {
 
 func (r *LocationRouter) Create(c *gin.Context) {
 	deviceID := c.Param("device_id")
+	receivedAt := time.Now().UTC().Truncate(time.Millisecond)
 
 	var location api_model.CreateLocation
 
@@ -62,7 +109,36 @@ func (r *LocationRouter) Create(c *gin.Context) {
 		return
 	}
 
-	_, err := r.service.Create(deviceID, location.Latitude, location.Longitude)
+	// validated as of now, a spooled location is validated again as of the time it was received
+	recordedAt, err := r.service.ValidateRecordedAt(location.RecordedAt)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	// the device is verified once replayed
+	if api_utils.IsDeviceUnverified(c) {
+		err := r.service.ValidateCoordinates(*location.Latitude, *location.Longitude)
+		if api_utils.HandleErrorResponse(c, err) {
+			return
+		}
+
+		r.spoolOrErrorResponse(c, deviceID, location, recordedAt, receivedAt, model.ErrDatabase)
+		return
+	}
+
+	_, err = r.service.Create(
+		c.Request.Context(),
+		deviceID,
+		*location.Latitude,
+		*location.Longitude,
+		location.RecordedAt,
+		location.Telemetry,
+	)
+	if r.Spoolable(c) && spool.Retryable(err) {
+		r.spoolOrErrorResponse(c, deviceID, location, recordedAt, receivedAt, err)
+		return
+	}
+
 	if api_utils.HandleErrorResponse(c, err) {
 		return
 	}
@@ -74,10 +150,187 @@ func (r *LocationRouter) Create(c *gin.Context) {
 	})
 }
 
+// CreateMany answers with a result per posted location, invalid ones fail alone
+func (r *LocationRouter) CreateMany(c *gin.Context) {
+	deviceID := c.Param("device_id")
+
+	// each location is validated on its own
+	var items []json.RawMessage
+
+	if api_utils.BindJsonOrErrorResponse(c, &items) {
+		return
+	}
+
+	if len(items) == 0 || len(items) > batch_max_locations {
+		api_utils.HandleErrorResponse(c, model.ErrInvalidArgs)
+		return
+	}
+
+	results := make([]api_model.CreateLocationResult, len(items))
+	locations := make([]model.Location, 0, len(items))
+	// the index of every valid location in the results
+	indexes := make([]int, 0, len(items))
+
+	for i, item := range items {
+		var params api_model.CreateLocation
+
+		if err := json.Unmarshal(item, &params); err != nil {
+			results[i].Error = &api_model.ErrorResponse{Message: err.Error()}
+			continue
+		}
+
+		if err := binding.Validator.ValidateStruct(&params); err != nil {
+			results[i].Error = &api_model.ErrorResponse{Message: err.Error()}
+			continue
+		}
+
+		location := model.Location{
+			Latitude:  *params.Latitude,
+			Longitude: *params.Longitude,
+			Telemetry: params.Telemetry,
+		}
+
+		if params.RecordedAt != nil {
+			location.RecordedAt = *params.RecordedAt
+		}
+
+		locations = append(locations, location)
+		indexes = append(indexes, i)
+	}
+
+	created, err := r.service.CreateMany(c.Request.Context(), deviceID, locations)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	// the failed locations get the message their error would respond with on its own
+	for i, result := range created {
+		if result.Err != nil {
+			_, message, ok := api_utils.ErrorStatus(result.Err)
+			if !ok {
+				message = "Something went wrong"
+			}
+
+			results[indexes[i]].Error = &api_model.ErrorResponse{Message: message}
+			continue
+		}
+
+		results[indexes[i]] = api_model.CreateLocationResult{
+			Success: true,
+			ID:      result.Location.ID.Hex(),
+		}
+	}
+
+	c.JSON(http.StatusOK, api_model.Response[[]api_model.CreateLocationResult]{
+		Data:  results,
+		Error: nil,
+	})
+}
+
+// Spoolable tells whether the request is a location post, buffered while the database is unavailable.
+// By-serial posts are not, their serial being resolved against the database before any spooling.
+func (r *LocationRouter) Spoolable(c *gin.Context) bool {
+	return r.spool != nil &&
+		c.Request.Method == http.MethodPost &&
+		strings.HasSuffix(c.FullPath(), "/locations/") &&
+		!strings.Contains(c.FullPath(), "/by-serial/")
+}
+
+// Importing tells whether the request is a history import, running longer than the other requests
+func (r *LocationRouter) Importing(c *gin.Context) bool {
+	return c.Request.Method == http.MethodPost &&
+		strings.HasSuffix(c.FullPath(), "/locations/import")
+}
+
+// spoolOrErrorResponse buffers the location failed by err, keeping the time it was received at,
+// which is also its recorded time unless reported
+func (r *LocationRouter) spoolOrErrorResponse(
+	c *gin.Context,
+	deviceID string,
+	params api_model.CreateLocation,
+	recordedAt time.Time,
+	receivedAt time.Time,
+	err error,
+) {
+	objectID, idErr := bson.ObjectIDFromHex(deviceID)
+	if idErr != nil {
+		api_utils.HandleErrorResponse(c, model.ErrInvalidArgs)
+		return
+	}
+
+	location := model.Location{
+		ID:         bson.NewObjectIDFromTimestamp(receivedAt),
+		CreatedAt:  receivedAt,
+		UpdatedAt:  receivedAt,
+		RecordedAt: cmp.Or(recordedAt, receivedAt),
+		DeviceID:   objectID,
+		Latitude:   *params.Latitude,
+		Longitude:  *params.Longitude,
+		Telemetry:  params.Telemetry,
+	}
+
+	body, _ := json.Marshal(api_model.Response[api_model.Operation]{
+		Data:  api_model.Operation{Success: true},
+		Error: nil,
+	})
+
+	entry := spool.Entry{Location: location}
+
+	// recorded for the retries of the post once replayed
+	if key, requestHash := api_utils.UnreservedIdempotencyKey(c); key != "" {
+		entry.Idempotency = &spool.IdempotentPost{
+			Key:         key,
+			RequestHash: requestHash,
+			Header:      map[string]string{"Content-Type": spooled_content_type},
+			Body:        body,
+		}
+	}
+
+	if spoolErr := r.spool.Append(entry); spoolErr != nil {
+		log.Error().Err(spoolErr).Str("deviceID", deviceID).Msg("Failed to spool location")
+		api_utils.HandleErrorResponse(c, err)
+		return
+	}
+
+	log.Warn().
+		Err(err).
+		Str("deviceID", deviceID).
+		Str("id", location.ID.Hex()).
+		Msg("Spooled location until the database is available")
+
+	c.Data(http.StatusAccepted, spooled_content_type, body)
+}
+
+func (r *LocationRouter) Ingest(c *gin.Context) {
+	var params api_model.IngestLocation
+
+	if api_utils.BindJsonOrErrorResponse(c, &params) {
+		return
+	}
+
+	device, err := r.service.Ingest(
+		c.Request.Context(),
+		params.Serial,
+		params.Name,
+		*params.Latitude,
+		*params.Longitude,
+		params.RecordedAt,
+		params.Telemetry,
+	)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, api_model.Response[*model.Device]{
+		Data:  device,
+		Error: nil,
+	})
+}
+
 func (r *LocationRouter) DeleteAll(c *gin.Context) {
 	deviceID := c.Param("device_id")
 
-	ok, err := r.service.DeleteAllByDevice(deviceID)
+	ok, err := r.service.DeleteAllByDevice(c.Request.Context(), deviceID)
 	if api_utils.HandleErrorResponse(c, err) {
 		return
 	}
@@ -92,7 +345,7 @@ func (r *LocationRouter) Delete(c *gin.Context) {
 	deviceID := c.Param("device_id")
 	id := c.Param("id")
 
-	ok, err := r.service.Delete(deviceID, id)
+	ok, err := r.service.Delete(c.Request.Context(), deviceID, id)
 	if api_utils.HandleErrorResponse(c, err) {
 		return
 	}
@@ -102,3 +355,136 @@ func (r *LocationRouter) Delete(c *gin.Context) {
 		Error: nil,
 	})
 }
+
+func (r *LocationRouter) GetTrash(c *gin.Context) {
+	deviceID := c.Param("device_id")
+
+	locations, err := r.service.GetDeletedByDevice(c.Request.Context(), deviceID)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, api_model.Response[[]model.Location]{
+		Data:  locations,
+		Error: nil,
+	})
+}
+
+func (r *LocationRouter) RestoreAll(c *gin.Context) {
+	deviceID := c.Param("device_id")
+
+	ok, err := r.service.RestoreAllByDevice(c.Request.Context(), deviceID)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, api_model.Response[api_model.Operation]{
+		Data:  api_model.Operation{Success: ok},
+		Error: nil,
+	})
+}
+
+func (r *LocationRouter) Restore(c *gin.Context) {
+	deviceID := c.Param("device_id")
+	id := c.Param("id")
+
+	ok, err := r.service.Restore(c.Request.Context(), deviceID, id)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, api_model.Response[api_model.Operation]{
+		Data:  api_model.Operation{Success: ok},
+		Error: nil,
+	})
+}
+
+func (r *LocationRouter) Import(c *gin.Context) {
+	deviceID := c.Param("device_id")
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, r.importMaxSize)
+
+	header, err := c.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			c.AbortWithStatusJSON(
+				http.StatusRequestEntityTooLarge,
+				api_model.Response[any]{
+					Error: &api_model.ErrorResponse{
+						Message: fmt.Sprintf("Location history is over %d bytes", r.importMaxSize),
+					},
+				},
+			)
+			return
+		}
+
+		api_utils.HandleErrorResponse(c, model.ErrInvalidArgs)
+		return
+	}
+
+	file, err := header.Open()
+	if err != nil {
+		api_utils.HandleErrorResponse(c, model.ErrInvalidArgs)
+		return
+	}
+
+	defer file.Close()
+
+	stats, err := r.service.ImportHistory(c.Request.Context(), deviceID, file)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, api_model.Response[api_model.ImportLocationsResult]{
+		Data: api_model.ImportLocationsResult{
+			Imported:   stats.Imported,
+			Skipped:    stats.Skipped,
+			Duplicates: stats.Duplicates,
+		},
+		Error: nil,
+	})
+}
+
+func (r *LocationRouter) GetNear(c *gin.Context) {
+	var params api_model.NearLocations
+
+	if api_utils.BindQueryOrErrorResponse(c, &params) {
+		return
+	}
+
+	locations, err := r.service.GetNear(
+		c.Request.Context(),
+		model.Coordinates{
+			Latitude:  params.Latitude,
+			Longitude: params.Longitude,
+		},
+		params.MaxDistance,
+	)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, api_model.Response[[]model.Location]{
+		Data:  locations,
+		Error: nil,
+	})
+}
+
+func (r *LocationRouter) GetWithin(c *gin.Context) {
+	var params api_model.WithinLocations
+
+	if api_utils.BindJsonOrErrorResponse(c, &params) {
+		return
+	}
+
+	locations, err := r.service.GetWithinPolygon(c.Request.Context(), params.Polygon)
+	if api_utils.HandleErrorResponse(c, err) {
+		return
+	}
+
+	c.JSON(http.StatusOK, api_model.Response[[]model.Location]{
+		Data:  locations,
+		Error: nil,
+	})
+}
@@ -0,0 +1,26 @@
+package middlewares
+
+import (
+	api_utils "dwimc/internal/api/utils"
+	"dwimc/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DeviceBySerialMiddleware resolves the serial param into the device_id param,
+// letting the by-serial routes share the device id handlers.
+func DeviceBySerialMiddleware(service services.DeviceService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		device, err := service.GetBySerial(c.Request.Context(), c.Param("serial"))
+		if api_utils.HandleErrorResponse(c, err) {
+			return
+		}
+
+		c.Params = append(c.Params, gin.Param{
+			Key:   "device_id",
+			Value: device.ID.Hex(),
+		})
+
+		c.Next()
+	}
+}
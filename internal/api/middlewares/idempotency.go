@@ -0,0 +1,131 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	api_utils "dwimc/internal/api/utils"
+	"dwimc/internal/model"
+	"dwimc/internal/services"
+	"dwimc/internal/spool"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const IDEMPOTENCY_KEY_HEADER = "Idempotency-Key"
+
+// IDEMPOTENT_REPLAYED_HEADER marks a response replayed from an earlier request
+const IDEMPOTENT_REPLAYED_HEADER = "Idempotent-Replayed"
+
+const idempotency_key_max_length = 255
+
+// idempotency_complete_timeout bounds recording the response, the request context may be done by then
+const idempotency_complete_timeout = 5 * time.Second
+
+// idempotency_replayed_headers are recorded along with the response body
+var idempotency_replayed_headers = []string{"Content-Type", "ETag"}
+
+// IdempotencyMiddleware runs a POST sent with an Idempotency-Key header once,
+// its retries with the same key and body get the recorded response instead.
+// Server errors are not recorded, for the retries to run again. While the database is unavailable,
+// requests run without deduplication so the spooled ones are still accepted, and are deduplicated
+// once replayed (see spool.Replayer). A nil service disables it.
+func IdempotencyMiddleware(service services.IdempotencyService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IDEMPOTENCY_KEY_HEADER)
+		if service == nil || key == "" || c.Request.Method != http.MethodPost {
+			c.Next()
+			return
+		}
+
+		if len(key) > idempotency_key_max_length {
+			api_utils.HandleErrorResponse(c, model.ErrInvalidArgs)
+			return
+		}
+
+		// the body is read again by the handler
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			api_utils.HandleErrorResponse(c, model.ErrInvalidArgs)
+			return
+		}
+
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		hash.Write([]byte(c.Request.Method + " " + c.Request.URL.Path + "\n"))
+		hash.Write(body)
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		recorded, err := service.Begin(c.Request.Context(), key, requestHash)
+		if spool.Retryable(err) {
+			log.Warn().Err(err).Str("key", key).Msg("Running request without idempotency")
+			// a spooled request is deduplicated once replayed
+			api_utils.SetUnreservedIdempotencyKey(c, key, requestHash)
+			c.Next()
+			return
+		}
+
+		if api_utils.HandleErrorResponse(c, err) {
+			return
+		}
+
+		if recorded != nil {
+			for name, value := range recorded.Header {
+				c.Header(name, value)
+			}
+
+			c.Header(IDEMPOTENT_REPLAYED_HEADER, "true")
+			c.Data(recorded.StatusCode, recorded.Header["Content-Type"], recorded.Body)
+			c.Abort()
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		c.Next()
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(c.Request.Context()), idempotency_complete_timeout)
+		defer cancel()
+
+		status := writer.Status()
+		if status >= http.StatusInternalServerError {
+			_ = service.Release(ctx, key)
+			return
+		}
+
+		header := map[string]string{}
+		for _, name := range idempotency_replayed_headers {
+			if value := writer.Header().Get(name); value != "" {
+				header[name] = value
+			}
+		}
+
+		// the key is released for a retry to run again when the response can't be recorded
+		if err := service.Complete(ctx, key, requestHash, status, header, writer.body.Bytes()); err != nil {
+			_ = service.Release(ctx, key)
+		}
+	}
+}
+
+// recordingWriter keeps a copy of the response body
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
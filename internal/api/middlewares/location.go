@@ -4,15 +4,25 @@ import (
 	api_utils "dwimc/internal/api/utils"
 	"dwimc/internal/model"
 	"dwimc/internal/services"
+	"dwimc/internal/spool"
 
 	"github.com/gin-gonic/gin"
 )
 
-func DeviceExistsMiddleware(service services.DeviceService) gin.HandlerFunc {
+// DeviceExistsMiddleware answers requests of a missing device as not found.
+// While the database is unavailable, the requests matched by deferrable are let through unverified
+// (see api_utils.IsDeviceUnverified), for their handler to buffer them.
+func DeviceExistsMiddleware(service services.DeviceService, deferrable func(c *gin.Context) bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		deviceID := c.Param("device_id")
 
-		exists, err := service.Exists(deviceID)
+		exists, err := service.Exists(c.Request.Context(), deviceID)
+		if spool.Retryable(err) && deferrable != nil && deferrable(c) {
+			api_utils.SetDeviceUnverified(c)
+			c.Next()
+			return
+		}
+
 		if api_utils.HandleErrorResponse(c, err) {
 			return
 		}
@@ -0,0 +1,31 @@
+package middlewares
+
+import (
+	"context"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestTimeoutMiddleware sets a deadline to the request context,
+// cancelling any database work still running once it has passed.
+// The requests matched by slow, such as history imports, get slowTimeout instead.
+func RequestTimeoutMiddleware(
+	timeout time.Duration,
+	slowTimeout time.Duration,
+	slow func(c *gin.Context) bool,
+) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deadline := timeout
+		if slow(c) {
+			deadline = slowTimeout
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), deadline)
+		defer cancel()
+
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+	}
+}
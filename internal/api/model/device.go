@@ -9,3 +9,13 @@ type UpdateDevice struct {
 	Serial string `json:"serial" binding:"omitempty,nonempty"`
 	Name   string `json:"name" binding:"omitempty,nonempty"`
 }
+
+type UpdateDeviceRetention struct {
+	// RetentionPeriod in seconds, 0 - uses the default, negative - keeps locations forever
+	RetentionPeriod *int64 `json:"retention_period" binding:"required"`
+}
+
+type DeleteDeviceResult struct {
+	Success          bool  `json:"success"`
+	DeletedLocations int64 `json:"deleted_locations"`
+}
@@ -1,6 +1,56 @@
 package api_model
 
+import (
+	"dwimc/internal/model"
+	"time"
+)
+
+// CreateLocation takes (0,0) as reported by a device without a fix, see services.LocationPolicy.
+// The coordinates are pointers, telling a missing one apart from an explicit 0.
 type CreateLocation struct {
-	Latitude  float64 `json:"latitude" binding:"required,latitude"`
-	Longitude float64 `json:"longitude" binding:"required,longitude"`
-}
\ No newline at end of file
+	Latitude  *float64 `json:"latitude" binding:"required,latitude"`
+	Longitude *float64 `json:"longitude" binding:"required,longitude"`
+	// RecordedAt is when the device took the fix, defaults to the time it's received
+	RecordedAt *time.Time `json:"recorded_at"`
+	model.Telemetry
+}
+
+// CreateLocationResult is the outcome of a single location of a batch, in the posted order
+type CreateLocationResult struct {
+	Success bool           `json:"success"`
+	ID      string         `json:"id,omitempty"`
+	Error   *ErrorResponse `json:"error,omitempty"`
+}
+
+type IngestLocation struct {
+	Serial     string     `json:"serial" binding:"required,nonempty"`
+	Name       string     `json:"name" binding:"required,nonempty"`
+	Latitude   *float64   `json:"latitude" binding:"required,latitude"`
+	Longitude  *float64   `json:"longitude" binding:"required,longitude"`
+	RecordedAt *time.Time `json:"recorded_at"`
+	model.Telemetry
+}
+
+type FilterLocations struct {
+	MaxAccuracy *float64 `form:"max_accuracy" binding:"omitempty,gt=0"`
+}
+
+func (f FilterLocations) Filter() model.LocationFilter {
+	return model.LocationFilter{MaxAccuracy: f.MaxAccuracy}
+}
+
+type NearLocations struct {
+	Latitude    float64 `form:"latitude" binding:"required,latitude"`
+	Longitude   float64 `form:"longitude" binding:"required,longitude"`
+	MaxDistance float64 `form:"max_distance" binding:"required,gt=0"`
+}
+
+type WithinLocations struct {
+	Polygon []model.Coordinates `json:"polygon" binding:"required,min=3,dive"`
+}
+
+type ImportLocationsResult struct {
+	Imported   int64 `json:"imported"`
+	Skipped    int64 `json:"skipped"`
+	Duplicates int64 `json:"duplicates"`
+}
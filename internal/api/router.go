@@ -3,39 +3,52 @@ package api
 import (
 	"dwimc/internal/api/middlewares"
 	"dwimc/internal/services"
+	"dwimc/internal/spool"
 	"dwimc/internal/utils"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/go-playground/validator/v10"
 )
 
+// InitializeStatusRouters serves only the status routes, answering any other route as unavailable.
+// Used until the database is ready to serve the API.
+func InitializeStatusRouters(debugMode bool, isReady func() bool) *gin.Engine {
+	router, statusRouter := initializeEngine(debugMode, isReady)
+	router.NoRoute(statusRouter.Unavailable)
+
+	return router
+}
+
+// InitializeRouters deduplicates the device and location posts sent with an Idempotency-Key header
+// through idempotencyService, unless nil.
+// History imports get importTimeout instead of requestTimeout and are capped at importMaxSize bytes.
 func InitializeRouters(
 	debugMode bool,
 	secretAPIKey string,
+	requestTimeout time.Duration,
+	importTimeout time.Duration,
+	importMaxSize int64,
+	isReady func() bool,
 	deviceService services.DeviceService,
 	locationService services.LocationService,
+	locationSpool *spool.Spool,
+	idempotencyService services.IdempotencyService,
 ) *gin.Engine {
 
-	statusRouter := NewStatusRouter()
 	deviceRouter := NewDeviceRouter(deviceService)
-	locationRouter := NewLocationRouter(locationService)
-
-	if debugMode {
-		gin.SetMode(gin.DebugMode)
-	} else {
-		gin.SetMode(gin.ReleaseMode)
-	}
+	locationRouter := NewLocationRouter(locationService, locationSpool, importMaxSize)
+	idempotent := middlewares.IdempotencyMiddleware(idempotencyService)
 
 	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
 		utils.RegisterValidations(v)
 	}
 
-	router := gin.Default()
-	router.GET("/healthz", statusRouter.Health)
-	router.GET("/livez", statusRouter.Live)
+	router, _ := initializeEngine(debugMode, isReady)
 
 	apiGroup := router.Group("/api")
+	apiGroup.Use(middlewares.RequestTimeoutMiddleware(requestTimeout, importTimeout, locationRouter.Importing))
 
 	// sets auth middleware
 	if len(secretAPIKey) > 0 {
@@ -46,18 +59,62 @@ func InitializeRouters(
 	deviceGroup := apiGroup.Group("/devices")
 	deviceGroup.GET("/", deviceRouter.GetAll)
 	deviceGroup.GET("/:device_id", deviceRouter.Get)
-	deviceGroup.POST("/", deviceRouter.Create)
+	deviceGroup.POST("/", idempotent, deviceRouter.Create)
+	deviceGroup.PUT("/:device_id/retention", deviceRouter.UpdateRetention)
 	deviceGroup.DELETE("/:device_id", deviceRouter.Delete)
+	deviceGroup.GET("/trash", deviceRouter.GetTrash)
+	deviceGroup.POST("/:device_id/restore", deviceRouter.Restore)
 
 	// setup location routes
 	locationGroup := deviceGroup.Group("/:device_id/locations")
-	locationGroup.Use(middlewares.DeviceExistsMiddleware(deviceService))
+	locationGroup.Use(middlewares.DeviceExistsMiddleware(deviceService, locationRouter.Spoolable))
+	setupLocationRoutes(locationGroup, locationRouter, idempotent)
+
+	// setup the same device and location routes by the device serial
+	serialGroup := deviceGroup.Group("/by-serial/:serial")
+	serialGroup.Use(middlewares.DeviceBySerialMiddleware(deviceService))
+	serialGroup.GET("", deviceRouter.Get)
+	serialGroup.PUT("/retention", deviceRouter.UpdateRetention)
+	serialGroup.DELETE("", deviceRouter.Delete)
+	setupLocationRoutes(serialGroup.Group("/locations"), locationRouter, idempotent)
+
+	apiGroup.POST("/ingest", idempotent, locationRouter.Ingest)
+
+	// setup spatial routes across all devices
+	spatialGroup := apiGroup.Group("/locations")
+	spatialGroup.GET("/near", locationRouter.GetNear)
+	spatialGroup.POST("/within", locationRouter.GetWithin)
+
+	return router
+}
+
+func initializeEngine(debugMode bool, isReady func() bool) (*gin.Engine, *StatusRouter) {
+	statusRouter := NewStatusRouter(isReady)
+
+	if debugMode {
+		gin.SetMode(gin.DebugMode)
+	} else {
+		gin.SetMode(gin.ReleaseMode)
+	}
 
+	router := gin.Default()
+	router.GET("/healthz", statusRouter.Health)
+	router.GET("/livez", statusRouter.Live)
+	router.GET("/readyz", statusRouter.Ready)
+
+	return router, statusRouter
+}
+
+// setupLocationRoutes runs the location posts through idempotent
+func setupLocationRoutes(locationGroup *gin.RouterGroup, locationRouter *LocationRouter, idempotent gin.HandlerFunc) {
 	locationGroup.GET("/", locationRouter.GetAll)
 	locationGroup.GET("/latest", locationRouter.GetLatest)
-	locationGroup.POST("/", locationRouter.Create)
+	locationGroup.POST("/", idempotent, locationRouter.Create)
+	locationGroup.POST("/batch", idempotent, locationRouter.CreateMany)
 	locationGroup.DELETE("/", locationRouter.DeleteAll)
 	locationGroup.DELETE("/:id", locationRouter.Delete)
-
-	return router
+	locationGroup.GET("/trash", locationRouter.GetTrash)
+	locationGroup.POST("/restore", locationRouter.RestoreAll)
+	locationGroup.POST("/:id/restore", locationRouter.Restore)
+	locationGroup.POST("/import", locationRouter.Import)
 }
@@ -1,17 +1,18 @@
 package api
 
 import (
+	api_model "dwimc/internal/api/model"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
 )
 
 type StatusRouter struct {
-
+	isReady func() bool
 }
 
-func NewStatusRouter() *StatusRouter {
-	return &StatusRouter{}
+func NewStatusRouter(isReady func() bool) *StatusRouter {
+	return &StatusRouter{isReady: isReady}
 }
 
 func (r *StatusRouter) Health(c *gin.Context) {
@@ -22,4 +23,30 @@ func (r *StatusRouter) Health(c *gin.Context) {
 
 func (r *StatusRouter) Live(c *gin.Context) {
 	c.Status(http.StatusOK)
-}
\ No newline at end of file
+}
+
+// Ready reports whether the service is connected to its database and serving the API
+func (r *StatusRouter) Ready(c *gin.Context) {
+	if !r.isReady() {
+		c.JSON(http.StatusServiceUnavailable, map[string]string{
+			"status": "not ready",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, map[string]string{
+		"status": "ready",
+	})
+}
+
+// Unavailable answers any API route until the service is ready
+func (r *StatusRouter) Unavailable(c *gin.Context) {
+	c.AbortWithStatusJSON(
+		http.StatusServiceUnavailable,
+		api_model.Response[any]{
+			Error: &api_model.ErrorResponse{
+				Message: "Service unavailable",
+			},
+		},
+	)
+}
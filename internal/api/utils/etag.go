@@ -0,0 +1,39 @@
+package api_utils
+
+import (
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// SetETag exposes the item version as a strong entity tag. It covers the fields set through the API,
+// not the ones the service keeps up to date (such as the device last location), guarding the updates
+// conditioned by If-Match rather than the whole representation.
+func SetETag(c *gin.Context, version int64) {
+	c.Header("ETag", strconv.Quote(strconv.FormatInt(version, 10)))
+}
+
+// IfMatchVersion returns the version required by the If-Match header, 0 when any version matches.
+// Only a single strong entity tag is supported, anything else can never match.
+func IfMatchVersion(c *gin.Context) (int64, error) {
+	value := strings.TrimSpace(c.GetHeader("If-Match"))
+	if value == "" || value == "*" {
+		return 0, nil
+	}
+
+	if len(value) > 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		version, err := strconv.ParseInt(value[1:len(value)-1], 10, 64)
+		if err == nil && version > 0 {
+			return version, nil
+		}
+	}
+
+	return 0, utils.AsError(
+		model.ErrPreconditionFailed,
+		fmt.Sprintf("unsupported If-Match: %s", value),
+	)
+}
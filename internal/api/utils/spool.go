@@ -0,0 +1,36 @@
+package api_utils
+
+import "github.com/gin-gonic/gin"
+
+// device_unverified_key marks a request let through while its device could not be verified,
+// the database being unavailable.
+const device_unverified_key = "device_unverified"
+
+func SetDeviceUnverified(c *gin.Context) {
+	c.Set(device_unverified_key, true)
+}
+
+func IsDeviceUnverified(c *gin.Context) bool {
+	return c.GetBool(device_unverified_key)
+}
+
+// unreserved_idempotency_key_key holds the Idempotency-Key of a request let through without deduplication,
+// the database being unavailable, along with the hash of the request.
+const unreserved_idempotency_key_key = "unreserved_idempotency_key"
+
+type unreservedIdempotencyKey struct {
+	key         string
+	requestHash string
+}
+
+func SetUnreservedIdempotencyKey(c *gin.Context, key string, requestHash string) {
+	c.Set(unreserved_idempotency_key_key, unreservedIdempotencyKey{key: key, requestHash: requestHash})
+}
+
+// UnreservedIdempotencyKey returns an empty key unless the request was let through without deduplication
+func UnreservedIdempotencyKey(c *gin.Context) (key string, requestHash string) {
+	value, _ := c.Get(unreserved_idempotency_key_key)
+	unreserved, _ := value.(unreservedIdempotencyKey)
+
+	return unreserved.key, unreserved.requestHash
+}
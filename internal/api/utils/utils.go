@@ -18,84 +18,88 @@ func BindJsonOrErrorResponse(c *gin.Context, obj any) bool {
 	return false
 }
 
+func BindQueryOrErrorResponse(c *gin.Context, obj any) bool {
+	if err := c.ShouldBindQuery(obj); err != nil {
+		return HandleErrorResponse(c, model.ErrInvalidArgs)
+	}
+
+	return false
+}
+
 func HandleErrorResponse(c *gin.Context, err error) bool {
 	if err == nil {
 		return false
 	}
 
-	switch {
-	case errors.Is(err, model.ErrDatabase),
-		errors.Is(err, model.ErrOperationFailed),
-		errors.Is(err, model.ErrInternal):
-		log.Error().
+	// the request deadline has passed or the client went away
+	if ctxErr := c.Request.Context().Err(); ctxErr != nil {
+		log.Warn().
 			Err(err).
-			Msg("something went wrong")
+			AnErr("reason", ctxErr).
+			Msg("request was cancelled")
 
 		c.AbortWithStatusJSON(
-			http.StatusInternalServerError,
+			http.StatusServiceUnavailable,
 			api_model.Response[any]{
 				Error: &api_model.ErrorResponse{
-					Message: "Something went wrong",
+					Message: "Request timeout",
 				},
 			},
 		)
 		return true
+	}
 
-	case errors.Is(err, model.ErrItemNotFound):
-		c.AbortWithStatusJSON(
-			http.StatusNotFound,
-			api_model.Response[any]{
-				Error: &api_model.ErrorResponse{
-					Message: "Not found",
-				},
+	status, message, ok := ErrorStatus(err)
+	if !ok {
+		return false
+	}
+
+	if status == http.StatusInternalServerError {
+		log.Error().
+			Err(err).
+			Msg("something went wrong")
+	}
+
+	c.AbortWithStatusJSON(
+		status,
+		api_model.Response[any]{
+			Error: &api_model.ErrorResponse{
+				Message: message,
 			},
-		)
-		return true
+		},
+	)
+	return true
+}
+
+// ErrorStatus maps a model error to the status and message of its response, ok is false for other errors
+func ErrorStatus(err error) (status int, message string, ok bool) {
+	switch {
+	case errors.Is(err, model.ErrDatabase),
+		errors.Is(err, model.ErrOperationFailed),
+		errors.Is(err, model.ErrInternal):
+		return http.StatusInternalServerError, "Something went wrong", true
+
+	case errors.Is(err, model.ErrItemNotFound):
+		return http.StatusNotFound, "Not found", true
 
 	case errors.Is(err, model.ErrItemConflict):
-		c.AbortWithStatusJSON(
-			http.StatusConflict,
-			api_model.Response[any]{
-				Error: &api_model.ErrorResponse{
-					Message: "Conflict",
-				},
-			},
-		)
-		return true
+		return http.StatusConflict, "Conflict", true
+
+	case errors.Is(err, model.ErrPreconditionFailed):
+		return http.StatusPreconditionFailed, "Precondition failed", true
+
+	case errors.Is(err, model.ErrNotSupported):
+		return http.StatusNotImplemented, "Not supported", true
 
 	case errors.Is(err, model.ErrInvalidArgs):
-		c.AbortWithStatusJSON(
-			http.StatusBadRequest,
-			api_model.Response[any]{
-				Error: &api_model.ErrorResponse{
-					Message: "Bad request",
-				},
-			},
-		)
-		return true
+		return http.StatusBadRequest, "Bad request", true
 
 	case errors.Is(err, model.ErrUnauthenticated):
-		c.AbortWithStatusJSON(
-			http.StatusUnauthorized,
-			api_model.Response[any]{
-				Error: &api_model.ErrorResponse{
-					Message: "Unauthenticated",
-				},
-			},
-		)
-		return true
+		return http.StatusUnauthorized, "Unauthenticated", true
 
 	case errors.Is(err, model.ErrUnauthorized):
-		c.AbortWithStatusJSON(
-			http.StatusForbidden,
-			api_model.Response[any]{
-				Error: &api_model.ErrorResponse{
-					Message: "Unauthorized",
-				},
-			},
-		)
-		return true
+		return http.StatusForbidden, "Unauthorized", true
 	}
 
-	return false
+	return 0, "", false
 }
@@ -4,86 +4,423 @@ import (
 	"context"
 	"dwimc/internal/api"
 	"dwimc/internal/database"
+	"dwimc/internal/encryption"
+	"dwimc/internal/migrations"
 	"dwimc/internal/repositories"
 	"dwimc/internal/services"
-	_ "dwimc/internal/utils"
+	"dwimc/internal/spool"
+	"dwimc/internal/utils"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
-	"go.mongodb.org/mongo-driver/v2/mongo"
 )
 
 const stop_timeout = 5 * time.Second
+const retention_sweep_interval = time.Hour
+const trash_sweep_interval = time.Hour
+const event_log_queue_size = 256
+const spool_replay_interval = 10 * time.Second
+const idempotency_sweep_interval = time.Hour
+
+// the database connection is retried with an exponential backoff between these intervals
+const connect_retry_min_interval = time.Second
+const connect_retry_max_interval = 30 * time.Second
+
+// errOutdatedSchema stops the service instead of retrying, the schema won't migrate itself
+var errOutdatedSchema = errors.New("outdated database schema")
 
 type APIService struct {
 	params APIServiceParams
-	client *mongo.Client
 	server *http.Server
+	// cancels all in-flight requests contexts when stopping
+	cancel context.CancelFunc
+
+	// database is set once connected, guarded by mutex since connecting runs in the background
+	mutex    sync.Mutex
+	database database.Database
+
+	// router serves the status routes only, until the database is ready
+	router atomic.Pointer[gin.Engine]
+	ready  atomic.Bool
+
+	events services.EventBus
+	// spool buffers location posts while the database is unavailable, nil when disabled
+	spool *spool.Spool
 }
 
 type APIServiceParams struct {
-	Port                 int
-	DatabaseURI          string
-	DatabaseName         string
-	SecretAPIKey         string
-	DebugMode            bool
-	LocationHistoryLimit int
+	Port                    int
+	DatabaseURI             string
+	DatabaseName            string
+	SecretAPIKey            string
+	DebugMode               bool
+	RequestTimeout          time.Duration
+	MigrateOnStartup        bool
+	LocationHistoryLimit    int
+	LocationRetentionPeriod time.Duration
+	TrashGracePeriod        time.Duration
+	// ImportTimeout replaces RequestTimeout for history imports, capped at ImportMaxSize bytes
+	ImportTimeout time.Duration
+	ImportMaxSize int64
+	// Keyring encrypts the stored coordinates, nil stores them in plain
+	Keyring *encryption.Keyring
+	// LocationSpoolDir holds the location posts buffered while the database is unavailable, empty disables it
+	LocationSpoolDir string
+	// RecordedAtMaxSkew rejects locations reported as recorded longer ago, 0 accepts any delay
+	RecordedAtMaxSkew time.Duration
+	// IdempotencyKeyTTL is how long the responses of requests sent with an Idempotency-Key are replayed,
+	// 0 disables deduplicating them
+	IdempotencyKeyTTL time.Duration
+	// LocationPolicy screens new locations for outliers, the zero value accepts all of them
+	LocationPolicy services.LocationPolicy
+	// StationaryRadius in meters, locations within it of the latest one refresh it instead of being added,
+	// 0 adds all of them
+	StationaryRadius float64
 }
 
-func NewAPIService(params APIServiceParams) APIService {
-	return APIService{
+func NewAPIService(params APIServiceParams) *APIService {
+	events := services.NewDefaultEventBus()
+	events.Subscribe("log", event_log_queue_size, logEvent)
+
+	return &APIService{
 		params: params,
+		events: events,
 	}
 }
 
+// Events is the bus of device and location changes, integrations subscribe to it before starting
+func (s *APIService) Events() services.EventBus {
+	return s.events
+}
+
+// Start serves the status routes right away, the API is served once connected to the database.
+// Returns when the server stops or the database can never be used.
 func (s *APIService) Start() error {
 	log.Info().Msg("Starting service...")
 
-	client, err := database.InitializeDatabase(s.params.DatabaseURI)
+	baseContext, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+
+	s.router.Store(api.InitializeStatusRouters(s.params.DebugMode, s.ready.Load))
+
+	if s.params.LocationSpoolDir != "" {
+		locationSpool, err := spool.Open(s.params.LocationSpoolDir)
+		if err != nil {
+			return err
+		}
+
+		s.spool = locationSpool
+	}
+
+	s.server = &http.Server{
+		Addr: fmt.Sprintf(":%d", s.params.Port),
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			s.router.Load().ServeHTTP(w, r)
+		}),
+		BaseContext: func(net.Listener) context.Context {
+			return baseContext
+		},
+	}
+
+	errs := make(chan error, 2)
+
+	go func() {
+		errs <- s.connect(baseContext)
+	}()
+
+	go func() {
+		errs <- s.server.ListenAndServe()
+	}()
+
+	log.Debug().Msgf("Starting server on: %v", s.server.Addr)
+
+	for {
+		// a successful connection keeps the server running
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+}
+
+// connect retries connecting to the database until it succeeds, then serves the API.
+// An outdated schema or missing encryption keys are not retried.
+func (s *APIService) connect(ctx context.Context) error {
+	retryInterval := connect_retry_min_interval
+
+	for {
+		repos, err := s.initializeRepositories(ctx)
+		if err == nil {
+			s.serve(ctx, repos)
+			return nil
+		}
+
+		if errors.Is(err, errOutdatedSchema) ||
+			errors.Is(err, repositories.ErrMissingEncryptionKey) ||
+			errors.Is(err, repositories.ErrEncryptionNotSupported) {
+			return err
+		}
+
+		log.Warn().
+			Err(err).
+			Dur("retryIn", retryInterval).
+			Msg("Database is not available")
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(retryInterval):
+		}
+
+		retryInterval = min(retryInterval*2, connect_retry_max_interval)
+	}
+}
+
+// serve starts the background sweepers and replaces the status router with the API one
+func (s *APIService) serve(ctx context.Context, repos *repositories.Repositories) {
+	deviceService := services.NewDefaultDeviceService(
+		repos.Device,
+		repos.Location,
+		repos.Transactor,
+		s.events,
+	)
+
+	go deleteOrphanedLocations(ctx, deviceService)
+	go sweepExpiredLocations(ctx, deviceService, s.params.LocationRetentionPeriod)
+	go sweepTrash(ctx, deviceService, s.params.TrashGracePeriod)
+
+	locationService := services.NewDefaultLocationService(
+		repos.Location,
+		repos.Device,
+		repos.Transactor,
+		s.events,
+		s.params.LocationHistoryLimit,
+		s.params.RecordedAtMaxSkew,
+		s.params.LocationPolicy,
+		s.params.StationaryRadius,
+	)
+
+	var idempotencyService services.IdempotencyService
+	if s.params.IdempotencyKeyTTL > 0 {
+		idempotencyService = services.NewDefaultIdempotencyService(repos.Idempotency, s.params.IdempotencyKeyTTL)
+		go sweepIdempotencyKeys(ctx, idempotencyService)
+	}
+
+	if s.spool != nil {
+		go replaySpool(ctx, s.spool, spool.Replayer(locationService, idempotencyService))
+	}
+
+	s.router.Store(api.InitializeRouters(
+		s.params.DebugMode,
+		s.params.SecretAPIKey,
+		s.params.RequestTimeout,
+		s.params.ImportTimeout,
+		s.params.ImportMaxSize,
+		s.ready.Load,
+		deviceService,
+		locationService,
+		s.spool,
+		idempotencyService,
+	))
+
+	s.ready.Store(true)
+
+	log.Info().Msg("Starting service... DONE")
+}
+
+func (s *APIService) initializeRepositories(ctx context.Context) (*repositories.Repositories, error) {
+	db, err := database.InitializeDatabase(s.params.DatabaseURI, s.params.DatabaseName)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to initialize the database")
-		return err
+		return nil, err
 	}
 
-	s.client = client
+	if _, ok := db.(*database.MemoryDatabase); ok {
+		log.Warn().Msg("Using in-memory database, all data will be lost on shutdown")
+	}
 
-	context := context.Background()
+	// indexes are created by the migrations, once the database is reachable
+	if err := s.migrate(ctx, db); err != nil {
+		closeDatabase(db)
+		return nil, err
+	}
 
-	deviceRepo, err := repositories.NewMongodbDeviceRepository(context, client, s.params.DatabaseName)
+	repos, err := repositories.InitializeRepositories(ctx, db, s.params.Keyring)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to initialize device repository")
-		return err
+		closeDatabase(db)
+		return nil, err
 	}
 
-	locationRepo, err := repositories.NewMongodbLocationRepository(context, client, s.params.DatabaseName)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// stopped while connecting
+	if ctx.Err() != nil {
+		closeDatabase(db)
+		return nil, ctx.Err()
+	}
+
+	s.database = db
+
+	return repos, nil
+}
+
+func closeDatabase(db database.Database) {
+	cctx, cancel := context.WithTimeout(context.Background(), stop_timeout)
+	defer cancel()
+
+	if err := db.Close(cctx); err != nil {
+		log.Warn().Err(err).Msg("Failed to close the database")
+	}
+}
+
+// migrate applies pending migrations when enabled, otherwise refuses to start on an outdated schema
+func (s *APIService) migrate(ctx context.Context, db database.Database) error {
+	if !s.params.MigrateOnStartup {
+		pending, err := migrations.Pending(ctx, db)
+		if err != nil {
+			return err
+		}
+
+		if len(pending) > 0 {
+			return utils.AsError(
+				errOutdatedSchema,
+				fmt.Sprintf("%d pending migrations, run `dwimc migrate` first", len(pending)),
+			)
+		}
+
+		return nil
+	}
+
+	applied, err := migrations.Run(ctx, db, false)
 	if err != nil {
-		log.Error().Err(err).Msg("Failed to initialize location repository")
 		return err
 	}
 
-	router := api.InitializeRouters(
-		s.params.DebugMode,
-		s.params.SecretAPIKey,
-		services.NewDefaultDeviceService(
-			deviceRepo,
-			locationRepo,
-		),
-		services.NewDefaultLocationService(
-			locationRepo,
-			s.params.LocationHistoryLimit,
-		),
-	)
+	if len(applied) > 0 {
+		log.Info().Int("applied", len(applied)).Msg("Migrated the database")
+	}
 
-	s.server = &http.Server{
-		Addr:    fmt.Sprintf(":%d", s.params.Port),
-		Handler: router,
+	return nil
+}
+
+// deleteOrphanedLocations cleans up locations left behind by devices deleted in earlier versions,
+// or by device deletions interrupted without transactions
+func deleteOrphanedLocations(ctx context.Context, deviceService services.DeviceService) {
+	deleted, err := deviceService.DeleteOrphanedLocations(ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to delete orphaned locations")
+		return
 	}
 
-	log.Debug().Msgf("Starting server on: %v", s.server.Addr)
-	log.Info().Msg("Starting service... DONE")
-	return s.server.ListenAndServe()
+	if deleted > 0 {
+		log.Info().Int64("deleted", deleted).Msg("Deleted orphaned locations")
+	}
+}
+
+// sweepExpiredLocations periodically deletes locations past their retention period,
+// runs even without a default period since devices may override it.
+func sweepExpiredLocations(ctx context.Context, deviceService services.DeviceService, retention time.Duration) {
+	sweep(ctx, retention_sweep_interval, func() {
+		deleted, err := deviceService.DeleteExpiredLocations(ctx, retention)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to delete expired locations")
+		} else if deleted > 0 {
+			log.Info().Int64("deleted", deleted).Msg("Deleted expired locations")
+		}
+	})
+}
+
+// sweepTrash periodically purges devices and locations kept in the trash longer than the grace period,
+// a grace period of 0 keeps the trash forever.
+func sweepTrash(ctx context.Context, deviceService services.DeviceService, grace time.Duration) {
+	if grace <= 0 {
+		return
+	}
+
+	sweep(ctx, trash_sweep_interval, func() {
+		devices, locations, err := deviceService.PurgeDeleted(ctx, time.Now().UTC().Add(-grace))
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to purge the trash")
+		} else if devices > 0 || locations > 0 {
+			log.Info().
+				Int64("devices", devices).
+				Int64("locations", locations).
+				Msg("Purged the trash")
+		}
+	})
+}
+
+// replaySpool records the location posts buffered while the database was unavailable, in order
+func replaySpool(ctx context.Context, locationSpool *spool.Spool, replay spool.ReplayFunc) {
+	sweep(ctx, spool_replay_interval, func() {
+		replayed, err := locationSpool.Replay(ctx, replay)
+		if err != nil {
+			log.Warn().Err(err).Int("replayed", replayed).Msg("Failed to replay the spooled locations")
+		} else if replayed > 0 {
+			log.Info().Int("replayed", replayed).Msg("Replayed the spooled locations")
+		}
+	})
+}
+
+// sweepIdempotencyKeys periodically deletes the expired idempotency keys
+func sweepIdempotencyKeys(ctx context.Context, idempotencyService services.IdempotencyService) {
+	sweep(ctx, idempotency_sweep_interval, func() {
+		deleted, err := idempotencyService.DeleteExpired(ctx)
+		if err != nil {
+			log.Warn().Err(err).Msg("Failed to delete expired idempotency keys")
+		} else if deleted > 0 {
+			log.Info().Int64("deleted", deleted).Msg("Deleted expired idempotency keys")
+		}
+	})
+}
+
+// logEvent logs the ids of what changed, never the coordinates of the locations
+func logEvent(ctx context.Context, event services.Event) {
+	entry := log.Debug().Str("event", event.EventType())
+
+	switch event := event.(type) {
+	case services.DeviceCreated:
+		entry = entry.Str("deviceID", event.Device.ID.Hex())
+
+	case services.DeviceDeleted:
+		entry = entry.Str("deviceID", event.DeviceID).Int64("locations", event.Locations)
+
+	case services.DeviceRestored:
+		entry = entry.Str("deviceID", event.Device.ID.Hex()).Int64("locations", event.Locations)
+
+	case services.LocationRecorded:
+		entry = entry.Str("deviceID", event.Location.DeviceID.Hex()).Str("id", event.Location.ID.Hex())
+
+	case services.LocationRefreshed:
+		entry = entry.Str("deviceID", event.Location.DeviceID.Hex()).Str("id", event.Location.ID.Hex())
+
+	case services.LocationsPurged:
+		entry = entry.Str("deviceID", event.DeviceID).Int64("count", event.Count).Str("reason", string(event.Reason))
+	}
+
+	entry.Msg("Published event")
+}
+
+// sweep runs the job right away and then on every interval until the context is done
+func sweep(ctx context.Context, interval time.Duration, job func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		job()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
 func (s *APIService) Stop() error {
@@ -92,6 +429,8 @@ func (s *APIService) Stop() error {
 
 	var err1, err2 error
 
+	s.ready.Store(false)
+
 	if s.server != nil {
 		cctx, cancel := context.WithTimeout(context.Background(), stop_timeout)
 		defer cancel()
@@ -99,11 +438,35 @@ func (s *APIService) Stop() error {
 		err1 = s.server.Shutdown(cctx)
 	}
 
-	if s.client != nil {
+	// requests still running after the graceful shutdown are cancelled
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	// subscribers may still use the database
+	cctx, cancel := context.WithTimeout(context.Background(), stop_timeout)
+	defer cancel()
+
+	if err := s.events.Close(cctx); err != nil {
+		log.Warn().Err(err).Msg("Failed to drain the event subscribers")
+	}
+
+	// no more requests to spool, the rest is replayed on the next start
+	if s.spool != nil {
+		if err := s.spool.Close(); err != nil {
+			log.Warn().Err(err).Msg("Failed to close the location spool")
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.database != nil {
 		cctx, cancel := context.WithTimeout(context.Background(), stop_timeout)
 		defer cancel()
 
-		err2 = s.client.Disconnect(cctx)
+		err2 = s.database.Close(cctx)
+		s.database = nil
 	}
 
 	if err1 != nil && err2 == nil {
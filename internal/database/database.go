@@ -0,0 +1,83 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+const DB_OP_TIMEOUT_DURATION = 5 * time.Second
+const DB_POOL_SIZE = 3
+
+// Database is a connected storage backend, selected by the database uri scheme
+type Database interface {
+	Close(ctx context.Context) error
+}
+
+type MongodbDatabase struct {
+	Client *mongo.Client
+	Name   string
+}
+
+func (d *MongodbDatabase) Close(ctx context.Context) error {
+	return d.Client.Disconnect(ctx)
+}
+
+type SqliteDatabase struct {
+	DB *sql.DB
+}
+
+func (d *SqliteDatabase) Close(ctx context.Context) error {
+	return d.DB.Close()
+}
+
+type PostgresDatabase struct {
+	DB *sql.DB
+}
+
+func (d *PostgresDatabase) Close(ctx context.Context) error {
+	return d.DB.Close()
+}
+
+type MemoryDatabase struct{}
+
+func (d *MemoryDatabase) Close(ctx context.Context) error {
+	return nil
+}
+
+// InitializeDatabase connects to the backend matching the uri scheme,
+// mongodb is used for any unknown scheme.
+// name is the database name, used only by mongodb.
+func InitializeDatabase(uri string, name string) (Database, error) {
+	switch {
+	case strings.HasPrefix(uri, MEMORY_URI_PREFIX):
+		return &MemoryDatabase{}, nil
+
+	case strings.HasPrefix(uri, SQLITE_URI_PREFIX):
+		db, err := InitializeSqliteDatabase(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		return &SqliteDatabase{DB: db}, nil
+
+	case IsPostgresURI(uri):
+		db, err := InitializePostgresDatabase(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		return &PostgresDatabase{DB: db}, nil
+
+	default:
+		client, err := InitializeMongodbDatabase(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		return &MongodbDatabase{Client: client, Name: name}, nil
+	}
+}
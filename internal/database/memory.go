@@ -0,0 +1,4 @@
+package database
+
+// MEMORY_URI_PREFIX selects the in-process memory storage, which needs no initialization
+const MEMORY_URI_PREFIX = "memory://"
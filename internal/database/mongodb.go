@@ -2,16 +2,12 @@ package database
 
 import (
 	"context"
-	"time"
 
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
-const DB_OP_TIMEOUT_DURATION = 5 * time.Second
-const DB_POOL_SIZE = 3
-
-func InitializeDatabase(uri string) (*mongo.Client, error) {
+func InitializeMongodbDatabase(uri string) (*mongo.Client, error) {
 	opts := options.Client().
 		ApplyURI(uri).
 		SetTimeout(DB_OP_TIMEOUT_DURATION).
@@ -24,6 +20,8 @@ func InitializeDatabase(uri string) (*mongo.Client, error) {
 
 	err = client.Ping(context.Background(), nil)
 	if err != nil {
+		// the caller may retry, don't leak the client connection pool
+		_ = client.Disconnect(context.Background())
 		return nil, err
 	}
 
@@ -0,0 +1,46 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+const SQLITE_URI_PREFIX = "sqlite://"
+const SQLITE_BUSY_TIMEOUT_MS = "5000"
+
+// InitializeSqliteDatabase opens the database file from an uri such as:
+// sqlite:///var/lib/dwimc/dwimc.db (absolute) or sqlite://dwimc.db (relative)
+func InitializeSqliteDatabase(uri string) (*sql.DB, error) {
+	dsn := strings.TrimPrefix(uri, SQLITE_URI_PREFIX)
+
+	separator := "?"
+	if strings.Contains(dsn, "?") {
+		separator = "&"
+	}
+
+	dsn += separator +
+		"_pragma=busy_timeout(" + SQLITE_BUSY_TIMEOUT_MS + ")&" +
+		"_pragma=journal_mode(WAL)&" +
+		"_pragma=synchronous(NORMAL)"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite allows a single writer, a single connection avoids busy errors
+	db.SetMaxOpenConns(1)
+
+	cctx, cancel := context.WithTimeout(context.Background(), DB_OP_TIMEOUT_DURATION)
+	defer cancel()
+
+	if err := db.PingContext(cctx); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
@@ -0,0 +1,142 @@
+// Package encryption seals data with AES-GCM keys identified by ids,
+// so data sealed with older keys can still be opened after rotating keys.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var ErrUnknownKey = errors.New("unknown encryption key")
+
+var keyIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Keyring holds the encryption keys, the active key seals while all of them open
+type Keyring struct {
+	activeID string
+	keys     map[string]cipher.AEAD
+}
+
+// ParseKeyring parses "id:key" entries separated by commas or new lines,
+// keys are base64 encoded AES keys (16, 24 or 32 bytes) and the first entry is the active one.
+func ParseKeyring(value string) (*Keyring, error) {
+	keyring := &Keyring{keys: map[string]cipher.AEAD{}}
+
+	entries := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		id = strings.TrimSpace(id)
+		if !ok || !keyIDPattern.MatchString(id) {
+			return nil, fmt.Errorf("invalid key entry, expected id:base64 key")
+		}
+
+		if _, exists := keyring.keys[id]; exists {
+			return nil, fmt.Errorf("duplicate key id: %s", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+
+		if keyring.activeID == "" {
+			keyring.activeID = id
+		}
+
+		keyring.keys[id] = aead
+	}
+
+	if keyring.activeID == "" {
+		return nil, fmt.Errorf("no encryption keys")
+	}
+
+	return keyring, nil
+}
+
+// LoadKeyring parses the keys given directly or read from a file,
+// returns nil when neither is set.
+func LoadKeyring(keys string, file string) (*Keyring, error) {
+	if keys != "" && file != "" {
+		return nil, fmt.Errorf("encryption keys are set both directly and by a file")
+	}
+
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = string(content)
+	}
+
+	if keys == "" {
+		return nil, nil
+	}
+
+	return ParseKeyring(keys)
+}
+
+// ActiveKeyID returns the id of the key new data is sealed with
+func (k *Keyring) ActiveKeyID() string {
+	return k.activeID
+}
+
+// Has tells whether the keyring holds the key of the given id
+func (k *Keyring) Has(keyID string) bool {
+	_, ok := k.keys[keyID]
+	return ok
+}
+
+// Seal encrypts and authenticates the plaintext along with the additional data using the active key,
+// returns the key id and the random nonce followed by the ciphertext.
+func (k *Keyring) Seal(plaintext []byte, additionalData []byte) (string, []byte, error) {
+	aead := k.keys[k.activeID]
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+
+	return k.activeID, aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Open decrypts data sealed by Seal with the key of the given id
+func (k *Keyring) Open(keyID string, data []byte, additionalData []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyID)
+	}
+
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed data is too short")
+	}
+
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
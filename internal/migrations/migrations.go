@@ -0,0 +1,93 @@
+package migrations
+
+import (
+	"context"
+	"dwimc/internal/database"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+)
+
+// SCHEMA_MIGRATIONS is the collection (or table) recording the applied versions
+const SCHEMA_MIGRATIONS = "schema_migrations"
+
+type Migration struct {
+	Version     int
+	Description string
+}
+
+// step is a migration with its backend specific up function,
+// every up function must be idempotent since it may run against
+// a database that was partially migrated by older versions.
+type step[T any] struct {
+	Migration
+	up func(ctx context.Context, handle T) error
+}
+
+// Run applies all pending migrations in order and returns them,
+// on dry run the pending migrations are returned without being applied.
+func Run(ctx context.Context, db database.Database, dryRun bool) ([]Migration, error) {
+	switch db := db.(type) {
+	case *database.MemoryDatabase:
+		// the in-memory store is always created with the latest schema
+		return []Migration{}, nil
+
+	case *database.SqliteDatabase:
+		return runSqlite(ctx, db.DB, dryRun)
+
+	case *database.PostgresDatabase:
+		return runPostgres(ctx, db.DB, dryRun)
+
+	case *database.MongodbDatabase:
+		return runMongodb(ctx, db.Client.Database(db.Name), dryRun)
+
+	default:
+		return nil, utils.AsError(
+			model.ErrInternal,
+			fmt.Sprintf("unsupported database: %T", db),
+		)
+	}
+}
+
+// Pending returns the migrations not applied yet
+func Pending(ctx context.Context, db database.Database) ([]Migration, error) {
+	return Run(ctx, db, true)
+}
+
+// run applies the steps missing from applied in order using apply,
+// it stops at the first failure so versions are never skipped.
+func run[T any](
+	ctx context.Context,
+	steps []step[T],
+	applied map[int]bool,
+	dryRun bool,
+	apply func(ctx context.Context, step step[T]) error,
+) ([]Migration, error) {
+	migrations := []Migration{}
+
+	for _, step := range steps {
+		if applied[step.Version] {
+			continue
+		}
+
+		if !dryRun {
+			log.Info().
+				Int("version", step.Version).
+				Str("description", step.Description).
+				Msg("Applying migration...")
+
+			if err := apply(ctx, step); err != nil {
+				return migrations, utils.AsError(
+					model.ErrDatabase,
+					fmt.Sprintf("migration %d failed: %v", step.Version, err),
+				)
+			}
+		}
+
+		migrations = append(migrations, step.Migration)
+	}
+
+	return migrations, nil
+}
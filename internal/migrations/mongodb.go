@@ -0,0 +1,348 @@
+package migrations
+
+import (
+	"context"
+	"dwimc/internal/model"
+	"dwimc/internal/repositories"
+	"dwimc/internal/utils"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+var mongodbMigrations = []step[*mongo.Database]{
+	{
+		Migration: Migration{
+			Version:     1,
+			Description: "create devices and locations indexes",
+		},
+		up: func(ctx context.Context, db *mongo.Database) error {
+			if _, err := db.Collection(repositories.COLLECTION_NAME_DEVICES).Indexes().CreateOne(
+				ctx,
+				mongo.IndexModel{
+					Keys: bson.M{
+						"serial": 1,
+					},
+					Options: options.Index().SetUnique(true),
+				}); err != nil {
+				return err
+			}
+
+			_, err := db.Collection(repositories.COLLECTION_NAME_LOCATIONS).Indexes().CreateOne(
+				ctx,
+				mongo.IndexModel{
+					Keys: bson.M{
+						"deviceId": 1,
+					},
+					Options: options.Index().SetUnique(false),
+				})
+
+			return err
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     2,
+			Description: "add location retention",
+		},
+		up: func(ctx context.Context, db *mongo.Database) error {
+			// a TTL index can't keep the latest location, expired ones are deleted by a sweeper
+			_, err := db.Collection(repositories.COLLECTION_NAME_LOCATIONS).Indexes().CreateOne(
+				ctx,
+				mongo.IndexModel{
+					Keys: bson.D{
+						{Key: "deviceId", Value: 1},
+						{Key: "createdAt", Value: 1},
+					},
+					Options: options.Index().SetUnique(false),
+				})
+
+			return err
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     3,
+			Description: "add location geojson points",
+		},
+		up: func(ctx context.Context, db *mongo.Database) error {
+			collection := db.Collection(repositories.COLLECTION_NAME_LOCATIONS)
+
+			// backfills before indexing, the index rejects documents with invalid points
+			if _, err := collection.UpdateMany(
+				ctx,
+				bson.M{"point": bson.M{"$exists": false}},
+				mongo.Pipeline{
+					{{Key: "$set", Value: bson.M{
+						"point": bson.M{
+							"type":        model.GEO_POINT_TYPE,
+							"coordinates": bson.A{"$longitude", "$latitude"},
+						},
+					}}},
+				},
+			); err != nil {
+				return err
+			}
+
+			_, err := collection.Indexes().CreateOne(
+				ctx,
+				mongo.IndexModel{
+					Keys: bson.M{
+						"point": "2dsphere",
+					},
+				})
+
+			return err
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     4,
+			Description: "add device last location",
+		},
+		up: func(ctx context.Context, db *mongo.Database) error {
+			devices := db.Collection(repositories.COLLECTION_NAME_DEVICES)
+			locations := db.Collection(repositories.COLLECTION_NAME_LOCATIONS)
+
+			cursor, err := devices.Find(ctx, bson.M{"lastLocation": bson.M{"$exists": false}})
+			if err != nil {
+				return err
+			}
+
+			var pending []model.Device
+			if err := cursor.All(ctx, &pending); err != nil {
+				return err
+			}
+
+			for _, device := range pending {
+				var location model.Location
+
+				err := locations.FindOne(
+					ctx,
+					bson.M{"deviceId": device.ID},
+					options.FindOne().SetSort(bson.D{
+						{Key: "updatedAt", Value: -1},
+						{Key: "_id", Value: -1},
+					}),
+				).Decode(&location)
+
+				if err != nil {
+					if err == mongo.ErrNoDocuments {
+						continue
+					}
+
+					return err
+				}
+
+				// devices are not spatially indexed
+				location.Point = nil
+
+				if _, err := devices.UpdateOne(
+					ctx,
+					bson.M{"_id": device.ID},
+					bson.M{"$set": bson.M{"lastLocation": location}},
+				); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     5,
+			Description: "add soft delete",
+		},
+		up: func(ctx context.Context, db *mongo.Database) error {
+			// only items in the trash are indexed, for listing and purging them
+			for _, name := range []string{
+				repositories.COLLECTION_NAME_DEVICES,
+				repositories.COLLECTION_NAME_LOCATIONS,
+			} {
+				if _, err := db.Collection(name).Indexes().CreateOne(
+					ctx,
+					mongo.IndexModel{
+						Keys:    bson.M{"deletedAt": 1},
+						Options: options.Index().SetSparse(true),
+					}); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     6,
+			Description: "add device version",
+		},
+		up: func(ctx context.Context, db *mongo.Database) error {
+			// existing devices start at the first version, new ones get it on upsert
+			_, err := db.Collection(repositories.COLLECTION_NAME_DEVICES).UpdateMany(
+				ctx,
+				bson.M{"version": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"version": 1}},
+			)
+
+			return err
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     7,
+			Description: "add encrypted coordinates",
+		},
+		up: func(ctx context.Context, db *mongo.Database) error {
+			// only encrypted locations are indexed, for finding the keys in use
+			_, err := db.Collection(repositories.COLLECTION_NAME_LOCATIONS).Indexes().CreateOne(
+				ctx,
+				mongo.IndexModel{
+					Keys:    bson.M{"encrypted.kid": 1},
+					Options: options.Index().SetSparse(true),
+				})
+
+			return err
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     9,
+			Description: "add location recorded time",
+		},
+		up: func(ctx context.Context, db *mongo.Database) error {
+			collection := db.Collection(repositories.COLLECTION_NAME_LOCATIONS)
+
+			// existing locations were recorded when created, same for the devices last ones
+			if _, err := collection.UpdateMany(
+				ctx,
+				bson.M{"recordedAt": bson.M{"$exists": false}},
+				mongo.Pipeline{
+					{{Key: "$set", Value: bson.M{"recordedAt": "$createdAt"}}},
+				},
+			); err != nil {
+				return err
+			}
+
+			if _, err := db.Collection(repositories.COLLECTION_NAME_DEVICES).UpdateMany(
+				ctx,
+				bson.M{
+					"lastLocation":            bson.M{"$ne": nil},
+					"lastLocation.recordedAt": bson.M{"$exists": false},
+				},
+				mongo.Pipeline{
+					{{Key: "$set", Value: bson.M{"lastLocation.recordedAt": "$lastLocation.createdAt"}}},
+				},
+			); err != nil {
+				return err
+			}
+
+			_, err := collection.Indexes().CreateOne(
+				ctx,
+				mongo.IndexModel{
+					Keys: bson.D{
+						{Key: "deviceId", Value: 1},
+						{Key: "recordedAt", Value: -1},
+						{Key: "_id", Value: -1},
+					},
+					Options: options.Index().SetUnique(false),
+				})
+
+			return err
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     10,
+			Description: "add idempotency keys",
+		},
+		up: func(ctx context.Context, db *mongo.Database) error {
+			// keys are looked up by their _id, expired ones are deleted by a sweeper
+			_, err := db.Collection(repositories.COLLECTION_NAME_IDEMPOTENCY_KEYS).Indexes().CreateOne(
+				ctx,
+				mongo.IndexModel{
+					Keys:    bson.M{"expiresAt": 1},
+					Options: options.Index().SetUnique(false),
+				})
+
+			return err
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     12,
+			Description: "add location seen count",
+		},
+		up: func(ctx context.Context, db *mongo.Database) error {
+			// existing locations were seen once, same for the devices last ones
+			if _, err := db.Collection(repositories.COLLECTION_NAME_LOCATIONS).UpdateMany(
+				ctx,
+				bson.M{"seenCount": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"seenCount": 1}},
+			); err != nil {
+				return err
+			}
+
+			_, err := db.Collection(repositories.COLLECTION_NAME_DEVICES).UpdateMany(
+				ctx,
+				bson.M{
+					"lastLocation":           bson.M{"$ne": nil},
+					"lastLocation.seenCount": bson.M{"$exists": false},
+				},
+				bson.M{"$set": bson.M{"lastLocation.seenCount": 1}},
+			)
+
+			return err
+		},
+	},
+}
+
+type mongodbSchemaMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+func runMongodb(ctx context.Context, db *mongo.Database, dryRun bool) ([]Migration, error) {
+	collection := db.Collection(SCHEMA_MIGRATIONS)
+
+	cursor, err := collection.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	var records []mongodbSchemaMigration
+	if err := cursor.All(ctx, &records); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	applied := map[int]bool{}
+	for _, record := range records {
+		applied[record.Version] = true
+	}
+
+	return run(ctx, mongodbMigrations, applied, dryRun,
+		func(ctx context.Context, step step[*mongo.Database]) error {
+			if err := step.up(ctx, db); err != nil {
+				return err
+			}
+
+			// upserts, another instance may have applied the same migration meanwhile
+			_, err := collection.UpdateOne(
+				ctx,
+				bson.M{"_id": step.Version},
+				bson.M{"$setOnInsert": mongodbSchemaMigration{
+					Version:     step.Version,
+					Description: step.Description,
+					AppliedAt:   time.Now().UTC(),
+				}},
+				options.UpdateOne().SetUpsert(true),
+			)
+
+			return err
+		},
+	)
+}
@@ -0,0 +1,204 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"dwimc/internal/repositories"
+)
+
+var postgresDialect = sqlDialect{
+	tableExists: `SELECT to_regclass($1) IS NOT NULL`,
+	createTable: `CREATE TABLE IF NOT EXISTS ` + SCHEMA_MIGRATIONS + ` (
+		version     INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`,
+	insertVersion: `INSERT INTO ` + SCHEMA_MIGRATIONS + ` (version, description)
+		VALUES ($1, $2)
+		ON CONFLICT (version) DO NOTHING`,
+}
+
+var postgresMigrations = []step[*sql.Tx]{
+	{
+		Migration: Migration{
+			Version:     1,
+			Description: "create devices and locations tables",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			return execSqlStatements(ctx, tx,
+				`CREATE EXTENSION IF NOT EXISTS postgis`,
+				`CREATE TABLE IF NOT EXISTS `+repositories.TABLE_NAME_DEVICES+` (
+					id         TEXT PRIMARY KEY,
+					created_at TIMESTAMPTZ NOT NULL,
+					updated_at TIMESTAMPTZ NOT NULL,
+					serial     TEXT NOT NULL,
+					name       TEXT NOT NULL
+				)`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS devices_serial_idx
+					ON `+repositories.TABLE_NAME_DEVICES+` (serial)`,
+				`CREATE TABLE IF NOT EXISTS `+repositories.TABLE_NAME_LOCATIONS+` (
+					id         TEXT PRIMARY KEY,
+					created_at TIMESTAMPTZ NOT NULL,
+					updated_at TIMESTAMPTZ NOT NULL,
+					device_id  TEXT NOT NULL,
+					point      geography(Point, 4326) NOT NULL
+				)`,
+				`CREATE INDEX IF NOT EXISTS locations_device_id_idx
+					ON `+repositories.TABLE_NAME_LOCATIONS+` (device_id)`,
+				`CREATE INDEX IF NOT EXISTS locations_point_idx
+					ON `+repositories.TABLE_NAME_LOCATIONS+` USING GIST (point)`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     2,
+			Description: "add location retention",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			return execSqlStatements(ctx, tx,
+				`ALTER TABLE `+repositories.TABLE_NAME_DEVICES+`
+					ADD COLUMN IF NOT EXISTS retention_period BIGINT NOT NULL DEFAULT 0`,
+				`CREATE INDEX IF NOT EXISTS locations_device_id_created_at_idx
+					ON `+repositories.TABLE_NAME_LOCATIONS+` (device_id, created_at)`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     4,
+			Description: "add device last location",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			return execSqlStatements(ctx, tx,
+				`ALTER TABLE `+repositories.TABLE_NAME_DEVICES+`
+					ADD COLUMN IF NOT EXISTS last_location_id TEXT`,
+				`UPDATE `+repositories.TABLE_NAME_DEVICES+` SET last_location_id = (
+					SELECT id FROM `+repositories.TABLE_NAME_LOCATIONS+` l
+					WHERE l.device_id = `+repositories.TABLE_NAME_DEVICES+`.id
+					ORDER BY l.updated_at DESC, l.id DESC
+					LIMIT 1
+				)
+				WHERE last_location_id IS NULL`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     5,
+			Description: "add soft delete",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			return execSqlStatements(ctx, tx,
+				`ALTER TABLE `+repositories.TABLE_NAME_DEVICES+`
+					ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+				`ALTER TABLE `+repositories.TABLE_NAME_LOCATIONS+`
+					ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ`,
+				`CREATE INDEX IF NOT EXISTS devices_deleted_at_idx
+					ON `+repositories.TABLE_NAME_DEVICES+` (deleted_at)`,
+				`CREATE INDEX IF NOT EXISTS locations_deleted_at_idx
+					ON `+repositories.TABLE_NAME_LOCATIONS+` (deleted_at)`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     6,
+			Description: "add device version",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			// existing and newly inserted devices start at the first version
+			return execSqlStatements(ctx, tx,
+				`ALTER TABLE `+repositories.TABLE_NAME_DEVICES+`
+					ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     8,
+			Description: "add location telemetry",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			// all optional, existing locations have none
+			return execSqlStatements(ctx, tx,
+				`ALTER TABLE `+repositories.TABLE_NAME_LOCATIONS+`
+					ADD COLUMN IF NOT EXISTS accuracy DOUBLE PRECISION,
+					ADD COLUMN IF NOT EXISTS altitude DOUBLE PRECISION,
+					ADD COLUMN IF NOT EXISTS speed DOUBLE PRECISION,
+					ADD COLUMN IF NOT EXISTS bearing DOUBLE PRECISION,
+					ADD COLUMN IF NOT EXISTS battery SMALLINT,
+					ADD COLUMN IF NOT EXISTS provider TEXT`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     9,
+			Description: "add location recorded time",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			// existing locations were recorded when created
+			return execSqlStatements(ctx, tx,
+				`ALTER TABLE `+repositories.TABLE_NAME_LOCATIONS+`
+					ADD COLUMN IF NOT EXISTS recorded_at TIMESTAMPTZ`,
+				`UPDATE `+repositories.TABLE_NAME_LOCATIONS+` SET recorded_at = created_at WHERE recorded_at IS NULL`,
+				`ALTER TABLE `+repositories.TABLE_NAME_LOCATIONS+`
+					ALTER COLUMN recorded_at SET NOT NULL`,
+				`CREATE INDEX IF NOT EXISTS locations_device_id_recorded_at_idx
+					ON `+repositories.TABLE_NAME_LOCATIONS+` (device_id, recorded_at)`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     10,
+			Description: "add idempotency keys",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			return execSqlStatements(ctx, tx,
+				`CREATE TABLE IF NOT EXISTS `+repositories.TABLE_NAME_IDEMPOTENCY_KEYS+` (
+					id TEXT PRIMARY KEY,
+					request_hash TEXT NOT NULL,
+					status_code INTEGER NOT NULL,
+					header TEXT,
+					body BYTEA,
+					created_at TIMESTAMPTZ NOT NULL,
+					expires_at TIMESTAMPTZ NOT NULL
+				)`,
+				`CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx
+					ON `+repositories.TABLE_NAME_IDEMPOTENCY_KEYS+` (expires_at)`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     11,
+			Description: "add location screening",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			return execSqlStatements(ctx, tx,
+				`ALTER TABLE `+repositories.TABLE_NAME_LOCATIONS+`
+					ADD COLUMN IF NOT EXISTS outlier TEXT`,
+				`ALTER TABLE `+repositories.TABLE_NAME_LOCATIONS+`
+					ADD COLUMN IF NOT EXISTS rejected BOOLEAN NOT NULL DEFAULT FALSE`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     12,
+			Description: "add location seen count",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			return execSqlStatements(ctx, tx,
+				`ALTER TABLE `+repositories.TABLE_NAME_LOCATIONS+`
+					ADD COLUMN IF NOT EXISTS seen_count INTEGER NOT NULL DEFAULT 1`,
+			)
+		},
+	},
+}
+
+func runPostgres(ctx context.Context, db *sql.DB, dryRun bool) ([]Migration, error) {
+	return runSql(ctx, db, postgresDialect, postgresMigrations, dryRun)
+}
@@ -0,0 +1,105 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+)
+
+// sqlDialect holds the statements that differ between the sql backends
+type sqlDialect struct {
+	// tableExists returns a single boolean row, the table name is the only argument
+	tableExists string
+	createTable string
+	// insertVersion ignores versions already recorded by another instance
+	insertVersion string
+}
+
+func runSql(
+	ctx context.Context,
+	db *sql.DB,
+	dialect sqlDialect,
+	steps []step[*sql.Tx],
+	dryRun bool,
+) ([]Migration, error) {
+	applied, err := sqlAppliedVersions(ctx, db, dialect)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if !dryRun {
+		if _, err := db.ExecContext(ctx, dialect.createTable); err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+	}
+
+	// every migration is applied and recorded in its own transaction
+	return run(ctx, steps, applied, dryRun,
+		func(ctx context.Context, step step[*sql.Tx]) error {
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+
+			defer tx.Rollback()
+
+			if err := step.up(ctx, tx); err != nil {
+				return err
+			}
+
+			if _, err := tx.ExecContext(
+				ctx,
+				dialect.insertVersion,
+				step.Version,
+				step.Description,
+			); err != nil {
+				return err
+			}
+
+			return tx.Commit()
+		},
+	)
+}
+
+func sqlAppliedVersions(ctx context.Context, db *sql.DB, dialect sqlDialect) (map[int]bool, error) {
+	applied := map[int]bool{}
+
+	// a dry run must not create the versions table
+	var exists bool
+	if err := db.QueryRowContext(ctx, dialect.tableExists, SCHEMA_MIGRATIONS).Scan(&exists); err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return applied, nil
+	}
+
+	rows, err := db.QueryContext(ctx, `SELECT version FROM `+SCHEMA_MIGRATIONS)
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+
+		applied[version] = true
+	}
+
+	return applied, rows.Err()
+}
+
+func execSqlStatements(ctx context.Context, tx *sql.Tx, statements ...string) error {
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
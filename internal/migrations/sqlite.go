@@ -0,0 +1,307 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"dwimc/internal/repositories"
+)
+
+var sqliteDialect = sqlDialect{
+	tableExists: `SELECT COUNT(*) > 0 FROM sqlite_master WHERE type = 'table' AND name = ?`,
+	createTable: `CREATE TABLE IF NOT EXISTS ` + SCHEMA_MIGRATIONS + ` (
+		version     INTEGER PRIMARY KEY,
+		description TEXT NOT NULL,
+		applied_at  INTEGER NOT NULL DEFAULT (CAST(unixepoch('subsec') * 1000 AS INTEGER))
+	)`,
+	insertVersion: `INSERT INTO ` + SCHEMA_MIGRATIONS + ` (version, description)
+		VALUES (?, ?)
+		ON CONFLICT (version) DO NOTHING`,
+}
+
+var sqliteMigrations = []step[*sql.Tx]{
+	{
+		Migration: Migration{
+			Version:     1,
+			Description: "create devices and locations tables",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			return execSqlStatements(ctx, tx,
+				`CREATE TABLE IF NOT EXISTS `+repositories.TABLE_NAME_DEVICES+` (
+					id         TEXT PRIMARY KEY,
+					created_at INTEGER NOT NULL,
+					updated_at INTEGER NOT NULL,
+					serial     TEXT NOT NULL,
+					name       TEXT NOT NULL
+				)`,
+				`CREATE UNIQUE INDEX IF NOT EXISTS devices_serial_idx
+					ON `+repositories.TABLE_NAME_DEVICES+` (serial)`,
+				`CREATE TABLE IF NOT EXISTS `+repositories.TABLE_NAME_LOCATIONS+` (
+					id         TEXT PRIMARY KEY,
+					created_at INTEGER NOT NULL,
+					updated_at INTEGER NOT NULL,
+					device_id  TEXT NOT NULL,
+					latitude   REAL NOT NULL,
+					longitude  REAL NOT NULL
+				)`,
+				`CREATE INDEX IF NOT EXISTS locations_device_id_idx
+					ON `+repositories.TABLE_NAME_LOCATIONS+` (device_id)`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     2,
+			Description: "add location retention",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			if err := sqliteAddColumn(
+				ctx,
+				tx,
+				repositories.TABLE_NAME_DEVICES,
+				"retention_period",
+				"INTEGER NOT NULL DEFAULT 0",
+			); err != nil {
+				return err
+			}
+
+			return execSqlStatements(ctx, tx,
+				`CREATE INDEX IF NOT EXISTS locations_device_id_created_at_idx
+					ON `+repositories.TABLE_NAME_LOCATIONS+` (device_id, created_at)`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     3,
+			Description: "add locations coordinates index",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			// sqlite has no spatial index, spatial queries prefilter by a bounding box
+			return execSqlStatements(ctx, tx,
+				`CREATE INDEX IF NOT EXISTS locations_latitude_longitude_idx
+					ON `+repositories.TABLE_NAME_LOCATIONS+` (latitude, longitude)`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     4,
+			Description: "add device last location",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			if err := sqliteAddColumn(
+				ctx,
+				tx,
+				repositories.TABLE_NAME_DEVICES,
+				"last_location_id",
+				"TEXT",
+			); err != nil {
+				return err
+			}
+
+			return execSqlStatements(ctx, tx,
+				`UPDATE `+repositories.TABLE_NAME_DEVICES+` SET last_location_id = (
+					SELECT id FROM `+repositories.TABLE_NAME_LOCATIONS+` l
+					WHERE l.device_id = `+repositories.TABLE_NAME_DEVICES+`.id
+					ORDER BY l.updated_at DESC, l.id DESC
+					LIMIT 1
+				)
+				WHERE last_location_id IS NULL`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     5,
+			Description: "add soft delete",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			for _, table := range []string{
+				repositories.TABLE_NAME_DEVICES,
+				repositories.TABLE_NAME_LOCATIONS,
+			} {
+				if err := sqliteAddColumn(ctx, tx, table, "deleted_at", "INTEGER"); err != nil {
+					return err
+				}
+			}
+
+			return execSqlStatements(ctx, tx,
+				`CREATE INDEX IF NOT EXISTS devices_deleted_at_idx
+					ON `+repositories.TABLE_NAME_DEVICES+` (deleted_at)`,
+				`CREATE INDEX IF NOT EXISTS locations_deleted_at_idx
+					ON `+repositories.TABLE_NAME_LOCATIONS+` (deleted_at)`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     6,
+			Description: "add device version",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			// existing and newly inserted devices start at the first version
+			return sqliteAddColumn(
+				ctx,
+				tx,
+				repositories.TABLE_NAME_DEVICES,
+				"version",
+				"INTEGER NOT NULL DEFAULT 1",
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     7,
+			Description: "add encrypted coordinates",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			// encrypted locations hold their coordinates in the blob sealed with the key of key_id
+			if err := sqliteAddColumn(ctx, tx, repositories.TABLE_NAME_LOCATIONS, "key_id", "TEXT"); err != nil {
+				return err
+			}
+
+			if err := sqliteAddColumn(ctx, tx, repositories.TABLE_NAME_LOCATIONS, "coordinates", "BLOB"); err != nil {
+				return err
+			}
+
+			return execSqlStatements(ctx, tx,
+				`CREATE INDEX IF NOT EXISTS locations_key_id_idx
+					ON `+repositories.TABLE_NAME_LOCATIONS+` (key_id)
+					WHERE key_id IS NOT NULL`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     8,
+			Description: "add location telemetry",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			// all optional, existing locations have none
+			if err := sqliteAddColumn(ctx, tx, repositories.TABLE_NAME_LOCATIONS, "accuracy", "REAL"); err != nil {
+				return err
+			}
+
+			if err := sqliteAddColumn(ctx, tx, repositories.TABLE_NAME_LOCATIONS, "altitude", "REAL"); err != nil {
+				return err
+			}
+
+			if err := sqliteAddColumn(ctx, tx, repositories.TABLE_NAME_LOCATIONS, "speed", "REAL"); err != nil {
+				return err
+			}
+
+			if err := sqliteAddColumn(ctx, tx, repositories.TABLE_NAME_LOCATIONS, "bearing", "REAL"); err != nil {
+				return err
+			}
+
+			if err := sqliteAddColumn(ctx, tx, repositories.TABLE_NAME_LOCATIONS, "battery", "INTEGER"); err != nil {
+				return err
+			}
+
+			return sqliteAddColumn(ctx, tx, repositories.TABLE_NAME_LOCATIONS, "provider", "TEXT")
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     9,
+			Description: "add location recorded time",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			if err := sqliteAddColumn(
+				ctx,
+				tx,
+				repositories.TABLE_NAME_LOCATIONS,
+				"recorded_at",
+				"INTEGER NOT NULL DEFAULT 0",
+			); err != nil {
+				return err
+			}
+
+			// existing locations were recorded when created
+			return execSqlStatements(ctx, tx,
+				`UPDATE `+repositories.TABLE_NAME_LOCATIONS+` SET recorded_at = created_at WHERE recorded_at = 0`,
+				`CREATE INDEX IF NOT EXISTS locations_device_id_recorded_at_idx
+					ON `+repositories.TABLE_NAME_LOCATIONS+` (device_id, recorded_at)`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     10,
+			Description: "add idempotency keys",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			return execSqlStatements(ctx, tx,
+				`CREATE TABLE IF NOT EXISTS `+repositories.TABLE_NAME_IDEMPOTENCY_KEYS+` (
+					id TEXT PRIMARY KEY,
+					request_hash TEXT NOT NULL,
+					status_code INTEGER NOT NULL,
+					header TEXT,
+					body BLOB,
+					created_at INTEGER NOT NULL,
+					expires_at INTEGER NOT NULL
+				)`,
+				`CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx
+					ON `+repositories.TABLE_NAME_IDEMPOTENCY_KEYS+` (expires_at)`,
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     11,
+			Description: "add location screening",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			if err := sqliteAddColumn(ctx, tx, repositories.TABLE_NAME_LOCATIONS, "outlier", "TEXT"); err != nil {
+				return err
+			}
+
+			return sqliteAddColumn(
+				ctx,
+				tx,
+				repositories.TABLE_NAME_LOCATIONS,
+				"rejected",
+				"INTEGER NOT NULL DEFAULT 0",
+			)
+		},
+	},
+	{
+		Migration: Migration{
+			Version:     12,
+			Description: "add location seen count",
+		},
+		up: func(ctx context.Context, tx *sql.Tx) error {
+			return sqliteAddColumn(
+				ctx,
+				tx,
+				repositories.TABLE_NAME_LOCATIONS,
+				"seen_count",
+				"INTEGER NOT NULL DEFAULT 1",
+			)
+		},
+	},
+}
+
+// sqliteAddColumn adds the column unless it exists, sqlite has no ADD COLUMN IF NOT EXISTS
+func sqliteAddColumn(ctx context.Context, tx *sql.Tx, table string, column string, definition string) error {
+	var exists bool
+	if err := tx.QueryRowContext(
+		ctx,
+		`SELECT COUNT(*) > 0 FROM pragma_table_info(?) WHERE name = ?`,
+		table,
+		column,
+	).Scan(&exists); err != nil {
+		return err
+	}
+
+	if exists {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, `ALTER TABLE `+table+` ADD COLUMN `+column+` `+definition)
+	return err
+}
+
+func runSqlite(ctx context.Context, db *sql.DB, dryRun bool) ([]Migration, error) {
+	return runSql(ctx, db, sqliteDialect, sqliteMigrations, dryRun)
+}
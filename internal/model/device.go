@@ -12,4 +12,28 @@ type Device struct {
 	UpdatedAt time.Time     `json:"updated_at" bson:"updatedAt"`
 	Serial    string        `json:"serial" bson:"serial"`
 	Name      string        `json:"name" bson:"name"`
+	// Version is incremented on every change of the device itself (not of its last location),
+	// writes conditioned on it fail with ErrPreconditionFailed once it moved on.
+	Version int64 `json:"version" bson:"version"`
+	// RetentionPeriod overrides the default locations retention period, in seconds.
+	// 0 - uses the default, negative - keeps locations regardless of their age
+	RetentionPeriod int64 `json:"retention_period,omitempty" bson:"retentionPeriod,omitempty"`
+	// LastLocation is the latest location of the device, kept along with the device for cheap listing
+	LastLocation *Location `json:"last_location,omitempty" bson:"lastLocation,omitempty"`
+	// DeletedAt marks a device moved to the trash, set only when listing the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deletedAt,omitempty"`
+}
+
+// Retention returns how long the device locations are kept, 0 keeps them forever
+func (d *Device) Retention(defaultPeriod time.Duration) time.Duration {
+	switch {
+	case d.RetentionPeriod > 0:
+		return time.Duration(d.RetentionPeriod) * time.Second
+
+	case d.RetentionPeriod < 0:
+		return 0
+
+	default:
+		return defaultPeriod
+	}
 }
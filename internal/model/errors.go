@@ -3,12 +3,14 @@ package model
 import "errors"
 
 var (
-	ErrItemNotFound    = errors.New("item not found")
-	ErrItemConflict    = errors.New("item already exists")
-	ErrInvalidArgs     = errors.New("invalid arguments")
-	ErrOperationFailed = errors.New("operation failed")
-	ErrDatabase        = errors.New("database error")
-	ErrInternal        = errors.New("internal error")
+	ErrItemNotFound       = errors.New("item not found")
+	ErrItemConflict       = errors.New("item already exists")
+	ErrPreconditionFailed = errors.New("precondition failed")
+	ErrInvalidArgs        = errors.New("invalid arguments")
+	ErrOperationFailed    = errors.New("operation failed")
+	ErrNotSupported       = errors.New("not supported")
+	ErrDatabase           = errors.New("database error")
+	ErrInternal           = errors.New("internal error")
 )
 
 var (
@@ -0,0 +1,113 @@
+package model
+
+import "math"
+
+const GEO_POINT_TYPE = "Point"
+
+// EARTH_RADIUS in meters, the mean radius used by mongodb spherical queries
+const EARTH_RADIUS = 6378100.0
+
+// GeoPoint is a GeoJSON point, coordinates are ordered as [longitude, latitude]
+type GeoPoint struct {
+	Type        string    `json:"type" bson:"type"`
+	Coordinates []float64 `json:"coordinates" bson:"coordinates"`
+}
+
+func NewGeoPoint(latitude float64, longitude float64) *GeoPoint {
+	return &GeoPoint{
+		Type:        GEO_POINT_TYPE,
+		Coordinates: []float64{longitude, latitude},
+	}
+}
+
+type Coordinates struct {
+	Latitude  float64 `json:"latitude" binding:"latitude"`
+	Longitude float64 `json:"longitude" binding:"longitude"`
+}
+
+// DistanceTo returns the great-circle distance in meters (haversine)
+func (c Coordinates) DistanceTo(other Coordinates) float64 {
+	lat1 := c.Latitude * math.Pi / 180
+	lat2 := other.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (other.Longitude - c.Longitude) * math.Pi / 180
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * EARTH_RADIUS * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// Polygon is a single ring of coordinates, closing it is optional
+type Polygon []Coordinates
+
+// Ring returns the polygon as closed GeoJSON [longitude, latitude] positions
+func (p Polygon) Ring() [][]float64 {
+	ring := make([][]float64, 0, len(p)+1)
+	for _, c := range p {
+		ring = append(ring, []float64{c.Longitude, c.Latitude})
+	}
+
+	if len(p) > 0 && p[0] != p[len(p)-1] {
+		ring = append(ring, []float64{p[0].Longitude, p[0].Latitude})
+	}
+
+	return ring
+}
+
+// Bounds returns the south west and north east corners of the polygon
+func (p Polygon) Bounds() (Coordinates, Coordinates) {
+	sw := Coordinates{Latitude: math.Inf(1), Longitude: math.Inf(1)}
+	ne := Coordinates{Latitude: math.Inf(-1), Longitude: math.Inf(-1)}
+
+	for _, c := range p {
+		sw.Latitude = math.Min(sw.Latitude, c.Latitude)
+		sw.Longitude = math.Min(sw.Longitude, c.Longitude)
+		ne.Latitude = math.Max(ne.Latitude, c.Latitude)
+		ne.Longitude = math.Max(ne.Longitude, c.Longitude)
+	}
+
+	return sw, ne
+}
+
+// Contains tests the point against the polygon by ray casting,
+// edges are treated as straight lines on the latitude / longitude plane.
+func (p Polygon) Contains(c Coordinates) bool {
+	inside := false
+
+	for i, j := 0, len(p)-1; i < len(p); j, i = i, i+1 {
+		a, b := p[i], p[j]
+
+		if (a.Latitude > c.Latitude) != (b.Latitude > c.Latitude) &&
+			c.Longitude < (b.Longitude-a.Longitude)*(c.Latitude-a.Latitude)/(b.Latitude-a.Latitude)+a.Longitude {
+			inside = !inside
+		}
+	}
+
+	return inside
+}
+
+// NearBounds returns the south west and north east corners of a box containing
+// every point within the distance (meters) from the center.
+func NearBounds(center Coordinates, distance float64) (Coordinates, Coordinates) {
+	angular := distance / EARTH_RADIUS
+	lat := center.Latitude * math.Pi / 180
+
+	sw := Coordinates{Latitude: -90, Longitude: -180}
+	ne := Coordinates{Latitude: 90, Longitude: 180}
+
+	sw.Latitude = math.Max(-90, (lat-angular)*180/math.Pi)
+	ne.Latitude = math.Min(90, (lat+angular)*180/math.Pi)
+
+	// the box spans all longitudes when reaching a pole or crossing the antimeridian
+	if sw.Latitude > -90 && ne.Latitude < 90 {
+		dLon := math.Asin(math.Sin(angular)/math.Cos(lat)) * 180 / math.Pi
+
+		if center.Longitude-dLon >= -180 && center.Longitude+dLon <= 180 {
+			sw.Longitude = center.Longitude - dLon
+			ne.Longitude = center.Longitude + dLon
+		}
+	}
+
+	return sw, ne
+}
@@ -0,0 +1,22 @@
+package model
+
+import "time"
+
+// IdempotencyKey holds the response of a request sent with an Idempotency-Key header,
+// replayed to the retries of the same request until it expires.
+type IdempotencyKey struct {
+	Key string `json:"key" bson:"_id"`
+	// RequestHash identifies the request the key was first sent with
+	RequestHash string `json:"request_hash" bson:"requestHash"`
+	// StatusCode is 0 while the first request is still running
+	StatusCode int               `json:"status_code" bson:"statusCode"`
+	Header     map[string]string `json:"header,omitempty" bson:"header,omitempty"`
+	Body       []byte            `json:"body,omitempty" bson:"body,omitempty"`
+	CreatedAt  time.Time         `json:"created_at" bson:"createdAt"`
+	ExpiresAt  time.Time         `json:"expires_at" bson:"expiresAt"`
+}
+
+// Completed tells whether the response of the first request is known
+func (k *IdempotencyKey) Completed() bool {
+	return k.StatusCode != 0
+}
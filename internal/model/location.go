@@ -10,7 +10,79 @@ type Location struct {
 	ID        bson.ObjectID `json:"id" bson:"_id"`
 	CreatedAt time.Time     `json:"created_at" bson:"createdAt"`
 	UpdatedAt time.Time     `json:"updated_at" bson:"updatedAt"`
-	DeviceID  bson.ObjectID `json:"device_id" bson:"deviceId"`
-	Latitude  float64       `json:"latitude" binding:"required,latitude" bson:"latitude"`
-	Longitude float64       `json:"longitude" binding:"required,longitude" bson:"longitude"`
+	// RecordedAt is when the device took the fix, the location history goes by it.
+	// Same as CreatedAt unless reported by the device.
+	RecordedAt time.Time     `json:"recorded_at" bson:"recordedAt"`
+	DeviceID   bson.ObjectID `json:"device_id" bson:"deviceId"`
+	Latitude   float64       `json:"latitude" binding:"required,latitude" bson:"latitude"`
+	Longitude  float64       `json:"longitude" binding:"required,longitude" bson:"longitude"`
+	// SeenCount is how many fixes were reported in a row within the stationary radius of this one,
+	// UpdatedAt is when the last of them was reported.
+	SeenCount int64 `json:"seen_count" bson:"seenCount"`
+	// Point duplicates the coordinates for spatial indexing (stored by mongodb only)
+	Point *GeoPoint `json:"-" bson:"point,omitempty"`
+	// DeletedAt marks a location moved to the trash, set only when listing the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty" bson:"deletedAt,omitempty"`
+	// Encrypted replaces the coordinates when stored encrypted, never set when read
+	Encrypted *EncryptedCoordinates `json:"-" bson:"encrypted,omitempty"`
+	Telemetry `bson:",inline"`
+	Screening `bson:",inline"`
+}
+
+// Telemetry holds the optional details of a location fix, as reported by the device
+type Telemetry struct {
+	// Accuracy is the estimated horizontal accuracy radius in meters
+	Accuracy *float64 `json:"accuracy,omitempty" binding:"omitempty,gte=0" bson:"accuracy,omitempty"`
+	// Altitude in meters above the WGS 84 ellipsoid
+	Altitude *float64 `json:"altitude,omitempty" bson:"altitude,omitempty"`
+	// Speed over ground in meters per second
+	Speed *float64 `json:"speed,omitempty" binding:"omitempty,gte=0" bson:"speed,omitempty"`
+	// Bearing is the direction of travel in degrees clockwise from the north
+	Bearing *float64 `json:"bearing,omitempty" binding:"omitempty,gte=0,lt=360" bson:"bearing,omitempty"`
+	// Battery level of the device in percent
+	Battery *int `json:"battery,omitempty" binding:"omitempty,gte=0,lte=100" bson:"battery,omitempty"`
+	// Provider of the fix, such as gps, network or fused
+	Provider string `json:"provider,omitempty" binding:"omitempty,max=32" bson:"provider,omitempty"`
+}
+
+// The reasons a fix is found implausible, see Screening
+const (
+	OutlierNullIsland = "null_island"
+	OutlierAccuracy   = "accuracy"
+	OutlierSpeed      = "speed"
+)
+
+// Screening is the verdict of the ingestion policy on a fix, the zero value is a plausible one
+type Screening struct {
+	// Outlier is the reason the fix was found implausible
+	Outlier string `json:"outlier,omitempty" bson:"outlier,omitempty"`
+	// Rejected outliers are kept for auditing but never become the latest location
+	Rejected bool `json:"rejected,omitempty" bson:"rejected,omitempty"`
+}
+
+// LocationFilter narrows the locations read, the zero value matches all of them
+type LocationFilter struct {
+	// MaxAccuracy skips fixes less accurate than the given meters, fixes without an accuracy are kept
+	MaxAccuracy *float64
+}
+
+func (f LocationFilter) Matches(location Location) bool {
+	if f.MaxAccuracy != nil && location.Accuracy != nil && *location.Accuracy > *f.MaxAccuracy {
+		return false
+	}
+
+	return true
+}
+
+// EncryptedCoordinates are the location coordinates sealed with the key of KeyID
+type EncryptedCoordinates struct {
+	KeyID string `bson:"kid"`
+	Data  []byte `bson:"data"`
+}
+
+func (l *Location) Coordinates() Coordinates {
+	return Coordinates{
+		Latitude:  l.Latitude,
+		Longitude: l.Longitude,
+	}
 }
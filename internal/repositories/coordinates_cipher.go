@@ -0,0 +1,100 @@
+package repositories
+
+import (
+	"dwimc/internal/encryption"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+var (
+	ErrEncryptionNotSupported = errors.New("coordinates encryption is not supported by the database")
+	ErrMissingEncryptionKey   = errors.New("missing coordinates encryption key")
+)
+
+// coordinatesCipher encrypts the coordinates of the stored locations when a keyring is set,
+// encrypted locations are bound to their id so their coordinates can't be swapped.
+type coordinatesCipher struct {
+	keyring *encryption.Keyring
+}
+
+func (c coordinatesCipher) enabled() bool {
+	return c.keyring != nil
+}
+
+// refuseSpatial fails spatial queries, encrypted coordinates can't be indexed
+func (c coordinatesCipher) refuseSpatial() error {
+	if !c.enabled() {
+		return nil
+	}
+
+	return utils.AsError(
+		model.ErrNotSupported,
+		"spatial queries are not supported with encrypted coordinates",
+	)
+}
+
+// seal returns the location to store, its coordinates and spatial point replaced by the encrypted ones
+func (c coordinatesCipher) seal(location model.Location) (model.Location, error) {
+	if !c.enabled() {
+		return location, nil
+	}
+
+	plaintext := make([]byte, 16)
+	binary.BigEndian.PutUint64(plaintext[:8], math.Float64bits(location.Latitude))
+	binary.BigEndian.PutUint64(plaintext[8:], math.Float64bits(location.Longitude))
+
+	keyID, data, err := c.keyring.Seal(plaintext, location.ID[:])
+	if err != nil {
+		return location, utils.AsError(model.ErrInternal, err.Error())
+	}
+
+	location.Latitude = 0
+	location.Longitude = 0
+	location.Point = nil
+	location.Encrypted = &model.EncryptedCoordinates{
+		KeyID: keyID,
+		Data:  data,
+	}
+
+	return location, nil
+}
+
+// open decrypts the coordinates of a stored location in place, plain ones are left as is
+func (c coordinatesCipher) open(location *model.Location) error {
+	if location == nil || location.Encrypted == nil {
+		return nil
+	}
+
+	if !c.enabled() || !c.keyring.Has(location.Encrypted.KeyID) {
+		return utils.AsError(ErrMissingEncryptionKey, location.Encrypted.KeyID)
+	}
+
+	plaintext, err := c.keyring.Open(location.Encrypted.KeyID, location.Encrypted.Data, location.ID[:])
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, "failed to decrypt coordinates: "+err.Error())
+	}
+
+	if len(plaintext) != 16 {
+		return utils.AsError(model.ErrDatabase, "invalid encrypted coordinates")
+	}
+
+	location.Latitude = math.Float64frombits(binary.BigEndian.Uint64(plaintext[:8]))
+	location.Longitude = math.Float64frombits(binary.BigEndian.Uint64(plaintext[8:]))
+	location.Encrypted = nil
+
+	return nil
+}
+
+// openAll decrypts the coordinates of the stored locations in place
+func (c coordinatesCipher) openAll(locations []model.Location) error {
+	for i := range locations {
+		if err := c.open(&locations[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
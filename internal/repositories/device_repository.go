@@ -2,6 +2,7 @@ package repositories
 
 import (
 	"context"
+	"dwimc/internal/encryption"
 	"dwimc/internal/model"
 	"dwimc/internal/utils"
 	"errors"
@@ -15,47 +16,59 @@ import (
 
 const COLLECTION_NAME_DEVICES = "devices"
 
+// DeviceRepository reads only devices which are not in the trash,
+// unless stated otherwise.
+//
+// Writes taking a version apply only to the device at that version, failing with
+// ErrPreconditionFailed otherwise, 0 applies to any version.
 type DeviceRepository interface {
-	GetAll() ([]model.Device, error)
-	Get(id string) (*model.Device, error)
-	Exists(id string) (bool, error)
-	Create(serial string, name string) (*model.Device, error)
-	Delete(id string) (bool, error)
+	GetAll(ctx context.Context) ([]model.Device, error)
+	Get(ctx context.Context, id string) (*model.Device, error)
+	GetBySerial(ctx context.Context, serial string) (*model.Device, error)
+	Exists(ctx context.Context, id string) (bool, error)
+	// Create upserts the device by its serial, a device in the trash is taken out of it
+	// without its last location. The version is bumped only when the device changes,
+	// a conditioned write never creates a device. Returns whether the device was created.
+	Create(ctx context.Context, serial string, name string, version int64) (*model.Device, bool, error)
+	SetRetentionPeriod(ctx context.Context, id string, retentionPeriod int64, version int64) (*model.Device, error)
+	// SetLastLocation replaces the device last location unless it holds a newer one (by recorded time, then id)
+	SetLastLocation(ctx context.Context, id string, location *model.Location) error
+	// ReplaceLastLocation replaces the device last location regardless of its age, nil clears it
+	ReplaceLastLocation(ctx context.Context, id string, location *model.Location) error
+	// SoftDelete moves the device to the trash
+	SoftDelete(ctx context.Context, id string, version int64, deletedAt time.Time) (bool, error)
+	GetAllDeleted(ctx context.Context) ([]model.Device, error)
+	GetDeleted(ctx context.Context, id string) (*model.Device, error)
+	// Restore takes the device out of the trash
+	Restore(ctx context.Context, id string) (bool, error)
+	// Delete removes the device permanently, whether it is in the trash or not
+	Delete(ctx context.Context, id string) (bool, error)
+	// Import upserts the device by its id as is, keeping its timestamps, version and trash state.
+	// The last location is cleared, a serial of another device is a conflict.
+	Import(ctx context.Context, device model.Device) error
 }
 
 type MongodbDeviceRepository struct {
-	context    context.Context
 	collection *mongo.Collection
+	cipher     coordinatesCipher
 }
 
+// NewMongodbDeviceRepository encrypts the last locations when given a keyring, see NewMongodbLocationRepository
 func NewMongodbDeviceRepository(
-	context context.Context,
 	client *mongo.Client,
 	dbName string,
-) (DeviceRepository, error) {
-	collection := client.Database(dbName).Collection(COLLECTION_NAME_DEVICES)
-
-	if _, err := collection.Indexes().CreateOne(
-		context,
-		mongo.IndexModel{
-			Keys: bson.M{
-				"serial": 1,
-			},
-			Options: options.Index().SetUnique(true),
-		}); err != nil {
-		return nil, utils.AsError(model.ErrDatabase, err.Error())
-	}
-
+	keyring *encryption.Keyring,
+) DeviceRepository {
 	return &MongodbDeviceRepository{
-		context:    context,
-		collection: collection,
-	}, nil
+		collection: client.Database(dbName).Collection(COLLECTION_NAME_DEVICES),
+		cipher:     coordinatesCipher{keyring: keyring},
+	}
 }
 
-func (r *MongodbDeviceRepository) GetAll() ([]model.Device, error) {
+func (r *MongodbDeviceRepository) GetAll(ctx context.Context) ([]model.Device, error) {
 	devices := []model.Device{}
 
-	cursor, err := r.collection.Find(r.context, bson.M{})
+	cursor, err := r.collection.Find(ctx, bson.M{"deletedAt": nil})
 	if err != nil {
 		if err == mongo.ErrNoDocuments {
 			return devices, nil
@@ -63,22 +76,26 @@ func (r *MongodbDeviceRepository) GetAll() ([]model.Device, error) {
 		return nil, err
 	}
 
-	defer cursor.Close(r.context)
+	defer cursor.Close(ctx)
 
-	for cursor.Next(r.context) {
+	for cursor.Next(ctx) {
 		var device model.Device
 
 		if err := cursor.Decode(&device); err != nil {
 			return nil, utils.AsError(model.ErrDatabase, err.Error())
 		}
 
+		if err := r.cipher.open(device.LastLocation); err != nil {
+			return nil, err
+		}
+
 		devices = append(devices, device)
 	}
 
 	return devices, nil
 }
 
-func (r *MongodbDeviceRepository) Get(id string) (*model.Device, error) {
+func (r *MongodbDeviceRepository) Get(ctx context.Context, id string) (*model.Device, error) {
 	var device model.Device
 
 	objectID, err := bson.ObjectIDFromHex(id)
@@ -90,8 +107,8 @@ func (r *MongodbDeviceRepository) Get(id string) (*model.Device, error) {
 	}
 
 	err = r.collection.FindOne(
-		r.context,
-		bson.M{"_id": objectID},
+		ctx,
+		bson.M{"_id": objectID, "deletedAt": nil},
 	).Decode(&device)
 
 	if err != nil {
@@ -102,10 +119,37 @@ func (r *MongodbDeviceRepository) Get(id string) (*model.Device, error) {
 		return nil, utils.AsError(model.ErrDatabase, err.Error())
 	}
 
+	if err := r.cipher.open(device.LastLocation); err != nil {
+		return nil, err
+	}
+
+	return &device, nil
+}
+
+func (r *MongodbDeviceRepository) GetBySerial(ctx context.Context, serial string) (*model.Device, error) {
+	var device model.Device
+
+	err := r.collection.FindOne(
+		ctx,
+		bson.M{"serial": serial, "deletedAt": nil},
+	).Decode(&device)
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, utils.AsError(model.ErrItemNotFound, "device not found")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if err := r.cipher.open(device.LastLocation); err != nil {
+		return nil, err
+	}
+
 	return &device, nil
 }
 
-func (r *MongodbDeviceRepository) Exists(id string) (bool, error) {
+func (r *MongodbDeviceRepository) Exists(ctx context.Context, id string) (bool, error) {
 	objectID, err := bson.ObjectIDFromHex(id)
 	if err != nil {
 		return false, utils.AsError(
@@ -115,8 +159,8 @@ func (r *MongodbDeviceRepository) Exists(id string) (bool, error) {
 	}
 
 	err = r.collection.FindOne(
-		r.context,
-		bson.M{"_id": objectID},
+		ctx,
+		bson.M{"_id": objectID, "deletedAt": nil},
 	).Err()
 
 	if err != nil {
@@ -130,52 +174,341 @@ func (r *MongodbDeviceRepository) Exists(id string) (bool, error) {
 	return true, nil
 }
 
-func (r *MongodbDeviceRepository) Create(serial string, name string) (*model.Device, error) {
+func (r *MongodbDeviceRepository) Create(ctx context.Context, serial string, name string, version int64) (*model.Device, bool, error) {
 	if len(serial) == 0 && len(name) == 0 {
-		return nil, utils.AsError(model.ErrInvalidArgs, "Fields are empty")
+		return nil, false, utils.AsError(model.ErrInvalidArgs, "Fields are empty")
 	}
 
-	var device model.Device
-
 	updatedAt := time.Now().UTC()
 	filter := bson.M{"serial": serial}
-	update := bson.M{
-		"$set": bson.M{
+	if version != 0 {
+		filter["version"] = version
+	}
+
+	// an update pipeline, drops the last location of a device taken out of the trash
+	// and bumps the version of a new, renamed or restored device
+	update := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"version": bson.M{"$cond": bson.A{
+				bson.M{"$or": bson.A{
+					bson.M{"$ne": bson.A{"$name", name}},
+					bson.M{"$gt": bson.A{"$deletedAt", nil}},
+				}},
+				bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}},
+				"$version",
+			}},
+		}}},
+		{{Key: "$set", Value: bson.M{
 			"serial":    serial,
 			"name":      name,
 			"updatedAt": updatedAt,
-		},
-		"$setOnInsert": bson.M{"createdAt": updatedAt},
+			"createdAt": bson.M{"$ifNull": bson.A{"$createdAt", updatedAt}},
+			"lastLocation": bson.M{"$cond": bson.A{
+				bson.M{"$gt": bson.A{"$deletedAt", nil}},
+				"$$REMOVE",
+				"$lastLocation",
+			}},
+		}}},
+		{{Key: "$unset", Value: "deletedAt"}},
 	}
 
-	opts := options.FindOneAndUpdate().
-		SetUpsert(true).
-		SetReturnDocument(options.After)
-
-	err := r.collection.FindOneAndUpdate(
-		r.context,
+	// an update rather than a find and modify, which doesn't tell an upsert apart
+	result, err := r.collection.UpdateOne(
+		ctx,
 		filter,
 		update,
-		opts,
+		options.UpdateOne().SetUpsert(version == 0),
+	)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNilValue) {
+			return nil, false, utils.AsError(model.ErrInvalidArgs, err.Error())
+		}
+
+		return nil, false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	// we don't handle conflict since we are using upsert
+	if result.MatchedCount == 0 && result.UpsertedCount == 0 {
+		return nil, false, utils.AsError(model.ErrPreconditionFailed, "device version mismatch")
+	}
+
+	var device model.Device
+
+	if err := r.collection.FindOne(ctx, bson.M{"serial": serial}).Decode(&device); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, false, utils.AsError(model.ErrItemNotFound, "device not found")
+		}
+
+		return nil, false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if err := r.cipher.open(device.LastLocation); err != nil {
+		return nil, false, err
+	}
+
+	return &device, result.UpsertedCount > 0, nil
+}
+
+func (r *MongodbDeviceRepository) SetRetentionPeriod(ctx context.Context, id string, retentionPeriod int64, version int64) (*model.Device, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	var device model.Device
+
+	filter := bson.M{"_id": objectID, "deletedAt": nil}
+	if version != 0 {
+		filter["version"] = version
+	}
+
+	err = r.collection.FindOneAndUpdate(
+		ctx,
+		filter,
+		bson.M{
+			"$set": bson.M{
+				"retentionPeriod": retentionPeriod,
+				"updatedAt":       time.Now().UTC(),
+			},
+			"$inc": bson.M{"version": 1},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
 	).Decode(&device)
 
 	if err != nil {
-		// we don't handle conflict since we are using upsert
 		if errors.Is(err, mongo.ErrNoDocuments) {
-			return nil, utils.AsError(model.ErrItemNotFound, "device not found")
+			return nil, r.versionMismatchOrNotFound(ctx, id, version)
 		}
 
-		if errors.Is(err, mongo.ErrNilValue) {
-			return nil, utils.AsError(model.ErrInvalidArgs, err.Error())
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if err := r.cipher.open(device.LastLocation); err != nil {
+		return nil, err
+	}
+
+	return &device, nil
+}
+
+func (r *MongodbDeviceRepository) SetLastLocation(ctx context.Context, id string, location *model.Location) error {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	document, err := r.lastLocationDocument(location)
+	if err != nil {
+		return err
+	}
+
+	// a concurrent or earlier reported newer location wins, no match is not an error
+	_, err = r.collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id": objectID,
+			"$or": bson.A{
+				bson.M{"lastLocation": nil},
+				bson.M{"lastLocation.recordedAt": bson.M{"$lt": location.RecordedAt}},
+				bson.M{"lastLocation.recordedAt": location.RecordedAt, "lastLocation._id": bson.M{"$lte": location.ID}},
+			},
+		},
+		bson.M{"$set": bson.M{"lastLocation": document}},
+	)
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return nil
+}
+
+func (r *MongodbDeviceRepository) ReplaceLastLocation(ctx context.Context, id string, location *model.Location) error {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	update := bson.M{"$unset": bson.M{"lastLocation": ""}}
+	if location != nil {
+		document, err := r.lastLocationDocument(location)
+		if err != nil {
+			return err
 		}
 
+		update = bson.M{"$set": bson.M{"lastLocation": document}}
+	}
+
+	result, err := r.collection.UpdateOne(ctx, bson.M{"_id": objectID}, update)
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if result.MatchedCount == 0 {
+		return utils.AsError(model.ErrItemNotFound, "device not found")
+	}
+
+	return nil
+}
+
+func (r *MongodbDeviceRepository) SoftDelete(ctx context.Context, id string, version int64, deletedAt time.Time) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	filter := bson.M{"_id": objectID, "deletedAt": nil}
+	if version != 0 {
+		filter["version"] = version
+	}
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		filter,
+		bson.M{
+			"$set": bson.M{"deletedAt": deletedAt},
+			"$inc": bson.M{"version": 1},
+		},
+	)
+
+	if err != nil {
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if result.ModifiedCount == 0 {
+		// a missing device is not an error, a mismatching one is
+		if err := r.versionMismatchOrNotFound(ctx, id, version); !errors.Is(err, model.ErrItemNotFound) {
+			return false, err
+		}
+
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func (r *MongodbDeviceRepository) GetAllDeleted(ctx context.Context) ([]model.Device, error) {
+	cursor, err := r.collection.Find(
+		ctx,
+		bson.M{"deletedAt": bson.M{"$ne": nil}},
+		options.Find().SetSort(bson.D{{Key: "deletedAt", Value: -1}, {Key: "_id", Value: 1}}),
+	)
+	if err != nil {
 		return nil, utils.AsError(model.ErrDatabase, err.Error())
 	}
 
+	devices := []model.Device{}
+	if err := cursor.All(ctx, &devices); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	for _, device := range devices {
+		if err := r.cipher.open(device.LastLocation); err != nil {
+			return nil, err
+		}
+	}
+
+	return devices, nil
+}
+
+func (r *MongodbDeviceRepository) GetDeleted(ctx context.Context, id string) (*model.Device, error) {
+	var device model.Device
+
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	err = r.collection.FindOne(
+		ctx,
+		bson.M{"_id": objectID, "deletedAt": bson.M{"$ne": nil}},
+	).Decode(&device)
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, utils.AsError(model.ErrItemNotFound, "device not found in trash")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if err := r.cipher.open(device.LastLocation); err != nil {
+		return nil, err
+	}
+
 	return &device, nil
 }
 
-func (r *MongodbDeviceRepository) Delete(id string) (bool, error) {
+func (r *MongodbDeviceRepository) Restore(ctx context.Context, id string) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{"_id": objectID, "deletedAt": bson.M{"$ne": nil}},
+		bson.M{
+			"$unset": bson.M{"deletedAt": ""},
+			"$inc":   bson.M{"version": 1},
+		},
+	)
+
+	if err != nil {
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return result.ModifiedCount > 0, nil
+}
+
+func (r *MongodbDeviceRepository) Import(ctx context.Context, device model.Device) error {
+	err := r.collection.FindOne(
+		ctx,
+		bson.M{"serial": device.Serial, "_id": bson.M{"$ne": device.ID}},
+	).Err()
+
+	if err == nil {
+		return utils.AsError(
+			model.ErrItemConflict,
+			fmt.Sprintf("serial belongs to another device: %s", device.Serial),
+		)
+	}
+
+	if !errors.Is(err, mongo.ErrNoDocuments) {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	device.LastLocation = nil
+
+	if _, err := r.collection.ReplaceOne(
+		ctx,
+		bson.M{"_id": device.ID},
+		device,
+		options.Replace().SetUpsert(true),
+	); err != nil {
+		return utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	return nil
+}
+
+func (r *MongodbDeviceRepository) Delete(ctx context.Context, id string) (bool, error) {
 	objectID, err := bson.ObjectIDFromHex(id)
 	if err != nil {
 		return false, utils.AsError(
@@ -185,7 +518,7 @@ func (r *MongodbDeviceRepository) Delete(id string) (bool, error) {
 	}
 
 	result, err := r.collection.DeleteOne(
-		r.context,
+		ctx,
 		bson.M{"_id": objectID},
 	)
 
@@ -195,3 +528,25 @@ func (r *MongodbDeviceRepository) Delete(id string) (bool, error) {
 
 	return result.DeletedCount > 0, nil
 }
+
+// versionMismatchOrNotFound tells why a write conditioned on the version matched no device
+func (r *MongodbDeviceRepository) versionMismatchOrNotFound(ctx context.Context, id string, version int64) error {
+	if version == 0 {
+		return utils.AsError(model.ErrItemNotFound, "device not found")
+	}
+
+	if _, err := r.Exists(ctx, id); err != nil {
+		return err
+	}
+
+	return utils.AsError(model.ErrPreconditionFailed, "device version mismatch")
+}
+
+// lastLocationDocument copies the location without its spatial point,
+// devices are not spatially indexed.
+func (r *MongodbDeviceRepository) lastLocationDocument(location *model.Location) (model.Location, error) {
+	document := *location
+	document.Point = nil
+
+	return r.cipher.seal(document)
+}
@@ -0,0 +1,208 @@
+package repositories
+
+import (
+	"context"
+	"dwimc/internal/encryption"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"fmt"
+	"slices"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// EncryptionRepository manages the keys the stored coordinates are encrypted with
+type EncryptionRepository interface {
+	// KeyIDs returns the sorted ids of the keys in use by the stored locations
+	KeyIDs(ctx context.Context) ([]string, error)
+	// Reencrypt encrypts again the coordinates not encrypted with the active key,
+	// or stores all of them in plain when decrypt is set. Locations are rewritten in small steps
+	// so it can run along the service, returns the number of rewritten locations.
+	Reencrypt(ctx context.Context, decrypt bool) (int64, error)
+}
+
+type MongodbEncryptionRepository struct {
+	locations *mongo.Collection
+	devices   *mongo.Collection
+	cipher    coordinatesCipher
+}
+
+func NewMongodbEncryptionRepository(
+	client *mongo.Client,
+	dbName string,
+	keyring *encryption.Keyring,
+) EncryptionRepository {
+	return &MongodbEncryptionRepository{
+		locations: client.Database(dbName).Collection(COLLECTION_NAME_LOCATIONS),
+		devices:   client.Database(dbName).Collection(COLLECTION_NAME_DEVICES),
+		cipher:    coordinatesCipher{keyring: keyring},
+	}
+}
+
+func (r *MongodbEncryptionRepository) KeyIDs(ctx context.Context) ([]string, error) {
+	keyIDs := []string{}
+
+	// devices hold a copy of their last location
+	for collection, field := range map[*mongo.Collection]string{
+		r.locations: "encrypted.kid",
+		r.devices:   "lastLocation.encrypted.kid",
+	} {
+		var ids []string
+		if err := collection.Distinct(ctx, field, bson.M{}).Decode(&ids); err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		keyIDs = append(keyIDs, ids...)
+	}
+
+	slices.Sort(keyIDs)
+
+	return slices.Compact(keyIDs), nil
+}
+
+func (r *MongodbEncryptionRepository) Reencrypt(ctx context.Context, decrypt bool) (int64, error) {
+	if !decrypt && !r.cipher.enabled() {
+		return 0, utils.AsError(ErrMissingEncryptionKey, "no active key")
+	}
+
+	cursor, err := r.locations.Find(ctx, r.pendingFilter("", decrypt))
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer cursor.Close(ctx)
+
+	var rewritten int64
+	for cursor.Next(ctx) {
+		var location model.Location
+		if err := cursor.Decode(&location); err != nil {
+			return rewritten, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		if err := r.cipher.open(&location); err != nil {
+			return rewritten, err
+		}
+
+		update := bson.M{
+			"$set": bson.M{
+				"latitude":  location.Latitude,
+				"longitude": location.Longitude,
+				"point":     model.NewGeoPoint(location.Latitude, location.Longitude),
+			},
+			"$unset": bson.M{"encrypted": ""},
+		}
+
+		if !decrypt {
+			stored, err := r.cipher.seal(location)
+			if err != nil {
+				return rewritten, err
+			}
+
+			update = bson.M{
+				"$set": bson.M{
+					"latitude":  stored.Latitude,
+					"longitude": stored.Longitude,
+					"encrypted": stored.Encrypted,
+				},
+				"$unset": bson.M{"point": ""},
+			}
+		}
+
+		if _, err := r.locations.UpdateOne(ctx, bson.M{"_id": location.ID}, update); err != nil {
+			return rewritten, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		rewritten++
+	}
+
+	if err := cursor.Err(); err != nil {
+		return rewritten, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return rewritten, r.reencryptLastLocations(ctx, decrypt)
+}
+
+// reencryptLastLocations rewrites the copies of the last locations held by the devices,
+// a last location replaced meanwhile is left as is.
+func (r *MongodbEncryptionRepository) reencryptLastLocations(ctx context.Context, decrypt bool) error {
+	filter := r.pendingFilter("lastLocation.", decrypt)
+	filter["lastLocation"] = bson.M{"$ne": nil}
+
+	cursor, err := r.devices.Find(ctx, filter)
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var device model.Device
+		if err := cursor.Decode(&device); err != nil {
+			return utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		location := device.LastLocation
+		if err := r.cipher.open(location); err != nil {
+			return err
+		}
+
+		document := *location
+		if !decrypt {
+			sealed, err := r.cipher.seal(document)
+			if err != nil {
+				return err
+			}
+
+			document = sealed
+		}
+
+		if _, err := r.devices.UpdateOne(
+			ctx,
+			bson.M{"_id": device.ID, "lastLocation._id": location.ID},
+			bson.M{"$set": bson.M{"lastLocation": document}},
+		); err != nil {
+			return utils.AsError(model.ErrDatabase, err.Error())
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return nil
+}
+
+// pendingFilter matches the locations to rewrite, prefixed by the path of embedded ones
+func (r *MongodbEncryptionRepository) pendingFilter(prefix string, decrypt bool) bson.M {
+	if decrypt {
+		return bson.M{prefix + "encrypted": bson.M{"$exists": true}}
+	}
+
+	return bson.M{prefix + "encrypted.kid": bson.M{"$ne": r.cipher.keyring.ActiveKeyID()}}
+}
+
+// checkEncryptionKeys refuses a keyring missing keys the stored coordinates are encrypted with
+func checkEncryptionKeys(ctx context.Context, repository EncryptionRepository, keyring *encryption.Keyring) error {
+	keyIDs, err := repository.KeyIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	missing := []string{}
+	for _, keyID := range keyIDs {
+		if keyring == nil || !keyring.Has(keyID) {
+			missing = append(missing, keyID)
+		}
+	}
+
+	if len(missing) > 0 {
+		return utils.AsError(
+			ErrMissingEncryptionKey,
+			fmt.Sprintf("coordinates are encrypted with unknown keys: %s", strings.Join(missing, ", ")),
+		)
+	}
+
+	return nil
+}
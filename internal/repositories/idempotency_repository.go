@@ -0,0 +1,100 @@
+package repositories
+
+import (
+	"context"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const COLLECTION_NAME_IDEMPOTENCY_KEYS = "idempotency_keys"
+
+// IdempotencyRepository stores the responses of requests sent with an idempotency key,
+// a key expired by its CreatedAt time counts as missing.
+type IdempotencyRepository interface {
+	// Reserve stores the key of a request about to run unless a live one exists,
+	// returns the existing key or nil once reserved.
+	Reserve(ctx context.Context, key model.IdempotencyKey) (*model.IdempotencyKey, error)
+	// Complete replaces the reserved key along with the response of its request
+	Complete(ctx context.Context, key model.IdempotencyKey) error
+	// Release deletes the key of a request which didn't complete, for its retry to run again
+	Release(ctx context.Context, key string) error
+	// DeleteExpired deletes the keys expired before the given time
+	DeleteExpired(ctx context.Context, before time.Time) (int64, error)
+}
+
+type MongodbIdempotencyRepository struct {
+	collection *mongo.Collection
+}
+
+func NewMongodbIdempotencyRepository(client *mongo.Client, dbName string) IdempotencyRepository {
+	return &MongodbIdempotencyRepository{
+		collection: client.Database(dbName).Collection(COLLECTION_NAME_IDEMPOTENCY_KEYS),
+	}
+}
+
+func (r *MongodbIdempotencyRepository) Reserve(ctx context.Context, key model.IdempotencyKey) (*model.IdempotencyKey, error) {
+	// replaces an expired key, a live one fails the upsert as a duplicate
+	_, err := r.collection.ReplaceOne(
+		ctx,
+		bson.M{"_id": key.Key, "expiresAt": bson.M{"$lte": key.CreatedAt}},
+		key,
+		options.Replace().SetUpsert(true),
+	)
+	if err == nil {
+		return nil, nil
+	}
+
+	if !mongo.IsDuplicateKeyError(err) {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	var existing model.IdempotencyKey
+
+	err = r.collection.FindOne(ctx, bson.M{"_id": key.Key}).Decode(&existing)
+	if err != nil {
+		// released meanwhile
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, utils.AsError(model.ErrItemConflict, "idempotency key is in use")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return &existing, nil
+}
+
+func (r *MongodbIdempotencyRepository) Complete(ctx context.Context, key model.IdempotencyKey) error {
+	result, err := r.collection.ReplaceOne(ctx, bson.M{"_id": key.Key}, key)
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if result.MatchedCount == 0 {
+		return utils.AsError(model.ErrItemNotFound, "idempotency key not found")
+	}
+
+	return nil
+}
+
+func (r *MongodbIdempotencyRepository) Release(ctx context.Context, key string) error {
+	if _, err := r.collection.DeleteOne(ctx, bson.M{"_id": key}); err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return nil
+}
+
+func (r *MongodbIdempotencyRepository) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	result, err := r.collection.DeleteMany(ctx, bson.M{"expiresAt": bson.M{"$lte": before}})
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return result.DeletedCount, nil
+}
@@ -1,9 +1,12 @@
 package repositories
 
 import (
+	"cmp"
 	"context"
+	"dwimc/internal/encryption"
 	"dwimc/internal/model"
 	"dwimc/internal/utils"
+	"errors"
 	"fmt"
 	"time"
 
@@ -14,45 +17,83 @@ import (
 
 const COLLECTION_NAME_LOCATIONS = "locations"
 
+// mongodb_newest_first sorts locations by the time they were recorded at, see GetLatestByDevice
+var mongodb_newest_first = bson.D{{Key: "recordedAt", Value: -1}, {Key: "_id", Value: -1}}
+
+// LocationRepository reads only locations which are not in the trash,
+// unless stated otherwise. The history goes by the time locations were recorded at, then by their id.
 type LocationRepository interface {
-	GetAllByDevice(deviceID string) ([]model.Location, error)
-	GetLatestByDevice(deviceID string) (*model.Location, error)
-	Create(deviceID string, latitude float64, longitude float64) (*model.Location, error)
-	Delete(deviceID string, id string) (bool, error)
-	DeleteAllByDevice(deviceID string) (bool, error)
-	DeleteOldByDevice(deviceID string, skip int) (int64, error)
+	// GetAllByDevice returns the device locations, oldest first
+	GetAllByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) ([]model.Location, error)
+	// GetLatestByDevice returns the newest location, rejected ones are never the latest
+	GetLatestByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) (*model.Location, error)
+	// Create stamps the location with the current time, also recorded at it unless recordedAt is set
+	Create(
+		ctx context.Context,
+		deviceID string,
+		latitude float64,
+		longitude float64,
+		recordedAt time.Time,
+		telemetry model.Telemetry,
+		screening model.Screening,
+	) (*model.Location, error)
+	// CreateMany adds the locations in a single insert, stamped same as Create.
+	// Only their coordinates, recorded time, telemetry, screening and seen count (at least 1) are taken,
+	// they are returned in the same order.
+	CreateMany(ctx context.Context, deviceID string, locations []model.Location) ([]model.Location, error)
+	// Refresh marks the location as seen again count more times, last at updatedAt.
+	// Fails with ErrItemNotFound when the location is missing or in the trash.
+	Refresh(ctx context.Context, deviceID string, id string, updatedAt time.Time, count int64) (*model.Location, error)
+	// SoftDelete moves the location to the trash
+	SoftDelete(ctx context.Context, deviceID string, id string, deletedAt time.Time) (bool, error)
+	SoftDeleteAllByDevice(ctx context.Context, deviceID string, deletedAt time.Time) (int64, error)
+	GetDeletedByDevice(ctx context.Context, deviceID string) ([]model.Location, error)
+	// Restore takes the location out of the trash
+	Restore(ctx context.Context, deviceID string, id string) (bool, error)
+	// RestoreAllByDevice takes the device locations out of the trash,
+	// only the ones deleted at the given time when set.
+	RestoreAllByDevice(ctx context.Context, deviceID string, deletedAt *time.Time) (int64, error)
+	// PurgeDeleted permanently removes locations moved to the trash before the given time
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, error)
+	// Delete and DeleteAllByDevice remove locations permanently, whether they are in the trash or not
+	Delete(ctx context.Context, deviceID string, id string) (bool, error)
+	DeleteAllByDevice(ctx context.Context, deviceID string) (int64, error)
+	// DeleteOldByDevice keeps only the newest locations, whether they are in the trash or not,
+	// it never deletes more than required when called concurrently. The latest location
+	// (see GetLatestByDevice) is always kept, even when newer rejected ones outnumber the limit.
+	DeleteOldByDevice(ctx context.Context, deviceID string, skip int) (int64, error)
+	// DeleteExpiredByDevice deletes locations recorded before the given time,
+	// the latest location (see GetLatestByDevice) is always kept regardless of its age.
+	DeleteExpiredByDevice(ctx context.Context, deviceID string, before time.Time) (int64, error)
+	GetDeviceIDs(ctx context.Context) ([]string, error)
+	// GetNear returns the locations within the distance (meters) from the center, nearest first.
+	// Spatial queries fail with ErrNotSupported when the coordinates are encrypted.
+	GetNear(ctx context.Context, center model.Coordinates, maxDistance float64) ([]model.Location, error)
+	GetWithinPolygon(ctx context.Context, polygon model.Polygon) ([]model.Location, error)
+	// Import upserts the location by its id as is, keeping its timestamps and trash state.
+	Import(ctx context.Context, location model.Location) (*model.Location, error)
+	// ImportMany upserts the locations same as Import in a single write, they are returned in the same order.
+	ImportMany(ctx context.Context, locations []model.Location) ([]model.Location, error)
 }
 
 type MongodbLocationRepository struct {
-	context    context.Context
 	collection *mongo.Collection
+	cipher     coordinatesCipher
 }
 
+// NewMongodbLocationRepository encrypts the stored coordinates when given a keyring
 func NewMongodbLocationRepository(
-	context context.Context,
 	client *mongo.Client,
 	dbName string,
-) (LocationRepository, error) {
-	collection := client.Database(dbName).Collection(COLLECTION_NAME_LOCATIONS)
-
-	if _, err := collection.Indexes().CreateOne(
-		context,
-		mongo.IndexModel{
-			Keys: bson.M{
-				"deviceId": 1,
-			},
-			Options: options.Index().SetUnique(false),
-		}); err != nil {
-		return nil, utils.AsError(model.ErrDatabase, err.Error())
-	}
-
+	keyring *encryption.Keyring,
+) LocationRepository {
 	return &MongodbLocationRepository{
-		context:    context,
-		collection: collection,
-	}, nil
+		collection: client.Database(dbName).Collection(COLLECTION_NAME_LOCATIONS),
+		cipher:     coordinatesCipher{keyring: keyring},
+	}
 }
 
-func (r *MongodbLocationRepository) GetAllByDevice(deviceID string) ([]model.Location, error) {
+func (r *MongodbLocationRepository) GetAllByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) ([]model.Location, error) {
 	objectID, err := bson.ObjectIDFromHex(deviceID)
 	if err != nil {
 		return nil, utils.AsError(
@@ -64,8 +105,9 @@ func (r *MongodbLocationRepository) GetAllByDevice(deviceID string) ([]model.Loc
 	locations := []model.Location{}
 
 	cursor, err := r.collection.Find(
-		r.context,
-		bson.M{"deviceId": objectID},
+		ctx,
+		mongodbLocationFilter(bson.M{"deviceId": objectID, "deletedAt": nil}, filter),
+		options.Find().SetSort(bson.D{{Key: "recordedAt", Value: 1}, {Key: "_id", Value: 1}}),
 	)
 
 	if err != nil {
@@ -75,22 +117,26 @@ func (r *MongodbLocationRepository) GetAllByDevice(deviceID string) ([]model.Loc
 		return nil, err
 	}
 
-	defer cursor.Close(r.context)
+	defer cursor.Close(ctx)
 
-	for cursor.Next(r.context) {
+	for cursor.Next(ctx) {
 		var location model.Location
 
 		if err := cursor.Decode(&location); err != nil {
 			return nil, utils.AsError(model.ErrDatabase, err.Error())
 		}
 
+		if err := r.cipher.open(&location); err != nil {
+			return nil, err
+		}
+
 		locations = append(locations, location)
 	}
 
 	return locations, nil
 }
 
-func (r *MongodbLocationRepository) GetLatestByDevice(deviceID string) (*model.Location, error) {
+func (r *MongodbLocationRepository) GetLatestByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) (*model.Location, error) {
 	objectID, err := bson.ObjectIDFromHex(deviceID)
 	if err != nil {
 		return nil, utils.AsError(
@@ -102,9 +148,9 @@ func (r *MongodbLocationRepository) GetLatestByDevice(deviceID string) (*model.L
 	var location model.Location
 
 	err = r.collection.FindOne(
-		r.context,
-		bson.M{"deviceId": objectID},
-		options.FindOne().SetSort(bson.D{{Key: "updatedAt", Value: -1}}),
+		ctx,
+		mongodbLocationFilter(bson.M{"deviceId": objectID, "deletedAt": nil, "rejected": bson.M{"$ne": true}}, filter),
+		options.FindOne().SetSort(mongodb_newest_first),
 	).Decode(&location)
 
 	if err != nil {
@@ -115,10 +161,22 @@ func (r *MongodbLocationRepository) GetLatestByDevice(deviceID string) (*model.L
 		return nil, utils.AsError(model.ErrDatabase, err.Error())
 	}
 
+	if err := r.cipher.open(&location); err != nil {
+		return nil, err
+	}
+
 	return &location, nil
 }
 
-func (r *MongodbLocationRepository) Create(deviceID string, latitude float64, longitude float64) (*model.Location, error) {
+func (r *MongodbLocationRepository) Create(
+	ctx context.Context,
+	deviceID string,
+	latitude float64,
+	longitude float64,
+	recordedAt time.Time,
+	telemetry model.Telemetry,
+	screening model.Screening,
+) (*model.Location, error) {
 	objectID, err := bson.ObjectIDFromHex(deviceID)
 	if err != nil {
 		return nil, utils.AsError(
@@ -127,17 +185,28 @@ func (r *MongodbLocationRepository) Create(deviceID string, latitude float64, lo
 		)
 	}
 
-	created := time.Now().UTC()
+	// mongodb stores dates in milliseconds precision
+	created := time.Now().UTC().Truncate(time.Millisecond)
 	location := &model.Location{
-		ID:        bson.NewObjectID(),
-		CreatedAt: created,
-		UpdatedAt: created,
-		DeviceID:  objectID,
-		Latitude:  latitude,
-		Longitude: longitude,
+		ID:         bson.NewObjectID(),
+		CreatedAt:  created,
+		UpdatedAt:  created,
+		RecordedAt: cmp.Or(recordedAt, created),
+		DeviceID:   objectID,
+		Latitude:   latitude,
+		Longitude:  longitude,
+		SeenCount:  1,
+		Point:      model.NewGeoPoint(latitude, longitude),
+		Telemetry:  telemetry,
+		Screening:  screening,
+	}
+
+	stored, err := r.cipher.seal(*location)
+	if err != nil {
+		return nil, err
 	}
 
-	result, err := r.collection.InsertOne(r.context, location)
+	result, err := r.collection.InsertOne(ctx, stored)
 	if err != nil {
 		return nil, utils.AsError(model.ErrOperationFailed, err.Error())
 	}
@@ -149,7 +218,257 @@ func (r *MongodbLocationRepository) Create(deviceID string, latitude float64, lo
 	return location, nil
 }
 
-func (r *MongodbLocationRepository) Delete(deviceID string, id string) (bool, error) {
+func (r *MongodbLocationRepository) CreateMany(
+	ctx context.Context,
+	deviceID string,
+	locations []model.Location,
+) ([]model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	if len(locations) == 0 {
+		return []model.Location{}, nil
+	}
+
+	// mongodb stores dates in milliseconds precision
+	created := time.Now().UTC().Truncate(time.Millisecond)
+
+	createdLocations := make([]model.Location, 0, len(locations))
+	documents := make([]any, 0, len(locations))
+
+	for _, params := range locations {
+		location := model.Location{
+			ID:         bson.NewObjectID(),
+			CreatedAt:  created,
+			UpdatedAt:  created,
+			RecordedAt: cmp.Or(params.RecordedAt, created),
+			DeviceID:   objectID,
+			Latitude:   params.Latitude,
+			Longitude:  params.Longitude,
+			SeenCount:  max(params.SeenCount, 1),
+			Point:      model.NewGeoPoint(params.Latitude, params.Longitude),
+			Telemetry:  params.Telemetry,
+			Screening:  params.Screening,
+		}
+
+		stored, err := r.cipher.seal(location)
+		if err != nil {
+			return nil, err
+		}
+
+		createdLocations = append(createdLocations, location)
+		documents = append(documents, stored)
+	}
+
+	if _, err := r.collection.InsertMany(ctx, documents); err != nil {
+		return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	return createdLocations, nil
+}
+
+func (r *MongodbLocationRepository) Refresh(
+	ctx context.Context,
+	deviceID string,
+	id string,
+	updatedAt time.Time,
+	count int64,
+) (*model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	var location model.Location
+
+	err = r.collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": objectID, "deviceId": deviceOID, "deletedAt": nil},
+		bson.M{
+			"$set": bson.M{"updatedAt": updatedAt.UTC().Truncate(time.Millisecond)},
+			"$inc": bson.M{"seenCount": count},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&location)
+
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, utils.AsError(model.ErrItemNotFound, "location not found")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if err := r.cipher.open(&location); err != nil {
+		return nil, err
+	}
+
+	return &location, nil
+}
+
+func (r *MongodbLocationRepository) SoftDelete(ctx context.Context, deviceID string, id string, deletedAt time.Time) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id":       objectID,
+			"deviceId":  deviceOID,
+			"deletedAt": nil,
+		},
+		bson.M{"$set": bson.M{"deletedAt": deletedAt}},
+	)
+
+	if err != nil {
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return result.ModifiedCount > 0, nil
+}
+
+func (r *MongodbLocationRepository) SoftDeleteAllByDevice(ctx context.Context, deviceID string, deletedAt time.Time) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	result, err := r.collection.UpdateMany(
+		ctx,
+		bson.M{"deviceId": objectID, "deletedAt": nil},
+		bson.M{"$set": bson.M{"deletedAt": deletedAt}},
+	)
+
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return result.ModifiedCount, nil
+}
+
+func (r *MongodbLocationRepository) GetDeletedByDevice(ctx context.Context, deviceID string) ([]model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	return r.find(
+		ctx,
+		bson.M{"deviceId": objectID, "deletedAt": bson.M{"$ne": nil}},
+		options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}),
+	)
+}
+
+func (r *MongodbLocationRepository) Restore(ctx context.Context, deviceID string, id string) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	result, err := r.collection.UpdateOne(
+		ctx,
+		bson.M{
+			"_id":       objectID,
+			"deviceId":  deviceOID,
+			"deletedAt": bson.M{"$ne": nil},
+		},
+		bson.M{"$unset": bson.M{"deletedAt": ""}},
+	)
+
+	if err != nil {
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return result.ModifiedCount > 0, nil
+}
+
+func (r *MongodbLocationRepository) RestoreAllByDevice(ctx context.Context, deviceID string, deletedAt *time.Time) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	filter := bson.M{"deviceId": objectID, "deletedAt": bson.M{"$ne": nil}}
+	if deletedAt != nil {
+		filter["deletedAt"] = *deletedAt
+	}
+
+	result, err := r.collection.UpdateMany(
+		ctx,
+		filter,
+		bson.M{"$unset": bson.M{"deletedAt": ""}},
+	)
+
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return result.ModifiedCount, nil
+}
+
+func (r *MongodbLocationRepository) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	result, err := r.collection.DeleteMany(
+		ctx,
+		bson.M{"deletedAt": bson.M{"$lt": before}},
+	)
+
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return result.DeletedCount, nil
+}
+
+func (r *MongodbLocationRepository) Delete(ctx context.Context, deviceID string, id string) (bool, error) {
 	objectID, err := bson.ObjectIDFromHex(id)
 	if err != nil {
 		return false, utils.AsError(
@@ -167,7 +486,7 @@ func (r *MongodbLocationRepository) Delete(deviceID string, id string) (bool, er
 	}
 
 	result, err := r.collection.DeleteOne(
-		r.context,
+		ctx,
 		bson.M{
 			"_id":      objectID,
 			"deviceId": deviceOID,
@@ -181,28 +500,28 @@ func (r *MongodbLocationRepository) Delete(deviceID string, id string) (bool, er
 	return result.DeletedCount > 0, nil
 }
 
-func (r *MongodbLocationRepository) DeleteAllByDevice(deviceID string) (bool, error) {
+func (r *MongodbLocationRepository) DeleteAllByDevice(ctx context.Context, deviceID string) (int64, error) {
 	objectID, err := bson.ObjectIDFromHex(deviceID)
 	if err != nil {
-		return false, utils.AsError(
+		return 0, utils.AsError(
 			model.ErrInvalidArgs,
 			fmt.Sprintf("invalid id: %s", deviceID),
 		)
 	}
 
 	result, err := r.collection.DeleteMany(
-		r.context,
+		ctx,
 		bson.M{"deviceId": objectID},
 	)
 
 	if err != nil {
-		return false, utils.AsError(model.ErrDatabase, err.Error())
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
 	}
 
-	return result.DeletedCount > 0, nil
+	return result.DeletedCount, nil
 }
 
-func (r *MongodbLocationRepository) DeleteOldByDevice(deviceID string, skip int) (int64, error) {
+func (r *MongodbLocationRepository) DeleteOldByDevice(ctx context.Context, deviceID string, skip int) (int64, error) {
 	objectID, err := bson.ObjectIDFromHex(deviceID)
 	if err != nil {
 		return 0, utils.AsError(
@@ -211,19 +530,20 @@ func (r *MongodbLocationRepository) DeleteOldByDevice(deviceID string, skip int)
 		)
 	}
 
-	// gets all locations ids sort by creation - newer first
-	// skips the first ones to keep (by number of skip / limit)
-	// then, delete all these locations picked.
-	cursor, err := r.collection.Find(
-		r.context,
+	// the newest location to delete, the ones recorded before it follow
+	var threshold model.Location
+
+	err = r.collection.FindOne(
+		ctx,
 		bson.M{"deviceId": objectID},
-		options.Find().
-			SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+		options.FindOne().
+			SetSort(mongodb_newest_first).
 			SetSkip(int64(skip)).
-			SetProjection(bson.M{"_id": 1}),
-	)
+			SetProjection(bson.M{"recordedAt": 1}),
+	).Decode(&threshold)
+
 	if err != nil {
-		// there are no more than the limit which is fine
+		// no more locations than to keep
 		if err == mongo.ErrNoDocuments {
 			return 0, nil
 		}
@@ -231,32 +551,190 @@ func (r *MongodbLocationRepository) DeleteOldByDevice(deviceID string, skip int)
 		return 0, utils.AsError(model.ErrDatabase, err.Error())
 	}
 
-	defer cursor.Close(r.context)
+	// newer locations only push the threshold forward, so a stale read deletes less and never more
+	filter := bson.M{
+		"deviceId": objectID,
+		"$or": bson.A{
+			bson.M{"recordedAt": bson.M{"$lt": threshold.RecordedAt}},
+			bson.M{"recordedAt": threshold.RecordedAt, "_id": bson.M{"$lte": threshold.ID}},
+		},
+	}
+
+	// the latest location is kept, none when all of them were rejected
+	latest, err := r.GetLatestByDevice(ctx, deviceID, model.LocationFilter{})
+	if err != nil && !errors.Is(err, model.ErrItemNotFound) {
+		return 0, err
+	}
 
-	var oldLocations []struct {
-		ID bson.ObjectID `bson:"_id"`
+	if latest != nil {
+		filter["_id"] = bson.M{"$ne": latest.ID}
 	}
 
-	if err := cursor.All(r.context, &oldLocations); err != nil {
+	result, err := r.collection.DeleteMany(ctx, filter)
+	if err != nil {
 		return 0, utils.AsError(model.ErrDatabase, err.Error())
 	}
 
-	if len(oldLocations) == 0 {
-		return 0, nil
+	return result.DeletedCount, nil
+}
+
+func (r *MongodbLocationRepository) DeleteExpiredByDevice(ctx context.Context, deviceID string, before time.Time) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
 	}
 
-	oldIDs := []bson.ObjectID{}
-	for _, loc := range oldLocations {
-		oldIDs = append(oldIDs, loc.ID)
+	filter := bson.M{
+		"deviceId":   objectID,
+		"recordedAt": bson.M{"$lt": before},
 	}
 
-	result, err := r.collection.DeleteMany(
-		r.context,
-		bson.M{"_id": bson.M{"$in": oldIDs}},
-	)
+	// the latest location is kept, none when all of them were rejected
+	latest, err := r.GetLatestByDevice(ctx, deviceID, model.LocationFilter{})
+	if err != nil && !errors.Is(err, model.ErrItemNotFound) {
+		return 0, err
+	}
+
+	if latest != nil {
+		filter["_id"] = bson.M{"$ne": latest.ID}
+	}
+
+	result, err := r.collection.DeleteMany(ctx, filter)
 	if err != nil {
 		return 0, utils.AsError(model.ErrDatabase, err.Error())
 	}
 
 	return result.DeletedCount, nil
 }
+
+func (r *MongodbLocationRepository) GetDeviceIDs(ctx context.Context) ([]string, error) {
+	var objectIDs []bson.ObjectID
+
+	if err := r.collection.Distinct(
+		ctx,
+		"deviceId",
+		bson.M{},
+	).Decode(&objectIDs); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	deviceIDs := []string{}
+	for _, objectID := range objectIDs {
+		deviceIDs = append(deviceIDs, objectID.Hex())
+	}
+
+	return deviceIDs, nil
+}
+
+func (r *MongodbLocationRepository) Import(ctx context.Context, location model.Location) (*model.Location, error) {
+	imported, err := r.ImportMany(ctx, []model.Location{location})
+	if err != nil {
+		return nil, err
+	}
+
+	return &imported[0], nil
+}
+
+// ImportMany replaces the location documents by their ids, inserting the missing ones
+func (r *MongodbLocationRepository) ImportMany(ctx context.Context, locations []model.Location) ([]model.Location, error) {
+	if len(locations) == 0 {
+		return []model.Location{}, nil
+	}
+
+	imported := make([]model.Location, 0, len(locations))
+	models := make([]mongo.WriteModel, 0, len(locations))
+
+	for _, location := range locations {
+		location.SeenCount = max(location.SeenCount, 1)
+		location.Point = model.NewGeoPoint(location.Latitude, location.Longitude)
+
+		stored, err := r.cipher.seal(location)
+		if err != nil {
+			return nil, err
+		}
+
+		imported = append(imported, location)
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.M{"_id": location.ID}).
+			SetReplacement(stored).
+			SetUpsert(true))
+	}
+
+	if _, err := r.collection.BulkWrite(ctx, models); err != nil {
+		return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	return imported, nil
+}
+
+func (r *MongodbLocationRepository) GetNear(ctx context.Context, center model.Coordinates, maxDistance float64) ([]model.Location, error) {
+	if err := r.cipher.refuseSpatial(); err != nil {
+		return nil, err
+	}
+
+	// $nearSphere sorts by distance
+	return r.find(ctx, bson.M{
+		"point": bson.M{
+			"$nearSphere": bson.M{
+				"$geometry":    model.NewGeoPoint(center.Latitude, center.Longitude),
+				"$maxDistance": maxDistance,
+			},
+		},
+		"deletedAt": nil,
+	})
+}
+
+func (r *MongodbLocationRepository) GetWithinPolygon(ctx context.Context, polygon model.Polygon) ([]model.Location, error) {
+	if err := r.cipher.refuseSpatial(); err != nil {
+		return nil, err
+	}
+
+	return r.find(ctx, bson.M{
+		"point": bson.M{
+			"$geoWithin": bson.M{
+				"$geometry": bson.M{
+					"type":        "Polygon",
+					"coordinates": bson.A{polygon.Ring()},
+				},
+			},
+		},
+		"deletedAt": nil,
+	})
+}
+
+// mongodbLocationFilter narrows the query by the location filter, fixes without an accuracy are kept
+func mongodbLocationFilter(query bson.M, filter model.LocationFilter) bson.M {
+	if filter.MaxAccuracy != nil {
+		query["$or"] = bson.A{
+			bson.M{"accuracy": nil},
+			bson.M{"accuracy": bson.M{"$lte": *filter.MaxAccuracy}},
+		}
+	}
+
+	return query
+}
+
+func (r *MongodbLocationRepository) find(
+	ctx context.Context,
+	filter bson.M,
+	opts ...options.Lister[options.FindOptions],
+) ([]model.Location, error) {
+	cursor, err := r.collection.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	locations := []model.Location{}
+	if err := cursor.All(ctx, &locations); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if err := r.cipher.openAll(locations); err != nil {
+		return nil, err
+	}
+
+	return locations, nil
+}
@@ -0,0 +1,334 @@
+package repositories
+
+import (
+	"bytes"
+	"context"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type MemoryDeviceRepository struct {
+	store *MemoryStore
+}
+
+func NewMemoryDeviceRepository(store *MemoryStore) DeviceRepository {
+	return &MemoryDeviceRepository{
+		store: store,
+	}
+}
+
+func (r *MemoryDeviceRepository) GetAll(ctx context.Context) ([]model.Device, error) {
+	defer r.store.rlock(ctx)()
+
+	devices := []model.Device{}
+	for _, device := range r.store.devices {
+		if device.DeletedAt == nil {
+			devices = append(devices, device)
+		}
+	}
+
+	// keeps insertion order, same as mongodb natural order
+	slices.SortFunc(devices, func(a, b model.Device) int {
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+
+	return devices, nil
+}
+
+func (r *MemoryDeviceRepository) Get(ctx context.Context, id string) (*model.Device, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	defer r.store.rlock(ctx)()
+
+	device, ok := r.store.devices[objectID]
+	if !ok || device.DeletedAt != nil {
+		return nil, utils.AsError(model.ErrItemNotFound, "device not found")
+	}
+
+	return &device, nil
+}
+
+func (r *MemoryDeviceRepository) GetBySerial(ctx context.Context, serial string) (*model.Device, error) {
+	defer r.store.rlock(ctx)()
+
+	id, ok := r.store.serials[serial]
+	if !ok || r.store.devices[id].DeletedAt != nil {
+		return nil, utils.AsError(model.ErrItemNotFound, "device not found")
+	}
+
+	device := r.store.devices[id]
+
+	return &device, nil
+}
+
+func (r *MemoryDeviceRepository) Exists(ctx context.Context, id string) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	defer r.store.rlock(ctx)()
+
+	if device, ok := r.store.devices[objectID]; !ok || device.DeletedAt != nil {
+		return false, utils.AsError(model.ErrItemNotFound, "device not found")
+	}
+
+	return true, nil
+}
+
+func (r *MemoryDeviceRepository) Create(ctx context.Context, serial string, name string, version int64) (*model.Device, bool, error) {
+	if len(serial) == 0 && len(name) == 0 {
+		return nil, false, utils.AsError(model.ErrInvalidArgs, "Fields are empty")
+	}
+
+	defer r.store.lock(ctx)()
+
+	// mongodb stores dates in milliseconds precision
+	updatedAt := time.Now().UTC().Truncate(time.Millisecond)
+
+	// upserts by serial, same as the mongodb implementation
+	device := model.Device{
+		ID:        bson.NewObjectID(),
+		CreatedAt: updatedAt,
+	}
+
+	id, ok := r.store.serials[serial]
+	if ok {
+		device = r.store.devices[id]
+	}
+
+	if version != 0 && (!ok || device.Version != version) {
+		return nil, false, utils.AsError(model.ErrPreconditionFailed, "device version mismatch")
+	}
+
+	if !ok || device.Name != name || device.DeletedAt != nil {
+		device.Version++
+	}
+
+	if device.DeletedAt != nil {
+		device.DeletedAt = nil
+		device.LastLocation = nil
+	}
+
+	device.Serial = serial
+	device.Name = name
+	device.UpdatedAt = updatedAt
+
+	memorySet(r.store, r.store.devices, device.ID, device)
+	memorySet(r.store, r.store.serials, serial, device.ID)
+
+	return &device, !ok, nil
+}
+
+func (r *MemoryDeviceRepository) SetRetentionPeriod(ctx context.Context, id string, retentionPeriod int64, version int64) (*model.Device, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	device, ok := r.store.devices[objectID]
+	if !ok || device.DeletedAt != nil {
+		return nil, utils.AsError(model.ErrItemNotFound, "device not found")
+	}
+
+	if version != 0 && device.Version != version {
+		return nil, utils.AsError(model.ErrPreconditionFailed, "device version mismatch")
+	}
+
+	device.RetentionPeriod = retentionPeriod
+	device.UpdatedAt = time.Now().UTC().Truncate(time.Millisecond)
+	device.Version++
+
+	memorySet(r.store, r.store.devices, objectID, device)
+
+	return &device, nil
+}
+
+func (r *MemoryDeviceRepository) SetLastLocation(ctx context.Context, id string, location *model.Location) error {
+	return r.updateLastLocation(ctx, id, location, false)
+}
+
+func (r *MemoryDeviceRepository) ReplaceLastLocation(ctx context.Context, id string, location *model.Location) error {
+	return r.updateLastLocation(ctx, id, location, true)
+}
+
+func (r *MemoryDeviceRepository) updateLastLocation(ctx context.Context, id string, location *model.Location, force bool) error {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	device, ok := r.store.devices[objectID]
+	if !ok {
+		return utils.AsError(model.ErrItemNotFound, "device not found")
+	}
+
+	if location == nil {
+		device.LastLocation = nil
+	} else if force ||
+		device.LastLocation == nil ||
+		newerFirst(location.RecordedAt, device.LastLocation.RecordedAt, location.ID, device.LastLocation.ID) <= 0 {
+		// stored as a copy, callers may keep changing their location
+		lastLocation := *location
+		device.LastLocation = &lastLocation
+	}
+
+	memorySet(r.store, r.store.devices, objectID, device)
+
+	return nil
+}
+
+func (r *MemoryDeviceRepository) SoftDelete(ctx context.Context, id string, version int64, deletedAt time.Time) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	device, ok := r.store.devices[objectID]
+	if !ok || device.DeletedAt != nil {
+		return false, nil
+	}
+
+	if version != 0 && device.Version != version {
+		return false, utils.AsError(model.ErrPreconditionFailed, "device version mismatch")
+	}
+
+	device.DeletedAt = &deletedAt
+	device.Version++
+	memorySet(r.store, r.store.devices, objectID, device)
+
+	return true, nil
+}
+
+func (r *MemoryDeviceRepository) GetAllDeleted(ctx context.Context) ([]model.Device, error) {
+	defer r.store.rlock(ctx)()
+
+	devices := []model.Device{}
+	for _, device := range r.store.devices {
+		if device.DeletedAt != nil {
+			devices = append(devices, device)
+		}
+	}
+
+	// recently deleted first, same as the other implementations
+	slices.SortFunc(devices, func(a, b model.Device) int {
+		return newerFirst(*a.DeletedAt, *b.DeletedAt, b.ID, a.ID)
+	})
+
+	return devices, nil
+}
+
+func (r *MemoryDeviceRepository) GetDeleted(ctx context.Context, id string) (*model.Device, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	defer r.store.rlock(ctx)()
+
+	device, ok := r.store.devices[objectID]
+	if !ok || device.DeletedAt == nil {
+		return nil, utils.AsError(model.ErrItemNotFound, "device not found in trash")
+	}
+
+	return &device, nil
+}
+
+func (r *MemoryDeviceRepository) Restore(ctx context.Context, id string) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	device, ok := r.store.devices[objectID]
+	if !ok || device.DeletedAt == nil {
+		return false, nil
+	}
+
+	device.DeletedAt = nil
+	device.Version++
+	memorySet(r.store, r.store.devices, objectID, device)
+
+	return true, nil
+}
+
+func (r *MemoryDeviceRepository) Import(ctx context.Context, device model.Device) error {
+	defer r.store.lock(ctx)()
+
+	if id, ok := r.store.serials[device.Serial]; ok && id != device.ID {
+		return utils.AsError(
+			model.ErrItemConflict,
+			fmt.Sprintf("serial belongs to another device: %s", device.Serial),
+		)
+	}
+
+	if existing, ok := r.store.devices[device.ID]; ok {
+		memoryDelete(r.store, r.store.serials, existing.Serial)
+	}
+
+	device.LastLocation = nil
+
+	memorySet(r.store, r.store.devices, device.ID, device)
+	memorySet(r.store, r.store.serials, device.Serial, device.ID)
+
+	return nil
+}
+
+func (r *MemoryDeviceRepository) Delete(ctx context.Context, id string) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	device, ok := r.store.devices[objectID]
+	if !ok {
+		return false, nil
+	}
+
+	memoryDelete(r.store, r.store.devices, objectID)
+	memoryDelete(r.store, r.store.serials, device.Serial)
+
+	return true, nil
+}
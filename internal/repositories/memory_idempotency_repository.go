@@ -0,0 +1,65 @@
+package repositories
+
+import (
+	"context"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"time"
+)
+
+type MemoryIdempotencyRepository struct {
+	store *MemoryStore
+}
+
+func NewMemoryIdempotencyRepository(store *MemoryStore) IdempotencyRepository {
+	return &MemoryIdempotencyRepository{
+		store: store,
+	}
+}
+
+func (r *MemoryIdempotencyRepository) Reserve(ctx context.Context, key model.IdempotencyKey) (*model.IdempotencyKey, error) {
+	defer r.store.lock(ctx)()
+
+	if existing, ok := r.store.idempotencyKeys[key.Key]; ok && existing.ExpiresAt.After(key.CreatedAt) {
+		return &existing, nil
+	}
+
+	memorySet(r.store, r.store.idempotencyKeys, key.Key, key)
+
+	return nil, nil
+}
+
+func (r *MemoryIdempotencyRepository) Complete(ctx context.Context, key model.IdempotencyKey) error {
+	defer r.store.lock(ctx)()
+
+	if _, ok := r.store.idempotencyKeys[key.Key]; !ok {
+		return utils.AsError(model.ErrItemNotFound, "idempotency key not found")
+	}
+
+	memorySet(r.store, r.store.idempotencyKeys, key.Key, key)
+
+	return nil
+}
+
+func (r *MemoryIdempotencyRepository) Release(ctx context.Context, key string) error {
+	defer r.store.lock(ctx)()
+
+	memoryDelete(r.store, r.store.idempotencyKeys, key)
+
+	return nil
+}
+
+func (r *MemoryIdempotencyRepository) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	defer r.store.lock(ctx)()
+
+	var deleted int64
+
+	for id, key := range r.store.idempotencyKeys {
+		if !key.ExpiresAt.After(before) {
+			memoryDelete(r.store, r.store.idempotencyKeys, id)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
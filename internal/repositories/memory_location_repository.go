@@ -0,0 +1,570 @@
+package repositories
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type MemoryLocationRepository struct {
+	store *MemoryStore
+}
+
+func NewMemoryLocationRepository(store *MemoryStore) LocationRepository {
+	return &MemoryLocationRepository{
+		store: store,
+	}
+}
+
+func (r *MemoryLocationRepository) GetAllByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) ([]model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	defer r.store.rlock(ctx)()
+
+	locations := r.sortedByDevice(objectID, false, func(a, b model.Location) int {
+		return newerFirst(b.RecordedAt, a.RecordedAt, b.ID, a.ID)
+	})
+
+	return slices.DeleteFunc(locations, func(location model.Location) bool {
+		return !filter.Matches(location)
+	}), nil
+}
+
+func (r *MemoryLocationRepository) GetLatestByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) (*model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	defer r.store.rlock(ctx)()
+
+	locations := r.sortedByDevice(objectID, false, func(a, b model.Location) int {
+		return newerFirst(a.RecordedAt, b.RecordedAt, a.ID, b.ID)
+	})
+
+	for _, location := range locations {
+		if !location.Rejected && filter.Matches(location) {
+			return &location, nil
+		}
+	}
+
+	return nil, utils.AsError(model.ErrItemNotFound, "device not found")
+}
+
+func (r *MemoryLocationRepository) Create(
+	ctx context.Context,
+	deviceID string,
+	latitude float64,
+	longitude float64,
+	recordedAt time.Time,
+	telemetry model.Telemetry,
+	screening model.Screening,
+) (*model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	// mongodb stores dates in milliseconds precision
+	created := time.Now().UTC().Truncate(time.Millisecond)
+	location := model.Location{
+		ID:         bson.NewObjectID(),
+		CreatedAt:  created,
+		UpdatedAt:  created,
+		RecordedAt: cmp.Or(recordedAt, created),
+		DeviceID:   objectID,
+		Latitude:   latitude,
+		Longitude:  longitude,
+		SeenCount:  1,
+		Telemetry:  telemetry,
+		Screening:  screening,
+	}
+
+	defer r.store.lock(ctx)()
+
+	if _, ok := r.store.locations[objectID]; !ok {
+		memorySet(r.store, r.store.locations, objectID, map[bson.ObjectID]model.Location{})
+	}
+
+	memorySet(r.store, r.store.locations[objectID], location.ID, location)
+
+	return &location, nil
+}
+
+func (r *MemoryLocationRepository) CreateMany(
+	ctx context.Context,
+	deviceID string,
+	locations []model.Location,
+) ([]model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	if _, ok := r.store.locations[objectID]; !ok {
+		memorySet(r.store, r.store.locations, objectID, map[bson.ObjectID]model.Location{})
+	}
+
+	// mongodb stores dates in milliseconds precision
+	created := time.Now().UTC().Truncate(time.Millisecond)
+	createdLocations := make([]model.Location, 0, len(locations))
+
+	for _, params := range locations {
+		location := model.Location{
+			ID:         bson.NewObjectID(),
+			CreatedAt:  created,
+			UpdatedAt:  created,
+			RecordedAt: cmp.Or(params.RecordedAt, created),
+			DeviceID:   objectID,
+			Latitude:   params.Latitude,
+			Longitude:  params.Longitude,
+			SeenCount:  max(params.SeenCount, 1),
+			Telemetry:  params.Telemetry,
+			Screening:  params.Screening,
+		}
+
+		memorySet(r.store, r.store.locations[objectID], location.ID, location)
+		createdLocations = append(createdLocations, location)
+	}
+
+	return createdLocations, nil
+}
+
+func (r *MemoryLocationRepository) Refresh(
+	ctx context.Context,
+	deviceID string,
+	id string,
+	updatedAt time.Time,
+	count int64,
+) (*model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	location, ok := r.store.locations[deviceOID][objectID]
+	if !ok || location.DeletedAt != nil {
+		return nil, utils.AsError(model.ErrItemNotFound, "location not found")
+	}
+
+	// mongodb stores dates in milliseconds precision
+	location.UpdatedAt = updatedAt.UTC().Truncate(time.Millisecond)
+	location.SeenCount += count
+	memorySet(r.store, r.store.locations[deviceOID], objectID, location)
+
+	return &location, nil
+}
+
+func (r *MemoryLocationRepository) SoftDelete(ctx context.Context, deviceID string, id string, deletedAt time.Time) (bool, error) {
+	return r.setDeletedAt(ctx, deviceID, id, &deletedAt)
+}
+
+func (r *MemoryLocationRepository) SoftDeleteAllByDevice(ctx context.Context, deviceID string, deletedAt time.Time) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	var deleted int64
+
+	for id, location := range r.store.locations[objectID] {
+		if location.DeletedAt == nil {
+			location.DeletedAt = &deletedAt
+			memorySet(r.store, r.store.locations[objectID], id, location)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (r *MemoryLocationRepository) GetDeletedByDevice(ctx context.Context, deviceID string) ([]model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	defer r.store.rlock(ctx)()
+
+	locations := r.sortedByDevice(objectID, true, func(a, b model.Location) int {
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+
+	return locations, nil
+}
+
+func (r *MemoryLocationRepository) Restore(ctx context.Context, deviceID string, id string) (bool, error) {
+	return r.setDeletedAt(ctx, deviceID, id, nil)
+}
+
+func (r *MemoryLocationRepository) RestoreAllByDevice(ctx context.Context, deviceID string, deletedAt *time.Time) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	var restored int64
+
+	for id, location := range r.store.locations[objectID] {
+		if location.DeletedAt == nil || (deletedAt != nil && !location.DeletedAt.Equal(*deletedAt)) {
+			continue
+		}
+
+		location.DeletedAt = nil
+		memorySet(r.store, r.store.locations[objectID], id, location)
+		restored++
+	}
+
+	return restored, nil
+}
+
+func (r *MemoryLocationRepository) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	defer r.store.lock(ctx)()
+
+	var deleted int64
+
+	for deviceID, locations := range r.store.locations {
+		for id, location := range locations {
+			if location.DeletedAt != nil && location.DeletedAt.Before(before) {
+				memoryDelete(r.store, r.store.locations[deviceID], id)
+				deleted++
+			}
+		}
+	}
+
+	return deleted, nil
+}
+
+// setDeletedAt moves the location in or out of the trash, nil restores it.
+func (r *MemoryLocationRepository) setDeletedAt(ctx context.Context, deviceID string, id string, deletedAt *time.Time) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	location, ok := r.store.locations[deviceOID][objectID]
+	if !ok || (location.DeletedAt == nil) == (deletedAt == nil) {
+		return false, nil
+	}
+
+	location.DeletedAt = deletedAt
+	memorySet(r.store, r.store.locations[deviceOID], objectID, location)
+
+	return true, nil
+}
+
+func (r *MemoryLocationRepository) Delete(ctx context.Context, deviceID string, id string) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	if _, ok := r.store.locations[deviceOID][objectID]; !ok {
+		return false, nil
+	}
+
+	memoryDelete(r.store, r.store.locations[deviceOID], objectID)
+
+	return true, nil
+}
+
+func (r *MemoryLocationRepository) DeleteAllByDevice(ctx context.Context, deviceID string) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	deleted := len(r.store.locations[objectID])
+	memoryDelete(r.store, r.store.locations, objectID)
+
+	return int64(deleted), nil
+}
+
+func (r *MemoryLocationRepository) DeleteOldByDevice(ctx context.Context, deviceID string, skip int) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	// keeps the newest by recorded time, trashed or not
+	locations := make([]model.Location, 0, len(r.store.locations[objectID]))
+	for _, location := range r.store.locations[objectID] {
+		locations = append(locations, location)
+	}
+
+	if len(locations) <= skip {
+		return 0, nil
+	}
+
+	slices.SortFunc(locations, func(a, b model.Location) int {
+		return newerFirst(a.RecordedAt, b.RecordedAt, a.ID, b.ID)
+	})
+
+	// the latest location is kept, even when newer rejected ones outnumber the limit
+	latest := slices.IndexFunc(locations, func(location model.Location) bool {
+		return location.DeletedAt == nil && !location.Rejected
+	})
+
+	var deleted int64
+
+	for i, location := range locations[skip:] {
+		if i+skip == latest {
+			continue
+		}
+
+		memoryDelete(r.store, r.store.locations[objectID], location.ID)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+func (r *MemoryLocationRepository) DeleteExpiredByDevice(ctx context.Context, deviceID string, before time.Time) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	defer r.store.lock(ctx)()
+
+	latest := r.sortedByDevice(objectID, false, func(a, b model.Location) int {
+		return newerFirst(a.RecordedAt, b.RecordedAt, a.ID, b.ID)
+	})
+	latest = slices.DeleteFunc(latest, func(location model.Location) bool {
+		return location.Rejected
+	})
+
+	var deleted int64
+
+	// the latest location is kept
+	for id, location := range r.store.locations[objectID] {
+		if len(latest) > 0 && id == latest[0].ID {
+			continue
+		}
+
+		if location.RecordedAt.Before(before) {
+			memoryDelete(r.store, r.store.locations[objectID], id)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+func (r *MemoryLocationRepository) GetDeviceIDs(ctx context.Context) ([]string, error) {
+	defer r.store.rlock(ctx)()
+
+	deviceIDs := []string{}
+	for deviceID, locations := range r.store.locations {
+		if len(locations) > 0 {
+			deviceIDs = append(deviceIDs, deviceID.Hex())
+		}
+	}
+
+	return deviceIDs, nil
+}
+
+func (r *MemoryLocationRepository) GetNear(ctx context.Context, center model.Coordinates, maxDistance float64) ([]model.Location, error) {
+	defer r.store.rlock(ctx)()
+
+	locations := r.filter(func(location model.Location) bool {
+		return location.DeletedAt == nil && center.DistanceTo(location.Coordinates()) <= maxDistance
+	})
+
+	sortByDistance(center, locations)
+
+	return locations, nil
+}
+
+func (r *MemoryLocationRepository) GetWithinPolygon(ctx context.Context, polygon model.Polygon) ([]model.Location, error) {
+	defer r.store.rlock(ctx)()
+
+	locations := r.filter(func(location model.Location) bool {
+		return location.DeletedAt == nil && polygon.Contains(location.Coordinates())
+	})
+
+	slices.SortFunc(locations, func(a, b model.Location) int {
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+
+	return locations, nil
+}
+
+func (r *MemoryLocationRepository) Import(ctx context.Context, location model.Location) (*model.Location, error) {
+	imported, err := r.ImportMany(ctx, []model.Location{location})
+	if err != nil {
+		return nil, err
+	}
+
+	return &imported[0], nil
+}
+
+// ImportMany stores the locations under their devices, removing any copy of them held by another device
+func (r *MemoryLocationRepository) ImportMany(ctx context.Context, locations []model.Location) ([]model.Location, error) {
+	defer r.store.lock(ctx)()
+
+	imported := make([]model.Location, 0, len(locations))
+
+	for _, location := range locations {
+		// the location may have moved to another device
+		for _, deviceLocations := range r.store.locations {
+			memoryDelete(r.store, deviceLocations, location.ID)
+		}
+
+		location.SeenCount = max(location.SeenCount, 1)
+
+		if _, ok := r.store.locations[location.DeviceID]; !ok {
+			memorySet(r.store, r.store.locations, location.DeviceID, map[bson.ObjectID]model.Location{})
+		}
+
+		memorySet(r.store, r.store.locations[location.DeviceID], location.ID, location)
+		imported = append(imported, location)
+	}
+
+	return imported, nil
+}
+
+// filter returns a copy of all devices locations matching, the caller must hold the lock.
+func (r *MemoryLocationRepository) filter(match func(location model.Location) bool) []model.Location {
+	locations := []model.Location{}
+	for _, deviceLocations := range r.store.locations {
+		for _, location := range deviceLocations {
+			if match(location) {
+				locations = append(locations, location)
+			}
+		}
+	}
+
+	return locations
+}
+
+// sortedByDevice returns a copy of the device's locations, either the deleted or the other ones,
+// the caller must hold the lock.
+func (r *MemoryLocationRepository) sortedByDevice(
+	deviceID bson.ObjectID,
+	deleted bool,
+	compare func(a, b model.Location) int,
+) []model.Location {
+	locations := []model.Location{}
+	for _, location := range r.store.locations[deviceID] {
+		if (location.DeletedAt != nil) == deleted {
+			locations = append(locations, location)
+		}
+	}
+
+	slices.SortFunc(locations, compare)
+
+	return locations
+}
+
+// newerFirst orders by time descending, ties are broken by the newer object id.
+func newerFirst(a, b time.Time, aID, bID bson.ObjectID) int {
+	if c := b.Compare(a); c != 0 {
+		return c
+	}
+
+	return bytes.Compare(bID[:], aID[:])
+}
+
+// sortByDistance orders the locations nearest first, ties are broken by id.
+func sortByDistance(center model.Coordinates, locations []model.Location) {
+	slices.SortStableFunc(locations, func(a, b model.Location) int {
+		if c := cmp.Compare(
+			center.DistanceTo(a.Coordinates()),
+			center.DistanceTo(b.Coordinates()),
+		); c != 0 {
+			return c
+		}
+
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+}
@@ -0,0 +1,108 @@
+package repositories
+
+import (
+	"context"
+	"dwimc/internal/model"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type memoryTransactionKey struct{}
+
+// MemoryStore holds the data of all memory repositories,
+// sharing a single lock allows transactions across them.
+type MemoryStore struct {
+	mutex     sync.RWMutex
+	devices   map[bson.ObjectID]model.Device
+	serials   map[string]bson.ObjectID
+	locations map[bson.ObjectID]map[bson.ObjectID]model.Location
+	// idempotencyKeys are looked up by their key
+	idempotencyKeys map[string]model.IdempotencyKey
+	// undo reverts the writes of the running transaction, newest last, nil outside of one
+	undo []func()
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		devices:         map[bson.ObjectID]model.Device{},
+		serials:         map[string]bson.ObjectID{},
+		locations:       map[bson.ObjectID]map[bson.ObjectID]model.Location{},
+		idempotencyKeys: map[string]model.IdempotencyKey{},
+	}
+}
+
+func (s *MemoryStore) inTransaction(ctx context.Context) bool {
+	return ctx.Value(memoryTransactionKey{}) == s
+}
+
+// lock acquires the write lock unless the transaction already holds it,
+// returning the matching unlock.
+func (s *MemoryStore) lock(ctx context.Context) func() {
+	if s.inTransaction(ctx) {
+		return func() {}
+	}
+
+	s.mutex.Lock()
+	return s.mutex.Unlock
+}
+
+func (s *MemoryStore) rlock(ctx context.Context) func() {
+	if s.inTransaction(ctx) {
+		return func() {}
+	}
+
+	s.mutex.RLock()
+	return s.mutex.RUnlock
+}
+
+// memorySet writes the map entry, the caller must hold the lock.
+// Within a transaction the previous entry is logged, see MemoryStore.rollback.
+func memorySet[K comparable, V any](s *MemoryStore, m map[K]V, key K, value V) {
+	logUndo(s, m, key)
+	m[key] = value
+}
+
+// memoryDelete deletes the map entry, same as memorySet
+func memoryDelete[K comparable, V any](s *MemoryStore, m map[K]V, key K) {
+	if _, ok := m[key]; !ok {
+		return
+	}
+
+	logUndo(s, m, key)
+	delete(m, key)
+}
+
+func logUndo[K comparable, V any](s *MemoryStore, m map[K]V, key K) {
+	if s.undo == nil {
+		return
+	}
+
+	previous, ok := m[key]
+	s.undo = append(s.undo, func() {
+		if ok {
+			m[key] = previous
+		} else {
+			delete(m, key)
+		}
+	})
+}
+
+// begin starts logging the writes, the caller must hold the lock for the whole transaction.
+func (s *MemoryStore) begin() {
+	s.undo = []func(){}
+}
+
+// commit stops logging the writes, keeping them.
+func (s *MemoryStore) commit() {
+	s.undo = nil
+}
+
+// rollback reverts the writes logged since begin, newest first. Nothing is left to revert after commit.
+func (s *MemoryStore) rollback() {
+	for i := len(s.undo) - 1; i >= 0; i-- {
+		s.undo[i]()
+	}
+
+	s.undo = nil
+}
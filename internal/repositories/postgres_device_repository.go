@@ -0,0 +1,586 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// postgres_device_select reads devices along with their last location, see scanPostgresDevice
+const postgres_device_select = `SELECT d.id, d.created_at, d.updated_at, d.serial, d.name, d.version, d.retention_period, d.deleted_at,
+	l.id, l.created_at, l.updated_at, l.recorded_at,
+	ST_Y(l.point::geometry), ST_X(l.point::geometry), l.seen_count,
+	l.accuracy, l.altitude, l.speed, l.bearing, l.battery, l.provider, l.outlier, l.rejected
+	FROM ` + TABLE_NAME_DEVICES + ` d
+	LEFT JOIN ` + TABLE_NAME_LOCATIONS + ` l ON l.id = d.last_location_id`
+
+type PostgresDeviceRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresDeviceRepository(db *sql.DB) DeviceRepository {
+	return &PostgresDeviceRepository{
+		db: db,
+	}
+}
+
+func (r *PostgresDeviceRepository) GetAll(ctx context.Context) ([]model.Device, error) {
+	devices := []model.Device{}
+
+	rows, err := sqlExecutorFrom(ctx, r.db).QueryContext(
+		ctx,
+		postgres_device_select+`
+		WHERE d.deleted_at IS NULL
+		ORDER BY d.id`,
+	)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		device, err := scanPostgresDevice(rows)
+		if err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		devices = append(devices, *device)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return devices, nil
+}
+
+func (r *PostgresDeviceRepository) Get(ctx context.Context, id string) (*model.Device, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	device, err := scanPostgresDevice(sqlExecutorFrom(ctx, r.db).QueryRowContext(
+		ctx,
+		postgres_device_select+`
+		WHERE d.id = $1 AND d.deleted_at IS NULL`,
+		objectID.Hex(),
+	))
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.AsError(model.ErrItemNotFound, "device not found")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return device, nil
+}
+
+func (r *PostgresDeviceRepository) GetBySerial(ctx context.Context, serial string) (*model.Device, error) {
+	device, err := scanPostgresDevice(sqlExecutorFrom(ctx, r.db).QueryRowContext(
+		ctx,
+		postgres_device_select+`
+		WHERE d.serial = $1 AND d.deleted_at IS NULL`,
+		serial,
+	))
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.AsError(model.ErrItemNotFound, "device not found")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return device, nil
+}
+
+func (r *PostgresDeviceRepository) Exists(ctx context.Context, id string) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	var found int
+
+	err = sqlExecutorFrom(ctx, r.db).QueryRowContext(
+		ctx,
+		`SELECT 1 FROM `+TABLE_NAME_DEVICES+` WHERE id = $1 AND deleted_at IS NULL`,
+		objectID.Hex(),
+	).Scan(&found)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, utils.AsError(model.ErrItemNotFound, "device not found")
+		}
+
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return true, nil
+}
+
+func (r *PostgresDeviceRepository) Create(ctx context.Context, serial string, name string, version int64) (*model.Device, bool, error) {
+	if len(serial) == 0 && len(name) == 0 {
+		return nil, false, utils.AsError(model.ErrInvalidArgs, "Fields are empty")
+	}
+
+	updatedAt := time.Now().UTC().Truncate(time.Millisecond)
+
+	var id string
+	var err error
+
+	// a conflict keeps the id of the existing device
+	newID := bson.NewObjectID().Hex()
+
+	if version != 0 {
+		// a conditioned write updates the device at the given version only
+		err = sqlExecutorFrom(ctx, r.db).QueryRowContext(
+			ctx,
+			`UPDATE `+TABLE_NAME_DEVICES+` SET
+				version = CASE
+					WHEN name <> $1 OR deleted_at IS NOT NULL THEN version + 1
+					ELSE version
+				END,
+				name = $1,
+				updated_at = $2,
+				deleted_at = NULL,
+				last_location_id = CASE WHEN deleted_at IS NULL THEN last_location_id END
+			WHERE serial = $3 AND version = $4
+			RETURNING id`,
+			name,
+			updatedAt,
+			serial,
+			version,
+		).Scan(&id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, utils.AsError(model.ErrPreconditionFailed, "device version mismatch")
+		}
+	} else {
+		// upserts by the unique serial, keeping the original id and creation time,
+		// a device in the trash is taken out of it without its last location
+		err = sqlExecutorFrom(ctx, r.db).QueryRowContext(
+			ctx,
+			`INSERT INTO `+TABLE_NAME_DEVICES+` (id, created_at, updated_at, serial, name)
+			VALUES ($1, $2, $2, $3, $4)
+			ON CONFLICT (serial) DO UPDATE SET
+				version = CASE
+					WHEN `+TABLE_NAME_DEVICES+`.name <> EXCLUDED.name
+						OR `+TABLE_NAME_DEVICES+`.deleted_at IS NOT NULL
+					THEN `+TABLE_NAME_DEVICES+`.version + 1
+					ELSE `+TABLE_NAME_DEVICES+`.version
+				END,
+				name = EXCLUDED.name,
+				updated_at = EXCLUDED.updated_at,
+				deleted_at = NULL,
+				last_location_id = CASE
+					WHEN `+TABLE_NAME_DEVICES+`.deleted_at IS NULL THEN `+TABLE_NAME_DEVICES+`.last_location_id
+				END
+			RETURNING id`,
+			newID,
+			updatedAt,
+			serial,
+			name,
+		).Scan(&id)
+	}
+
+	if err != nil {
+		return nil, false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	device, err := r.Get(ctx, id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return device, id == newID, nil
+}
+
+func (r *PostgresDeviceRepository) SetRetentionPeriod(ctx context.Context, id string, retentionPeriod int64, version int64) (*model.Device, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	var updatedID string
+
+	err = sqlExecutorFrom(ctx, r.db).QueryRowContext(
+		ctx,
+		`UPDATE `+TABLE_NAME_DEVICES+`
+		SET retention_period = $1, updated_at = $2, version = version + 1
+		WHERE id = $3 AND deleted_at IS NULL AND ($4::bigint = 0 OR version = $4)
+		RETURNING id`,
+		retentionPeriod,
+		time.Now().UTC(),
+		objectID.Hex(),
+		version,
+	).Scan(&updatedID)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, r.versionMismatchOrNotFound(ctx, id, version)
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return r.Get(ctx, updatedID)
+}
+
+func (r *PostgresDeviceRepository) SetLastLocation(ctx context.Context, id string, location *model.Location) error {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	// a concurrent or earlier reported newer location wins, no match is not an error
+	if _, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`UPDATE `+TABLE_NAME_DEVICES+`
+		SET last_location_id = $1
+		WHERE id = $2 AND NOT EXISTS (
+			SELECT 1 FROM `+TABLE_NAME_LOCATIONS+`
+			WHERE id = `+TABLE_NAME_DEVICES+`.last_location_id
+				AND (recorded_at, id) > ($3::timestamptz, $1)
+		)`,
+		location.ID.Hex(),
+		objectID.Hex(),
+		location.RecordedAt,
+	); err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return nil
+}
+
+func (r *PostgresDeviceRepository) ReplaceLastLocation(ctx context.Context, id string, location *model.Location) error {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	var locationID sql.NullString
+	if location != nil {
+		locationID = sql.NullString{String: location.ID.Hex(), Valid: true}
+	}
+
+	result, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`UPDATE `+TABLE_NAME_DEVICES+` SET last_location_id = $1 WHERE id = $2`,
+		locationID,
+		objectID.Hex(),
+	)
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if updated == 0 {
+		return utils.AsError(model.ErrItemNotFound, "device not found")
+	}
+
+	return nil
+}
+
+func (r *PostgresDeviceRepository) SoftDelete(ctx context.Context, id string, version int64, deletedAt time.Time) (bool, error) {
+	return r.setDeletedAt(ctx, id, version, sql.Null[time.Time]{V: deletedAt, Valid: true})
+}
+
+func (r *PostgresDeviceRepository) GetAllDeleted(ctx context.Context) ([]model.Device, error) {
+	devices := []model.Device{}
+
+	rows, err := sqlExecutorFrom(ctx, r.db).QueryContext(
+		ctx,
+		postgres_device_select+`
+		WHERE d.deleted_at IS NOT NULL
+		ORDER BY d.deleted_at DESC, d.id`,
+	)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		device, err := scanPostgresDevice(rows)
+		if err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		devices = append(devices, *device)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return devices, nil
+}
+
+func (r *PostgresDeviceRepository) GetDeleted(ctx context.Context, id string) (*model.Device, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	device, err := scanPostgresDevice(sqlExecutorFrom(ctx, r.db).QueryRowContext(
+		ctx,
+		postgres_device_select+`
+		WHERE d.id = $1 AND d.deleted_at IS NOT NULL`,
+		objectID.Hex(),
+	))
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.AsError(model.ErrItemNotFound, "device not found in trash")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return device, nil
+}
+
+func (r *PostgresDeviceRepository) Restore(ctx context.Context, id string) (bool, error) {
+	return r.setDeletedAt(ctx, id, 0, sql.Null[time.Time]{})
+}
+
+// setDeletedAt moves the device in or out of the trash, null restores it.
+func (r *PostgresDeviceRepository) setDeletedAt(ctx context.Context, id string, version int64, deletedAt sql.Null[time.Time]) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	// only a change of state counts
+	result, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`UPDATE `+TABLE_NAME_DEVICES+`
+		SET deleted_at = $1, version = version + 1
+		WHERE id = $2 AND (deleted_at IS NULL) <> ($1::timestamptz IS NULL) AND ($3::bigint = 0 OR version = $3)`,
+		deletedAt,
+		objectID.Hex(),
+		version,
+	)
+	if err != nil {
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if updated == 0 {
+		// a device not in the expected state is not an error, a mismatching one is
+		if err := r.versionMismatchOrNotFound(ctx, id, version); !errors.Is(err, model.ErrItemNotFound) {
+			return false, err
+		}
+
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// versionMismatchOrNotFound tells why a write conditioned on the version matched no device
+func (r *PostgresDeviceRepository) versionMismatchOrNotFound(ctx context.Context, id string, version int64) error {
+	if version == 0 {
+		return utils.AsError(model.ErrItemNotFound, "device not found")
+	}
+
+	if _, err := r.Exists(ctx, id); err != nil {
+		return err
+	}
+
+	return utils.AsError(model.ErrPreconditionFailed, "device version mismatch")
+}
+
+func (r *PostgresDeviceRepository) Import(ctx context.Context, device model.Device) error {
+	executor := sqlExecutorFrom(ctx, r.db)
+
+	var conflicting int
+
+	err := executor.QueryRowContext(
+		ctx,
+		`SELECT 1 FROM `+TABLE_NAME_DEVICES+` WHERE serial = $1 AND id <> $2`,
+		device.Serial,
+		device.ID.Hex(),
+	).Scan(&conflicting)
+
+	if err == nil {
+		return utils.AsError(
+			model.ErrItemConflict,
+			fmt.Sprintf("serial belongs to another device: %s", device.Serial),
+		)
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	var deletedAt sql.NullTime
+	if device.DeletedAt != nil {
+		deletedAt = sql.NullTime{Time: *device.DeletedAt, Valid: true}
+	}
+
+	if _, err := executor.ExecContext(
+		ctx,
+		`INSERT INTO `+TABLE_NAME_DEVICES+`
+		(id, created_at, updated_at, serial, name, version, retention_period, deleted_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		ON CONFLICT (id) DO UPDATE SET
+			created_at = EXCLUDED.created_at,
+			updated_at = EXCLUDED.updated_at,
+			serial = EXCLUDED.serial,
+			name = EXCLUDED.name,
+			version = EXCLUDED.version,
+			retention_period = EXCLUDED.retention_period,
+			deleted_at = EXCLUDED.deleted_at,
+			last_location_id = NULL`,
+		device.ID.Hex(),
+		device.CreatedAt,
+		device.UpdatedAt,
+		device.Serial,
+		device.Name,
+		device.Version,
+		device.RetentionPeriod,
+		deletedAt,
+	); err != nil {
+		return utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	return nil
+}
+
+func (r *PostgresDeviceRepository) Delete(ctx context.Context, id string) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	result, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_DEVICES+` WHERE id = $1`,
+		objectID.Hex(),
+	)
+	if err != nil {
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return deleted > 0, nil
+}
+
+func scanPostgresDevice(row rowScanner) (*model.Device, error) {
+	var device model.Device
+	var id string
+	var deletedAt sql.NullTime
+
+	// the last location columns are null without one
+	var locationID sql.NullString
+	var locationCreatedAt, locationUpdatedAt, locationRecordedAt sql.NullTime
+	var latitude, longitude sql.NullFloat64
+	var locationSeenCount sql.NullInt64
+	var telemetry sqlTelemetry
+	var screening sqlScreening
+
+	if err := row.Scan(slices.Concat([]any{
+		&id,
+		&device.CreatedAt,
+		&device.UpdatedAt,
+		&device.Serial,
+		&device.Name,
+		&device.Version,
+		&device.RetentionPeriod,
+		&deletedAt,
+		&locationID,
+		&locationCreatedAt,
+		&locationUpdatedAt,
+		&locationRecordedAt,
+		&latitude,
+		&longitude,
+		&locationSeenCount,
+	}, telemetry.dest(), screening.dest())...); err != nil {
+		return nil, err
+	}
+
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	device.ID = objectID
+	device.CreatedAt = device.CreatedAt.UTC()
+	device.UpdatedAt = device.UpdatedAt.UTC()
+
+	if deletedAt.Valid {
+		deletedTime := deletedAt.Time.UTC()
+		device.DeletedAt = &deletedTime
+	}
+
+	if locationID.Valid {
+		locationOID, err := bson.ObjectIDFromHex(locationID.String)
+		if err != nil {
+			return nil, err
+		}
+
+		device.LastLocation = &model.Location{
+			ID:         locationOID,
+			CreatedAt:  locationCreatedAt.Time.UTC(),
+			UpdatedAt:  locationUpdatedAt.Time.UTC(),
+			RecordedAt: locationRecordedAt.Time.UTC(),
+			DeviceID:   objectID,
+			Latitude:   latitude.Float64,
+			Longitude:  longitude.Float64,
+			SeenCount:  locationSeenCount.Int64,
+			Telemetry:  telemetry.telemetry(),
+			Screening:  screening.screening(),
+		}
+	}
+
+	return &device, nil
+}
@@ -0,0 +1,176 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+type PostgresIdempotencyRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresIdempotencyRepository(db *sql.DB) IdempotencyRepository {
+	return &PostgresIdempotencyRepository{
+		db: db,
+	}
+}
+
+func (r *PostgresIdempotencyRepository) Reserve(ctx context.Context, key model.IdempotencyKey) (*model.IdempotencyKey, error) {
+	header, err := json.Marshal(key.Header)
+	if err != nil {
+		return nil, utils.AsError(model.ErrInternal, err.Error())
+	}
+
+	executor := sqlExecutorFrom(ctx, r.db)
+
+	// replaces an expired key only, nothing is written while a live one exists
+	result, err := executor.ExecContext(
+		ctx,
+		`INSERT INTO `+TABLE_NAME_IDEMPOTENCY_KEYS+`
+		(id, request_hash, status_code, header, body, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (id) DO UPDATE SET
+			request_hash = EXCLUDED.request_hash,
+			status_code = EXCLUDED.status_code,
+			header = EXCLUDED.header,
+			body = EXCLUDED.body,
+			created_at = EXCLUDED.created_at,
+			expires_at = EXCLUDED.expires_at
+		WHERE `+TABLE_NAME_IDEMPOTENCY_KEYS+`.expires_at <= EXCLUDED.created_at`,
+		key.Key,
+		key.RequestHash,
+		key.StatusCode,
+		string(header),
+		key.Body,
+		key.CreatedAt,
+		key.ExpiresAt,
+	)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	reserved, err := result.RowsAffected()
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if reserved > 0 {
+		return nil, nil
+	}
+
+	existing, err := scanPostgresIdempotencyKey(executor.QueryRowContext(
+		ctx,
+		`SELECT id, request_hash, status_code, header, body, created_at, expires_at
+		FROM `+TABLE_NAME_IDEMPOTENCY_KEYS+`
+		WHERE id = $1`,
+		key.Key,
+	))
+	if err != nil {
+		// released meanwhile
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.AsError(model.ErrItemConflict, "idempotency key is in use")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return existing, nil
+}
+
+func (r *PostgresIdempotencyRepository) Complete(ctx context.Context, key model.IdempotencyKey) error {
+	header, err := json.Marshal(key.Header)
+	if err != nil {
+		return utils.AsError(model.ErrInternal, err.Error())
+	}
+
+	result, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`UPDATE `+TABLE_NAME_IDEMPOTENCY_KEYS+`
+		SET request_hash = $1, status_code = $2, header = $3, body = $4, created_at = $5, expires_at = $6
+		WHERE id = $7`,
+		key.RequestHash,
+		key.StatusCode,
+		string(header),
+		key.Body,
+		key.CreatedAt,
+		key.ExpiresAt,
+		key.Key,
+	)
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if updated == 0 {
+		return utils.AsError(model.ErrItemNotFound, "idempotency key not found")
+	}
+
+	return nil
+}
+
+func (r *PostgresIdempotencyRepository) Release(ctx context.Context, key string) error {
+	if _, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_IDEMPOTENCY_KEYS+` WHERE id = $1`,
+		key,
+	); err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return nil
+}
+
+func (r *PostgresIdempotencyRepository) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	result, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_IDEMPOTENCY_KEYS+` WHERE expires_at <= $1`,
+		before,
+	)
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return deleted, nil
+}
+
+func scanPostgresIdempotencyKey(row rowScanner) (*model.IdempotencyKey, error) {
+	var key model.IdempotencyKey
+	var header sql.NullString
+
+	if err := row.Scan(
+		&key.Key,
+		&key.RequestHash,
+		&key.StatusCode,
+		&header,
+		&key.Body,
+		&key.CreatedAt,
+		&key.ExpiresAt,
+	); err != nil {
+		return nil, err
+	}
+
+	if header.Valid {
+		if err := json.Unmarshal([]byte(header.String), &key.Header); err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+	}
+
+	key.CreatedAt = key.CreatedAt.UTC()
+	key.ExpiresAt = key.ExpiresAt.UTC()
+
+	return &key, nil
+}
@@ -0,0 +1,782 @@
+package repositories
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// postgres_location_columns reads the point back as plain coordinates
+const postgres_location_columns = `id, created_at, updated_at, recorded_at, device_id,
+	ST_Y(point::geometry) AS latitude,
+	ST_X(point::geometry) AS longitude,
+	deleted_at, seen_count, ` + sql_telemetry_columns + `, ` + sql_screening_columns
+
+// postgres_location_filter matches the locations of a model.LocationFilter, the first filter arg is $2
+const postgres_location_filter = `($2::double precision IS NULL OR accuracy IS NULL OR accuracy <= $2)`
+
+type PostgresLocationRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresLocationRepository(db *sql.DB) LocationRepository {
+	return &PostgresLocationRepository{
+		db: db,
+	}
+}
+
+func (r *PostgresLocationRepository) GetAllByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) ([]model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	locations := []model.Location{}
+
+	rows, err := sqlExecutorFrom(ctx, r.db).QueryContext(
+		ctx,
+		`SELECT `+postgres_location_columns+`
+		FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE device_id = $1 AND deleted_at IS NULL
+			AND `+postgres_location_filter+`
+		ORDER BY recorded_at, id`,
+		objectID.Hex(),
+		pointerToNull(filter.MaxAccuracy),
+	)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		location, err := scanPostgresLocation(rows)
+		if err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		locations = append(locations, *location)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return locations, nil
+}
+
+func (r *PostgresLocationRepository) GetLatestByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) (*model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	location, err := scanPostgresLocation(sqlExecutorFrom(ctx, r.db).QueryRowContext(
+		ctx,
+		`SELECT `+postgres_location_columns+`
+		FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE device_id = $1 AND deleted_at IS NULL AND NOT rejected
+			AND `+postgres_location_filter+`
+		ORDER BY recorded_at DESC, id DESC
+		LIMIT 1`,
+		objectID.Hex(),
+		pointerToNull(filter.MaxAccuracy),
+	))
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.AsError(model.ErrItemNotFound, "device not found")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return location, nil
+}
+
+func (r *PostgresLocationRepository) Create(
+	ctx context.Context,
+	deviceID string,
+	latitude float64,
+	longitude float64,
+	recordedAt time.Time,
+	telemetry model.Telemetry,
+	screening model.Screening,
+) (*model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	created := time.Now().UTC().Truncate(time.Millisecond)
+	location := &model.Location{
+		ID:         bson.NewObjectID(),
+		CreatedAt:  created,
+		UpdatedAt:  created,
+		RecordedAt: cmp.Or(recordedAt, created),
+		DeviceID:   objectID,
+		Latitude:   latitude,
+		Longitude:  longitude,
+		SeenCount:  1,
+		Telemetry:  telemetry,
+		Screening:  screening,
+	}
+
+	// points are stored as (longitude, latitude) in WGS 84
+	if _, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`INSERT INTO `+TABLE_NAME_LOCATIONS+`
+		(id, created_at, updated_at, device_id, point, recorded_at, `+sql_telemetry_columns+`, `+sql_screening_columns+`)
+		VALUES ($1, $2, $3, $4, ST_SetSRID(ST_MakePoint($5, $6), 4326)::geography,
+			$7, $8, $9, $10, $11, $12, $13, $14, $15)`,
+		slices.Concat([]any{
+			location.ID.Hex(),
+			location.CreatedAt,
+			location.UpdatedAt,
+			location.DeviceID.Hex(),
+			location.Longitude,
+			location.Latitude,
+			location.RecordedAt,
+		}, sqlTelemetryArgs(location.Telemetry), sqlScreeningArgs(location.Screening))...,
+	); err != nil {
+		return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	return location, nil
+}
+
+func (r *PostgresLocationRepository) CreateMany(
+	ctx context.Context,
+	deviceID string,
+	locations []model.Location,
+) ([]model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	if len(locations) == 0 {
+		return []model.Location{}, nil
+	}
+
+	created := time.Now().UTC().Truncate(time.Millisecond)
+	createdLocations := make([]model.Location, 0, len(locations))
+
+	// passed as arrays of columns, unnested back to rows in their order
+	var ids []string
+	var providers []*string
+	var latitudes, longitudes []float64
+	var recordedAts []time.Time
+	var accuracies, altitudes, speeds, bearings []*float64
+	var batteries []*int
+	var outliers []*string
+	var rejected []bool
+	var seenCounts []int64
+
+	for _, params := range locations {
+		location := model.Location{
+			ID:         bson.NewObjectID(),
+			CreatedAt:  created,
+			UpdatedAt:  created,
+			RecordedAt: cmp.Or(params.RecordedAt, created),
+			DeviceID:   objectID,
+			Latitude:   params.Latitude,
+			Longitude:  params.Longitude,
+			SeenCount:  max(params.SeenCount, 1),
+			Telemetry:  params.Telemetry,
+			Screening:  params.Screening,
+		}
+
+		ids = append(ids, location.ID.Hex())
+		latitudes = append(latitudes, location.Latitude)
+		longitudes = append(longitudes, location.Longitude)
+		recordedAts = append(recordedAts, location.RecordedAt)
+		accuracies = append(accuracies, location.Accuracy)
+		altitudes = append(altitudes, location.Altitude)
+		speeds = append(speeds, location.Speed)
+		bearings = append(bearings, location.Bearing)
+		batteries = append(batteries, location.Battery)
+		providers = append(providers, nullToPointer(sqlTelemetryProvider(location.Telemetry)))
+		outliers = append(outliers, nullToPointer(sql.Null[string]{V: location.Outlier, Valid: location.Outlier != ""}))
+		rejected = append(rejected, location.Rejected)
+		seenCounts = append(seenCounts, location.SeenCount)
+
+		createdLocations = append(createdLocations, location)
+	}
+
+	// the locations are written in a single statement
+	if _, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`INSERT INTO `+TABLE_NAME_LOCATIONS+`
+		(id, created_at, updated_at, device_id, point, recorded_at, seen_count,
+			`+sql_telemetry_columns+`, `+sql_screening_columns+`)
+		SELECT v.id, $2, $2, $1, ST_SetSRID(ST_MakePoint(v.longitude, v.latitude), 4326)::geography,
+			v.recorded_at, v.seen_count,
+			v.accuracy, v.altitude, v.speed, v.bearing, v.battery, v.provider, v.outlier, v.rejected
+		FROM unnest(
+			$3::text[], $4::double precision[], $5::double precision[], $6::timestamptz[],
+			$7::double precision[], $8::double precision[], $9::double precision[], $10::double precision[],
+			$11::smallint[], $12::text[], $13::text[], $14::boolean[], $15::integer[]
+		) AS v(id, latitude, longitude, recorded_at,
+			accuracy, altitude, speed, bearing, battery, provider, outlier, rejected, seen_count)`,
+		objectID.Hex(),
+		created,
+		ids,
+		latitudes,
+		longitudes,
+		recordedAts,
+		accuracies,
+		altitudes,
+		speeds,
+		bearings,
+		batteries,
+		providers,
+		outliers,
+		rejected,
+		seenCounts,
+	); err != nil {
+		return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	return createdLocations, nil
+}
+
+func (r *PostgresLocationRepository) SoftDelete(ctx context.Context, deviceID string, id string, deletedAt time.Time) (bool, error) {
+	return r.setDeletedAt(ctx, deviceID, id, sql.Null[time.Time]{V: deletedAt, Valid: true})
+}
+
+func (r *PostgresLocationRepository) SoftDeleteAllByDevice(ctx context.Context, deviceID string, deletedAt time.Time) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	return r.exec(
+		ctx,
+		`UPDATE `+TABLE_NAME_LOCATIONS+`
+		SET deleted_at = $1
+		WHERE device_id = $2 AND deleted_at IS NULL`,
+		deletedAt,
+		objectID.Hex(),
+	)
+}
+
+func (r *PostgresLocationRepository) GetDeletedByDevice(ctx context.Context, deviceID string) ([]model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	return r.query(
+		ctx,
+		`SELECT `+postgres_location_columns+`
+		FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE device_id = $1 AND deleted_at IS NOT NULL
+		ORDER BY id`,
+		objectID.Hex(),
+	)
+}
+
+func (r *PostgresLocationRepository) Restore(ctx context.Context, deviceID string, id string) (bool, error) {
+	return r.setDeletedAt(ctx, deviceID, id, sql.Null[time.Time]{})
+}
+
+func (r *PostgresLocationRepository) RestoreAllByDevice(ctx context.Context, deviceID string, deletedAt *time.Time) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	// without a time, restores all of the device locations in the trash
+	var at sql.Null[time.Time]
+	if deletedAt != nil {
+		at = sql.Null[time.Time]{V: *deletedAt, Valid: true}
+	}
+
+	return r.exec(
+		ctx,
+		`UPDATE `+TABLE_NAME_LOCATIONS+`
+		SET deleted_at = NULL
+		WHERE device_id = $1 AND deleted_at IS NOT NULL AND ($2::timestamptz IS NULL OR deleted_at = $2)`,
+		objectID.Hex(),
+		at,
+	)
+}
+
+func (r *PostgresLocationRepository) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	return r.exec(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_LOCATIONS+` WHERE deleted_at < $1`,
+		before,
+	)
+}
+
+func (r *PostgresLocationRepository) Refresh(
+	ctx context.Context,
+	deviceID string,
+	id string,
+	updatedAt time.Time,
+	count int64,
+) (*model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	locations, err := r.query(
+		ctx,
+		`UPDATE `+TABLE_NAME_LOCATIONS+`
+		SET updated_at = $1, seen_count = seen_count + $2
+		WHERE id = $3 AND device_id = $4 AND deleted_at IS NULL
+		RETURNING `+postgres_location_columns,
+		updatedAt.UTC().Truncate(time.Millisecond),
+		count,
+		objectID.Hex(),
+		deviceOID.Hex(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(locations) == 0 {
+		return nil, utils.AsError(model.ErrItemNotFound, "location not found")
+	}
+
+	return &locations[0], nil
+}
+
+// setDeletedAt moves the location in or out of the trash, null restores it.
+func (r *PostgresLocationRepository) setDeletedAt(ctx context.Context, deviceID string, id string, deletedAt sql.Null[time.Time]) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	// only a change of state counts
+	updated, err := r.exec(
+		ctx,
+		`UPDATE `+TABLE_NAME_LOCATIONS+`
+		SET deleted_at = $1
+		WHERE id = $2 AND device_id = $3 AND (deleted_at IS NULL) <> ($1::timestamptz IS NULL)`,
+		deletedAt,
+		objectID.Hex(),
+		deviceOID.Hex(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return updated > 0, nil
+}
+
+func (r *PostgresLocationRepository) Delete(ctx context.Context, deviceID string, id string) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	deleted, err := r.exec(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_LOCATIONS+` WHERE id = $1 AND device_id = $2`,
+		objectID.Hex(),
+		deviceOID.Hex(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return deleted > 0, nil
+}
+
+func (r *PostgresLocationRepository) DeleteAllByDevice(ctx context.Context, deviceID string) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	return r.exec(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_LOCATIONS+` WHERE device_id = $1`,
+		objectID.Hex(),
+	)
+}
+
+func (r *PostgresLocationRepository) DeleteOldByDevice(ctx context.Context, deviceID string, skip int) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	// deletes all locations recorded before the newest ones to keep (by number of skip / limit),
+	// a single statement so concurrent trims can't delete more than needed,
+	// the latest location is kept, same as GetLatestByDevice, even when newer ones were rejected
+	return r.exec(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE device_id = $1 AND id NOT IN (
+			SELECT id FROM `+TABLE_NAME_LOCATIONS+`
+			WHERE device_id = $1
+			ORDER BY recorded_at DESC, id DESC
+			LIMIT $2
+		) AND id IS DISTINCT FROM (
+			SELECT id FROM `+TABLE_NAME_LOCATIONS+`
+			WHERE device_id = $1 AND deleted_at IS NULL AND NOT rejected
+			ORDER BY recorded_at DESC, id DESC
+			LIMIT 1
+		)`,
+		objectID.Hex(),
+		skip,
+	)
+}
+
+func (r *PostgresLocationRepository) DeleteExpiredByDevice(ctx context.Context, deviceID string, before time.Time) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	// the latest location is kept, same as GetLatestByDevice, even when all of the others were rejected
+	return r.exec(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE device_id = $1 AND recorded_at < $2 AND id IS DISTINCT FROM (
+			SELECT id FROM `+TABLE_NAME_LOCATIONS+`
+			WHERE device_id = $1 AND deleted_at IS NULL AND NOT rejected
+			ORDER BY recorded_at DESC, id DESC
+			LIMIT 1
+		)`,
+		objectID.Hex(),
+		before,
+	)
+}
+
+func (r *PostgresLocationRepository) GetDeviceIDs(ctx context.Context) ([]string, error) {
+	rows, err := sqlExecutorFrom(ctx, r.db).QueryContext(
+		ctx,
+		`SELECT DISTINCT device_id FROM `+TABLE_NAME_LOCATIONS,
+	)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer rows.Close()
+
+	deviceIDs := []string{}
+	for rows.Next() {
+		var deviceID string
+		if err := rows.Scan(&deviceID); err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return deviceIDs, nil
+}
+
+func (r *PostgresLocationRepository) GetNear(ctx context.Context, center model.Coordinates, maxDistance float64) ([]model.Location, error) {
+	return r.query(
+		ctx,
+		`SELECT `+postgres_location_columns+`
+		FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE deleted_at IS NULL
+			AND ST_DWithin(point, ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography, $3)
+		ORDER BY ST_Distance(point, ST_SetSRID(ST_MakePoint($1, $2), 4326)::geography), id`,
+		center.Longitude,
+		center.Latitude,
+		maxDistance,
+	)
+}
+
+func (r *PostgresLocationRepository) GetWithinPolygon(ctx context.Context, polygon model.Polygon) ([]model.Location, error) {
+	positions := []string{}
+	for _, position := range polygon.Ring() {
+		positions = append(positions, fmt.Sprintf(
+			"%s %s",
+			strconv.FormatFloat(position[0], 'f', -1, 64),
+			strconv.FormatFloat(position[1], 'f', -1, 64),
+		))
+	}
+
+	return r.query(
+		ctx,
+		`SELECT `+postgres_location_columns+`
+		FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE deleted_at IS NULL
+			AND ST_Covers(ST_GeogFromText($1), point)
+		ORDER BY id`,
+		fmt.Sprintf("SRID=4326;POLYGON((%s))", strings.Join(positions, ", ")),
+	)
+}
+
+func (r *PostgresLocationRepository) query(ctx context.Context, query string, args ...any) ([]model.Location, error) {
+	rows, err := sqlExecutorFrom(ctx, r.db).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer rows.Close()
+
+	locations := []model.Location{}
+	for rows.Next() {
+		location, err := scanPostgresLocation(rows)
+		if err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		locations = append(locations, *location)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return locations, nil
+}
+
+func (r *PostgresLocationRepository) Import(ctx context.Context, location model.Location) (*model.Location, error) {
+	imported, err := r.ImportMany(ctx, []model.Location{location})
+	if err != nil {
+		return nil, err
+	}
+
+	return &imported[0], nil
+}
+
+func (r *PostgresLocationRepository) ImportMany(ctx context.Context, locations []model.Location) ([]model.Location, error) {
+	if len(locations) == 0 {
+		return []model.Location{}, nil
+	}
+
+	imported := make([]model.Location, 0, len(locations))
+
+	// passed as arrays of columns, unnested back to rows, same as CreateMany
+	var ids, deviceIDs []string
+	var providers []*string
+	var createdAts, updatedAts, recordedAts []time.Time
+	var deletedAts []*time.Time
+	var latitudes, longitudes []float64
+	var accuracies, altitudes, speeds, bearings []*float64
+	var batteries []*int
+	var outliers []*string
+	var rejected []bool
+	var seenCounts []int64
+
+	for _, location := range locations {
+		location.SeenCount = max(location.SeenCount, 1)
+
+		ids = append(ids, location.ID.Hex())
+		deviceIDs = append(deviceIDs, location.DeviceID.Hex())
+		createdAts = append(createdAts, location.CreatedAt)
+		updatedAts = append(updatedAts, location.UpdatedAt)
+		recordedAts = append(recordedAts, location.RecordedAt)
+		deletedAts = append(deletedAts, location.DeletedAt)
+		latitudes = append(latitudes, location.Latitude)
+		longitudes = append(longitudes, location.Longitude)
+		accuracies = append(accuracies, location.Accuracy)
+		altitudes = append(altitudes, location.Altitude)
+		speeds = append(speeds, location.Speed)
+		bearings = append(bearings, location.Bearing)
+		batteries = append(batteries, location.Battery)
+		providers = append(providers, nullToPointer(sqlTelemetryProvider(location.Telemetry)))
+		outliers = append(outliers, nullToPointer(sql.Null[string]{V: location.Outlier, Valid: location.Outlier != ""}))
+		rejected = append(rejected, location.Rejected)
+		seenCounts = append(seenCounts, location.SeenCount)
+
+		imported = append(imported, location)
+	}
+
+	// same as CreateMany, keeping the given ids, timestamps and trash state
+	if _, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`INSERT INTO `+TABLE_NAME_LOCATIONS+`
+		(id, created_at, updated_at, device_id, point, deleted_at, recorded_at, seen_count,
+			`+sql_telemetry_columns+`, `+sql_screening_columns+`)
+		SELECT v.id, v.created_at, v.updated_at, v.device_id,
+			ST_SetSRID(ST_MakePoint(v.longitude, v.latitude), 4326)::geography,
+			v.deleted_at, v.recorded_at, v.seen_count,
+			v.accuracy, v.altitude, v.speed, v.bearing, v.battery, v.provider, v.outlier, v.rejected
+		FROM unnest(
+			$1::text[], $2::timestamptz[], $3::timestamptz[], $4::text[],
+			$5::double precision[], $6::double precision[], $7::timestamptz[], $8::timestamptz[],
+			$9::double precision[], $10::double precision[], $11::double precision[], $12::double precision[],
+			$13::smallint[], $14::text[], $15::text[], $16::boolean[], $17::integer[]
+		) AS v(id, created_at, updated_at, device_id, latitude, longitude, deleted_at, recorded_at,
+			accuracy, altitude, speed, bearing, battery, provider, outlier, rejected, seen_count)
+		ON CONFLICT (id) DO UPDATE SET
+			created_at = EXCLUDED.created_at,
+			updated_at = EXCLUDED.updated_at,
+			recorded_at = EXCLUDED.recorded_at,
+			device_id = EXCLUDED.device_id,
+			point = EXCLUDED.point,
+			deleted_at = EXCLUDED.deleted_at,
+			seen_count = EXCLUDED.seen_count,
+			accuracy = EXCLUDED.accuracy,
+			altitude = EXCLUDED.altitude,
+			speed = EXCLUDED.speed,
+			bearing = EXCLUDED.bearing,
+			battery = EXCLUDED.battery,
+			provider = EXCLUDED.provider,
+			outlier = EXCLUDED.outlier,
+			rejected = EXCLUDED.rejected`,
+		ids,
+		createdAts,
+		updatedAts,
+		deviceIDs,
+		latitudes,
+		longitudes,
+		deletedAts,
+		recordedAts,
+		accuracies,
+		altitudes,
+		speeds,
+		bearings,
+		batteries,
+		providers,
+		outliers,
+		rejected,
+		seenCounts,
+	); err != nil {
+		return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	return imported, nil
+}
+
+func (r *PostgresLocationRepository) exec(ctx context.Context, query string, args ...any) (int64, error) {
+	result, err := sqlExecutorFrom(ctx, r.db).ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return affected, nil
+}
+
+func scanPostgresLocation(row rowScanner) (*model.Location, error) {
+	var location model.Location
+	var id, deviceID string
+	var deletedAt sql.NullTime
+	var telemetry sqlTelemetry
+	var screening sqlScreening
+
+	if err := row.Scan(slices.Concat([]any{
+		&id,
+		&location.CreatedAt,
+		&location.UpdatedAt,
+		&location.RecordedAt,
+		&deviceID,
+		&location.Latitude,
+		&location.Longitude,
+		&deletedAt,
+		&location.SeenCount,
+	}, telemetry.dest(), screening.dest())...); err != nil {
+		return nil, err
+	}
+
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	location.ID = objectID
+	location.DeviceID = deviceOID
+	location.CreatedAt = location.CreatedAt.UTC()
+	location.UpdatedAt = location.UpdatedAt.UTC()
+	location.RecordedAt = location.RecordedAt.UTC()
+	location.Telemetry = telemetry.telemetry()
+	location.Screening = screening.screening()
+
+	if deletedAt.Valid {
+		deletedTime := deletedAt.Time.UTC()
+		location.DeletedAt = &deletedTime
+	}
+
+	return &location, nil
+}
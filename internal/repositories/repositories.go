@@ -0,0 +1,100 @@
+package repositories
+
+import (
+	"context"
+	"dwimc/internal/database"
+	"dwimc/internal/encryption"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"fmt"
+)
+
+type Repositories struct {
+	Device     DeviceRepository
+	Location   LocationRepository
+	Transactor Transactor
+	// Idempotency keeps the responses of requests sent with an idempotency key
+	Idempotency IdempotencyRepository
+	// Encryption is nil for the backends not supporting coordinates encryption
+	Encryption EncryptionRepository
+}
+
+// InitializeRepositories creates the repositories matching the connected database backend,
+// the database schema is expected to be migrated already.
+//
+// The coordinates are encrypted when given a keyring, which must hold all of the keys
+// the stored coordinates are encrypted with (ErrMissingEncryptionKey otherwise).
+func InitializeRepositories(
+	ctx context.Context,
+	db database.Database,
+	keyring *encryption.Keyring,
+) (*Repositories, error) {
+	switch db := db.(type) {
+	case *database.MemoryDatabase:
+		if keyring != nil {
+			return nil, utils.AsError(ErrEncryptionNotSupported, "memory")
+		}
+
+		store := NewMemoryStore()
+
+		return &Repositories{
+			Device:      NewMemoryDeviceRepository(store),
+			Location:    NewMemoryLocationRepository(store),
+			Transactor:  NewMemoryTransactor(store),
+			Idempotency: NewMemoryIdempotencyRepository(store),
+		}, nil
+
+	case *database.SqliteDatabase:
+		repos := &Repositories{
+			Device:      NewSqliteDeviceRepository(db.DB, keyring),
+			Location:    NewSqliteLocationRepository(db.DB, keyring),
+			Transactor:  NewSqlTransactor(db.DB),
+			Idempotency: NewSqliteIdempotencyRepository(db.DB),
+			Encryption:  NewSqliteEncryptionRepository(db.DB, keyring),
+		}
+
+		if err := checkEncryptionKeys(ctx, repos.Encryption, keyring); err != nil {
+			return nil, err
+		}
+
+		return repos, nil
+
+	case *database.PostgresDatabase:
+		if keyring != nil {
+			return nil, utils.AsError(ErrEncryptionNotSupported, "postgres")
+		}
+
+		return &Repositories{
+			Device:      NewPostgresDeviceRepository(db.DB),
+			Location:    NewPostgresLocationRepository(db.DB),
+			Transactor:  NewSqlTransactor(db.DB),
+			Idempotency: NewPostgresIdempotencyRepository(db.DB),
+		}, nil
+
+	case *database.MongodbDatabase:
+		transactor, err := NewMongodbTransactor(ctx, db.Client)
+		if err != nil {
+			return nil, err
+		}
+
+		repos := &Repositories{
+			Device:      NewMongodbDeviceRepository(db.Client, db.Name, keyring),
+			Location:    NewMongodbLocationRepository(db.Client, db.Name, keyring),
+			Transactor:  transactor,
+			Idempotency: NewMongodbIdempotencyRepository(db.Client, db.Name),
+			Encryption:  NewMongodbEncryptionRepository(db.Client, db.Name, keyring),
+		}
+
+		if err := checkEncryptionKeys(ctx, repos.Encryption, keyring); err != nil {
+			return nil, err
+		}
+
+		return repos, nil
+
+	default:
+		return nil, utils.AsError(
+			model.ErrInternal,
+			fmt.Sprintf("unsupported database: %T", db),
+		)
+	}
+}
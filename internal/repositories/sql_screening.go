@@ -0,0 +1,34 @@
+package repositories
+
+import (
+	"database/sql"
+	"dwimc/internal/model"
+)
+
+// sql_screening_columns are the location screening columns of sqlite and postgres, the outlier is null for a plausible fix
+const sql_screening_columns = `outlier, rejected`
+
+// sqlScreening scans the columns of sql_screening_columns
+type sqlScreening struct {
+	outlier  sql.Null[string]
+	rejected sql.Null[bool]
+}
+
+func (s *sqlScreening) dest() []any {
+	return []any{&s.outlier, &s.rejected}
+}
+
+func (s *sqlScreening) screening() model.Screening {
+	return model.Screening{
+		Outlier:  s.outlier.V,
+		Rejected: s.rejected.V,
+	}
+}
+
+// sqlScreeningArgs returns the values of sql_screening_columns, in the same order
+func sqlScreeningArgs(screening model.Screening) []any {
+	return []any{
+		sql.Null[string]{V: screening.Outlier, Valid: screening.Outlier != ""},
+		screening.Rejected,
+	}
+}
@@ -0,0 +1,67 @@
+package repositories
+
+import (
+	"database/sql"
+	"dwimc/internal/model"
+)
+
+// sql_telemetry_columns are the location telemetry columns of sqlite and postgres, null when not reported
+const sql_telemetry_columns = `accuracy, altitude, speed, bearing, battery, provider`
+
+// sqlTelemetry scans the columns of sql_telemetry_columns
+type sqlTelemetry struct {
+	accuracy sql.Null[float64]
+	altitude sql.Null[float64]
+	speed    sql.Null[float64]
+	bearing  sql.Null[float64]
+	battery  sql.Null[int]
+	provider sql.Null[string]
+}
+
+func (t *sqlTelemetry) dest() []any {
+	return []any{&t.accuracy, &t.altitude, &t.speed, &t.bearing, &t.battery, &t.provider}
+}
+
+func (t *sqlTelemetry) telemetry() model.Telemetry {
+	return model.Telemetry{
+		Accuracy: nullToPointer(t.accuracy),
+		Altitude: nullToPointer(t.altitude),
+		Speed:    nullToPointer(t.speed),
+		Bearing:  nullToPointer(t.bearing),
+		Battery:  nullToPointer(t.battery),
+		Provider: t.provider.V,
+	}
+}
+
+// sqlTelemetryArgs returns the values of sql_telemetry_columns, in the same order
+func sqlTelemetryArgs(telemetry model.Telemetry) []any {
+	return []any{
+		pointerToNull(telemetry.Accuracy),
+		pointerToNull(telemetry.Altitude),
+		pointerToNull(telemetry.Speed),
+		pointerToNull(telemetry.Bearing),
+		pointerToNull(telemetry.Battery),
+		sqlTelemetryProvider(telemetry),
+	}
+}
+
+// sqlTelemetryProvider stores an unreported provider as null
+func sqlTelemetryProvider(telemetry model.Telemetry) sql.Null[string] {
+	return sql.Null[string]{V: telemetry.Provider, Valid: telemetry.Provider != ""}
+}
+
+func pointerToNull[T any](value *T) sql.Null[T] {
+	if value == nil {
+		return sql.Null[T]{}
+	}
+
+	return sql.Null[T]{V: *value, Valid: true}
+}
+
+func nullToPointer[T any](value sql.Null[T]) *T {
+	if !value.Valid {
+		return nil
+	}
+
+	return &value.V
+}
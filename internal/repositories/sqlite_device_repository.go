@@ -0,0 +1,623 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"dwimc/internal/encryption"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const TABLE_NAME_DEVICES = "devices"
+
+// sqlite_device_select reads devices along with their last location, see scanSqliteDevice
+const sqlite_device_select = `SELECT d.id, d.created_at, d.updated_at, d.serial, d.name, d.version, d.retention_period, d.deleted_at,
+	l.id, l.created_at, l.updated_at, l.recorded_at, l.latitude, l.longitude, l.seen_count, l.key_id, l.coordinates,
+	l.accuracy, l.altitude, l.speed, l.bearing, l.battery, l.provider, l.outlier, l.rejected
+	FROM ` + TABLE_NAME_DEVICES + ` d
+	LEFT JOIN ` + TABLE_NAME_LOCATIONS + ` l ON l.id = d.last_location_id`
+
+type SqliteDeviceRepository struct {
+	db     *sql.DB
+	cipher coordinatesCipher
+}
+
+// NewSqliteDeviceRepository decrypts the last locations with the keyring, see NewSqliteLocationRepository
+func NewSqliteDeviceRepository(db *sql.DB, keyring *encryption.Keyring) DeviceRepository {
+	return &SqliteDeviceRepository{
+		db:     db,
+		cipher: coordinatesCipher{keyring: keyring},
+	}
+}
+
+func (r *SqliteDeviceRepository) GetAll(ctx context.Context) ([]model.Device, error) {
+	devices := []model.Device{}
+
+	rows, err := sqlExecutorFrom(ctx, r.db).QueryContext(
+		ctx,
+		sqlite_device_select+`
+		WHERE d.deleted_at IS NULL
+		ORDER BY d.id`,
+	)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		device, err := r.scan(rows)
+		if err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		devices = append(devices, *device)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return devices, nil
+}
+
+func (r *SqliteDeviceRepository) Get(ctx context.Context, id string) (*model.Device, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	device, err := r.scan(sqlExecutorFrom(ctx, r.db).QueryRowContext(
+		ctx,
+		sqlite_device_select+`
+		WHERE d.id = ? AND d.deleted_at IS NULL`,
+		objectID.Hex(),
+	))
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.AsError(model.ErrItemNotFound, "device not found")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return device, nil
+}
+
+func (r *SqliteDeviceRepository) GetBySerial(ctx context.Context, serial string) (*model.Device, error) {
+	device, err := r.scan(sqlExecutorFrom(ctx, r.db).QueryRowContext(
+		ctx,
+		sqlite_device_select+`
+		WHERE d.serial = ? AND d.deleted_at IS NULL`,
+		serial,
+	))
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.AsError(model.ErrItemNotFound, "device not found")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return device, nil
+}
+
+func (r *SqliteDeviceRepository) Exists(ctx context.Context, id string) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	var found int
+
+	err = sqlExecutorFrom(ctx, r.db).QueryRowContext(
+		ctx,
+		`SELECT 1 FROM `+TABLE_NAME_DEVICES+` WHERE id = ? AND deleted_at IS NULL`,
+		objectID.Hex(),
+	).Scan(&found)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, utils.AsError(model.ErrItemNotFound, "device not found")
+		}
+
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return true, nil
+}
+
+func (r *SqliteDeviceRepository) Create(ctx context.Context, serial string, name string, version int64) (*model.Device, bool, error) {
+	if len(serial) == 0 && len(name) == 0 {
+		return nil, false, utils.AsError(model.ErrInvalidArgs, "Fields are empty")
+	}
+
+	updatedAt := time.Now().UTC().UnixMilli()
+
+	var id string
+	var err error
+
+	// a conflict keeps the id of the existing device
+	newID := bson.NewObjectID().Hex()
+
+	if version != 0 {
+		// a conditioned write updates the device at the given version only
+		err = sqlExecutorFrom(ctx, r.db).QueryRowContext(
+			ctx,
+			`UPDATE `+TABLE_NAME_DEVICES+` SET
+				version = CASE
+					WHEN name <> ?1 OR deleted_at IS NOT NULL THEN version + 1
+					ELSE version
+				END,
+				name = ?1,
+				updated_at = ?2,
+				deleted_at = NULL,
+				last_location_id = CASE WHEN deleted_at IS NULL THEN last_location_id END
+			WHERE serial = ?3 AND version = ?4
+			RETURNING id`,
+			name,
+			updatedAt,
+			serial,
+			version,
+		).Scan(&id)
+
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, false, utils.AsError(model.ErrPreconditionFailed, "device version mismatch")
+		}
+	} else {
+		// upserts by the unique serial, keeping the original id and creation time,
+		// a device in the trash is taken out of it without its last location
+		err = sqlExecutorFrom(ctx, r.db).QueryRowContext(
+			ctx,
+			`INSERT INTO `+TABLE_NAME_DEVICES+` (id, created_at, updated_at, serial, name)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT (serial) DO UPDATE SET
+				version = CASE
+					WHEN `+TABLE_NAME_DEVICES+`.name <> excluded.name
+						OR `+TABLE_NAME_DEVICES+`.deleted_at IS NOT NULL
+					THEN `+TABLE_NAME_DEVICES+`.version + 1
+					ELSE `+TABLE_NAME_DEVICES+`.version
+				END,
+				name = excluded.name,
+				updated_at = excluded.updated_at,
+				deleted_at = NULL,
+				last_location_id = CASE
+					WHEN `+TABLE_NAME_DEVICES+`.deleted_at IS NULL THEN `+TABLE_NAME_DEVICES+`.last_location_id
+				END
+			RETURNING id`,
+			newID,
+			updatedAt,
+			updatedAt,
+			serial,
+			name,
+		).Scan(&id)
+	}
+
+	if err != nil {
+		return nil, false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	device, err := r.Get(ctx, id)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return device, id == newID, nil
+}
+
+func (r *SqliteDeviceRepository) SetRetentionPeriod(ctx context.Context, id string, retentionPeriod int64, version int64) (*model.Device, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	var updatedID string
+
+	err = sqlExecutorFrom(ctx, r.db).QueryRowContext(
+		ctx,
+		`UPDATE `+TABLE_NAME_DEVICES+`
+		SET retention_period = ?, updated_at = ?, version = version + 1
+		WHERE id = ? AND deleted_at IS NULL AND (?4 = 0 OR version = ?4)
+		RETURNING id`,
+		retentionPeriod,
+		time.Now().UTC().UnixMilli(),
+		objectID.Hex(),
+		version,
+	).Scan(&updatedID)
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, r.versionMismatchOrNotFound(ctx, id, version)
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return r.Get(ctx, updatedID)
+}
+
+func (r *SqliteDeviceRepository) SetLastLocation(ctx context.Context, id string, location *model.Location) error {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	// a concurrent or earlier reported newer location wins, no match is not an error
+	if _, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`UPDATE `+TABLE_NAME_DEVICES+`
+		SET last_location_id = ?
+		WHERE id = ? AND NOT EXISTS (
+			SELECT 1 FROM `+TABLE_NAME_LOCATIONS+`
+			WHERE id = `+TABLE_NAME_DEVICES+`.last_location_id
+				AND (recorded_at, id) > (?, ?)
+		)`,
+		location.ID.Hex(),
+		objectID.Hex(),
+		location.RecordedAt.UnixMilli(),
+		location.ID.Hex(),
+	); err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return nil
+}
+
+func (r *SqliteDeviceRepository) ReplaceLastLocation(ctx context.Context, id string, location *model.Location) error {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	var locationID sql.NullString
+	if location != nil {
+		locationID = sql.NullString{String: location.ID.Hex(), Valid: true}
+	}
+
+	result, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`UPDATE `+TABLE_NAME_DEVICES+` SET last_location_id = ? WHERE id = ?`,
+		locationID,
+		objectID.Hex(),
+	)
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if updated == 0 {
+		return utils.AsError(model.ErrItemNotFound, "device not found")
+	}
+
+	return nil
+}
+
+func (r *SqliteDeviceRepository) SoftDelete(ctx context.Context, id string, version int64, deletedAt time.Time) (bool, error) {
+	return r.setDeletedAt(ctx, id, version, sql.Null[int64]{V: deletedAt.UnixMilli(), Valid: true})
+}
+
+func (r *SqliteDeviceRepository) GetAllDeleted(ctx context.Context) ([]model.Device, error) {
+	devices := []model.Device{}
+
+	rows, err := sqlExecutorFrom(ctx, r.db).QueryContext(
+		ctx,
+		sqlite_device_select+`
+		WHERE d.deleted_at IS NOT NULL
+		ORDER BY d.deleted_at DESC, d.id`,
+	)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		device, err := r.scan(rows)
+		if err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		devices = append(devices, *device)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return devices, nil
+}
+
+func (r *SqliteDeviceRepository) GetDeleted(ctx context.Context, id string) (*model.Device, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	device, err := r.scan(sqlExecutorFrom(ctx, r.db).QueryRowContext(
+		ctx,
+		sqlite_device_select+`
+		WHERE d.id = ? AND d.deleted_at IS NOT NULL`,
+		objectID.Hex(),
+	))
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.AsError(model.ErrItemNotFound, "device not found in trash")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return device, nil
+}
+
+func (r *SqliteDeviceRepository) Restore(ctx context.Context, id string) (bool, error) {
+	return r.setDeletedAt(ctx, id, 0, sql.Null[int64]{})
+}
+
+// setDeletedAt moves the device in or out of the trash, null restores it.
+func (r *SqliteDeviceRepository) setDeletedAt(ctx context.Context, id string, version int64, deletedAt sql.Null[int64]) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	// only a change of state counts
+	result, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`UPDATE `+TABLE_NAME_DEVICES+`
+		SET deleted_at = ?1, version = version + 1
+		WHERE id = ?2 AND (deleted_at IS NULL) <> (?1 IS NULL) AND (?3 = 0 OR version = ?3)`,
+		deletedAt,
+		objectID.Hex(),
+		version,
+	)
+	if err != nil {
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if updated == 0 {
+		// a device not in the expected state is not an error, a mismatching one is
+		if err := r.versionMismatchOrNotFound(ctx, id, version); !errors.Is(err, model.ErrItemNotFound) {
+			return false, err
+		}
+
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// versionMismatchOrNotFound tells why a write conditioned on the version matched no device
+func (r *SqliteDeviceRepository) versionMismatchOrNotFound(ctx context.Context, id string, version int64) error {
+	if version == 0 {
+		return utils.AsError(model.ErrItemNotFound, "device not found")
+	}
+
+	if _, err := r.Exists(ctx, id); err != nil {
+		return err
+	}
+
+	return utils.AsError(model.ErrPreconditionFailed, "device version mismatch")
+}
+
+func (r *SqliteDeviceRepository) Import(ctx context.Context, device model.Device) error {
+	executor := sqlExecutorFrom(ctx, r.db)
+
+	var conflicting int
+
+	err := executor.QueryRowContext(
+		ctx,
+		`SELECT 1 FROM `+TABLE_NAME_DEVICES+` WHERE serial = ? AND id <> ?`,
+		device.Serial,
+		device.ID.Hex(),
+	).Scan(&conflicting)
+
+	if err == nil {
+		return utils.AsError(
+			model.ErrItemConflict,
+			fmt.Sprintf("serial belongs to another device: %s", device.Serial),
+		)
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	var deletedAt sql.NullInt64
+	if device.DeletedAt != nil {
+		deletedAt = sql.NullInt64{Int64: device.DeletedAt.UnixMilli(), Valid: true}
+	}
+
+	if _, err := executor.ExecContext(
+		ctx,
+		`INSERT INTO `+TABLE_NAME_DEVICES+`
+		(id, created_at, updated_at, serial, name, version, retention_period, deleted_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			created_at = excluded.created_at,
+			updated_at = excluded.updated_at,
+			serial = excluded.serial,
+			name = excluded.name,
+			version = excluded.version,
+			retention_period = excluded.retention_period,
+			deleted_at = excluded.deleted_at,
+			last_location_id = NULL`,
+		device.ID.Hex(),
+		device.CreatedAt.UnixMilli(),
+		device.UpdatedAt.UnixMilli(),
+		device.Serial,
+		device.Name,
+		device.Version,
+		device.RetentionPeriod,
+		deletedAt,
+	); err != nil {
+		return utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	return nil
+}
+
+func (r *SqliteDeviceRepository) Delete(ctx context.Context, id string) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	result, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_DEVICES+` WHERE id = ?`,
+		objectID.Hex(),
+	)
+	if err != nil {
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return deleted > 0, nil
+}
+
+// scan reads the device with its last location decrypted
+func (r *SqliteDeviceRepository) scan(row rowScanner) (*model.Device, error) {
+	device, err := scanSqliteDevice(row)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.cipher.open(device.LastLocation); err != nil {
+		return nil, err
+	}
+
+	return device, nil
+}
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanSqliteDevice(row rowScanner) (*model.Device, error) {
+	var device model.Device
+	var id string
+	var createdAt, updatedAt int64
+	var deletedAt sql.NullInt64
+
+	// the last location columns are null without one
+	var locationID sql.NullString
+	var locationCreatedAt, locationUpdatedAt, locationRecordedAt, locationSeenCount sql.NullInt64
+	var latitude, longitude sql.NullFloat64
+	var keyID sql.NullString
+	var coordinates []byte
+	var telemetry sqlTelemetry
+	var screening sqlScreening
+
+	if err := row.Scan(slices.Concat([]any{
+		&id,
+		&createdAt,
+		&updatedAt,
+		&device.Serial,
+		&device.Name,
+		&device.Version,
+		&device.RetentionPeriod,
+		&deletedAt,
+		&locationID,
+		&locationCreatedAt,
+		&locationUpdatedAt,
+		&locationRecordedAt,
+		&latitude,
+		&longitude,
+		&locationSeenCount,
+		&keyID,
+		&coordinates,
+	}, telemetry.dest(), screening.dest())...); err != nil {
+		return nil, err
+	}
+
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	device.ID = objectID
+	device.CreatedAt = time.UnixMilli(createdAt).UTC()
+	device.UpdatedAt = time.UnixMilli(updatedAt).UTC()
+
+	if deletedAt.Valid {
+		deletedTime := time.UnixMilli(deletedAt.Int64).UTC()
+		device.DeletedAt = &deletedTime
+	}
+
+	if locationID.Valid {
+		locationOID, err := bson.ObjectIDFromHex(locationID.String)
+		if err != nil {
+			return nil, err
+		}
+
+		device.LastLocation = &model.Location{
+			ID:         locationOID,
+			CreatedAt:  time.UnixMilli(locationCreatedAt.Int64).UTC(),
+			UpdatedAt:  time.UnixMilli(locationUpdatedAt.Int64).UTC(),
+			RecordedAt: time.UnixMilli(locationRecordedAt.Int64).UTC(),
+			DeviceID:   objectID,
+			Latitude:   latitude.Float64,
+			Longitude:  longitude.Float64,
+			SeenCount:  locationSeenCount.Int64,
+			Telemetry:  telemetry.telemetry(),
+			Screening:  screening.screening(),
+		}
+
+		if keyID.Valid {
+			device.LastLocation.Encrypted = &model.EncryptedCoordinates{
+				KeyID: keyID.String,
+				Data:  coordinates,
+			}
+		}
+	}
+
+	return &device, nil
+}
@@ -0,0 +1,173 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"dwimc/internal/encryption"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+)
+
+// sqlite_reencrypt_batch_size locations are rewritten per transaction, keeping the database available meanwhile
+const sqlite_reencrypt_batch_size = 500
+
+type SqliteEncryptionRepository struct {
+	db     *sql.DB
+	cipher coordinatesCipher
+}
+
+func NewSqliteEncryptionRepository(db *sql.DB, keyring *encryption.Keyring) EncryptionRepository {
+	return &SqliteEncryptionRepository{
+		db:     db,
+		cipher: coordinatesCipher{keyring: keyring},
+	}
+}
+
+func (r *SqliteEncryptionRepository) KeyIDs(ctx context.Context) ([]string, error) {
+	rows, err := sqlExecutorFrom(ctx, r.db).QueryContext(
+		ctx,
+		`SELECT DISTINCT key_id FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE key_id IS NOT NULL
+		ORDER BY key_id`,
+	)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer rows.Close()
+
+	keyIDs := []string{}
+	for rows.Next() {
+		var keyID string
+		if err := rows.Scan(&keyID); err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		keyIDs = append(keyIDs, keyID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return keyIDs, nil
+}
+
+// Reencrypt rewrites the locations in batches by id, devices read their last location from the locations table
+func (r *SqliteEncryptionRepository) Reencrypt(ctx context.Context, decrypt bool) (int64, error) {
+	if !decrypt && !r.cipher.enabled() {
+		return 0, utils.AsError(ErrMissingEncryptionKey, "no active key")
+	}
+
+	var rewritten int64
+	after := ""
+
+	for {
+		locations, err := r.pending(ctx, after, decrypt)
+		if err != nil {
+			return rewritten, err
+		}
+
+		if len(locations) == 0 {
+			return rewritten, nil
+		}
+
+		err = NewSqlTransactor(r.db).WithTransaction(ctx, func(ctx context.Context) error {
+			for _, location := range locations {
+				// a location rewritten meanwhile is left as is
+				currentKeyID, _ := sqliteEncryptedColumns(location)
+
+				if err := r.cipher.open(&location); err != nil {
+					return err
+				}
+
+				stored := location
+				if !decrypt {
+					sealed, err := r.cipher.seal(location)
+					if err != nil {
+						return err
+					}
+
+					stored = sealed
+				}
+
+				keyID, coordinates := sqliteEncryptedColumns(stored)
+
+				result, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+					ctx,
+					`UPDATE `+TABLE_NAME_LOCATIONS+`
+					SET latitude = ?, longitude = ?, key_id = ?, coordinates = ?
+					WHERE id = ? AND key_id IS ?`,
+					stored.Latitude,
+					stored.Longitude,
+					keyID,
+					coordinates,
+					location.ID.Hex(),
+					currentKeyID,
+				)
+				if err != nil {
+					return utils.AsError(model.ErrDatabase, err.Error())
+				}
+
+				affected, err := result.RowsAffected()
+				if err != nil {
+					return utils.AsError(model.ErrDatabase, err.Error())
+				}
+
+				rewritten += affected
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			return rewritten, err
+		}
+
+		after = locations[len(locations)-1].ID.Hex()
+	}
+}
+
+// pending returns the next batch of locations to rewrite, ordered by id
+func (r *SqliteEncryptionRepository) pending(ctx context.Context, after string, decrypt bool) ([]model.Location, error) {
+	condition := `key_id IS NOT NULL`
+	args := []any{after}
+
+	if !decrypt {
+		condition = `(key_id IS NULL OR key_id <> ?)`
+		args = append(args, r.cipher.keyring.ActiveKeyID())
+	}
+
+	args = append(args, sqlite_reencrypt_batch_size)
+
+	rows, err := sqlExecutorFrom(ctx, r.db).QueryContext(
+		ctx,
+		`SELECT `+sqlite_location_columns+`
+		FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE id > ? AND `+condition+`
+		ORDER BY id
+		LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer rows.Close()
+
+	locations := []model.Location{}
+	for rows.Next() {
+		location, err := scanSqliteLocation(rows)
+		if err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		locations = append(locations, *location)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return locations, nil
+}
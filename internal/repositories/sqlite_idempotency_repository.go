@@ -0,0 +1,179 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const TABLE_NAME_IDEMPOTENCY_KEYS = "idempotency_keys"
+
+type SqliteIdempotencyRepository struct {
+	db *sql.DB
+}
+
+func NewSqliteIdempotencyRepository(db *sql.DB) IdempotencyRepository {
+	return &SqliteIdempotencyRepository{
+		db: db,
+	}
+}
+
+func (r *SqliteIdempotencyRepository) Reserve(ctx context.Context, key model.IdempotencyKey) (*model.IdempotencyKey, error) {
+	header, err := json.Marshal(key.Header)
+	if err != nil {
+		return nil, utils.AsError(model.ErrInternal, err.Error())
+	}
+
+	executor := sqlExecutorFrom(ctx, r.db)
+
+	// replaces an expired key only, nothing is written while a live one exists
+	result, err := executor.ExecContext(
+		ctx,
+		`INSERT INTO `+TABLE_NAME_IDEMPOTENCY_KEYS+`
+		(id, request_hash, status_code, header, body, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET
+			request_hash = excluded.request_hash,
+			status_code = excluded.status_code,
+			header = excluded.header,
+			body = excluded.body,
+			created_at = excluded.created_at,
+			expires_at = excluded.expires_at
+		WHERE `+TABLE_NAME_IDEMPOTENCY_KEYS+`.expires_at <= excluded.created_at`,
+		key.Key,
+		key.RequestHash,
+		key.StatusCode,
+		string(header),
+		key.Body,
+		key.CreatedAt.UnixMilli(),
+		key.ExpiresAt.UnixMilli(),
+	)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	reserved, err := result.RowsAffected()
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if reserved > 0 {
+		return nil, nil
+	}
+
+	existing, err := scanSqliteIdempotencyKey(executor.QueryRowContext(
+		ctx,
+		`SELECT id, request_hash, status_code, header, body, created_at, expires_at
+		FROM `+TABLE_NAME_IDEMPOTENCY_KEYS+`
+		WHERE id = ?`,
+		key.Key,
+	))
+	if err != nil {
+		// released meanwhile
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.AsError(model.ErrItemConflict, "idempotency key is in use")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return existing, nil
+}
+
+func (r *SqliteIdempotencyRepository) Complete(ctx context.Context, key model.IdempotencyKey) error {
+	header, err := json.Marshal(key.Header)
+	if err != nil {
+		return utils.AsError(model.ErrInternal, err.Error())
+	}
+
+	result, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`UPDATE `+TABLE_NAME_IDEMPOTENCY_KEYS+`
+		SET request_hash = ?, status_code = ?, header = ?, body = ?, created_at = ?, expires_at = ?
+		WHERE id = ?`,
+		key.RequestHash,
+		key.StatusCode,
+		string(header),
+		key.Body,
+		key.CreatedAt.UnixMilli(),
+		key.ExpiresAt.UnixMilli(),
+		key.Key,
+	)
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if updated == 0 {
+		return utils.AsError(model.ErrItemNotFound, "idempotency key not found")
+	}
+
+	return nil
+}
+
+func (r *SqliteIdempotencyRepository) Release(ctx context.Context, key string) error {
+	if _, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_IDEMPOTENCY_KEYS+` WHERE id = ?`,
+		key,
+	); err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return nil
+}
+
+func (r *SqliteIdempotencyRepository) DeleteExpired(ctx context.Context, before time.Time) (int64, error) {
+	result, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_IDEMPOTENCY_KEYS+` WHERE expires_at <= ?`,
+		before.UnixMilli(),
+	)
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return deleted, nil
+}
+
+func scanSqliteIdempotencyKey(row rowScanner) (*model.IdempotencyKey, error) {
+	var key model.IdempotencyKey
+	var header sql.NullString
+	var createdAt, expiresAt int64
+
+	if err := row.Scan(
+		&key.Key,
+		&key.RequestHash,
+		&key.StatusCode,
+		&header,
+		&key.Body,
+		&createdAt,
+		&expiresAt,
+	); err != nil {
+		return nil, err
+	}
+
+	if header.Valid {
+		if err := json.Unmarshal([]byte(header.String), &key.Header); err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+	}
+
+	key.CreatedAt = time.UnixMilli(createdAt).UTC()
+	key.ExpiresAt = time.UnixMilli(expiresAt).UTC()
+
+	return &key, nil
+}
@@ -0,0 +1,826 @@
+package repositories
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"dwimc/internal/encryption"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const TABLE_NAME_LOCATIONS = "locations"
+
+// sqlite_location_columns are read by scanSqliteLocation
+const sqlite_location_columns = `id, created_at, updated_at, recorded_at, device_id, latitude, longitude, deleted_at,
+	key_id, coordinates, seen_count, ` + sql_telemetry_columns + `, ` + sql_screening_columns
+
+type SqliteLocationRepository struct {
+	db     *sql.DB
+	cipher coordinatesCipher
+}
+
+// NewSqliteLocationRepository encrypts the stored coordinates when given a keyring
+func NewSqliteLocationRepository(db *sql.DB, keyring *encryption.Keyring) LocationRepository {
+	return &SqliteLocationRepository{
+		db:     db,
+		cipher: coordinatesCipher{keyring: keyring},
+	}
+}
+
+func (r *SqliteLocationRepository) GetAllByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) ([]model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	locations := []model.Location{}
+
+	rows, err := sqlExecutorFrom(ctx, r.db).QueryContext(
+		ctx,
+		`SELECT `+sqlite_location_columns+`
+		FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE device_id = ? AND deleted_at IS NULL
+			AND `+sqlite_location_filter+`
+		ORDER BY recorded_at, id`,
+		append([]any{objectID.Hex()}, sqliteLocationFilterArgs(filter)...)...,
+	)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		location, err := scanSqliteLocation(rows)
+		if err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		locations = append(locations, *location)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if err := r.cipher.openAll(locations); err != nil {
+		return nil, err
+	}
+
+	return locations, nil
+}
+
+func (r *SqliteLocationRepository) GetLatestByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) (*model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	location, err := scanSqliteLocation(sqlExecutorFrom(ctx, r.db).QueryRowContext(
+		ctx,
+		`SELECT `+sqlite_location_columns+`
+		FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE device_id = ? AND deleted_at IS NULL AND rejected = 0
+			AND `+sqlite_location_filter+`
+		ORDER BY recorded_at DESC, id DESC
+		LIMIT 1`,
+		append([]any{objectID.Hex()}, sqliteLocationFilterArgs(filter)...)...,
+	))
+
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, utils.AsError(model.ErrItemNotFound, "device not found")
+		}
+
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if err := r.cipher.open(location); err != nil {
+		return nil, err
+	}
+
+	return location, nil
+}
+
+func (r *SqliteLocationRepository) Create(
+	ctx context.Context,
+	deviceID string,
+	latitude float64,
+	longitude float64,
+	recordedAt time.Time,
+	telemetry model.Telemetry,
+	screening model.Screening,
+) (*model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	created := time.Now().UTC().Truncate(time.Millisecond)
+	location := &model.Location{
+		ID:         bson.NewObjectID(),
+		CreatedAt:  created,
+		UpdatedAt:  created,
+		RecordedAt: cmp.Or(recordedAt, created),
+		DeviceID:   objectID,
+		Latitude:   latitude,
+		Longitude:  longitude,
+		SeenCount:  1,
+		Telemetry:  telemetry,
+		Screening:  screening,
+	}
+
+	stored, err := r.cipher.seal(*location)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, coordinates := sqliteEncryptedColumns(stored)
+
+	if _, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`INSERT INTO `+TABLE_NAME_LOCATIONS+`
+		(id, created_at, updated_at, recorded_at, device_id, latitude, longitude, key_id, coordinates, seen_count,
+			`+sql_telemetry_columns+`, `+sql_screening_columns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		slices.Concat([]any{
+			location.ID.Hex(),
+			location.CreatedAt.UnixMilli(),
+			location.UpdatedAt.UnixMilli(),
+			location.RecordedAt.UnixMilli(),
+			location.DeviceID.Hex(),
+			stored.Latitude,
+			stored.Longitude,
+			keyID,
+			coordinates,
+			location.SeenCount,
+		}, sqlTelemetryArgs(location.Telemetry), sqlScreeningArgs(location.Screening))...,
+	); err != nil {
+		return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	return location, nil
+}
+
+func (r *SqliteLocationRepository) CreateMany(
+	ctx context.Context,
+	deviceID string,
+	locations []model.Location,
+) ([]model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	if len(locations) == 0 {
+		return []model.Location{}, nil
+	}
+
+	created := time.Now().UTC().Truncate(time.Millisecond)
+	createdLocations := make([]model.Location, 0, len(locations))
+	stored := make([]model.Location, 0, len(locations))
+
+	for _, params := range locations {
+		location := model.Location{
+			ID:         bson.NewObjectID(),
+			CreatedAt:  created,
+			UpdatedAt:  created,
+			RecordedAt: cmp.Or(params.RecordedAt, created),
+			DeviceID:   objectID,
+			Latitude:   params.Latitude,
+			Longitude:  params.Longitude,
+			SeenCount:  max(params.SeenCount, 1),
+			Telemetry:  params.Telemetry,
+			Screening:  params.Screening,
+		}
+
+		sealed, err := r.cipher.seal(location)
+		if err != nil {
+			return nil, err
+		}
+
+		createdLocations = append(createdLocations, location)
+		stored = append(stored, sealed)
+	}
+
+	rows := make([]string, 0, len(createdLocations))
+	args := make([]any, 0, 18*len(createdLocations))
+
+	for i, location := range createdLocations {
+		keyID, coordinates := sqliteEncryptedColumns(stored[i])
+
+		rows = append(rows, `(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		args = append(args, slices.Concat([]any{
+			location.ID.Hex(),
+			location.CreatedAt.UnixMilli(),
+			location.UpdatedAt.UnixMilli(),
+			location.RecordedAt.UnixMilli(),
+			location.DeviceID.Hex(),
+			stored[i].Latitude,
+			stored[i].Longitude,
+			keyID,
+			coordinates,
+			location.SeenCount,
+		}, sqlTelemetryArgs(location.Telemetry), sqlScreeningArgs(location.Screening))...)
+	}
+
+	if _, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`INSERT INTO `+TABLE_NAME_LOCATIONS+`
+		(id, created_at, updated_at, recorded_at, device_id, latitude, longitude, key_id, coordinates, seen_count,
+			`+sql_telemetry_columns+`, `+sql_screening_columns+`)
+		VALUES `+strings.Join(rows, ", "),
+		args...,
+	); err != nil {
+		return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	return createdLocations, nil
+}
+
+func (r *SqliteLocationRepository) SoftDelete(ctx context.Context, deviceID string, id string, deletedAt time.Time) (bool, error) {
+	return r.setDeletedAt(ctx, deviceID, id, sql.Null[int64]{V: deletedAt.UnixMilli(), Valid: true})
+}
+
+func (r *SqliteLocationRepository) SoftDeleteAllByDevice(ctx context.Context, deviceID string, deletedAt time.Time) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	return r.exec(
+		ctx,
+		`UPDATE `+TABLE_NAME_LOCATIONS+`
+		SET deleted_at = ?
+		WHERE device_id = ? AND deleted_at IS NULL`,
+		deletedAt.UnixMilli(),
+		objectID.Hex(),
+	)
+}
+
+func (r *SqliteLocationRepository) GetDeletedByDevice(ctx context.Context, deviceID string) ([]model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	return r.query(
+		ctx,
+		`SELECT `+sqlite_location_columns+`
+		FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE device_id = ? AND deleted_at IS NOT NULL
+		ORDER BY id`,
+		objectID.Hex(),
+	)
+}
+
+func (r *SqliteLocationRepository) Restore(ctx context.Context, deviceID string, id string) (bool, error) {
+	return r.setDeletedAt(ctx, deviceID, id, sql.Null[int64]{})
+}
+
+func (r *SqliteLocationRepository) RestoreAllByDevice(ctx context.Context, deviceID string, deletedAt *time.Time) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	// without a time, restores all of the device locations in the trash
+	var at sql.Null[int64]
+	if deletedAt != nil {
+		at = sql.Null[int64]{V: deletedAt.UnixMilli(), Valid: true}
+	}
+
+	return r.exec(
+		ctx,
+		`UPDATE `+TABLE_NAME_LOCATIONS+`
+		SET deleted_at = NULL
+		WHERE device_id = ? AND deleted_at IS NOT NULL AND (? IS NULL OR deleted_at = ?)`,
+		objectID.Hex(),
+		at,
+		at,
+	)
+}
+
+func (r *SqliteLocationRepository) PurgeDeleted(ctx context.Context, before time.Time) (int64, error) {
+	return r.exec(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_LOCATIONS+` WHERE deleted_at < ?`,
+		before.UnixMilli(),
+	)
+}
+
+func (r *SqliteLocationRepository) Refresh(
+	ctx context.Context,
+	deviceID string,
+	id string,
+	updatedAt time.Time,
+	count int64,
+) (*model.Location, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	locations, err := r.query(
+		ctx,
+		`UPDATE `+TABLE_NAME_LOCATIONS+`
+		SET updated_at = ?, seen_count = seen_count + ?
+		WHERE id = ? AND device_id = ? AND deleted_at IS NULL
+		RETURNING `+sqlite_location_columns,
+		updatedAt.UnixMilli(),
+		count,
+		objectID.Hex(),
+		deviceOID.Hex(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(locations) == 0 {
+		return nil, utils.AsError(model.ErrItemNotFound, "location not found")
+	}
+
+	return &locations[0], nil
+}
+
+// setDeletedAt moves the location in or out of the trash, null restores it.
+func (r *SqliteLocationRepository) setDeletedAt(ctx context.Context, deviceID string, id string, deletedAt sql.Null[int64]) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	// only a change of state counts
+	updated, err := r.exec(
+		ctx,
+		`UPDATE `+TABLE_NAME_LOCATIONS+`
+		SET deleted_at = ?
+		WHERE id = ? AND device_id = ? AND (deleted_at IS NULL) <> (? IS NULL)`,
+		deletedAt,
+		objectID.Hex(),
+		deviceOID.Hex(),
+		deletedAt,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return updated > 0, nil
+}
+
+func (r *SqliteLocationRepository) Delete(ctx context.Context, deviceID string, id string) (bool, error) {
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", id),
+		)
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return false, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	deleted, err := r.exec(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_LOCATIONS+` WHERE id = ? AND device_id = ?`,
+		objectID.Hex(),
+		deviceOID.Hex(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	return deleted > 0, nil
+}
+
+func (r *SqliteLocationRepository) DeleteAllByDevice(ctx context.Context, deviceID string) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	return r.exec(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_LOCATIONS+` WHERE device_id = ?`,
+		objectID.Hex(),
+	)
+}
+
+func (r *SqliteLocationRepository) DeleteOldByDevice(ctx context.Context, deviceID string, skip int) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	// deletes all locations recorded before the newest ones to keep (by number of skip / limit),
+	// a single statement so concurrent trims can't delete more than needed,
+	// the latest location is kept, same as GetLatestByDevice, even when newer ones were rejected
+	return r.exec(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE device_id = ? AND id NOT IN (
+			SELECT id FROM `+TABLE_NAME_LOCATIONS+`
+			WHERE device_id = ?
+			ORDER BY recorded_at DESC, id DESC
+			LIMIT ?
+		) AND id IS NOT (
+			SELECT id FROM `+TABLE_NAME_LOCATIONS+`
+			WHERE device_id = ? AND deleted_at IS NULL AND rejected = 0
+			ORDER BY recorded_at DESC, id DESC
+			LIMIT 1
+		)`,
+		objectID.Hex(),
+		objectID.Hex(),
+		skip,
+		objectID.Hex(),
+	)
+}
+
+func (r *SqliteLocationRepository) DeleteExpiredByDevice(ctx context.Context, deviceID string, before time.Time) (int64, error) {
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return 0, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	// the latest location is kept, same as GetLatestByDevice, even when all of the others were rejected
+	return r.exec(
+		ctx,
+		`DELETE FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE device_id = ? AND recorded_at < ? AND id IS NOT (
+			SELECT id FROM `+TABLE_NAME_LOCATIONS+`
+			WHERE device_id = ? AND deleted_at IS NULL AND rejected = 0
+			ORDER BY recorded_at DESC, id DESC
+			LIMIT 1
+		)`,
+		objectID.Hex(),
+		before.UnixMilli(),
+		objectID.Hex(),
+	)
+}
+
+func (r *SqliteLocationRepository) GetDeviceIDs(ctx context.Context) ([]string, error) {
+	rows, err := sqlExecutorFrom(ctx, r.db).QueryContext(
+		ctx,
+		`SELECT DISTINCT device_id FROM `+TABLE_NAME_LOCATIONS,
+	)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer rows.Close()
+
+	deviceIDs := []string{}
+	for rows.Next() {
+		var deviceID string
+		if err := rows.Scan(&deviceID); err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		deviceIDs = append(deviceIDs, deviceID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return deviceIDs, nil
+}
+
+// GetNear filters by a bounding box and then by the exact distance, sqlite has no spatial functions
+func (r *SqliteLocationRepository) GetNear(ctx context.Context, center model.Coordinates, maxDistance float64) ([]model.Location, error) {
+	if err := r.cipher.refuseSpatial(); err != nil {
+		return nil, err
+	}
+
+	sw, ne := model.NearBounds(center, maxDistance)
+
+	candidates, err := r.query(
+		ctx,
+		`SELECT `+sqlite_location_columns+`
+		FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE deleted_at IS NULL
+			AND latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ?`,
+		sw.Latitude,
+		ne.Latitude,
+		sw.Longitude,
+		ne.Longitude,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	locations := []model.Location{}
+	for _, location := range candidates {
+		if center.DistanceTo(location.Coordinates()) <= maxDistance {
+			locations = append(locations, location)
+		}
+	}
+
+	sortByDistance(center, locations)
+
+	return locations, nil
+}
+
+// GetWithinPolygon filters by the polygon bounds and then by the polygon itself
+func (r *SqliteLocationRepository) GetWithinPolygon(ctx context.Context, polygon model.Polygon) ([]model.Location, error) {
+	if err := r.cipher.refuseSpatial(); err != nil {
+		return nil, err
+	}
+
+	sw, ne := polygon.Bounds()
+
+	candidates, err := r.query(
+		ctx,
+		`SELECT `+sqlite_location_columns+`
+		FROM `+TABLE_NAME_LOCATIONS+`
+		WHERE deleted_at IS NULL
+			AND latitude BETWEEN ? AND ? AND longitude BETWEEN ? AND ?
+		ORDER BY id`,
+		sw.Latitude,
+		ne.Latitude,
+		sw.Longitude,
+		ne.Longitude,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	locations := []model.Location{}
+	for _, location := range candidates {
+		if polygon.Contains(location.Coordinates()) {
+			locations = append(locations, location)
+		}
+	}
+
+	return locations, nil
+}
+
+func (r *SqliteLocationRepository) Import(ctx context.Context, location model.Location) (*model.Location, error) {
+	imported, err := r.ImportMany(ctx, []model.Location{location})
+	if err != nil {
+		return nil, err
+	}
+
+	return &imported[0], nil
+}
+
+func (r *SqliteLocationRepository) ImportMany(ctx context.Context, locations []model.Location) ([]model.Location, error) {
+	if len(locations) == 0 {
+		return []model.Location{}, nil
+	}
+
+	imported := make([]model.Location, 0, len(locations))
+	rows := make([]string, 0, len(locations))
+	args := make([]any, 0, 19*len(locations))
+
+	for _, location := range locations {
+		location.SeenCount = max(location.SeenCount, 1)
+
+		var deletedAt sql.NullInt64
+		if location.DeletedAt != nil {
+			deletedAt = sql.NullInt64{Int64: location.DeletedAt.UnixMilli(), Valid: true}
+		}
+
+		stored, err := r.cipher.seal(location)
+		if err != nil {
+			return nil, err
+		}
+
+		keyID, coordinates := sqliteEncryptedColumns(stored)
+
+		rows = append(rows, `(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+		args = append(args, slices.Concat([]any{
+			location.ID.Hex(),
+			location.CreatedAt.UnixMilli(),
+			location.UpdatedAt.UnixMilli(),
+			location.RecordedAt.UnixMilli(),
+			location.DeviceID.Hex(),
+			stored.Latitude,
+			stored.Longitude,
+			deletedAt,
+			keyID,
+			coordinates,
+			location.SeenCount,
+		}, sqlTelemetryArgs(location.Telemetry), sqlScreeningArgs(location.Screening))...)
+
+		imported = append(imported, location)
+	}
+
+	if _, err := sqlExecutorFrom(ctx, r.db).ExecContext(
+		ctx,
+		`INSERT INTO `+TABLE_NAME_LOCATIONS+`
+		(id, created_at, updated_at, recorded_at, device_id, latitude, longitude, deleted_at, key_id, coordinates,
+			seen_count, `+sql_telemetry_columns+`, `+sql_screening_columns+`)
+		VALUES `+strings.Join(rows, ", ")+`
+		ON CONFLICT (id) DO UPDATE SET
+			created_at = excluded.created_at,
+			updated_at = excluded.updated_at,
+			recorded_at = excluded.recorded_at,
+			device_id = excluded.device_id,
+			latitude = excluded.latitude,
+			longitude = excluded.longitude,
+			deleted_at = excluded.deleted_at,
+			key_id = excluded.key_id,
+			coordinates = excluded.coordinates,
+			seen_count = excluded.seen_count,
+			accuracy = excluded.accuracy,
+			altitude = excluded.altitude,
+			speed = excluded.speed,
+			bearing = excluded.bearing,
+			battery = excluded.battery,
+			provider = excluded.provider,
+			outlier = excluded.outlier,
+			rejected = excluded.rejected`,
+		args...,
+	); err != nil {
+		return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	return imported, nil
+}
+
+func (r *SqliteLocationRepository) query(ctx context.Context, query string, args ...any) ([]model.Location, error) {
+	rows, err := sqlExecutorFrom(ctx, r.db).QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer rows.Close()
+
+	locations := []model.Location{}
+	for rows.Next() {
+		location, err := scanSqliteLocation(rows)
+		if err != nil {
+			return nil, utils.AsError(model.ErrDatabase, err.Error())
+		}
+
+		locations = append(locations, *location)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if err := r.cipher.openAll(locations); err != nil {
+		return nil, err
+	}
+
+	return locations, nil
+}
+
+func (r *SqliteLocationRepository) exec(ctx context.Context, query string, args ...any) (int64, error) {
+	result, err := sqlExecutorFrom(ctx, r.db).ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return affected, nil
+}
+
+func scanSqliteLocation(row rowScanner) (*model.Location, error) {
+	var location model.Location
+	var id, deviceID string
+	var createdAt, updatedAt, recordedAt int64
+	var deletedAt sql.NullInt64
+	var keyID sql.NullString
+	var coordinates []byte
+	var telemetry sqlTelemetry
+	var screening sqlScreening
+
+	if err := row.Scan(slices.Concat([]any{
+		&id,
+		&createdAt,
+		&updatedAt,
+		&recordedAt,
+		&deviceID,
+		&location.Latitude,
+		&location.Longitude,
+		&deletedAt,
+		&keyID,
+		&coordinates,
+		&location.SeenCount,
+	}, telemetry.dest(), screening.dest())...); err != nil {
+		return nil, err
+	}
+
+	objectID, err := bson.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	deviceOID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	location.ID = objectID
+	location.DeviceID = deviceOID
+	location.CreatedAt = time.UnixMilli(createdAt).UTC()
+	location.UpdatedAt = time.UnixMilli(updatedAt).UTC()
+	location.RecordedAt = time.UnixMilli(recordedAt).UTC()
+	location.Telemetry = telemetry.telemetry()
+	location.Screening = screening.screening()
+
+	if deletedAt.Valid {
+		deletedTime := time.UnixMilli(deletedAt.Int64).UTC()
+		location.DeletedAt = &deletedTime
+	}
+
+	// decrypted by the repository, see coordinatesCipher
+	if keyID.Valid {
+		location.Encrypted = &model.EncryptedCoordinates{
+			KeyID: keyID.String,
+			Data:  coordinates,
+		}
+	}
+
+	return &location, nil
+}
+
+// sqlite_location_filter matches the locations of a model.LocationFilter, see sqliteLocationFilterArgs
+const sqlite_location_filter = `(? IS NULL OR accuracy IS NULL OR accuracy <= ?)`
+
+func sqliteLocationFilterArgs(filter model.LocationFilter) []any {
+	maxAccuracy := pointerToNull(filter.MaxAccuracy)
+
+	return []any{maxAccuracy, maxAccuracy}
+}
+
+// sqliteEncryptedColumns returns the key id and coordinates columns of a stored location, null when plain
+func sqliteEncryptedColumns(location model.Location) (sql.NullString, []byte) {
+	if location.Encrypted == nil {
+		return sql.NullString{}, nil
+	}
+
+	return sql.NullString{String: location.Encrypted.KeyID, Valid: true}, location.Encrypted.Data
+}
@@ -0,0 +1,155 @@
+package repositories
+
+import (
+	"context"
+	"database/sql"
+	"dwimc/internal/model"
+	"dwimc/internal/utils"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+)
+
+// Transactor runs a function atomically,
+// repositories called with the function's context are part of the transaction.
+type Transactor interface {
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
+type MongodbTransactor struct {
+	client    *mongo.Client
+	supported bool
+}
+
+// NewMongodbTransactor checks whether transactions are supported by the deployment,
+// a standalone server does not support them.
+func NewMongodbTransactor(ctx context.Context, client *mongo.Client) (Transactor, error) {
+	var hello struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+
+	if err := client.Database("admin").RunCommand(
+		ctx,
+		bson.D{{Key: "hello", Value: 1}},
+	).Decode(&hello); err != nil {
+		return nil, utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	// replica set members report their set name, mongos routers report isdbgrid
+	supported := len(hello.SetName) > 0 || hello.Msg == "isdbgrid"
+	if !supported {
+		log.Warn().Msg("Mongodb transactions are not supported by a standalone server, " +
+			"multi-document operations will not be atomic, " +
+			"devices partially deleted or restored are cleaned up on the next start, " +
+			"run mongodb as a (single member) replica set for atomic operations")
+	}
+
+	return &MongodbTransactor{
+		client:    client,
+		supported: supported,
+	}, nil
+}
+
+func (t *MongodbTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	// already part of a transaction, or transactions are not available
+	if mongo.SessionFromContext(ctx) != nil || !t.supported {
+		return fn(ctx)
+	}
+
+	session, err := t.client.StartSession()
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx context.Context) (any, error) {
+		return nil, fn(ctx)
+	})
+
+	return err
+}
+
+type sqlTransactionKey struct{}
+
+type SqlTransactor struct {
+	db *sql.DB
+}
+
+func NewSqlTransactor(db *sql.DB) Transactor {
+	return &SqlTransactor{db: db}
+}
+
+func (t *SqlTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if _, ok := ctx.Value(sqlTransactionKey{}).(*sql.Tx); ok {
+		return fn(ctx)
+	}
+
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	if err := fn(context.WithValue(ctx, sqlTransactionKey{}, tx)); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			log.Warn().Err(rollbackErr).Msg("Failed to rollback transaction")
+		}
+
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return utils.AsError(model.ErrDatabase, err.Error())
+	}
+
+	return nil
+}
+
+// sqlExecutor is implemented by both *sql.DB and *sql.Tx
+type sqlExecutor interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// sqlExecutorFrom returns the transaction the context is part of, or the database itself
+func sqlExecutorFrom(ctx context.Context, db *sql.DB) sqlExecutor {
+	if tx, ok := ctx.Value(sqlTransactionKey{}).(*sql.Tx); ok {
+		return tx
+	}
+
+	return db
+}
+
+type MemoryTransactor struct {
+	store *MemoryStore
+}
+
+func NewMemoryTransactor(store *MemoryStore) Transactor {
+	return &MemoryTransactor{store: store}
+}
+
+// WithTransaction holds the store lock for the whole function,
+// reverting its writes when it fails.
+func (t *MemoryTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	if t.store.inTransaction(ctx) {
+		return fn(ctx)
+	}
+
+	t.store.mutex.Lock()
+	defer t.store.mutex.Unlock()
+
+	// reverted unless committed, also when the function panics
+	t.store.begin()
+	defer t.store.rollback()
+
+	if err := fn(context.WithValue(ctx, memoryTransactionKey{}, t.store)); err != nil {
+		return err
+	}
+
+	t.store.commit()
+
+	return nil
+}
@@ -0,0 +1,458 @@
+package services
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"dwimc/internal/model"
+	"dwimc/internal/repositories"
+	"dwimc/internal/utils"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// BACKUP_FORMAT and BACKUP_VERSION identify the archive, bump the version on incompatible changes
+const BACKUP_FORMAT = "dwimc-backup"
+const BACKUP_VERSION = 1
+
+// restore_batch_size is the number of locations restored at once
+const restore_batch_size = 500
+
+type RestoreMode string
+
+const (
+	// RestoreModeMerge keeps the existing data, upserting the archive items by their ids
+	RestoreModeMerge RestoreMode = "merge"
+	// RestoreModeReplace deletes all existing data before restoring the archive
+	RestoreModeReplace RestoreMode = "replace"
+)
+
+// BackupHeader is the first line of an archive
+type BackupHeader struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BackupRecord is every following line of an archive, holding either a device or a location.
+// A device is followed by all of its locations, including the ones in the trash.
+type BackupRecord struct {
+	Device   *model.Device   `json:"device,omitempty"`
+	Location *model.Location `json:"location,omitempty"`
+}
+
+type BackupStats struct {
+	Devices   int64 `json:"devices"`
+	Locations int64 `json:"locations"`
+	// Skipped counts devices not restored along with their locations
+	Skipped int64 `json:"skipped"`
+}
+
+type BackupService interface {
+	// Backup writes all devices and locations as gzip compressed NDJSON, one device at a time.
+	// The coordinates are written in plain, also when they are stored encrypted.
+	Backup(ctx context.Context, w io.Writer) (*BackupStats, error)
+	// Restore reads an archive written by Backup in batches, each one all or nothing where transactions
+	// are supported. Every item is upserted by its id, so a failed restore can be run again.
+	// The replace mode reads the whole archive first, deleting the existing data only when it is valid.
+	Restore(ctx context.Context, r io.Reader, mode RestoreMode) (*BackupStats, error)
+}
+
+type DefaultBackupService struct {
+	deviceRepo   repositories.DeviceRepository
+	locationRepo repositories.LocationRepository
+	transactor   repositories.Transactor
+}
+
+func NewDefaultBackupService(
+	deviceRepo repositories.DeviceRepository,
+	locationRepo repositories.LocationRepository,
+	transactor repositories.Transactor,
+) BackupService {
+	return &DefaultBackupService{
+		deviceRepo:   deviceRepo,
+		locationRepo: locationRepo,
+		transactor:   transactor,
+	}
+}
+
+func (s *DefaultBackupService) Backup(ctx context.Context, w io.Writer) (*BackupStats, error) {
+	stats := &BackupStats{}
+
+	gz := gzip.NewWriter(w)
+	encoder := json.NewEncoder(gz)
+
+	if err := encoder.Encode(BackupHeader{
+		Format:    BACKUP_FORMAT,
+		Version:   BACKUP_VERSION,
+		CreatedAt: time.Now().UTC(),
+	}); err != nil {
+		return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	devices, err := s.deviceRepo.GetAll(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := s.deviceRepo.GetAllDeleted(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, device := range append(devices, deleted...) {
+		var locations []model.Location
+
+		// a transaction reads a consistent snapshot of the device locations where supported,
+		// they are written out before reading the next device
+		err := s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+			var err error
+			locations, err = s.getAllLocations(ctx, device.ID.Hex())
+			return err
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := encoder.Encode(BackupRecord{Device: &device}); err != nil {
+			return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+		}
+
+		for _, location := range locations {
+			if err := encoder.Encode(BackupRecord{Location: &location}); err != nil {
+				return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+			}
+		}
+
+		stats.Devices++
+		stats.Locations += int64(len(locations))
+	}
+
+	if err := gz.Close(); err != nil {
+		return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+	}
+
+	return stats, nil
+}
+
+// getAllLocations returns the device locations in and out of the trash, oldest first
+func (s *DefaultBackupService) getAllLocations(ctx context.Context, deviceID string) ([]model.Location, error) {
+	locations, err := s.locationRepo.GetAllByDevice(ctx, deviceID, model.LocationFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	deleted, err := s.locationRepo.GetDeletedByDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	locations = append(locations, deleted...)
+	slices.SortFunc(locations, func(a, b model.Location) int {
+		return bytes.Compare(a.ID[:], b.ID[:])
+	})
+
+	return locations, nil
+}
+
+func (s *DefaultBackupService) Restore(ctx context.Context, r io.Reader, mode RestoreMode) (*BackupStats, error) {
+	if mode != RestoreModeMerge && mode != RestoreModeReplace {
+		return nil, utils.AsError(model.ErrInvalidArgs, fmt.Sprintf("invalid restore mode: %s", mode))
+	}
+
+	if mode == RestoreModeReplace {
+		// the whole archive is checked before deleting anything, read again from a copy of it
+		spooled, err := os.CreateTemp("", "dwimc-restore-*")
+		if err != nil {
+			return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+		}
+
+		defer os.Remove(spooled.Name())
+		defer spooled.Close()
+
+		if err := readArchive(io.TeeReader(r, spooled), checkArchiveRecord()); err != nil {
+			return nil, err
+		}
+
+		if _, err := spooled.Seek(0, io.SeekStart); err != nil {
+			return nil, utils.AsError(model.ErrOperationFailed, err.Error())
+		}
+
+		if err := s.deleteAll(ctx); err != nil {
+			return nil, err
+		}
+
+		r = spooled
+	}
+
+	stats := &BackupStats{}
+	restorer := deviceRestorer{service: s, stats: stats}
+
+	err := readArchive(r, func(record BackupRecord) error {
+		switch {
+		case record.Device != nil:
+			if err := restorer.finish(ctx); err != nil {
+				return err
+			}
+
+			return restorer.start(ctx, *record.Device)
+
+		case record.Location != nil:
+			return restorer.add(ctx, *record.Location)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := restorer.finish(ctx); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// readArchive checks the archive header and passes each of its records to handle, in order
+func readArchive(r io.Reader, handle func(record BackupRecord) error) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return utils.AsError(model.ErrInvalidArgs, fmt.Sprintf("invalid archive: %s", err.Error()))
+	}
+
+	defer gz.Close()
+
+	decoder := json.NewDecoder(gz)
+
+	var header BackupHeader
+	if err := decoder.Decode(&header); err != nil {
+		return utils.AsError(model.ErrInvalidArgs, fmt.Sprintf("invalid archive header: %s", err.Error()))
+	}
+
+	if header.Format != BACKUP_FORMAT {
+		return utils.AsError(model.ErrInvalidArgs, fmt.Sprintf("unknown archive format: %s", header.Format))
+	}
+
+	if header.Version < 1 || header.Version > BACKUP_VERSION {
+		return utils.AsError(model.ErrInvalidArgs, fmt.Sprintf("unsupported archive version: %d", header.Version))
+	}
+
+	for {
+		var record BackupRecord
+
+		err := decoder.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return utils.AsError(model.ErrInvalidArgs, fmt.Sprintf("invalid archive record: %s", err.Error()))
+		}
+
+		if err := handle(record); err != nil {
+			return err
+		}
+	}
+}
+
+// checkArchiveRecord fails on the records a restore would fail on, without restoring them
+func checkArchiveRecord() func(record BackupRecord) error {
+	var deviceID *bson.ObjectID
+
+	return func(record BackupRecord) error {
+		switch {
+		case record.Device != nil:
+			deviceID = &record.Device.ID
+
+		case record.Location != nil:
+			if deviceID == nil || record.Location.DeviceID != *deviceID {
+				return locationOutOfOrder(*record.Location)
+			}
+		}
+
+		return nil
+	}
+}
+
+func locationOutOfOrder(location model.Location) error {
+	return utils.AsError(
+		model.ErrInvalidArgs,
+		fmt.Sprintf("location %s does not follow its device", location.ID.Hex()),
+	)
+}
+
+// deleteAll permanently removes all devices and locations, including the trash and orphans,
+// a device at a time along with its locations.
+func (s *DefaultBackupService) deleteAll(ctx context.Context) error {
+	devices, err := s.deviceRepo.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := s.deviceRepo.GetAllDeleted(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, device := range append(devices, deleted...) {
+		err := s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+			if _, err := s.locationRepo.DeleteAllByDevice(ctx, device.ID.Hex()); err != nil {
+				return err
+			}
+
+			_, err := s.deviceRepo.Delete(ctx, device.ID.Hex())
+			return err
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	deviceIDs, err := s.locationRepo.GetDeviceIDs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, deviceID := range deviceIDs {
+		if _, err := s.locationRepo.DeleteAllByDevice(ctx, deviceID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deviceRestorer restores a single device at a time, followed by its locations in batches
+type deviceRestorer struct {
+	service *DefaultBackupService
+	stats   *BackupStats
+	device  *model.Device
+	skipped bool
+	// pending are the device locations not restored yet, up to restore_batch_size
+	pending []model.Location
+	// lastLocation is the restored device last location
+	lastLocation *model.Location
+}
+
+func (r *deviceRestorer) start(ctx context.Context, device model.Device) error {
+	r.device = &device
+	r.skipped = false
+	r.pending = nil
+	r.lastLocation = nil
+
+	// archives written before devices were versioned
+	if device.Version < 1 {
+		device.Version = 1
+	}
+
+	err := r.service.deviceRepo.Import(ctx, device)
+	if err == nil {
+		r.stats.Devices++
+		return nil
+	}
+
+	// a device registered again under another id is kept as is
+	if errors.Is(err, model.ErrItemConflict) {
+		log.Warn().
+			Err(err).
+			Str("id", device.ID.Hex()).
+			Str("serial", device.Serial).
+			Msg("Skipped restoring device")
+
+		r.skipped = true
+		r.stats.Skipped++
+		return nil
+	}
+
+	return err
+}
+
+func (r *deviceRestorer) add(ctx context.Context, location model.Location) error {
+	if r.device == nil || location.DeviceID != r.device.ID {
+		return locationOutOfOrder(location)
+	}
+
+	if r.skipped {
+		return nil
+	}
+
+	// backed up before locations had a recorded time
+	location.RecordedAt = cmp.Or(location.RecordedAt, location.CreatedAt)
+
+	r.pending = append(r.pending, location)
+	if len(r.pending) < restore_batch_size {
+		return nil
+	}
+
+	return r.flush(ctx)
+}
+
+// flush restores the pending locations at once
+func (r *deviceRestorer) flush(ctx context.Context) error {
+	if len(r.pending) == 0 {
+		return nil
+	}
+
+	var restored []model.Location
+
+	// the transaction may run again, the restorer is updated once it's done
+	err := r.service.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		var err error
+		restored, err = r.service.locationRepo.ImportMany(ctx, r.pending)
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	for _, location := range restored {
+		if r.device.LastLocation != nil && r.device.LastLocation.ID == location.ID {
+			r.lastLocation = &location
+		}
+	}
+
+	r.stats.Locations += int64(len(restored))
+	r.pending = nil
+	return nil
+}
+
+// finish restores the remaining locations and sets the last location of the restored device,
+// same as it was when backed up or the latest one when it was not restored.
+func (r *deviceRestorer) finish(ctx context.Context) error {
+	if r.device == nil || r.skipped {
+		return nil
+	}
+
+	if err := r.flush(ctx); err != nil {
+		return err
+	}
+
+	lastLocation := r.lastLocation
+	if lastLocation != nil {
+		// the device holds its last location as it was before moving to the trash
+		lastLocation.DeletedAt = nil
+	} else {
+		latest, err := r.service.locationRepo.GetLatestByDevice(ctx, r.device.ID.Hex(), model.LocationFilter{})
+		if err != nil && !errors.Is(err, model.ErrItemNotFound) {
+			return err
+		}
+
+		lastLocation = latest
+	}
+
+	return r.service.deviceRepo.ReplaceLastLocation(ctx, r.device.ID.Hex(), lastLocation)
+}
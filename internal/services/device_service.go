@@ -1,77 +1,377 @@
 package services
 
 import (
+	"context"
 	"dwimc/internal/model"
 	"dwimc/internal/repositories"
+	"errors"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
 
+// DeviceService writes taking a version apply only to the device at that version,
+// 0 applies to any version, see repositories.DeviceRepository.
 type DeviceService interface {
-	GetAll() ([]model.Device, error)
-	Get(id string) (*model.Device, error)
-	Exists(id string) (bool, error)
-	Create(id, name string) (*model.Device, error)
-	Delete(id string) (bool, error)
+	GetAll(ctx context.Context) ([]model.Device, error)
+	Get(ctx context.Context, id string) (*model.Device, error)
+	GetBySerial(ctx context.Context, serial string) (*model.Device, error)
+	Exists(ctx context.Context, id string) (bool, error)
+	Create(ctx context.Context, id, name string, version int64) (*model.Device, error)
+	SetRetentionPeriod(ctx context.Context, id string, retentionPeriod int64, version int64) (*model.Device, error)
+	Delete(ctx context.Context, id string, version int64) (bool, int64, error)
+	GetAllDeleted(ctx context.Context) ([]model.Device, error)
+	Restore(ctx context.Context, id string) (*model.Device, error)
+	PurgeDeleted(ctx context.Context, before time.Time) (int64, int64, error)
+	DeleteOrphanedLocations(ctx context.Context) (int64, error)
+	DeleteExpiredLocations(ctx context.Context, defaultRetention time.Duration) (int64, error)
 }
 
 type DefaultDeviceService struct {
-	repo                 repositories.DeviceRepository
-	locationRepo         repositories.LocationRepository
+	repo         repositories.DeviceRepository
+	locationRepo repositories.LocationRepository
+	transactor   repositories.Transactor
+	events       EventBus
 }
 
 func NewDefaultDeviceService(
 	repo repositories.DeviceRepository,
 	locationRepo repositories.LocationRepository,
+	transactor repositories.Transactor,
+	events EventBus,
 ) DeviceService {
 	return &DefaultDeviceService{
-		repo:                 repo,
-		locationRepo:         locationRepo,
+		repo:         repo,
+		locationRepo: locationRepo,
+		transactor:   transactor,
+		events:       events,
 	}
 }
 
-func (s *DefaultDeviceService) GetAll() ([]model.Device, error) {
-	return s.repo.GetAll()
+func (s *DefaultDeviceService) GetAll(ctx context.Context) ([]model.Device, error) {
+	return s.repo.GetAll(ctx)
 }
 
-func (s *DefaultDeviceService) Get(id string) (*model.Device, error) {
-	return s.repo.Get(id)
+func (s *DefaultDeviceService) Get(ctx context.Context, id string) (*model.Device, error) {
+	return s.repo.Get(ctx, id)
 }
 
-func (s *DefaultDeviceService) Exists(id string) (bool, error) {
-	return s.repo.Exists(id)
+func (s *DefaultDeviceService) GetBySerial(ctx context.Context, serial string) (*model.Device, error) {
+	return s.repo.GetBySerial(ctx, strings.TrimSpace(serial))
 }
 
-func (s *DefaultDeviceService) Create(serial string, name string) (*model.Device, error) {
-	device, err := s.repo.Create(
+func (s *DefaultDeviceService) Exists(ctx context.Context, id string) (bool, error) {
+	return s.repo.Exists(ctx, id)
+}
+
+func (s *DefaultDeviceService) Create(ctx context.Context, serial string, name string, version int64) (*model.Device, error) {
+	device, created, err := s.repo.Create(
+		ctx,
 		strings.TrimSpace(serial),
 		strings.TrimSpace(name),
+		version,
 	)
 	if err != nil {
 		log.Warn().
 			Err(err).
 			Str("serial", serial).
 			Str("name", name).
+			Int64("version", version).
 			Msg("Failed to create device")
 
 		return nil, err
 	}
 
+	if created {
+		s.events.Publish(DeviceCreated{Device: *device})
+	}
+
+	return device, nil
+}
+
+func (s *DefaultDeviceService) SetRetentionPeriod(ctx context.Context, id string, retentionPeriod int64, version int64) (*model.Device, error) {
+	device, err := s.repo.SetRetentionPeriod(ctx, id, retentionPeriod, version)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("id", id).
+			Int64("retentionPeriod", retentionPeriod).
+			Int64("version", version).
+			Msg("Failed to set device retention period")
+
+		return nil, err
+	}
+
+	return device, nil
+}
+
+// Delete moves the device along with all of its locations to the trash, all or nothing.
+// Without transactions (a standalone mongodb) the device goes first, the locations left
+// by a failure in between are moved to the trash by DeleteOrphanedLocations.
+// Returns whether the device was deleted and the number of locations removed.
+func (s *DefaultDeviceService) Delete(ctx context.Context, id string, version int64) (bool, int64, error) {
+	var deleted bool
+	var locationsDeleted int64
+
+	// the locations share the device deletion time, restoring the device restores only them
+	deletedAt := time.Now().UTC().Truncate(time.Millisecond)
+
+	err := s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		var err error
+
+		deleted, err = s.repo.SoftDelete(ctx, id, version, deletedAt)
+		if err != nil {
+			return err
+		}
+
+		// locations are removed even when the device is already gone, cleaning up orphans
+		locationsDeleted, err = s.locationRepo.SoftDeleteAllByDevice(ctx, id, deletedAt)
+		return err
+	})
+
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("id", id).
+			Int64("version", version).
+			Msg("Failed to delete device")
+
+		return false, 0, err
+	}
+
+	if deleted {
+		s.events.Publish(DeviceDeleted{DeviceID: id, Locations: locationsDeleted})
+	}
+
+	return deleted, locationsDeleted, nil
+}
+
+func (s *DefaultDeviceService) GetAllDeleted(ctx context.Context) ([]model.Device, error) {
+	return s.repo.GetAllDeleted(ctx)
+}
+
+// Restore takes the device out of the trash along with the locations deleted with it, all or nothing.
+func (s *DefaultDeviceService) Restore(ctx context.Context, id string) (*model.Device, error) {
+	var restored int64
+
+	err := s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		device, err := s.repo.GetDeleted(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		// locations first, without transactions a failure in between leaves them with a device
+		// still in the trash, moved back by DeleteOrphanedLocations
+		restored, err = s.locationRepo.RestoreAllByDevice(ctx, id, device.DeletedAt)
+		if err != nil {
+			return err
+		}
+
+		_, err = s.repo.Restore(ctx, id)
+		return err
+	})
+
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("id", id).
+			Msg("Failed to restore device")
+
+		return nil, err
+	}
+
+	log.Info().
+		Str("id", id).
+		Int64("locations", restored).
+		Msg("Restored device")
+
+	device, err := s.repo.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.events.Publish(DeviceRestored{Device: *device, Locations: restored})
+
 	return device, nil
 }
 
-func (s *DefaultDeviceService) Delete(id string) (bool, error) {
-	defer func() {
-		// deletes all locations associated with the device
-		_, err := s.locationRepo.DeleteAllByDevice(id)
+// PurgeDeleted permanently removes devices and locations moved to the trash before the given time.
+// Returns the number of devices and locations removed.
+func (s *DefaultDeviceService) PurgeDeleted(ctx context.Context, before time.Time) (int64, int64, error) {
+	devices, err := s.repo.GetAllDeleted(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var devicesPurged, locationsPurged int64
+
+	for _, device := range devices {
+		if !device.DeletedAt.Before(before) {
+			continue
+		}
+
+		id := device.ID.Hex()
+
+		var purged int64
+
+		err := s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+			// the device may have been restored in the meantime
+			if _, err := s.repo.GetDeleted(ctx, id); err != nil {
+				if errors.Is(err, model.ErrItemNotFound) {
+					return nil
+				}
+
+				return err
+			}
+
+			count, err := s.locationRepo.DeleteAllByDevice(ctx, id)
+			if err != nil {
+				return err
+			}
+
+			deleted, err := s.repo.Delete(ctx, id)
+			if err != nil {
+				return err
+			}
+
+			if deleted {
+				devicesPurged++
+			}
+
+			purged = count
+			return nil
+		})
+
+		if err != nil {
+			return devicesPurged, locationsPurged, err
+		}
+
+		if purged > 0 {
+			s.events.Publish(LocationsPurged{DeviceID: id, Count: purged, Reason: PurgeReasonTrash})
+		}
+
+		locationsPurged += purged
+	}
+
+	count, err := s.locationRepo.PurgeDeleted(ctx, before)
+	if err != nil {
+		return devicesPurged, locationsPurged, err
+	}
+
+	if count > 0 {
+		s.events.Publish(LocationsPurged{Count: count, Reason: PurgeReasonTrash})
+	}
+
+	return devicesPurged, locationsPurged + count, nil
+}
+
+// DeleteOrphanedLocations removes locations of devices which no longer exist,
+// such as the ones left by a failed cleanup of earlier versions, and moves the locations
+// left outside the trash by an interrupted non-transactional Delete or Restore
+// to the trash of their device.
+func (s *DefaultDeviceService) DeleteOrphanedLocations(ctx context.Context) (int64, error) {
+	deviceIDs, err := s.locationRepo.GetDeviceIDs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+
+	for _, deviceID := range deviceIDs {
+		_, err := s.repo.Exists(ctx, deviceID)
+		if err == nil {
+			continue
+		}
+
+		if !errors.Is(err, model.ErrItemNotFound) {
+			return deleted, err
+		}
+
+		// locations of a device in the trash are purged along with it
+		device, err := s.repo.GetDeleted(ctx, deviceID)
+		if err == nil {
+			count, err := s.locationRepo.SoftDeleteAllByDevice(ctx, deviceID, *device.DeletedAt)
+			if err != nil {
+				return deleted, err
+			}
+
+			if count > 0 {
+				log.Info().
+					Str("deviceID", deviceID).
+					Int64("deleted", count).
+					Msg("Moved locations of deleted device to the trash")
+			}
+
+			deleted += count
+			continue
+		}
+
+		if !errors.Is(err, model.ErrItemNotFound) {
+			return deleted, err
+		}
+
+		count, err := s.locationRepo.DeleteAllByDevice(ctx, deviceID)
+		if err != nil {
+			return deleted, err
+		}
+
+		log.Info().
+			Str("deviceID", deviceID).
+			Int64("deleted", count).
+			Msg("Deleted orphaned locations")
+
+		if count > 0 {
+			s.events.Publish(LocationsPurged{DeviceID: deviceID, Count: count, Reason: PurgeReasonOrphaned})
+		}
+
+		deleted += count
+	}
+
+	return deleted, nil
+}
+
+// DeleteExpiredLocations removes locations older than their device retention period,
+// the latest location of every device is kept regardless of its age.
+func (s *DefaultDeviceService) DeleteExpiredLocations(ctx context.Context, defaultRetention time.Duration) (int64, error) {
+	devices, err := s.repo.GetAll(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int64
+
+	for _, device := range devices {
+		retention := device.Retention(defaultRetention)
+		if retention <= 0 {
+			continue
+		}
+
+		count, err := s.locationRepo.DeleteExpiredByDevice(
+			ctx,
+			device.ID.Hex(),
+			time.Now().UTC().Add(-retention),
+		)
 		if err != nil {
-			log.Warn().
-				Err(err).
-				Str("id", id).
-				Msgf("failed to delete locations associated with device: %s", id)
+			return deleted, err
 		}
-	}()
 
-	return s.repo.Delete(id)
+		if count > 0 {
+			log.Info().
+				Str("deviceID", device.ID.Hex()).
+				Dur("retention", retention).
+				Int64("deleted", count).
+				Msg("Deleted expired locations")
+
+			s.events.Publish(LocationsPurged{
+				DeviceID: device.ID.Hex(),
+				Count:    count,
+				Reason:   PurgeReasonRetention,
+			})
+		}
+
+		deleted += count
+	}
+
+	return deleted, nil
 }
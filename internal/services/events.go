@@ -0,0 +1,221 @@
+package services
+
+import (
+	"context"
+	"dwimc/internal/model"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Event is a change of devices or locations, published once the change is committed
+type Event interface {
+	EventType() string
+}
+
+type DeviceCreated struct {
+	Device model.Device
+}
+
+func (DeviceCreated) EventType() string { return "device.created" }
+
+// DeviceDeleted is a device moved to the trash along with its locations
+type DeviceDeleted struct {
+	DeviceID  string
+	Locations int64
+}
+
+func (DeviceDeleted) EventType() string { return "device.deleted" }
+
+// DeviceRestored is a device taken out of the trash along with the locations deleted with it
+type DeviceRestored struct {
+	Device    model.Device
+	Locations int64
+}
+
+func (DeviceRestored) EventType() string { return "device.restored" }
+
+type LocationRecorded struct {
+	Location model.Location
+}
+
+func (LocationRecorded) EventType() string { return "location.recorded" }
+
+// LocationRefreshed is the latest location seen again by a device which hasn't moved, instead of a new one
+type LocationRefreshed struct {
+	Location model.Location
+}
+
+func (LocationRefreshed) EventType() string { return "location.refreshed" }
+
+type PurgeReason string
+
+const (
+	PurgeReasonHistoryLimit PurgeReason = "history_limit"
+	PurgeReasonRetention    PurgeReason = "retention"
+	PurgeReasonTrash        PurgeReason = "trash"
+	PurgeReasonOrphaned     PurgeReason = "orphaned"
+)
+
+// LocationsPurged is locations removed permanently,
+// DeviceID is empty for locations purged across devices.
+type LocationsPurged struct {
+	DeviceID string
+	Count    int64
+	Reason   PurgeReason
+}
+
+func (LocationsPurged) EventType() string { return "locations.purged" }
+
+// EventHandler handles a single event at a time, in the order published
+type EventHandler func(ctx context.Context, event Event)
+
+type EventBus interface {
+	// Publish hands the event to every subscriber without blocking,
+	// a subscriber with a full queue misses it.
+	Publish(event Event)
+	// Subscribe runs the handler on its own goroutine, queueing up to queueSize events.
+	// Returns a function unsubscribing the handler once its queue is drained.
+	Subscribe(name string, queueSize int, handler EventHandler) func()
+	// Close stops publishing and waits for the subscribers to drain their queues,
+	// cancelling the handlers context when ctx is done first.
+	Close(ctx context.Context) error
+}
+
+type DefaultEventBus struct {
+	mutex       sync.RWMutex
+	subscribers map[*subscriber]struct{}
+	closed      bool
+	wg          sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
+}
+
+type subscriber struct {
+	name    string
+	queue   chan Event
+	dropped atomic.Int64
+}
+
+func NewDefaultEventBus() EventBus {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &DefaultEventBus{
+		subscribers: map[*subscriber]struct{}{},
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+}
+
+func (b *DefaultEventBus) Publish(event Event) {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.closed {
+		return
+	}
+
+	for sub := range b.subscribers {
+		select {
+		case sub.queue <- event:
+		default:
+			// logged once in a while, a slow subscriber would flood the log otherwise
+			if dropped := sub.dropped.Add(1); dropped == 1 || dropped%100 == 0 {
+				log.Warn().
+					Str("subscriber", sub.name).
+					Str("event", event.EventType()).
+					Int64("dropped", dropped).
+					Msg("Event queue is full, dropping event")
+			}
+		}
+	}
+}
+
+func (b *DefaultEventBus) Subscribe(name string, queueSize int, handler EventHandler) func() {
+	sub := &subscriber{
+		name:  name,
+		queue: make(chan Event, max(queueSize, 1)),
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		close(sub.queue)
+		return func() {}
+	}
+
+	b.subscribers[sub] = struct{}{}
+
+	b.wg.Add(1)
+	go b.run(sub, handler)
+
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+
+		// closed along with the bus
+		if _, ok := b.subscribers[sub]; !ok {
+			return
+		}
+
+		delete(b.subscribers, sub)
+		close(sub.queue)
+	}
+}
+
+func (b *DefaultEventBus) run(sub *subscriber, handler EventHandler) {
+	defer b.wg.Done()
+
+	for event := range sub.queue {
+		b.handle(sub, handler, event)
+	}
+}
+
+// handle runs the handler, a failing subscriber must not take down the service
+func (b *DefaultEventBus) handle(sub *subscriber, handler EventHandler, event Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Error().
+				Str("subscriber", sub.name).
+				Str("event", event.EventType()).
+				Interface("panic", r).
+				Msg("Event handler panicked")
+		}
+	}()
+
+	handler(b.ctx, event)
+}
+
+func (b *DefaultEventBus) Close(ctx context.Context) error {
+	b.mutex.Lock()
+
+	if !b.closed {
+		b.closed = true
+
+		for sub := range b.subscribers {
+			close(sub.queue)
+		}
+
+		clear(b.subscribers)
+	}
+
+	b.mutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		b.cancel()
+		return nil
+
+	case <-ctx.Done():
+		b.cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,111 @@
+package services
+
+import (
+	"context"
+	"dwimc/internal/model"
+	"dwimc/internal/repositories"
+	"dwimc/internal/utils"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// idempotency_lease bounds how long a key is held by a request which never completes,
+// such as one of a crashed replica, before its retries run again
+const idempotency_lease = time.Minute
+
+type IdempotencyService interface {
+	// Begin reserves the key for the request identified by requestHash,
+	// returns the completed key of an earlier request to replay instead when there's one.
+	// Fails with ErrItemConflict while the earlier request still runs,
+	// or ErrInvalidArgs when the key was sent with another request.
+	Begin(ctx context.Context, key string, requestHash string) (*model.IdempotencyKey, error)
+	// Complete records the response of the request, replayed until the key expires
+	Complete(ctx context.Context, key string, requestHash string, statusCode int, header map[string]string, body []byte) error
+	// Release gives up the key of a failed request, for its retry to run again
+	Release(ctx context.Context, key string) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type DefaultIdempotencyService struct {
+	repo repositories.IdempotencyRepository
+	ttl  time.Duration
+}
+
+// NewDefaultIdempotencyService replays the responses for ttl once the first request completes
+func NewDefaultIdempotencyService(repo repositories.IdempotencyRepository, ttl time.Duration) IdempotencyService {
+	return &DefaultIdempotencyService{
+		repo: repo,
+		ttl:  ttl,
+	}
+}
+
+func (s *DefaultIdempotencyService) Begin(ctx context.Context, key string, requestHash string) (*model.IdempotencyKey, error) {
+	// mongodb stores dates in milliseconds precision
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	existing, err := s.repo.Reserve(ctx, model.IdempotencyKey{
+		Key:         key,
+		RequestHash: requestHash,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(min(idempotency_lease, s.ttl)),
+	})
+	if err != nil || existing == nil {
+		return nil, err
+	}
+
+	if existing.RequestHash != requestHash {
+		return nil, utils.AsError(model.ErrInvalidArgs, "idempotency key was sent with another request")
+	}
+
+	if !existing.Completed() {
+		return nil, utils.AsError(model.ErrItemConflict, "request with the same idempotency key is running")
+	}
+
+	return existing, nil
+}
+
+func (s *DefaultIdempotencyService) Complete(
+	ctx context.Context,
+	key string,
+	requestHash string,
+	statusCode int,
+	header map[string]string,
+	body []byte,
+) error {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	err := s.repo.Complete(ctx, model.IdempotencyKey{
+		Key:         key,
+		RequestHash: requestHash,
+		StatusCode:  statusCode,
+		Header:      header,
+		Body:        body,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(s.ttl),
+	})
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("key", key).
+			Msg("Failed to complete idempotency key")
+	}
+
+	return err
+}
+
+func (s *DefaultIdempotencyService) Release(ctx context.Context, key string) error {
+	err := s.repo.Release(ctx, key)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("key", key).
+			Msg("Failed to release idempotency key")
+	}
+
+	return err
+}
+
+func (s *DefaultIdempotencyService) DeleteExpired(ctx context.Context) (int64, error) {
+	return s.repo.DeleteExpired(ctx, time.Now().UTC())
+}
@@ -1,42 +1,146 @@
 package services
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"dwimc/internal/model"
 	"dwimc/internal/repositories"
+	"dwimc/internal/takeout"
+	"dwimc/internal/utils"
 	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
+// recorded_at_max_ahead tolerates the clock drift of devices reporting a time in the future
+const recorded_at_max_ahead = 5 * time.Minute
+
+// import_batch_size is the number of history points written at once
+const import_batch_size = 500
+
 type LocationService interface {
-	GetAllByDevice(deviceID string) ([]model.Location, error)
-	GetLatestByDevice(deviceID string) (*model.Location, error)
-	Create(deviceID string, latitude float64, longitude float64) (*model.Location, error)
-	DeleteAllByDevice(deviceID string) (bool, error)
-	Delete(deviceID string, id string) (bool, error)
+	GetAllByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) ([]model.Location, error)
+	GetLatestByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) (*model.Location, error)
+	Create(
+		ctx context.Context,
+		deviceID string,
+		latitude float64,
+		longitude float64,
+		recordedAt *time.Time,
+		telemetry model.Telemetry,
+	) (*model.Location, error)
+	// CreateMany adds the locations of a device at once, failing only the invalid ones,
+	// see CreateManyResult. Only their coordinates, recorded time and telemetry are taken.
+	CreateMany(ctx context.Context, deviceID string, locations []model.Location) ([]CreateManyResult, error)
+	// ValidateRecordedAt checks the time a device reports a location was recorded at,
+	// returns it in milliseconds precision or zero when not reported.
+	ValidateRecordedAt(recordedAt *time.Time) (time.Time, error)
+	// ValidateCoordinates refuses the (0,0) reported by devices without a fix, unless the policy screens it
+	ValidateCoordinates(latitude float64, longitude float64) error
+	// Replay records a location created earlier, keeping its id and time, validated as on Create
+	// as of the time it was created. Replaying the same location again overwrites it.
+	// A device which hasn't moved refreshes its latest location instead, as on Create.
+	Replay(ctx context.Context, location model.Location) error
+	Ingest(
+		ctx context.Context,
+		serial string,
+		name string,
+		latitude float64,
+		longitude float64,
+		recordedAt *time.Time,
+		telemetry model.Telemetry,
+	) (*model.Device, error)
+	DeleteAllByDevice(ctx context.Context, deviceID string) (bool, error)
+	Delete(ctx context.Context, deviceID string, id string) (bool, error)
+	GetDeletedByDevice(ctx context.Context, deviceID string) ([]model.Location, error)
+	RestoreAllByDevice(ctx context.Context, deviceID string) (bool, error)
+	Restore(ctx context.Context, deviceID string, id string) (bool, error)
+	GetNear(ctx context.Context, center model.Coordinates, maxDistance float64) ([]model.Location, error)
+	GetWithinPolygon(ctx context.Context, polygon model.Polygon) ([]model.Location, error)
+	ImportHistory(ctx context.Context, deviceID string, r io.Reader) (*ImportStats, error)
+}
+
+// CreateManyResult is the outcome of a single location of CreateMany, in the same order,
+// either the created location or the error it failed on
+type CreateManyResult struct {
+	Location *model.Location
+	Err      error
+}
+
+// ImportStats counts the points of an imported location history
+type ImportStats struct {
+	Imported int64 `json:"imported"`
+	// Skipped counts invalid points and the ones beyond the location history limit
+	Skipped int64 `json:"skipped"`
+	// Duplicates counts points repeated in the history or already known for the device
+	Duplicates int64 `json:"duplicates"`
+}
+
+// LocationPolicy screens the fixes as they are created, the zero value accepts all of them.
+// An outlier is still stored, along with the reason it was found implausible, see model.Screening.
+type LocationPolicy struct {
+	// MaxAccuracy in meters, less accurate fixes are outliers. 0 disables it
+	MaxAccuracy float64
+	// MaxSpeed in meters per second, fixes which can't be reached from the latest location
+	// any slower are outliers. 0 disables it
+	MaxSpeed float64
+	// NullIsland makes fixes at (0,0), reported by devices without a fix, outliers
+	NullIsland bool
+	// FlagOnly keeps the outliers eligible as the latest location instead of rejecting them
+	FlagOnly bool
 }
 
 type DefaultLocationService struct {
-	repo         repositories.LocationRepository
-	historyLimit int
+	repo            repositories.LocationRepository
+	deviceRepo      repositories.DeviceRepository
+	transactor      repositories.Transactor
+	events          EventBus
+	historyLimit    int
+	maxRecordedSkew time.Duration
+	policy          LocationPolicy
+	// stationaryRadius in meters, see foldStationary
+	stationaryRadius float64
 }
 
+// NewDefaultLocationService rejects locations recorded longer than maxRecordedSkew ago, 0 accepts any delay.
+// New locations are screened by the policy, the ones within stationaryRadius (meters) of the latest location
+// refresh it instead of being added, 0 adds all of them.
 func NewDefaultLocationService(
 	repo repositories.LocationRepository,
+	deviceRepo repositories.DeviceRepository,
+	transactor repositories.Transactor,
+	events EventBus,
 	historyLimit int,
+	maxRecordedSkew time.Duration,
+	policy LocationPolicy,
+	stationaryRadius float64,
 ) LocationService {
 	return &DefaultLocationService{
-		repo:         repo,
-		historyLimit: historyLimit,
+		repo:             repo,
+		deviceRepo:       deviceRepo,
+		transactor:       transactor,
+		events:           events,
+		historyLimit:     historyLimit,
+		maxRecordedSkew:  maxRecordedSkew,
+		policy:           policy,
+		stationaryRadius: stationaryRadius,
 	}
 }
 
-func (s *DefaultLocationService) GetAllByDevice(deviceID string) ([]model.Location, error) {
-	return s.repo.GetAllByDevice(deviceID)
+func (s *DefaultLocationService) GetAllByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) ([]model.Location, error) {
+	return s.repo.GetAllByDevice(ctx, deviceID, filter)
 }
 
-func (s *DefaultLocationService) GetLatestByDevice(deviceID string) (*model.Location, error) {
-	location, err := s.repo.GetLatestByDevice(deviceID)
+func (s *DefaultLocationService) GetLatestByDevice(ctx context.Context, deviceID string, filter model.LocationFilter) (*model.Location, error) {
+	location, err := s.repo.GetLatestByDevice(ctx, deviceID, filter)
 	// since we are not requesting for a specific location,
 	// we can ignore the error, returning nothing
 	if err != nil && !errors.Is(err, model.ErrItemNotFound) {
@@ -46,8 +150,60 @@ func (s *DefaultLocationService) GetLatestByDevice(deviceID string) (*model.Loca
 	return location, nil
 }
 
-func (s *DefaultLocationService) Create(deviceID string, latitude float64, longitude float64) (*model.Location, error) {
-	location, err := s.repo.Create(deviceID, latitude, longitude)
+// Create adds the location and sets it as the device last location unless a newer one was recorded
+// or it was rejected by the policy, all or nothing. A location without a recorded time is recorded now.
+// A device which hasn't moved refreshes its latest location instead, which is returned.
+func (s *DefaultLocationService) Create(
+	ctx context.Context,
+	deviceID string,
+	latitude float64,
+	longitude float64,
+	recordedAt *time.Time,
+	telemetry model.Telemetry,
+) (*model.Location, error) {
+	recorded, err := s.ValidateRecordedAt(recordedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.ValidateCoordinates(latitude, longitude); err != nil {
+		return nil, err
+	}
+
+	var location *model.Location
+	var refreshed bool
+
+	err = s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		previous, err := s.previousLocation(ctx, deviceID)
+		if err != nil {
+			return err
+		}
+
+		fix := model.Location{
+			RecordedAt: cmp.Or(recorded, time.Now().UTC()),
+			Latitude:   latitude,
+			Longitude:  longitude,
+			Telemetry:  telemetry,
+		}
+		fix.Screening = s.screen(fix, previous)
+
+		if refreshed = s.foldStationary([]model.Location{fix}, previous)[0] < 0; refreshed {
+			location, err = s.repo.Refresh(ctx, deviceID, previous.ID.Hex(), time.Now().UTC(), 1)
+			if err != nil {
+				return err
+			}
+
+			return s.deviceRepo.SetLastLocation(ctx, deviceID, location)
+		}
+
+		location, err = s.repo.Create(ctx, deviceID, latitude, longitude, recorded, telemetry, fix.Screening)
+		if err != nil {
+			return err
+		}
+
+		return s.setLastLocation(ctx, deviceID, []model.Location{*location})
+	})
+
 	if err != nil {
 		log.Warn().
 			Err(err).
@@ -59,34 +215,811 @@ func (s *DefaultLocationService) Create(deviceID string, latitude float64, longi
 		return nil, err
 	}
 
-	if s.historyLimit > 0 {
-		deleted, err := s.repo.DeleteOldByDevice(
-			location.DeviceID.Hex(),
-			s.historyLimit,
-		)
+	// nothing was added to the history
+	if refreshed {
+		s.events.Publish(LocationRefreshed{Location: *location})
+		return location, nil
+	}
+
+	s.events.Publish(LocationRecorded{Location: *location})
+	s.deleteOldLocations(ctx, location.DeviceID.Hex())
+
+	return location, nil
+}
+
+// CreateMany adds the valid locations in a single insert, the newest recorded one which was not rejected
+// becomes the device last location unless a newer one was recorded, all or nothing. The history is trimmed once.
+// Locations of a device which hasn't moved are folded into the one they refresh, see foldStationary,
+// and their result is that location.
+func (s *DefaultLocationService) CreateMany(
+	ctx context.Context,
+	deviceID string,
+	locations []model.Location,
+) ([]CreateManyResult, error) {
+	results := make([]CreateManyResult, len(locations))
+
+	valid := make([]model.Location, 0, len(locations))
+	// the index of every valid location in the results
+	indexes := make([]int, 0, len(locations))
+
+	for i, location := range locations {
+		if err := s.ValidateCoordinates(location.Latitude, location.Longitude); err != nil {
+			results[i].Err = err
+			continue
+		}
+
+		if !location.RecordedAt.IsZero() {
+			recorded, err := s.ValidateRecordedAt(&location.RecordedAt)
+			if err != nil {
+				results[i].Err = err
+				continue
+			}
+
+			location.RecordedAt = recorded
+		}
+
+		valid = append(valid, location)
+		indexes = append(indexes, i)
+	}
+
+	if len(valid) == 0 {
+		return results, nil
+	}
+
+	var created []model.Location
+	var refreshed *model.Location
+
+	// the location every valid one ends up as, an index of created or -1 for the refreshed one
+	into := make([]int, len(valid))
+
+	err := s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		// nothing is kept from a retried transaction
+		created, refreshed = nil, nil
+
+		previous, err := s.previousLocation(ctx, deviceID)
 		if err != nil {
-			log.Warn().
-				Err(err).
-				Str("deviceID", location.DeviceID.Hex()).
-				Int("skip", s.historyLimit).
-				Msg("Failed to delete old locations")
+			return err
+		}
+
+		s.screenAll(valid, previous)
+
+		folded := s.foldStationary(valid, previous)
+		added := make([]model.Location, 0, len(valid))
+		var seen int64
+
+		for i, j := range folded {
+			if j == i {
+				into[i] = len(added)
+				valid[i].SeenCount = 1
+				added = append(added, valid[i])
+			}
+		}
+
+		// the location folded into may come later in the batch
+		for i, j := range folded {
+			switch {
+			case j < 0:
+				into[i] = -1
+				seen++
+
+			case j != i:
+				into[i] = into[j]
+				added[into[j]].SeenCount++
+			}
+		}
 
+		if seen > 0 {
+			refreshed, err = s.repo.Refresh(ctx, deviceID, previous.ID.Hex(), time.Now().UTC(), seen)
+			if err != nil {
+				return err
+			}
+		}
+
+		created, err = s.repo.CreateMany(ctx, deviceID, added)
+		if err != nil {
+			return err
+		}
+
+		if refreshed != nil {
+			return s.setLastLocation(ctx, deviceID, append(slices.Clone(created), *refreshed))
+		}
+
+		return s.setLastLocation(ctx, deviceID, created)
+	})
+
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("deviceID", deviceID).
+			Int("count", len(valid)).
+			Msg("Failed to create locations")
+
+		return nil, err
+	}
+
+	for i, j := range into {
+		if j < 0 {
+			results[indexes[i]].Location = refreshed
 		} else {
-			log.Info().
-				Str("deviceID", location.DeviceID.Hex()).
-				Int("skip", s.historyLimit).
-				Int64("deleted", deleted).
-				Msg("Success deleting old locations")
+			results[indexes[i]].Location = &created[j]
 		}
 	}
 
-	return location, nil
+	for _, location := range created {
+		s.events.Publish(LocationRecorded{Location: location})
+	}
+
+	if refreshed != nil {
+		s.events.Publish(LocationRefreshed{Location: *refreshed})
+	}
+
+	if len(created) > 0 {
+		s.deleteOldLocations(ctx, deviceID)
+	}
+
+	return results, nil
 }
 
-func (s *DefaultLocationService) DeleteAllByDevice(deviceID string) (bool, error) {
-	return s.repo.DeleteAllByDevice(deviceID)
+func (s *DefaultLocationService) ValidateCoordinates(latitude float64, longitude float64) error {
+	if latitude == 0 && longitude == 0 && !s.policy.NullIsland {
+		return utils.AsError(model.ErrInvalidArgs, "coordinates are missing")
+	}
+
+	return nil
 }
 
-func (s *DefaultLocationService) Delete(deviceID string, id string) (bool, error) {
-	return s.repo.Delete(deviceID, id)
+// setLastLocation makes the newest of the created locations which were not rejected the device last location,
+// unless a newer one was recorded. Fails with ErrItemNotFound for a missing device either way.
+func (s *DefaultLocationService) setLastLocation(ctx context.Context, deviceID string, created []model.Location) error {
+	accepted := slices.DeleteFunc(slices.Clone(created), func(location model.Location) bool {
+		return location.Rejected
+	})
+
+	if len(accepted) == 0 {
+		exists, err := s.deviceRepo.Exists(ctx, deviceID)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return utils.AsError(model.ErrItemNotFound, "device not found")
+		}
+
+		return nil
+	}
+
+	newest := slices.MaxFunc(accepted, func(a, b model.Location) int {
+		return cmp.Or(
+			a.RecordedAt.Compare(b.RecordedAt),
+			bytes.Compare(a.ID[:], b.ID[:]),
+		)
+	})
+
+	return s.deviceRepo.SetLastLocation(ctx, deviceID, &newest)
+}
+
+// previousLocation returns the latest location new fixes are screened and folded against,
+// nil when neither needs it or the device has none
+func (s *DefaultLocationService) previousLocation(ctx context.Context, deviceID string) (*model.Location, error) {
+	if s.policy.MaxSpeed <= 0 && s.stationaryRadius <= 0 {
+		return nil, nil
+	}
+
+	latest, err := s.repo.GetLatestByDevice(ctx, deviceID, model.LocationFilter{})
+	if err != nil && !errors.Is(err, model.ErrItemNotFound) {
+		return nil, err
+	}
+
+	return latest, nil
+}
+
+// screen applies the policy to the fix, previous is the latest location of the device, if any
+func (s *DefaultLocationService) screen(location model.Location, previous *model.Location) model.Screening {
+	var outlier string
+
+	switch {
+	case s.policy.NullIsland && location.Latitude == 0 && location.Longitude == 0:
+		outlier = model.OutlierNullIsland
+
+	case s.policy.MaxAccuracy > 0 && location.Accuracy != nil && *location.Accuracy > s.policy.MaxAccuracy:
+		outlier = model.OutlierAccuracy
+
+	case s.policy.MaxSpeed > 0 && previous != nil && impliedSpeed(*previous, location) > s.policy.MaxSpeed:
+		outlier = model.OutlierSpeed
+
+	default:
+		return model.Screening{}
+	}
+
+	return model.Screening{Outlier: outlier, Rejected: !s.policy.FlagOnly}
+}
+
+// screenAll screens the locations in the order they were recorded at, each against the latest one
+// which was not rejected so far. Locations without a recorded time are taken as recorded now.
+func (s *DefaultLocationService) screenAll(locations []model.Location, previous *model.Location) {
+	for _, fix := range recordedOrder(locations) {
+		locations[fix.index].Screening = s.screen(fix.Location, previous)
+		if !locations[fix.index].Rejected && (previous == nil || !fix.RecordedAt.Before(previous.RecordedAt)) {
+			previous = &fix.Location
+		}
+	}
+}
+
+// foldStationary finds the screened locations which refresh the latest one instead of being added,
+// in the order they were recorded at. A plausible location recorded within the stationary radius of
+// the latest plausible one, and not before it, refreshes it, whether previous or added so far.
+// Returns the index of the location each one is folded into, its own when added and -1 for previous.
+func (s *DefaultLocationService) foldStationary(locations []model.Location, previous *model.Location) []int {
+	into := make([]int, len(locations))
+	for i := range into {
+		into[i] = i
+	}
+
+	if s.stationaryRadius <= 0 {
+		return into
+	}
+
+	latest, latestIndex := previous, -1
+
+	for _, fix := range recordedOrder(locations) {
+		// rejected ones never become the latest, delayed ones are added as they are
+		if fix.Rejected || (latest != nil && fix.RecordedAt.Before(latest.RecordedAt)) {
+			continue
+		}
+
+		if latest != nil && latest.Outlier == "" && fix.Outlier == "" &&
+			latest.Coordinates().DistanceTo(fix.Coordinates()) <= s.stationaryRadius {
+			into[fix.index] = latestIndex
+			continue
+		}
+
+		latest, latestIndex = &fix.Location, fix.index
+	}
+
+	return into
+}
+
+// indexedLocation is a location along with its index, see recordedOrder
+type indexedLocation struct {
+	model.Location
+	index int
+}
+
+// recordedOrder returns the locations in the order they were recorded at, along with their index.
+// Locations without a recorded time are taken as recorded now.
+func recordedOrder(locations []model.Location) []indexedLocation {
+	now := time.Now().UTC()
+
+	ordered := make([]indexedLocation, len(locations))
+	for i, location := range locations {
+		location.RecordedAt = cmp.Or(location.RecordedAt, now)
+		ordered[i] = indexedLocation{Location: location, index: i}
+	}
+
+	slices.SortStableFunc(ordered, func(a, b indexedLocation) int {
+		return a.RecordedAt.Compare(b.RecordedAt)
+	})
+
+	return ordered
+}
+
+// impliedSpeed returns the speed in meters per second needed to move between the fixes,
+// fixes less than a second apart are taken as a second apart
+func impliedSpeed(from model.Location, to model.Location) float64 {
+	elapsed := math.Abs(to.RecordedAt.Sub(from.RecordedAt).Seconds())
+
+	return from.Coordinates().DistanceTo(to.Coordinates()) / max(elapsed, 1)
+}
+
+// deleteOldLocations trims the device history to its limit after adding locations, failures are only logged.
+// The repositories keep the latest location, so the device last location is never trimmed away.
+func (s *DefaultLocationService) deleteOldLocations(ctx context.Context, deviceID string) {
+	if s.historyLimit <= 0 {
+		return
+	}
+
+	deleted, err := s.repo.DeleteOldByDevice(ctx, deviceID, s.historyLimit)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("deviceID", deviceID).
+			Int("skip", s.historyLimit).
+			Msg("Failed to delete old locations")
+
+		return
+	}
+
+	log.Info().
+		Str("deviceID", deviceID).
+		Int("skip", s.historyLimit).
+		Int64("deleted", deleted).
+		Msg("Success deleting old locations")
+
+	if deleted > 0 {
+		s.events.Publish(LocationsPurged{
+			DeviceID: deviceID,
+			Count:    deleted,
+			Reason:   PurgeReasonHistoryLimit,
+		})
+	}
+}
+
+func (s *DefaultLocationService) ValidateRecordedAt(recordedAt *time.Time) (time.Time, error) {
+	if recordedAt == nil {
+		return time.Time{}, nil
+	}
+
+	return s.validateRecordedAt(*recordedAt, time.Now().UTC())
+}
+
+// validateRecordedAt checks the recorded time of a location received at now
+func (s *DefaultLocationService) validateRecordedAt(recordedAt time.Time, now time.Time) (time.Time, error) {
+	// mongodb stores dates in milliseconds precision
+	recorded := recordedAt.UTC().Truncate(time.Millisecond)
+
+	if recorded.After(now.Add(recorded_at_max_ahead)) {
+		return time.Time{}, utils.AsError(model.ErrInvalidArgs, "recorded_at is in the future")
+	}
+
+	if s.maxRecordedSkew > 0 && recorded.Before(now.Add(-s.maxRecordedSkew)) {
+		return time.Time{}, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("recorded_at is older than %s", s.maxRecordedSkew),
+		)
+	}
+
+	return recorded, nil
+}
+
+func (s *DefaultLocationService) Replay(ctx context.Context, location model.Location) error {
+	deviceID := location.DeviceID.Hex()
+
+	// spooled before locations had a recorded time
+	location.RecordedAt = cmp.Or(location.RecordedAt, location.CreatedAt)
+
+	// spooled without going through Create, possibly before the validation changed
+	if err := s.ValidateCoordinates(location.Latitude, location.Longitude); err != nil {
+		return err
+	}
+
+	if _, err := s.validateRecordedAt(location.RecordedAt, location.CreatedAt); err != nil {
+		return err
+	}
+
+	var trimmed int64
+	var refreshed *model.Location
+
+	// the device may have been deleted meanwhile, the history and last location
+	// go by the recorded time, same as imported ones
+	err := s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		refreshed = nil
+
+		exists, err := s.deviceRepo.Exists(ctx, deviceID)
+		if err != nil {
+			return err
+		}
+
+		if !exists {
+			return model.ErrItemNotFound
+		}
+
+		// screened same as created, spooled before the policy was applied
+		previous, err := s.previousLocation(ctx, deviceID)
+		if err != nil {
+			return err
+		}
+
+		if previous != nil && previous.ID == location.ID {
+			previous = nil
+		}
+
+		location.Screening = s.screen(location, previous)
+
+		// folded same as created, seen when it was posted. Refreshed at that very time,
+		// the latest location was already refreshed by an earlier replay of it.
+		if s.foldStationary([]model.Location{location}, previous)[0] < 0 {
+			if previous.UpdatedAt.Equal(location.CreatedAt) {
+				refreshed = previous
+				return nil
+			}
+
+			seenAt := location.CreatedAt
+			if previous.UpdatedAt.After(seenAt) {
+				seenAt = previous.UpdatedAt
+			}
+
+			refreshed, err = s.repo.Refresh(ctx, deviceID, previous.ID.Hex(), seenAt, 1)
+			if err != nil {
+				return err
+			}
+
+			return s.deviceRepo.SetLastLocation(ctx, deviceID, refreshed)
+		}
+
+		if _, err := s.repo.Import(ctx, location); err != nil {
+			return err
+		}
+
+		if trimmed, err = s.trimHistory(ctx, deviceID); err != nil {
+			return err
+		}
+
+		return s.refreshLastLocation(ctx, deviceID)
+	})
+
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("deviceID", deviceID).
+			Str("id", location.ID.Hex()).
+			Msg("Failed to replay location")
+
+		return err
+	}
+
+	// nothing was added to the history
+	if refreshed != nil {
+		s.events.Publish(LocationRefreshed{Location: *refreshed})
+		return nil
+	}
+
+	s.events.Publish(LocationRecorded{Location: location})
+
+	if trimmed > 0 {
+		s.events.Publish(LocationsPurged{DeviceID: deviceID, Count: trimmed, Reason: PurgeReasonHistoryLimit})
+	}
+
+	return nil
+}
+
+// Ingest upserts the device by its serial and records the location,
+// returns the device along with its new last location.
+func (s *DefaultLocationService) Ingest(
+	ctx context.Context,
+	serial string,
+	name string,
+	latitude float64,
+	longitude float64,
+	recordedAt *time.Time,
+	telemetry model.Telemetry,
+) (*model.Device, error) {
+	// rejected before the device is upserted
+	if _, err := s.ValidateRecordedAt(recordedAt); err != nil {
+		return nil, err
+	}
+
+	if err := s.ValidateCoordinates(latitude, longitude); err != nil {
+		return nil, err
+	}
+
+	device, created, err := s.deviceRepo.Create(
+		ctx,
+		strings.TrimSpace(serial),
+		strings.TrimSpace(name),
+		0,
+	)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("serial", serial).
+			Str("name", name).
+			Msg("Failed to ingest device")
+
+		return nil, err
+	}
+
+	if created {
+		s.events.Publish(DeviceCreated{Device: *device})
+	}
+
+	if _, err := s.Create(ctx, device.ID.Hex(), latitude, longitude, recordedAt, telemetry); err != nil {
+		return nil, err
+	}
+
+	return s.deviceRepo.Get(ctx, device.ID.Hex())
+}
+
+// DeleteAllByDevice moves all of the device locations to the trash.
+func (s *DefaultLocationService) DeleteAllByDevice(ctx context.Context, deviceID string) (bool, error) {
+	var deleted int64
+
+	err := s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		var err error
+
+		deleted, err = s.repo.SoftDeleteAllByDevice(ctx, deviceID, time.Now().UTC().Truncate(time.Millisecond))
+		if err != nil {
+			return err
+		}
+
+		return s.deviceRepo.ReplaceLastLocation(ctx, deviceID, nil)
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return deleted > 0, nil
+}
+
+// Delete moves the location to the trash, recomputing the device last location from its history when needed.
+func (s *DefaultLocationService) Delete(ctx context.Context, deviceID string, id string) (bool, error) {
+	var deleted bool
+
+	err := s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		var err error
+
+		deleted, err = s.repo.SoftDelete(ctx, deviceID, id, time.Now().UTC().Truncate(time.Millisecond))
+		if err != nil || !deleted {
+			return err
+		}
+
+		device, err := s.deviceRepo.Get(ctx, deviceID)
+		if err != nil {
+			return err
+		}
+
+		if device.LastLocation != nil && device.LastLocation.ID.Hex() != id {
+			return nil
+		}
+
+		return s.refreshLastLocation(ctx, deviceID)
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return deleted, nil
+}
+
+func (s *DefaultLocationService) GetDeletedByDevice(ctx context.Context, deviceID string) ([]model.Location, error) {
+	return s.repo.GetDeletedByDevice(ctx, deviceID)
+}
+
+// RestoreAllByDevice takes all of the device locations out of the trash.
+func (s *DefaultLocationService) RestoreAllByDevice(ctx context.Context, deviceID string) (bool, error) {
+	var restored int64
+
+	err := s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		var err error
+
+		restored, err = s.repo.RestoreAllByDevice(ctx, deviceID, nil)
+		if err != nil || restored == 0 {
+			return err
+		}
+
+		return s.refreshLastLocation(ctx, deviceID)
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return restored > 0, nil
+}
+
+// Restore takes the location out of the trash, it becomes the device last location when it is the latest.
+func (s *DefaultLocationService) Restore(ctx context.Context, deviceID string, id string) (bool, error) {
+	var restored bool
+
+	err := s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+		var err error
+
+		restored, err = s.repo.Restore(ctx, deviceID, id)
+		if err != nil || !restored {
+			return err
+		}
+
+		return s.refreshLastLocation(ctx, deviceID)
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	return restored, nil
+}
+
+// refreshLastLocation recomputes the device last location from its history
+func (s *DefaultLocationService) refreshLastLocation(ctx context.Context, deviceID string) error {
+	latest, err := s.repo.GetLatestByDevice(ctx, deviceID, model.LocationFilter{})
+	if err != nil && !errors.Is(err, model.ErrItemNotFound) {
+		return err
+	}
+
+	return s.deviceRepo.ReplaceLastLocation(ctx, deviceID, latest)
+}
+
+func (s *DefaultLocationService) GetNear(ctx context.Context, center model.Coordinates, maxDistance float64) ([]model.Location, error) {
+	if maxDistance <= 0 {
+		return nil, utils.AsError(model.ErrInvalidArgs, "max distance must be positive")
+	}
+
+	return s.repo.GetNear(ctx, center, maxDistance)
+}
+
+func (s *DefaultLocationService) GetWithinPolygon(ctx context.Context, polygon model.Polygon) ([]model.Location, error) {
+	// a closed ring of a triangle has at least 4 positions
+	if len(polygon.Ring()) < 4 {
+		return nil, utils.AsError(model.ErrInvalidArgs, "polygon requires at least 3 points")
+	}
+
+	return s.repo.GetWithinPolygon(ctx, polygon)
+}
+
+// ImportHistory adds the points of a Google Takeout location history to the device, keeping their original time.
+// With a location history limit only the newest locations are kept, whether imported or not,
+// the older points are skipped. The points are written in batches, a failed import can be retried
+// as the points already written are skipped as duplicates.
+func (s *DefaultLocationService) ImportHistory(ctx context.Context, deviceID string, r io.Reader) (*ImportStats, error) {
+	if _, err := s.deviceRepo.Exists(ctx, deviceID); err != nil {
+		return nil, err
+	}
+
+	objectID, err := bson.ObjectIDFromHex(deviceID)
+	if err != nil {
+		return nil, utils.AsError(
+			model.ErrInvalidArgs,
+			fmt.Sprintf("invalid id: %s", deviceID),
+		)
+	}
+
+	points, invalid, err := takeout.Parse(r)
+	if err != nil {
+		return nil, utils.AsError(model.ErrInvalidArgs, fmt.Sprintf("invalid location history: %s", err.Error()))
+	}
+
+	stats := &ImportStats{Skipped: int64(invalid)}
+
+	existing, err := s.repo.GetAllByDevice(ctx, deviceID, model.LocationFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[historyKey]bool{}
+	for _, location := range existing {
+		seen[newHistoryKey(location.RecordedAt, location.Latitude, location.Longitude)] = true
+	}
+
+	locations := make([]model.Location, 0, len(points))
+	for _, point := range points {
+		// mongodb stores dates in milliseconds precision
+		at := point.Time.Truncate(time.Millisecond)
+
+		key := newHistoryKey(at, point.Latitude, point.Longitude)
+		if seen[key] {
+			stats.Duplicates++
+			continue
+		}
+
+		seen[key] = true
+
+		locations = append(locations, model.Location{
+			// ids follow the original time, same as the ones created on the spot
+			ID:         bson.NewObjectIDFromTimestamp(at),
+			CreatedAt:  at,
+			UpdatedAt:  at,
+			RecordedAt: at,
+			DeviceID:   objectID,
+			Latitude:   point.Latitude,
+			Longitude:  point.Longitude,
+		})
+	}
+
+	slices.SortStableFunc(locations, func(a, b model.Location) int {
+		return cmp.Or(
+			a.RecordedAt.Compare(b.RecordedAt),
+			bytes.Compare(a.ID[:], b.ID[:]),
+		)
+	})
+
+	// older points would be trimmed right away, along with the existing locations older than the kept ones
+	if cutoff := historyCutoff(slices.Concat(existing, locations), s.historyLimit); !cutoff.IsZero() {
+		older := slices.IndexFunc(locations, func(location model.Location) bool {
+			return !location.RecordedAt.Before(cutoff)
+		})
+
+		if older < 0 {
+			older = len(locations)
+		}
+
+		stats.Skipped += int64(older)
+		locations = locations[older:]
+	}
+
+	for batch := range slices.Chunk(locations, import_batch_size) {
+		if _, err = s.repo.ImportMany(ctx, batch); err != nil {
+			break
+		}
+	}
+
+	var trimmed int64
+
+	if err == nil {
+		err = s.transactor.WithTransaction(ctx, func(ctx context.Context) error {
+			if trimmed, err = s.trimHistory(ctx, deviceID); err != nil {
+				return err
+			}
+
+			return s.refreshLastLocation(ctx, deviceID)
+		})
+	}
+
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("deviceID", deviceID).
+			Msg("Failed to import location history")
+
+		return nil, err
+	}
+
+	stats.Imported = int64(len(locations))
+
+	log.Info().
+		Str("deviceID", deviceID).
+		Int64("imported", stats.Imported).
+		Int64("skipped", stats.Skipped).
+		Int64("duplicates", stats.Duplicates).
+		Msg("Imported location history")
+
+	if trimmed > 0 {
+		s.events.Publish(LocationsPurged{DeviceID: deviceID, Count: trimmed, Reason: PurgeReasonHistoryLimit})
+	}
+
+	return stats, nil
+}
+
+// trimHistory keeps the newest locations by recorded time up to the history limit.
+// Returns the number of locations deleted.
+func (s *DefaultLocationService) trimHistory(ctx context.Context, deviceID string) (int64, error) {
+	if s.historyLimit <= 0 {
+		return 0, nil
+	}
+
+	locations, err := s.repo.GetAllByDevice(ctx, deviceID, model.LocationFilter{})
+	if err != nil {
+		return 0, err
+	}
+
+	cutoff := historyCutoff(locations, s.historyLimit)
+	if cutoff.IsZero() {
+		return 0, nil
+	}
+
+	return s.repo.DeleteExpiredByDevice(ctx, deviceID, cutoff)
+}
+
+// historyCutoff returns the recorded time of the oldest location kept by the history limit,
+// the ones recorded before it are beyond the limit. Zero when all of them are within it.
+func historyCutoff(locations []model.Location, historyLimit int) time.Time {
+	if historyLimit <= 0 || len(locations) <= historyLimit {
+		return time.Time{}
+	}
+
+	times := make([]time.Time, 0, len(locations))
+	for _, location := range locations {
+		times = append(times, location.RecordedAt)
+	}
+
+	slices.SortFunc(times, func(a, b time.Time) int {
+		return b.Compare(a)
+	})
+
+	return times[historyLimit-1]
+}
+
+// historyKey identifies a point by its time and coordinates (about 1cm precision)
+type historyKey struct {
+	at        int64
+	latitude  int64
+	longitude int64
+}
+
+func newHistoryKey(at time.Time, latitude float64, longitude float64) historyKey {
+	return historyKey{
+		at:        at.UnixMilli(),
+		latitude:  int64(math.Round(latitude * 1e7)),
+		longitude: int64(math.Round(longitude * 1e7)),
+	}
 }
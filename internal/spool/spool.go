@@ -0,0 +1,347 @@
+// Package spool buffers location posts in a local append-only file while the database is unavailable,
+// replaying them in order once it's back.
+package spool
+
+import (
+	"bufio"
+	"context"
+	"dwimc/internal/model"
+	"dwimc/internal/services"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+// spool_file_name is appended to, its locations are moved to replaying_file_name once replayed
+const spool_file_name = "locations.ndjson"
+const replaying_file_name = "locations.replaying.ndjson"
+
+// ReplayFunc records a spooled location, a retryable error stops the replay until the next one
+type ReplayFunc func(ctx context.Context, entry Entry) error
+
+// Entry is a spooled location post, one line of the spool
+type Entry struct {
+	model.Location
+	// Idempotency is set for a post sent with an Idempotency-Key, which could not be reserved
+	Idempotency *IdempotentPost `json:"idempotency,omitempty"`
+}
+
+// IdempotentPost is the key of a spooled post and the response it was accepted with,
+// recorded once replayed for the retries of the post to get it back
+type IdempotentPost struct {
+	Key         string            `json:"key"`
+	RequestHash string            `json:"request_hash"`
+	Header      map[string]string `json:"header"`
+	Body        []byte            `json:"body"`
+}
+
+// Spool is an append-only file of locations, one JSON document per line
+type Spool struct {
+	dir string
+
+	// mutex guards the file appended to
+	mutex sync.Mutex
+	file  *os.File
+
+	// a single replay at a time
+	replayMutex sync.Mutex
+}
+
+// Open creates the spool directory unless it exists, keeping locations spooled before
+func Open(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{dir: dir}
+
+	file, err := s.openFile()
+	if err != nil {
+		return nil, err
+	}
+
+	s.file = file
+
+	return s, nil
+}
+
+// Retryable tells whether a failed write may succeed once the database is back,
+// invalid requests and missing devices never will.
+func Retryable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	for _, permanent := range []error{
+		model.ErrInvalidArgs,
+		model.ErrItemNotFound,
+		model.ErrItemConflict,
+		model.ErrPreconditionFailed,
+		model.ErrNotSupported,
+		model.ErrInternal,
+	} {
+		if errors.Is(err, permanent) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Append writes the entry to the spool, synced to the disk before returning
+func (s *Spool) Append(entry Entry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return fmt.Errorf("spool is closed")
+	}
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return s.file.Sync()
+}
+
+// Replay hands the spooled entries to replay in the order they were appended,
+// until the spool is empty or replay fails with a retryable error (see Retryable).
+// Entries failing otherwise are dropped. Returns the number of entries replayed.
+//
+// The locations are replayed at least once, replay is expected to be idempotent.
+func (s *Spool) Replay(ctx context.Context, replay ReplayFunc) (int, error) {
+	s.replayMutex.Lock()
+	defer s.replayMutex.Unlock()
+
+	replayed := 0
+
+	for {
+		entries, err := s.nextEntries()
+		if err != nil || len(entries) == 0 {
+			return replayed, err
+		}
+
+		for i, entry := range entries {
+			err := replay(ctx, entry)
+
+			if Retryable(err) {
+				// the rest are kept in order for the next replay
+				if err := s.writeReplaying(entries[i:]); err != nil {
+					log.Error().Err(err).Msg("Failed to keep the spooled locations")
+				}
+
+				return replayed, err
+			}
+
+			if err != nil {
+				log.Warn().
+					Err(err).
+					Str("deviceID", entry.DeviceID.Hex()).
+					Str("id", entry.ID.Hex()).
+					Msg("Dropping spooled location")
+
+				continue
+			}
+
+			replayed++
+		}
+
+		if err := os.Remove(s.path(replaying_file_name)); err != nil {
+			return replayed, err
+		}
+	}
+}
+
+// Replayer replays the entries through the location service. A post sent with an Idempotency-Key is
+// recorded once whether its retries or its replay came first, a nil idempotency service disables it.
+func Replayer(locationService services.LocationService, idempotencyService services.IdempotencyService) ReplayFunc {
+	return func(ctx context.Context, entry Entry) error {
+		post := entry.Idempotency
+		if post == nil || idempotencyService == nil {
+			return locationService.Replay(ctx, entry.Location)
+		}
+
+		recorded, err := idempotencyService.Begin(ctx, post.Key, post.RequestHash)
+		switch {
+		// the key was sent again with another request, which doesn't make this one a duplicate
+		case errors.Is(err, model.ErrInvalidArgs):
+			return locationService.Replay(ctx, entry.Location)
+
+		// a retry still runs, replayed once it is done
+		case errors.Is(err, model.ErrItemConflict):
+			return fmt.Errorf("spooled location %s is being retried", entry.ID.Hex())
+
+		case err != nil:
+			return err
+
+		// the post was retried and recorded meanwhile
+		case recorded != nil:
+			return nil
+		}
+
+		if err := locationService.Replay(ctx, entry.Location); err != nil {
+			_ = idempotencyService.Release(ctx, post.Key)
+			return err
+		}
+
+		// the retries get the response the post was accepted with, a retry may record it again otherwise
+		if err := idempotencyService.Complete(
+			ctx,
+			post.Key,
+			post.RequestHash,
+			http.StatusAccepted,
+			post.Header,
+			post.Body,
+		); err != nil {
+			_ = idempotencyService.Release(ctx, post.Key)
+		}
+
+		return nil
+	}
+}
+
+// Close stops appending, spooled locations are kept for the next time the spool is opened
+func (s *Spool) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+
+	return err
+}
+
+// nextEntries reads the entries left by an earlier replay, or else moves aside
+// the ones appended so far and reads them.
+func (s *Spool) nextEntries() ([]Entry, error) {
+	if _, err := os.Stat(s.path(replaying_file_name)); err == nil {
+		return s.readReplaying()
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil, fmt.Errorf("spool is closed")
+	}
+
+	info, err := s.file.Stat()
+	if err != nil || info.Size() == 0 {
+		return nil, err
+	}
+
+	if err := s.file.Close(); err != nil {
+		return nil, err
+	}
+
+	s.file = nil
+
+	// appending goes on in a new file, whether moving aside failed or not
+	renameErr := os.Rename(s.path(spool_file_name), s.path(replaying_file_name))
+
+	if s.file, err = s.openFile(); err != nil {
+		return nil, err
+	}
+
+	if renameErr != nil {
+		return nil, renameErr
+	}
+
+	return s.readReplaying()
+}
+
+func (s *Spool) readReplaying() ([]Entry, error) {
+	file, err := os.Open(s.path(replaying_file_name))
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	entries := []Entry{}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		// a line cut by a crash while appending is skipped, the lines of earlier versions hold a location alone
+		if len(line) > 0 {
+			var entry Entry
+			if err := json.Unmarshal(line, &entry); err != nil {
+				log.Warn().Err(err).Msg("Skipping a corrupted spooled location")
+			} else {
+				entries = append(entries, entry)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return entries, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// writeReplaying replaces the entries left to replay, atomically
+func (s *Spool) writeReplaying(entries []Entry) error {
+	tmp, err := os.CreateTemp(s.dir, replaying_file_name+".*")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path(replaying_file_name))
+}
+
+func (s *Spool) openFile() (*os.File, error) {
+	return os.OpenFile(s.path(spool_file_name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+}
+
+func (s *Spool) path(name string) string {
+	return filepath.Join(s.dir, name)
+}
@@ -0,0 +1,329 @@
+// Package takeout parses the location history exported by Google Takeout,
+// the legacy Records.json as well as the newer on-device Timeline exports.
+package takeout
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrUnknownFormat = errors.New("unknown location history format")
+
+// Point is a single location of the history
+type Point struct {
+	Time      time.Time
+	Latitude  float64
+	Longitude float64
+}
+
+func (p Point) valid() bool {
+	return !p.Time.IsZero() &&
+		p.Time.Unix() > 0 &&
+		p.Latitude >= -90 && p.Latitude <= 90 &&
+		p.Longitude >= -180 && p.Longitude <= 180 &&
+		!(p.Latitude == 0 && p.Longitude == 0)
+}
+
+// Parse detects the export format and returns its points in the file order,
+// along with the number of entries skipped for missing or invalid values.
+// The file is decoded one entry at a time, never held in memory as a whole.
+func Parse(r io.Reader) ([]Point, int, error) {
+	decoder := json.NewDecoder(r)
+
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// the iOS Timeline export is a bare list of segments
+	if token == json.Delim('[') {
+		candidates, err := decodeElements(decoder, segment.candidates)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		return collect(candidates)
+	}
+
+	if token != json.Delim('{') {
+		return nil, 0, ErrUnknownFormat
+	}
+
+	// the legacy locations win over the Timeline ones, whatever their order in the file
+	var records, segments, signals []candidate
+
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, 0, err
+		}
+
+		switch key {
+		case "locations":
+			records, err = decodeArray(decoder, func(entry record) []candidate {
+				return []candidate{entry.candidate()}
+			})
+		case "semanticSegments":
+			segments, err = decodeArray(decoder, segment.candidates)
+		case "rawSignals":
+			signals, err = decodeArray(decoder, signal.candidates)
+		default:
+			err = decoder.Decode(&json.RawMessage{})
+		}
+
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if _, err := decoder.Token(); err != nil {
+		return nil, 0, err
+	}
+
+	switch {
+	case records != nil:
+		return collect(records)
+
+	case segments != nil || signals != nil:
+		return collect(slices.Concat(segments, signals))
+
+	default:
+		return nil, 0, ErrUnknownFormat
+	}
+}
+
+// decodeArray decodes the next value as an array, one element at a time,
+// a null value returns no candidates.
+func decodeArray[T any](decoder *json.Decoder, candidates func(element T) []candidate) ([]candidate, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if token == nil {
+		return nil, nil
+	}
+
+	if token != json.Delim('[') {
+		return nil, ErrUnknownFormat
+	}
+
+	return decodeElements(decoder, candidates)
+}
+
+// decodeElements decodes the elements of an array up to its closing bracket, the opening one already read
+func decodeElements[T any](decoder *json.Decoder, candidates func(element T) []candidate) ([]candidate, error) {
+	result := []candidate{}
+
+	for decoder.More() {
+		var element T
+		if err := decoder.Decode(&element); err != nil {
+			return nil, err
+		}
+
+		result = append(result, candidates(element)...)
+	}
+
+	// the closing bracket
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// candidate is a parsed entry, ok is false when any of its values is missing or invalid
+type candidate struct {
+	point Point
+	ok    bool
+}
+
+func newCandidate(position latLng, at time.Time) candidate {
+	point := Point{
+		Time:      at,
+		Latitude:  position.latitude,
+		Longitude: position.longitude,
+	}
+
+	return candidate{point: point, ok: position.ok && point.valid()}
+}
+
+func collect(candidates []candidate) ([]Point, int, error) {
+	points := make([]Point, 0, len(candidates))
+	skipped := 0
+
+	for _, candidate := range candidates {
+		if !candidate.ok {
+			skipped++
+			continue
+		}
+
+		points = append(points, candidate.point)
+	}
+
+	return points, skipped, nil
+}
+
+// record is an entry of the legacy Records.json
+type record struct {
+	LatitudeE7  *int64 `json:"latitudeE7"`
+	LongitudeE7 *int64 `json:"longitudeE7"`
+	// Timestamp replaced TimestampMs in later exports
+	Timestamp   string `json:"timestamp"`
+	TimestampMs string `json:"timestampMs"`
+}
+
+func (r record) candidate() candidate {
+	if r.LatitudeE7 == nil || r.LongitudeE7 == nil {
+		return candidate{}
+	}
+
+	at := parseTime(r.Timestamp)
+	if at.IsZero() && r.TimestampMs != "" {
+		if ms, err := strconv.ParseInt(r.TimestampMs, 10, 64); err == nil {
+			at = time.UnixMilli(ms).UTC()
+		}
+	}
+
+	return newCandidate(latLng{
+		latitude:  float64(*r.LatitudeE7) / 1e7,
+		longitude: float64(*r.LongitudeE7) / 1e7,
+		ok:        true,
+	}, at)
+}
+
+// segment is a visit, an activity or a path of the Timeline exports,
+// the Android and iOS exports share the structure but not the coordinates notation.
+type segment struct {
+	StartTime string `json:"startTime"`
+	EndTime   string `json:"endTime"`
+	Visit     *struct {
+		TopCandidate struct {
+			PlaceLocation latLng `json:"placeLocation"`
+		} `json:"topCandidate"`
+	} `json:"visit"`
+	Activity *struct {
+		Start latLng `json:"start"`
+		End   latLng `json:"end"`
+	} `json:"activity"`
+	TimelinePath []struct {
+		Point string `json:"point"`
+		// Time is set by the Android export
+		Time string `json:"time"`
+		// DurationMinutesOffsetFromStartTime is set by the iOS export
+		DurationMinutesOffsetFromStartTime string `json:"durationMinutesOffsetFromStartTime"`
+	} `json:"timelinePath"`
+}
+
+func (s segment) candidates() []candidate {
+	candidates := []candidate{}
+
+	start := parseTime(s.StartTime)
+	end := parseTime(s.EndTime)
+
+	if s.Visit != nil {
+		candidates = append(candidates, newCandidate(s.Visit.TopCandidate.PlaceLocation, start))
+	}
+
+	if s.Activity != nil {
+		candidates = append(candidates,
+			newCandidate(s.Activity.Start, start),
+			newCandidate(s.Activity.End, end),
+		)
+	}
+
+	for _, path := range s.TimelinePath {
+		at := parseTime(path.Time)
+		if at.IsZero() && !start.IsZero() && path.DurationMinutesOffsetFromStartTime != "" {
+			if minutes, err := strconv.ParseFloat(path.DurationMinutesOffsetFromStartTime, 64); err == nil {
+				at = start.Add(time.Duration(minutes * float64(time.Minute)))
+			}
+		}
+
+		candidates = append(candidates, newCandidate(parseLatLng(path.Point), at))
+	}
+
+	return candidates
+}
+
+// signal is an entry of the Android Timeline raw signals, only the positions are taken
+type signal struct {
+	Position *struct {
+		LatLng    latLng `json:"LatLng"`
+		Timestamp string `json:"timestamp"`
+	} `json:"position"`
+}
+
+func (s signal) candidates() []candidate {
+	if s.Position == nil {
+		return nil
+	}
+
+	return []candidate{newCandidate(s.Position.LatLng, parseTime(s.Position.Timestamp))}
+}
+
+// latLng is a position as written by the Timeline exports, either a string
+// ("32.0853°, 34.7818°" or "geo:32.0853,34.7818") or an object holding it as latLng.
+type latLng struct {
+	latitude  float64
+	longitude float64
+	ok        bool
+}
+
+func (l *latLng) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*l = parseLatLng(value)
+		return nil
+	}
+
+	var object struct {
+		LatLng string `json:"latLng"`
+	}
+	if err := json.Unmarshal(data, &object); err != nil {
+		// an unexpected notation is skipped as an invalid entry
+		*l = latLng{}
+		return nil
+	}
+
+	*l = parseLatLng(object.LatLng)
+	return nil
+}
+
+func parseLatLng(value string) latLng {
+	value = strings.TrimPrefix(strings.TrimSpace(value), "geo:")
+	value = strings.ReplaceAll(value, "°", "")
+
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return latLng{}
+	}
+
+	latitude, err1 := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	longitude, err2 := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err1 != nil || err2 != nil || math.IsNaN(latitude) || math.IsNaN(longitude) {
+		return latLng{}
+	}
+
+	return latLng{latitude: latitude, longitude: longitude, ok: true}
+}
+
+// parseTime returns the zero time for a missing or invalid value
+func parseTime(value string) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	at, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return at.UTC()
+}
@@ -0,0 +1,340 @@
+package integration
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
+	"dwimc/internal/services"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupRestore(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+	const count = 3
+
+	ctx := context.Background()
+
+	setupEnv := func() (*gin.Engine, TestServices) {
+		return SetupTestEnvWithServices(t, TestEnvParams{
+			DatabaseName: "dwimc_test",
+			SecretAPIKey: validAPIKey,
+		})
+	}
+
+	createDevice := func(router *gin.Engine, serial string) model.Device {
+		return PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			"/api/devices/",
+			validAPIKey,
+			api_model.CreateDevice{
+				Serial: serial,
+				Name:   serial + "-name",
+			},
+		)
+	}
+
+	createLocations := func(router *gin.Engine, deviceID string) {
+		for i := range count {
+			PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+				validAPIKey,
+				api_model.CreateLocation{
+					Latitude:  Ptr(32.086880 + float64(i)),
+					Longitude: Ptr(34.775759),
+				},
+			)
+		}
+	}
+
+	getDevices := func(router *gin.Engine) []model.Device {
+		return PerformOKRequest[[]model.Device](t, router, "GET", "/api/devices/", validAPIKey, nil)
+	}
+
+	getTrashedDevices := func(router *gin.Engine) []model.Device {
+		return PerformOKRequest[[]model.Device](t, router, "GET", "/api/devices/trash", validAPIKey, nil)
+	}
+
+	getLocations := func(router *gin.Engine, deviceID string) []model.Location {
+		return PerformOKRequest[[]model.Location](
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+			validAPIKey,
+			nil,
+		)
+	}
+
+	getTrashedLocations := func(router *gin.Engine, deviceID string) []model.Location {
+		return PerformOKRequest[[]model.Location](
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/trash", deviceID),
+			validAPIKey,
+			nil,
+		)
+	}
+
+	// the source holds live devices, a device in the trash and a location in the trash
+	source, sourceServices := setupEnv()
+
+	device1 := createDevice(source, "device-1-serial")
+	createLocations(source, device1.ID.Hex())
+
+	device2 := createDevice(source, "device-2-serial")
+	createLocations(source, device2.ID.Hex())
+
+	device3 := createDevice(source, "device-3-serial")
+	createLocations(source, device3.ID.Hex())
+
+	device1Locations := getLocations(source, device1.ID.Hex())
+	require.Len(t, device1Locations, count)
+
+	PerformOKRequest[api_model.Operation](
+		t,
+		source,
+		"DELETE",
+		fmt.Sprintf("/api/devices/%s/locations/%s", device1.ID.Hex(), device1Locations[0].ID.Hex()),
+		validAPIKey,
+		nil,
+	)
+
+	PerformOKRequest[api_model.DeleteDeviceResult](
+		t,
+		source,
+		"DELETE",
+		"/api/devices/"+device3.ID.Hex(),
+		validAPIKey,
+		nil,
+	)
+
+	var archive bytes.Buffer
+
+	stats, err := sourceServices.Backup.Backup(ctx, &archive)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), stats.Devices)
+	assert.Equal(t, int64(3*count), stats.Locations)
+
+	assertRestored := func(t *testing.T, router *gin.Engine) {
+		assert.Equal(t, getDevices(source), getDevices(router), "Devices mismatch")
+		assert.Equal(t, getTrashedDevices(source), getTrashedDevices(router), "Trash mismatch")
+
+		for _, device := range []model.Device{device1, device2} {
+			assert.Equal(
+				t,
+				getLocations(source, device.ID.Hex()),
+				getLocations(router, device.ID.Hex()),
+				"Locations mismatch",
+			)
+			assert.Equal(
+				t,
+				getTrashedLocations(source, device.ID.Hex()),
+				getTrashedLocations(router, device.ID.Hex()),
+				"Trashed locations mismatch",
+			)
+		}
+	}
+
+	t.Run("Archive", func(t *testing.T) {
+		gz, err := gzip.NewReader(bytes.NewReader(archive.Bytes()))
+		require.NoError(t, err)
+
+		var header services.BackupHeader
+		require.NoError(t, json.NewDecoder(gz).Decode(&header))
+
+		assert.Equal(t, services.BACKUP_FORMAT, header.Format)
+		assert.Equal(t, services.BACKUP_VERSION, header.Version)
+	})
+
+	t.Run("Merge", func(t *testing.T) {
+		target, targetServices := setupEnv()
+
+		existing := createDevice(target, "device-4-serial")
+		conflicting := createDevice(target, "device-2-serial")
+
+		stats, err := targetServices.Backup.Restore(ctx, bytes.NewReader(archive.Bytes()), services.RestoreModeMerge)
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), stats.Devices)
+		assert.Equal(t, int64(2*count), stats.Locations)
+		assert.Equal(t, int64(1), stats.Skipped)
+
+		ids := []string{}
+		for _, device := range getDevices(target) {
+			ids = append(ids, device.ID.Hex())
+		}
+
+		assert.ElementsMatch(t, []string{
+			device1.ID.Hex(),
+			existing.ID.Hex(),
+			conflicting.ID.Hex(),
+		}, ids)
+
+		assert.Equal(
+			t,
+			getLocations(source, device1.ID.Hex()),
+			getLocations(target, device1.ID.Hex()),
+			"Locations mismatch",
+		)
+
+		// restoring twice upserts the same items
+		_, err = targetServices.Backup.Restore(ctx, bytes.NewReader(archive.Bytes()), services.RestoreModeMerge)
+		require.NoError(t, err)
+		assert.Len(t, getLocations(target, device1.ID.Hex()), count-1)
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		target, targetServices := setupEnv()
+
+		createDevice(target, "device-2-serial")
+		other := createDevice(target, "device-5-serial")
+		createLocations(target, other.ID.Hex())
+
+		stats, err := targetServices.Backup.Restore(ctx, bytes.NewReader(archive.Bytes()), services.RestoreModeReplace)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), stats.Devices)
+		assert.Equal(t, int64(3*count), stats.Locations)
+		assert.Zero(t, stats.Skipped)
+
+		assertRestored(t, target)
+
+		// the device in the trash is restored along with its locations
+		restored := PerformOKRequest[model.Device](
+			t,
+			target,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/restore", device3.ID.Hex()),
+			validAPIKey,
+			nil,
+		)
+
+		assert.Equal(t, device3.ID, restored.ID)
+		assert.NotNil(t, restored.LastLocation, "LastLocation is nil")
+		assert.Len(t, getLocations(target, device3.ID.Hex()), count)
+	})
+
+	t.Run("Interrupted", func(t *testing.T) {
+		const many = 1234
+
+		source, sourceServices := setupEnv()
+		device := createDevice(source, "device-6-serial")
+
+		records := make([]string, 0, many)
+		for i := range many {
+			records = append(records, fmt.Sprintf(
+				`{"latitudeE7": %d, "longitudeE7": 347757590, "timestampMs": "%d"}`,
+				320868800+i,
+				1556708400000+int64(i)*60000,
+			))
+		}
+
+		_, err := sourceServices.Location.ImportHistory(
+			ctx,
+			device.ID.Hex(),
+			strings.NewReader(`{"locations": [`+strings.Join(records, ",")+`]}`),
+		)
+		require.NoError(t, err)
+
+		var archive bytes.Buffer
+		_, err = sourceServices.Backup.Backup(ctx, &archive)
+		require.NoError(t, err)
+
+		gz, err := gzip.NewReader(bytes.NewReader(archive.Bytes()))
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(gz)
+		require.NoError(t, err)
+
+		// cut in the middle of a record, past the first batch
+		var truncated bytes.Buffer
+		truncatedGz := gzip.NewWriter(&truncated)
+		_, err = truncatedGz.Write(content[:len(content)*3/4+1])
+		require.NoError(t, err)
+		require.NoError(t, truncatedGz.Close())
+
+		target, targetServices := setupEnv()
+
+		_, err = targetServices.Backup.Restore(ctx, &truncated, services.RestoreModeMerge)
+		require.ErrorIs(t, err, model.ErrInvalidArgs)
+
+		// the batches restored before the failure are kept
+		restored := getLocations(target, device.ID.Hex())
+		assert.NotEmpty(t, restored)
+		assert.Less(t, len(restored), many)
+
+		// running the restore again completes it
+		stats, err := targetServices.Backup.Restore(ctx, bytes.NewReader(archive.Bytes()), services.RestoreModeMerge)
+		require.NoError(t, err)
+		assert.Equal(t, int64(many), stats.Locations)
+
+		assert.Equal(t, getLocations(source, device.ID.Hex()), getLocations(target, device.ID.Hex()), "Locations mismatch")
+		assert.Equal(t, getDevices(source), getDevices(target), "Devices mismatch")
+	})
+
+	t.Run("Replace Truncated", func(t *testing.T) {
+		target, targetServices := setupEnv()
+
+		other := createDevice(target, "device-5-serial")
+		createLocations(target, other.ID.Hex())
+
+		devices := getDevices(target)
+		locations := getLocations(target, other.ID.Hex())
+
+		gz, err := gzip.NewReader(bytes.NewReader(archive.Bytes()))
+		require.NoError(t, err)
+
+		content, err := io.ReadAll(gz)
+		require.NoError(t, err)
+
+		// cut in the middle of the last record
+		var truncated bytes.Buffer
+		truncatedGz := gzip.NewWriter(&truncated)
+		_, err = truncatedGz.Write(content[:len(content)-2])
+		require.NoError(t, err)
+		require.NoError(t, truncatedGz.Close())
+
+		_, err = targetServices.Backup.Restore(ctx, &truncated, services.RestoreModeReplace)
+		require.ErrorIs(t, err, model.ErrInvalidArgs)
+
+		// nothing is deleted
+		assert.Equal(t, devices, getDevices(target), "Devices mismatch")
+		assert.Equal(t, locations, getLocations(target, other.ID.Hex()), "Locations mismatch")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		_, targetServices := setupEnv()
+
+		_, err := targetServices.Backup.Restore(ctx, bytes.NewReader(archive.Bytes()), "overwrite")
+		assert.True(t, errors.Is(err, model.ErrInvalidArgs))
+
+		_, err = targetServices.Backup.Restore(ctx, bytes.NewReader([]byte("not an archive")), services.RestoreModeMerge)
+		assert.True(t, errors.Is(err, model.ErrInvalidArgs))
+
+		var future bytes.Buffer
+		gz := gzip.NewWriter(&future)
+		require.NoError(t, json.NewEncoder(gz).Encode(services.BackupHeader{
+			Format:  services.BACKUP_FORMAT,
+			Version: services.BACKUP_VERSION + 1,
+		}))
+		require.NoError(t, gz.Close())
+
+		_, err = targetServices.Backup.Restore(ctx, &future, services.RestoreModeMerge)
+		assert.True(t, errors.Is(err, model.ErrInvalidArgs))
+	})
+}
@@ -0,0 +1,186 @@
+package integration
+
+import (
+	"context"
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
+	"dwimc/internal/repositories"
+	"dwimc/internal/services"
+	"dwimc/internal/utils"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingLocationRepository fails moving the locations of a device to the trash
+type failingLocationRepository struct {
+	repositories.LocationRepository
+}
+
+func (r failingLocationRepository) SoftDeleteAllByDevice(ctx context.Context, deviceID string, deletedAt time.Time) (int64, error) {
+	return 0, utils.AsError(model.ErrDatabase, "location delete failed")
+}
+
+// standaloneTransactor runs without transactions, as on a standalone mongodb server
+type standaloneTransactor struct{}
+
+func (standaloneTransactor) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(ctx)
+}
+
+func TestDeviceCleanup(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+	const count = 3
+
+	ctx := context.Background()
+
+	router, testServices := SetupTestEnvWithServices(t, TestEnvParams{
+		DatabaseName: "dwimc_test",
+		SecretAPIKey: validAPIKey,
+	})
+
+	repos := testServices.Repositories
+
+	createDevice := func(serial string) string {
+		device := PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			"/api/devices/",
+			validAPIKey,
+			api_model.CreateDevice{
+				Serial: serial,
+				Name:   serial + "-name",
+			},
+		)
+
+		for i := range count {
+			operation := PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/locations/", device.ID.Hex()),
+				validAPIKey,
+				api_model.CreateLocation{
+					Latitude:  Ptr(32.086880 + float64(i)),
+					Longitude: Ptr(34.775759),
+				},
+			)
+
+			assert.True(t, operation.Success)
+		}
+
+		return device.ID.Hex()
+	}
+
+	getLocations := func(deviceID string) []model.Location {
+		return PerformOKRequest[[]model.Location](
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+			validAPIKey,
+			nil,
+		)
+	}
+
+	getTrashedLocations := func(deviceID string) []model.Location {
+		return PerformOKRequest[[]model.Location](
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/trash", deviceID),
+			validAPIKey,
+			nil,
+		)
+	}
+
+	t.Run("orphaned locations", func(t *testing.T) {
+		deviceID := createDevice("device-1-serial")
+		keptID := createDevice("device-2-serial")
+
+		// removing the device alone, as earlier versions failing to clean up did
+		deleted, err := repos.Device.Delete(ctx, deviceID)
+		require.NoError(t, err)
+		require.True(t, deleted)
+
+		removed, err := testServices.Device.DeleteOrphanedLocations(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(count), removed)
+
+		deviceIDs, err := repos.Location.GetDeviceIDs(ctx)
+		require.NoError(t, err)
+		assert.NotContains(t, deviceIDs, deviceID)
+		assert.Len(t, getLocations(keptID), count)
+
+		// nothing is left for another run
+		removed, err = testServices.Device.DeleteOrphanedLocations(ctx)
+		require.NoError(t, err)
+		assert.Zero(t, removed)
+	})
+
+	t.Run("rollback when the location delete fails", func(t *testing.T) {
+		deviceID := createDevice("device-3-serial")
+
+		deviceService := services.NewDefaultDeviceService(
+			repos.Device,
+			failingLocationRepository{repos.Location},
+			repos.Transactor,
+			testServices.Events,
+		)
+
+		_, _, err := deviceService.Delete(ctx, deviceID, 0)
+		require.ErrorIs(t, err, model.ErrDatabase)
+
+		device, err := testServices.Device.Get(ctx, deviceID)
+		require.NoError(t, err)
+		assert.Nil(t, device.DeletedAt, "DeletedAt is not nil")
+		assert.Len(t, getLocations(deviceID), count)
+		assert.Empty(t, getTrashedLocations(deviceID))
+	})
+
+	t.Run("interrupted delete without transactions", func(t *testing.T) {
+		deviceID := createDevice("device-4-serial")
+
+		deviceService := services.NewDefaultDeviceService(
+			repos.Device,
+			failingLocationRepository{repos.Location},
+			standaloneTransactor{},
+			testServices.Events,
+		)
+
+		_, _, err := deviceService.Delete(ctx, deviceID, 0)
+		require.ErrorIs(t, err, model.ErrDatabase)
+
+		// the device went to the trash without its locations
+		PerformFailedRequest(t, router, "GET", "/api/devices/"+deviceID, validAPIKey, nil, http.StatusNotFound)
+
+		trashed, err := repos.Location.GetDeletedByDevice(ctx, deviceID)
+		require.NoError(t, err)
+		assert.Empty(t, trashed)
+
+		moved, err := testServices.Device.DeleteOrphanedLocations(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, int64(count), moved)
+
+		trashed, err = repos.Location.GetDeletedByDevice(ctx, deviceID)
+		require.NoError(t, err)
+		assert.Len(t, trashed, count)
+
+		PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/restore", deviceID),
+			validAPIKey,
+			nil,
+		)
+
+		assert.Len(t, getLocations(deviceID), count)
+		assert.Empty(t, getTrashedLocations(deviceID))
+	})
+}
@@ -122,7 +122,7 @@ func TestDeviceAPI(t *testing.T) {
 			payload,
 		)
 
-		operation := PerformOKRequest[api_model.Operation](
+		result := PerformOKRequest[api_model.DeleteDeviceResult](
 			t,
 			router,
 			"DELETE",
@@ -131,9 +131,10 @@ func TestDeviceAPI(t *testing.T) {
 			nil,
 		)
 
-		assert.True(t, operation.Success)
+		assert.True(t, result.Success)
+		assert.Equal(t, int64(0), result.DeletedLocations, "Deleted locations mismatch")
 
-		operation = PerformOKRequest[api_model.Operation](
+		result = PerformOKRequest[api_model.DeleteDeviceResult](
 			t,
 			router,
 			"DELETE",
@@ -142,7 +143,7 @@ func TestDeviceAPI(t *testing.T) {
 			nil,
 		)
 
-		assert.False(t, operation.Success)
+		assert.False(t, result.Success)
 	})
 
 	t.Run("Get Device", func(t *testing.T) {
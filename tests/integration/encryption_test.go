@@ -0,0 +1,168 @@
+package integration
+
+import (
+	"context"
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/database"
+	"dwimc/internal/encryption"
+	"dwimc/internal/model"
+	"dwimc/internal/repositories"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryption(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+	const databaseName = "dwimc_test"
+
+	uri := os.Getenv(TEST_DATABASE_URI_ENV)
+	if strings.HasPrefix(uri, database.MEMORY_URI_PREFIX) || database.IsPostgresURI(uri) {
+		t.Skip("Coordinates encryption is supported by sqlite and mongodb only")
+	}
+
+	uri = setupDatabaseURI(t)
+
+	key := func(id string, b byte) string {
+		return id + ":" + base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+	}
+
+	keyring := func(t *testing.T, keys ...string) *encryption.Keyring {
+		keyring, err := encryption.ParseKeyring(strings.Join(keys, ","))
+		require.NoError(t, err)
+
+		return keyring
+	}
+
+	initializeRepositories := func(keyring *encryption.Keyring) error {
+		db, err := database.InitializeDatabase(uri, databaseName)
+		require.NoError(t, err)
+
+		defer db.Close(context.Background())
+
+		_, err = repositories.InitializeRepositories(context.Background(), db, keyring)
+		return err
+	}
+
+	getLatest := func(t *testing.T, keyring *encryption.Keyring, deviceID string) (model.Location, model.Device, TestServices) {
+		router, testServices := SetupTestEnvWithServices(t, TestEnvParams{
+			DatabaseName: databaseName,
+			SecretAPIKey: validAPIKey,
+			DatabaseURI:  uri,
+			Keyring:      keyring,
+		})
+
+		location := PerformOKRequest[model.Location](
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/latest", deviceID),
+			validAPIKey,
+			nil,
+		)
+
+		device := PerformOKRequest[model.Device](t, router, "GET", "/api/devices/"+deviceID, validAPIKey, nil)
+
+		return location, device, testServices
+	}
+
+	keyA := key("a", 'a')
+	keyB := key("b", 'b')
+
+	router, testServices := SetupTestEnvWithServices(t, TestEnvParams{
+		DatabaseName: databaseName,
+		SecretAPIKey: validAPIKey,
+		DatabaseURI:  uri,
+		Keyring:      keyring(t, keyA),
+	})
+
+	device := PerformOKRequest[model.Device](
+		t,
+		router,
+		"POST",
+		"/api/ingest",
+		validAPIKey,
+		api_model.IngestLocation{
+			Serial:    "device-1-serial",
+			Name:      "device-1-name",
+			Latitude:  Ptr(32.086880),
+			Longitude: Ptr(34.775759),
+		},
+	)
+	deviceID := device.ID.Hex()
+
+	t.Run("Encrypted", func(t *testing.T) {
+		keyIDs, err := testServices.Encryption.KeyIDs(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"a"}, keyIDs)
+
+		location, device, _ := getLatest(t, keyring(t, keyA), deviceID)
+		assert.Equal(t, 32.086880, location.Latitude)
+		assert.Equal(t, 34.775759, location.Longitude)
+
+		require.NotNil(t, device.LastLocation)
+		assert.Equal(t, 32.086880, device.LastLocation.Latitude)
+
+		// spatial queries can't use encrypted coordinates
+		PerformFailedRequest(
+			t,
+			router,
+			"GET",
+			"/api/locations/near?latitude=32.08&longitude=34.77&max_distance=1000",
+			validAPIKey,
+			nil,
+			http.StatusNotImplemented,
+		)
+	})
+
+	t.Run("Missing Key", func(t *testing.T) {
+		err := initializeRepositories(nil)
+		assert.ErrorIs(t, err, repositories.ErrMissingEncryptionKey)
+
+		err = initializeRepositories(keyring(t, keyB))
+		assert.ErrorIs(t, err, repositories.ErrMissingEncryptionKey)
+
+		assert.NoError(t, initializeRepositories(keyring(t, keyB, keyA)))
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		rotated := keyring(t, keyB, keyA)
+
+		location, _, testServices := getLatest(t, rotated, deviceID)
+		assert.Equal(t, 32.086880, location.Latitude)
+
+		rewritten, err := testServices.Encryption.Reencrypt(context.Background(), false)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), rewritten)
+
+		keyIDs, err := testServices.Encryption.KeyIDs(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"b"}, keyIDs)
+
+		// the old key can be dropped
+		location, device, _ := getLatest(t, keyring(t, keyB), deviceID)
+		assert.Equal(t, 34.775759, location.Longitude)
+		assert.Equal(t, 34.775759, device.LastLocation.Longitude)
+	})
+
+	t.Run("Decrypt", func(t *testing.T) {
+		_, _, testServices := getLatest(t, keyring(t, keyB), deviceID)
+
+		rewritten, err := testServices.Encryption.Reencrypt(context.Background(), true)
+		require.NoError(t, err)
+		assert.Equal(t, int64(1), rewritten)
+
+		// the keys are no longer needed
+		require.NoError(t, initializeRepositories(nil))
+
+		location, device, _ := getLatest(t, nil, deviceID)
+		assert.Equal(t, 32.086880, location.Latitude)
+		assert.Equal(t, 32.086880, device.LastLocation.Latitude)
+	})
+}
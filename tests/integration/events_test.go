@@ -0,0 +1,207 @@
+package integration
+
+import (
+	"context"
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
+	"dwimc/internal/services"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvents(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+
+	t.Run("Published", func(t *testing.T) {
+		router, testServices := SetupTestEnvWithServices(t, TestEnvParams{
+			DatabaseName:         "dwimc_test",
+			SecretAPIKey:         validAPIKey,
+			LocationHistoryLimit: 1,
+		})
+
+		received := make(chan services.Event, 16)
+		testServices.Events.Subscribe("test", 16, func(ctx context.Context, event services.Event) {
+			received <- event
+		})
+
+		next := func() services.Event {
+			select {
+			case event := <-received:
+				return event
+			case <-time.After(time.Second):
+				require.FailNow(t, "Missing event")
+				return nil
+			}
+		}
+
+		device := PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			"/api/devices/",
+			validAPIKey,
+			api_model.CreateDevice{
+				Serial: "device-1-serial",
+				Name:   "device-1-name",
+			},
+		)
+		deviceID := device.ID.Hex()
+
+		created, ok := next().(services.DeviceCreated)
+		require.True(t, ok, "DeviceCreated expected")
+		assert.Equal(t, device.ID, created.Device.ID)
+
+		// a no-op upsert right away, possibly within the same millisecond, creates nothing
+		PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			"/api/devices/",
+			validAPIKey,
+			api_model.CreateDevice{
+				Serial: "device-1-serial",
+				Name:   "device-1-name",
+			},
+		)
+
+		for i := range 2 {
+			PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+				validAPIKey,
+				api_model.CreateLocation{
+					Latitude:  Ptr(32.086880 + float64(i)),
+					Longitude: Ptr(34.775759),
+				},
+			)
+		}
+
+		recorded, ok := next().(services.LocationRecorded)
+		require.True(t, ok, "LocationRecorded expected")
+		assert.Equal(t, device.ID, recorded.Location.DeviceID)
+		assert.Equal(t, 32.086880, recorded.Location.Latitude)
+
+		_, ok = next().(services.LocationRecorded)
+		require.True(t, ok, "LocationRecorded expected")
+
+		// the history limit keeps the latest location only
+		assert.Equal(t, services.LocationsPurged{
+			DeviceID: deviceID,
+			Count:    1,
+			Reason:   services.PurgeReasonHistoryLimit,
+		}, next())
+
+		// upserting an existing device creates nothing
+		PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			"/api/devices/",
+			validAPIKey,
+			api_model.CreateDevice{
+				Serial: "device-1-serial",
+				Name:   "device-1-renamed",
+			},
+		)
+
+		PerformOKRequest[api_model.DeleteDeviceResult](t, router, "DELETE", "/api/devices/"+deviceID, validAPIKey, nil)
+
+		assert.Equal(t, services.DeviceDeleted{DeviceID: deviceID, Locations: 1}, next())
+
+		PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/restore", deviceID),
+			validAPIKey,
+			nil,
+		)
+
+		restored, ok := next().(services.DeviceRestored)
+		require.True(t, ok, "DeviceRestored expected")
+		assert.Equal(t, device.ID, restored.Device.ID)
+		assert.Equal(t, int64(1), restored.Locations)
+
+		// purging the trash
+		PerformOKRequest[api_model.DeleteDeviceResult](t, router, "DELETE", "/api/devices/"+deviceID, validAPIKey, nil)
+		next()
+
+		_, _, err := testServices.Device.PurgeDeleted(context.Background(), time.Now().UTC().Add(time.Minute))
+		require.NoError(t, err)
+
+		assert.Equal(t, services.LocationsPurged{
+			DeviceID: deviceID,
+			Count:    1,
+			Reason:   services.PurgeReasonTrash,
+		}, next())
+
+		select {
+		case event := <-received:
+			assert.Failf(t, "Unexpected event", "%#v", event)
+		default:
+		}
+	})
+
+	t.Run("Slow Subscriber", func(t *testing.T) {
+		events := services.NewDefaultEventBus()
+
+		release := make(chan struct{})
+		handled := make(chan services.Event, 16)
+
+		events.Subscribe("slow", 2, func(ctx context.Context, event services.Event) {
+			<-release
+			handled <- event
+		})
+
+		// publishing never blocks, events beyond the queue are dropped
+		published := make(chan struct{})
+		go func() {
+			for i := range 10 {
+				events.Publish(services.LocationsPurged{Count: int64(i)})
+			}
+			close(published)
+		}()
+
+		select {
+		case <-published:
+		case <-time.After(time.Second):
+			require.FailNow(t, "Publish blocked on a slow subscriber")
+		}
+
+		close(release)
+		require.NoError(t, events.Close(context.Background()))
+		close(handled)
+
+		counts := []int64{}
+		for event := range handled {
+			counts = append(counts, event.(services.LocationsPurged).Count)
+		}
+
+		// the queue holds 2 events, along with the one being handled when the handler got to it
+		require.NotEmpty(t, counts)
+		assert.Equal(t, int64(0), counts[0], "Events are handled in order")
+		assert.LessOrEqual(t, len(counts), 3)
+
+		// a panicking subscriber doesn't stop the others
+		events = services.NewDefaultEventBus()
+
+		received := make(chan services.Event, 1)
+		events.Subscribe("panicking", 1, func(ctx context.Context, event services.Event) {
+			panic("boom")
+		})
+		events.Subscribe("healthy", 1, func(ctx context.Context, event services.Event) {
+			received <- event
+		})
+
+		events.Publish(services.LocationsPurged{Count: 1})
+		require.NoError(t, events.Close(context.Background()))
+
+		assert.Len(t, received, 1)
+	})
+}
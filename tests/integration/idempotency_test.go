@@ -0,0 +1,240 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/database"
+	"dwimc/internal/model"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyAPI(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+
+	router := SetupTestEnv(t, TestEnvParams{
+		DatabaseName:      "dwimc_test",
+		SecretAPIKey:      validAPIKey,
+		IdempotencyKeyTTL: time.Hour,
+	})
+
+	performIdempotentRequest := func(url string, key string, payload any) *httptest.ResponseRecorder {
+		return performRequest(router, "POST", url, validAPIKey, payload, RequestHeader{"Idempotency-Key", key})
+	}
+
+	device := PerformOKRequest[model.Device](
+		t,
+		router,
+		"POST",
+		"/api/devices/",
+		validAPIKey,
+		api_model.CreateDevice{
+			Serial: "device-1-serial",
+			Name:   "device-1-name",
+		},
+	)
+	deviceID := device.ID.Hex()
+	locationsURL := fmt.Sprintf("/api/devices/%s/locations/", deviceID)
+
+	countLocations := func() int {
+		locations := PerformOKRequest[[]model.Location](t, router, "GET", locationsURL, validAPIKey, nil)
+		return len(locations)
+	}
+
+	t.Run("Location", func(t *testing.T) {
+		location := api_model.CreateLocation{
+			Latitude:  Ptr(32.086880),
+			Longitude: Ptr(34.775759),
+		}
+
+		first := performIdempotentRequest(locationsURL, "location-key-1", location)
+		require.Equal(t, http.StatusOK, first.Code)
+		assert.Empty(t, first.Header().Get("Idempotent-Replayed"))
+
+		// the retry gets the same response without creating another location
+		retry := performIdempotentRequest(locationsURL, "location-key-1", location)
+		require.Equal(t, http.StatusOK, retry.Code)
+		assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, first.Body.String(), retry.Body.String())
+		assert.Equal(t, first.Header().Get("Content-Type"), retry.Header().Get("Content-Type"))
+		assert.Equal(t, 1, countLocations())
+
+		// another key creates another location
+		w := performIdempotentRequest(locationsURL, "location-key-2", location)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, 2, countLocations())
+
+		// and so do requests without a key
+		for range 2 {
+			w := performIdempotentRequest(locationsURL, "", location)
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+		}
+		assert.Equal(t, 4, countLocations())
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		before := countLocations()
+		batch := []api_model.CreateLocation{
+			{Latitude: Ptr(32.086880), Longitude: Ptr(34.775759)},
+			{Latitude: Ptr(32.086881), Longitude: Ptr(34.775760)},
+		}
+
+		first := performIdempotentRequest(locationsURL+"batch", "batch-key", batch)
+		require.Equal(t, http.StatusOK, first.Code)
+
+		retry := performIdempotentRequest(locationsURL+"batch", "batch-key", batch)
+		require.Equal(t, http.StatusOK, retry.Code)
+		assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, first.Body.String(), retry.Body.String())
+		assert.Equal(t, before+2, countLocations())
+	})
+
+	t.Run("Device", func(t *testing.T) {
+		payload := api_model.CreateDevice{
+			Serial: "device-2-serial",
+			Name:   "device-2-name",
+		}
+
+		first := performIdempotentRequest("/api/devices/", "device-key", payload)
+		require.Equal(t, http.StatusOK, first.Code)
+
+		// a rename in between doesn't change the replayed response
+		PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			"/api/devices/",
+			validAPIKey,
+			api_model.CreateDevice{
+				Serial: "device-2-serial",
+				Name:   "device-2-renamed",
+			},
+		)
+
+		retry := performIdempotentRequest("/api/devices/", "device-key", payload)
+		require.Equal(t, http.StatusOK, retry.Code)
+		assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, first.Body.String(), retry.Body.String())
+		assert.NotEmpty(t, retry.Header().Get("ETag"))
+		assert.Equal(t, first.Header().Get("ETag"), retry.Header().Get("ETag"))
+
+		current := PerformOKRequest[model.Device](t, router, "GET", "/api/devices/by-serial/device-2-serial", validAPIKey, nil)
+		assert.Equal(t, "device-2-renamed", current.Name)
+	})
+
+	t.Run("Client errors are replayed", func(t *testing.T) {
+		invalid := api_model.CreateLocation{
+			Latitude:  Ptr(91.0),
+			Longitude: Ptr(34.775759),
+		}
+
+		first := performIdempotentRequest(locationsURL, "invalid-key", invalid)
+		require.Equal(t, http.StatusBadRequest, first.Code)
+
+		retry := performIdempotentRequest(locationsURL, "invalid-key", invalid)
+		require.Equal(t, http.StatusBadRequest, retry.Code)
+		assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, first.Body.String(), retry.Body.String())
+	})
+
+	t.Run("Invalid params", func(t *testing.T) {
+		location := api_model.CreateLocation{
+			Latitude:  Ptr(32.086880),
+			Longitude: Ptr(34.775759),
+		}
+
+		w := performIdempotentRequest(locationsURL, "reused-key", location)
+		require.Equal(t, http.StatusOK, w.Code)
+		before := countLocations()
+
+		// the same key with another body
+		location.Latitude = Ptr(31.0)
+		w = performIdempotentRequest(locationsURL, "reused-key", location)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		// the same key with another path
+		w = performIdempotentRequest("/api/devices/", "reused-key", api_model.CreateDevice{
+			Serial: "device-3-serial",
+			Name:   "device-3-name",
+		})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		// too long key
+		w = performIdempotentRequest(locationsURL, string(bytes.Repeat([]byte("k"), 256)), location)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		assert.Equal(t, before, countLocations())
+	})
+}
+
+func TestIdempotencyExpiration(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+	const ttl = 250 * time.Millisecond
+
+	params := TestEnvParams{
+		DatabaseName:      "dwimc_test",
+		SecretAPIKey:      validAPIKey,
+		IdempotencyKeyTTL: ttl,
+		DatabaseURI:       setupDatabaseURI(t),
+	}
+
+	router, testServices := SetupTestEnvWithServices(t, params)
+
+	performIdempotentRequest := func(router http.Handler, key string) *httptest.ResponseRecorder {
+		payload := api_model.CreateDevice{
+			Serial: "device-1-serial",
+			Name:   "device-1-name",
+		}
+
+		return performRequest(router, "POST", "/api/devices/", validAPIKey, payload, RequestHeader{"Idempotency-Key", key})
+	}
+
+	w := performIdempotentRequest(router, "device-key")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	t.Run("Shared across replicas", func(t *testing.T) {
+		if strings.HasPrefix(os.Getenv(TEST_DATABASE_URI_ENV), database.MEMORY_URI_PREFIX) {
+			t.Skip("The memory storage isn't shared across test envs")
+		}
+
+		replica := SetupTestEnv(t, params)
+
+		w := performIdempotentRequest(replica, "device-key")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "true", w.Header().Get("Idempotent-Replayed"))
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		time.Sleep(2 * ttl)
+
+		w := performIdempotentRequest(router, "device-key")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Empty(t, w.Header().Get("Idempotent-Replayed"))
+	})
+
+	t.Run("Sweep", func(t *testing.T) {
+		w := performIdempotentRequest(router, "another-key")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		// both keys are still live
+		deleted, err := testServices.Idempotency.DeleteExpired(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), deleted)
+
+		time.Sleep(2 * ttl)
+
+		deleted, err = testServices.Idempotency.DeleteExpired(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, int64(2), deleted)
+	})
+}
@@ -0,0 +1,301 @@
+package integration
+
+import (
+	"bytes"
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const takeoutRecords = `{
+	"locations": [
+		{"latitudeE7": 320868800, "longitudeE7": 347757590, "timestamp": "2019-05-01T10:00:00.123Z"},
+		{"latitudeE7": 321791110, "longitudeE7": 349161110, "timestampMs": "1556708400000"},
+		{"latitudeE7": 320868800, "longitudeE7": 347757590, "timestamp": "2019-05-01T10:00:00.123Z"},
+		{"longitudeE7": 347757590, "timestamp": "2019-05-01T12:00:00Z"}
+	]
+}`
+
+const takeoutAndroidTimeline = `{
+	"semanticSegments": [
+		{
+			"startTime": "2024-01-01T10:00:00.000+02:00",
+			"endTime": "2024-01-01T11:00:00.000+02:00",
+			"visit": {"topCandidate": {"placeLocation": {"latLng": "32.0868800°, 34.7757590°"}}}
+		},
+		{
+			"startTime": "2024-01-01T11:00:00.000+02:00",
+			"endTime": "2024-01-01T12:00:00.000+02:00",
+			"timelinePath": [
+				{"point": "32.1000000°, 34.8000000°", "time": "2024-01-01T11:30:00.000+02:00"}
+			]
+		}
+	],
+	"rawSignals": [
+		{"position": {"LatLng": "32.1791110°, 34.9161110°", "timestamp": "2024-01-01T13:00:00.000+02:00"}},
+		{"wifiScan": {}}
+	]
+}`
+
+const takeoutIOSTimeline = `[
+	{
+		"startTime": "2024-02-01T10:00:00.000+02:00",
+		"endTime": "2024-02-01T11:00:00.000+02:00",
+		"activity": {"start": "geo:32.086880,34.775759", "end": "geo:32.179111,34.916111"}
+	},
+	{
+		"startTime": "2024-02-01T11:00:00.000+02:00",
+		"endTime": "2024-02-01T12:00:00.000+02:00",
+		"timelinePath": [
+			{"point": "geo:32.100000,34.800000", "durationMinutesOffsetFromStartTime": "30"},
+			{"point": "not a point", "durationMinutesOffsetFromStartTime": "40"}
+		]
+	}
+]`
+
+func TestImportAPI(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+
+	setupRouter := func(historyLimit int) *gin.Engine {
+		return SetupTestEnv(t, TestEnvParams{
+			DatabaseName:         "dwimc_test",
+			SecretAPIKey:         validAPIKey,
+			LocationHistoryLimit: historyLimit,
+		})
+	}
+
+	createDevice := func(router *gin.Engine, serial string) model.Device {
+		return PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			"/api/devices/",
+			validAPIKey,
+			api_model.CreateDevice{
+				Serial: serial,
+				Name:   serial + "-name",
+			},
+		)
+	}
+
+	importHistory := func(router *gin.Engine, url string, content string) *httptest.ResponseRecorder {
+		var body bytes.Buffer
+
+		writer := multipart.NewWriter(&body)
+		part, err := writer.CreateFormFile("file", "Records.json")
+		require.NoError(t, err)
+
+		_, err = part.Write([]byte(content))
+		require.NoError(t, err)
+		require.NoError(t, writer.Close())
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", url, &body)
+		req.Header.Set("X-API-Key", validAPIKey)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	importOK := func(router *gin.Engine, deviceID string, content string) api_model.ImportLocationsResult {
+		w := importHistory(router, fmt.Sprintf("/api/devices/%s/locations/import", deviceID), content)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response api_model.Response[api_model.ImportLocationsResult]
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Nil(t, response.Error)
+
+		return response.Data
+	}
+
+	getLocations := func(router *gin.Engine, deviceID string) []model.Location {
+		return PerformOKRequest[[]model.Location](
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+			validAPIKey,
+			nil,
+		)
+	}
+
+	getLatest := func(router *gin.Engine, deviceID string) model.Location {
+		return PerformOKRequest[model.Location](
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/latest", deviceID),
+			validAPIKey,
+			nil,
+		)
+	}
+
+	t.Run("Records", func(t *testing.T) {
+		router := setupRouter(0)
+		device := createDevice(router, "device-1-serial")
+		deviceID := device.ID.Hex()
+
+		result := importOK(router, deviceID, takeoutRecords)
+
+		assert.Equal(t, int64(2), result.Imported)
+		assert.Equal(t, int64(1), result.Skipped)
+		assert.Equal(t, int64(1), result.Duplicates)
+
+		locations := getLocations(router, deviceID)
+		require.Len(t, locations, 2)
+
+		assert.Equal(t, time.Date(2019, 5, 1, 10, 0, 0, 123000000, time.UTC), locations[0].CreatedAt)
+		assert.Equal(t, 32.08688, locations[0].Latitude)
+		assert.Equal(t, 34.775759, locations[0].Longitude)
+		assert.Equal(t, time.UnixMilli(1556708400000).UTC(), locations[1].CreatedAt)
+
+		assert.Equal(t, locations[1].ID, getLatest(router, deviceID).ID, "Latest location mismatch")
+
+		// importing again finds all of the points already known
+		result = importOK(router, deviceID, takeoutRecords)
+
+		assert.Zero(t, result.Imported)
+		assert.Equal(t, int64(3), result.Duplicates)
+		assert.Len(t, getLocations(router, deviceID), 2)
+	})
+
+	t.Run("Timeline", func(t *testing.T) {
+		router := setupRouter(0)
+		device := createDevice(router, "device-2-serial")
+		deviceID := device.ID.Hex()
+
+		result := importOK(router, deviceID, takeoutAndroidTimeline)
+
+		assert.Equal(t, int64(3), result.Imported)
+		assert.Zero(t, result.Skipped)
+
+		latest := getLatest(router, deviceID)
+		assert.Equal(t, time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC), latest.CreatedAt)
+		assert.Equal(t, 32.179111, latest.Latitude)
+
+		// the iOS export goes through the by-serial route
+		w := importHistory(router, "/api/devices/by-serial/device-2-serial/locations/import", takeoutIOSTimeline)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+		var response api_model.Response[api_model.ImportLocationsResult]
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+		assert.Equal(t, int64(3), response.Data.Imported)
+		assert.Equal(t, int64(1), response.Data.Skipped)
+
+		locations := getLocations(router, deviceID)
+		require.Len(t, locations, 6)
+
+		assert.Equal(t, time.Date(2024, 2, 1, 9, 30, 0, 0, time.UTC), locations[5].CreatedAt)
+		assert.Equal(t, locations[5].ID, getLatest(router, deviceID).ID, "Latest location mismatch")
+	})
+
+	t.Run("History Limit", func(t *testing.T) {
+		router := setupRouter(2)
+		device := createDevice(router, "device-3-serial")
+		deviceID := device.ID.Hex()
+
+		// a location newer than the whole history
+		PerformOKRequest[api_model.Operation](
+			t,
+			router,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+			validAPIKey,
+			api_model.CreateLocation{
+				Latitude:  Ptr(32.5),
+				Longitude: Ptr(34.5),
+			},
+		)
+
+		result := importOK(router, deviceID, takeoutAndroidTimeline)
+
+		// only the newest point is kept along with the newer location
+		assert.Equal(t, int64(1), result.Imported)
+		assert.Equal(t, int64(2), result.Skipped)
+
+		locations := getLocations(router, deviceID)
+		require.Len(t, locations, 2)
+
+		assert.Equal(t, time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC), locations[0].CreatedAt)
+		assert.Equal(t, 32.5, getLatest(router, deviceID).Latitude, "Latest location mismatch")
+	})
+
+	t.Run("Batches", func(t *testing.T) {
+		const count = 1234
+
+		router := setupRouter(0)
+		device := createDevice(router, "device-5-serial")
+		deviceID := device.ID.Hex()
+
+		records := make([]string, 0, count)
+		for i := range count {
+			records = append(records, fmt.Sprintf(
+				`{"latitudeE7": %d, "longitudeE7": 347757590, "timestampMs": "%d"}`,
+				320868800+i,
+				1556708400000+int64(i)*60000,
+			))
+		}
+
+		content := `{"locations": [` + strings.Join(records, ",") + `]}`
+
+		result := importOK(router, deviceID, content)
+		assert.Equal(t, int64(count), result.Imported)
+
+		locations := getLocations(router, deviceID)
+		require.Len(t, locations, count)
+		assert.Equal(t, locations[count-1].ID, getLatest(router, deviceID).ID, "Latest location mismatch")
+
+		// importing again finds all of them known
+		result = importOK(router, deviceID, content)
+		assert.Zero(t, result.Imported)
+		assert.Equal(t, int64(count), result.Duplicates)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		router := setupRouter(0)
+		device := createDevice(router, "device-4-serial")
+
+		w := importHistory(router, fmt.Sprintf("/api/devices/%s/locations/import", device.ID.Hex()), `{"unknown": []}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = importHistory(router, fmt.Sprintf("/api/devices/%s/locations/import", device.ID.Hex()), `not json`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = importHistory(router, "/api/devices/67e97602e9621df49430c290/locations/import", takeoutRecords)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		PerformFailedRequest(
+			t,
+			router,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/locations/import", device.ID.Hex()),
+			validAPIKey,
+			nil,
+			http.StatusBadRequest,
+		)
+	})
+
+	t.Run("Too Large", func(t *testing.T) {
+		router := setupRouter(0)
+		device := createDevice(router, "device-6-serial")
+
+		content := `{"locations": [], "padding": "` + strings.Repeat("x", TEST_IMPORT_MAX_SIZE) + `"}`
+
+		w := importHistory(router, fmt.Sprintf("/api/devices/%s/locations/import", device.ID.Hex()), content)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+		assert.Empty(t, getLocations(router, device.ID.Hex()))
+	})
+}
@@ -3,68 +3,233 @@ package integration
 import (
 	"context"
 	"dwimc/internal/api"
+	api_model "dwimc/internal/api/model"
 	"dwimc/internal/database"
+	"dwimc/internal/encryption"
+	"dwimc/internal/migrations"
+	"dwimc/internal/model"
 	"dwimc/internal/repositories"
 	"dwimc/internal/services"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/require"
 	"github.com/testcontainers/testcontainers-go/modules/mongodb"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
 )
 
+// TEST_DATABASE_URI_ENV selects the storage backend tests run against,
+// a mongodb container is used when not set.
+// Example: TEST_DATABASE_URI=memory:// go test ./...
+const TEST_DATABASE_URI_ENV = "TEST_DATABASE_URI"
+
+const TEST_REQUEST_TIMEOUT = 10 * time.Second
+const TEST_IMPORT_TIMEOUT = time.Minute
+const TEST_IMPORT_MAX_SIZE = 1 << 20
+
 type TestEnvParams struct {
 	DatabaseName         string
 	SecretAPIKey         string
 	LocationHistoryLimit int
+	RecordedAtMaxSkew    time.Duration
+	// IdempotencyKeyTTL deduplicates the posts sent with an Idempotency-Key, 0 disables it
+	IdempotencyKeyTTL time.Duration
+	LocationPolicy    services.LocationPolicy
+	// StationaryRadius refreshes the latest location with the ones within it, 0 disables it
+	StationaryRadius float64
+	// DatabaseURI reuses a database of another test env, see setupDatabaseURI
+	DatabaseURI string
+	Keyring     *encryption.Keyring
+}
+
+// TestServices exposes the services behind the router for operations without an API,
+// such as background sweepers.
+type TestServices struct {
+	Device   services.DeviceService
+	Location services.LocationService
+	Backup   services.BackupService
+	Events   services.EventBus
+	// Encryption is nil for the backends not supporting coordinates encryption
+	Encryption repositories.EncryptionRepository
+	// Idempotency is nil unless TestEnvParams.IdempotencyKeyTTL is set
+	Idempotency services.IdempotencyService
+	// Repositories back the services, for services wired with failing or non-transactional parts
+	Repositories *repositories.Repositories
 }
 
 func SetupTestEnv(t *testing.T, params TestEnvParams) *gin.Engine {
+	router, _ := SetupTestEnvWithServices(t, params)
+	return router
+}
+
+func SetupTestEnvWithServices(t *testing.T, params TestEnvParams) (*gin.Engine, TestServices) {
 	ctx := context.Background()
 
-	container, err := mongodb.Run(ctx, "mongo:latest")
-	require.NoError(t, err, "Failed to create mongodb container")
+	uri := params.DatabaseURI
+	if uri == "" {
+		uri = setupDatabaseURI(t)
+	}
 
-	uri, err := container.ConnectionString(ctx)
-	require.NoError(t, err, "Failed to get mongodb container URI")
+	db, err := database.InitializeDatabase(uri, params.DatabaseName)
+	require.NoError(t, err, "Failed to initialize database")
 
-	client, err := database.InitializeDatabase(uri)
-	require.NoError(t, err, "Failed to initialize mongodb client")
+	t.Cleanup(func() {
+		err := db.Close(ctx)
+		require.NoError(t, err, "Failed to close database")
+	})
 
-	deviceRepo, err := repositories.NewMongodbDeviceRepository(
-		ctx,
-		client,
-		params.DatabaseName,
-	)
-	require.NoError(t, err, "Failed to create device repository")
+	_, err = migrations.Run(ctx, db, false)
+	require.NoError(t, err, "Failed to migrate database")
 
-	locationRepo, err := repositories.NewMongodbLocationRepository(
-		ctx,
-		client,
-		params.DatabaseName,
-	)
-	require.NoError(t, err, "Failed to create location repository")
+	repos, err := repositories.InitializeRepositories(ctx, db, params.Keyring)
+	require.NoError(t, err, "Failed to create repositories")
 
-	router := api.InitializeRouters(
-		false,
-		params.SecretAPIKey,
-		services.NewDefaultDeviceService(
-			deviceRepo,
-			locationRepo,
+	events := services.NewDefaultEventBus()
+
+	t.Cleanup(func() {
+		err := events.Close(ctx)
+		require.NoError(t, err, "Failed to close event bus")
+	})
+
+	testServices := TestServices{
+		Device: services.NewDefaultDeviceService(
+			repos.Device,
+			repos.Location,
+			repos.Transactor,
+			events,
 		),
-		services.NewDefaultLocationService(
-			locationRepo,
+		Location: services.NewDefaultLocationService(
+			repos.Location,
+			repos.Device,
+			repos.Transactor,
+			events,
 			params.LocationHistoryLimit,
+			params.RecordedAtMaxSkew,
+			params.LocationPolicy,
+			params.StationaryRadius,
+		),
+		Backup: services.NewDefaultBackupService(
+			repos.Device,
+			repos.Location,
+			repos.Transactor,
 		),
+		Events:       events,
+		Encryption:   repos.Encryption,
+		Repositories: repos,
+	}
+
+	if params.IdempotencyKeyTTL > 0 {
+		testServices.Idempotency = services.NewDefaultIdempotencyService(repos.Idempotency, params.IdempotencyKeyTTL)
+	}
+
+	router := api.InitializeRouters(
+		false,
+		params.SecretAPIKey,
+		TEST_REQUEST_TIMEOUT,
+		TEST_IMPORT_TIMEOUT,
+		TEST_IMPORT_MAX_SIZE,
+		func() bool { return true },
+		testServices.Device,
+		testServices.Location,
+		nil,
+		testServices.Idempotency,
+	)
+
+	return router, testServices
+}
+
+// SetupDeviceTestEnv is SetupTestEnvWithServices holding a single device, returns its id along with them
+func SetupDeviceTestEnv(t *testing.T, apiKey string, params TestEnvParams) (*gin.Engine, TestServices, string) {
+	params.DatabaseName = "dwimc_test"
+	params.SecretAPIKey = apiKey
+
+	router, testServices := SetupTestEnvWithServices(t, params)
+
+	device := PerformOKRequest[model.Device](
+		t,
+		router,
+		"POST",
+		"/api/devices/",
+		apiKey,
+		api_model.CreateDevice{
+			Serial: "device-1-serial",
+			Name:   "device-1-name",
+		},
 	)
 
+	return router, testServices, device.ID.Hex()
+}
+
+// FromHourAgo returns recorded times at offsets from an hour ago, the same one for every call,
+// so that every fix of a test has room to be recorded after the previous one
+func FromHourAgo() func(offset time.Duration) *time.Time {
+	base := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+
+	return func(offset time.Duration) *time.Time {
+		recordedAt := base.Add(offset)
+		return &recordedAt
+	}
+}
+
+// setupDatabaseURI returns a fresh and empty database for every test env
+func setupDatabaseURI(t *testing.T) string {
+	uri := os.Getenv(TEST_DATABASE_URI_ENV)
+
+	switch {
+	case strings.HasPrefix(uri, database.MEMORY_URI_PREFIX):
+		return uri
+
+	case strings.HasPrefix(uri, database.SQLITE_URI_PREFIX):
+		return database.SQLITE_URI_PREFIX + filepath.Join(t.TempDir(), "dwimc_test.db")
+
+	case database.IsPostgresURI(uri):
+		return setupPostgresContainer(t)
+
+	default:
+		return setupMongodbContainer(t)
+	}
+}
+
+func setupMongodbContainer(t *testing.T) string {
+	ctx := context.Background()
+
+	// a single member replica set, standalone servers do not support transactions
+	container, err := mongodb.Run(ctx, "mongo:latest", mongodb.WithReplicaSet("rs0"))
+	require.NoError(t, err, "Failed to create mongodb container")
+
 	t.Cleanup(func() {
-		err := client.Disconnect(ctx)
+		err := container.Terminate(ctx)
 		require.NoError(t, err, "Failed to close mongodb container")
+	})
+
+	uri, err := container.ConnectionString(ctx)
+	require.NoError(t, err, "Failed to get mongodb container URI")
+
+	return uri
+}
 
-		err = container.Terminate(ctx)
-		require.NoError(t, err, "Failed to close mongodb client")
+func setupPostgresContainer(t *testing.T) string {
+	ctx := context.Background()
+
+	container, err := postgres.Run(
+		ctx,
+		"postgis/postgis:17-3.5",
+		postgres.WithDatabase("dwimc_test"),
+		postgres.BasicWaitStrategies(),
+	)
+	require.NoError(t, err, "Failed to create postgres container")
+
+	t.Cleanup(func() {
+		err := container.Terminate(ctx)
+		require.NoError(t, err, "Failed to close postgres container")
 	})
 
-	return router
+	uri, err := container.ConnectionString(ctx, "sslmode=disable")
+	require.NoError(t, err, "Failed to get postgres container URI")
+
+	return uri
 }
@@ -5,7 +5,10 @@ import (
 	"dwimc/internal/model"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/v2/bson"
@@ -14,11 +17,13 @@ import (
 func TestLocationAPI(t *testing.T) {
 	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
 	const locationHistory = 5
+	const recordedAtMaxSkew = 24 * time.Hour
 
 	router := SetupTestEnv(t, TestEnvParams{
 		DatabaseName:         "dwimc_test",
 		SecretAPIKey:         validAPIKey,
 		LocationHistoryLimit: locationHistory,
+		RecordedAtMaxSkew:    recordedAtMaxSkew,
 	})
 
 	createDevice := func(serial string, name string) model.Device {
@@ -53,8 +58,8 @@ func TestLocationAPI(t *testing.T) {
 			operation := createLocation(
 				device.ID.Hex(),
 				api_model.CreateLocation{
-					Latitude:  32.086880,
-					Longitude: 34.775759,
+					Latitude:  Ptr(32.086880),
+					Longitude: Ptr(34.775759),
 				},
 			)
 
@@ -65,18 +70,18 @@ func TestLocationAPI(t *testing.T) {
 			payloads := []api_model.CreateLocation{
 				{},
 				{
-					Latitude:  -200.000000,
-					Longitude: 34.775759,
+					Latitude:  Ptr(-200.000000),
+					Longitude: Ptr(34.775759),
 				},
 				{
-					Latitude:  32.086880,
-					Longitude: 200.129387,
+					Latitude:  Ptr(32.086880),
+					Longitude: Ptr(200.129387),
 				},
 				{
-					Latitude: 32.086880,
+					Latitude: Ptr(32.086880),
 				},
 				{
-					Longitude: 34.775759,
+					Longitude: Ptr(34.775759),
 				},
 			}
 
@@ -105,8 +110,8 @@ func TestLocationAPI(t *testing.T) {
 				fmt.Sprintf("/api/devices/%s/locations/", bson.NewObjectID().Hex()),
 				validAPIKey,
 				api_model.CreateLocation{
-					Latitude:  32.086880,
-					Longitude: 34.775759,
+					Latitude:  Ptr(32.086880),
+					Longitude: Ptr(34.775759),
 				},
 				http.StatusNotFound,
 			)
@@ -118,8 +123,8 @@ func TestLocationAPI(t *testing.T) {
 	t.Run("Get Last Location", func(t *testing.T) {
 		t.Run("valid", func(t *testing.T) {
 			payload := api_model.CreateLocation{
-				Latitude:  32.086880,
-				Longitude: 34.775759,
+				Latitude:  Ptr(32.086880),
+				Longitude: Ptr(34.775759),
 			}
 
 			device := createDevice("device-2-serial", "device-2-name")
@@ -143,8 +148,8 @@ func TestLocationAPI(t *testing.T) {
 			assert.Equal(t, device.ID.Hex(), location.DeviceID.Hex(), "ID mismatch")
 			assert.Greater(t, location.CreatedAt.Unix(), int64(0), "CreatedAt should be valid time")
 			assert.Greater(t, location.UpdatedAt.Unix(), int64(0), "UpdatedAt should be valid time")
-			assert.Equal(t, payload.Latitude, location.Latitude, "Latitude mismatch")
-			assert.Equal(t, payload.Longitude, location.Longitude, "Longitude mismatch")
+			assert.Equal(t, *payload.Latitude, location.Latitude, "Latitude mismatch")
+			assert.Equal(t, *payload.Longitude, location.Longitude, "Longitude mismatch")
 		})
 
 		t.Run("nothing", func(t *testing.T) {
@@ -168,8 +173,8 @@ func TestLocationAPI(t *testing.T) {
 		t.Run("valid", func(t *testing.T) {
 			count := 3
 			payload := api_model.CreateLocation{
-				Latitude:  32.086880,
-				Longitude: 34.775759,
+				Latitude:  Ptr(32.086880),
+				Longitude: Ptr(34.775759),
 			}
 
 			device := createDevice("device-4-serial", "device-4-name")
@@ -198,8 +203,8 @@ func TestLocationAPI(t *testing.T) {
 				assert.Equal(t, device.ID.Hex(), location.DeviceID.Hex(), "ID mismatch")
 				assert.Greater(t, location.CreatedAt.Unix(), int64(0), "CreatedAt should be valid time")
 				assert.Greater(t, location.UpdatedAt.Unix(), int64(0), "UpdatedAt should be valid time")
-				assert.Equal(t, payload.Latitude, location.Latitude, "Latitude mismatch")
-				assert.Equal(t, payload.Longitude, location.Longitude, "Longitude mismatch")
+				assert.Equal(t, *payload.Latitude, location.Latitude, "Latitude mismatch")
+				assert.Equal(t, *payload.Longitude, location.Longitude, "Longitude mismatch")
 			}
 		})
 
@@ -211,8 +216,8 @@ func TestLocationAPI(t *testing.T) {
 				operation := createLocation(
 					device.ID.Hex(),
 					api_model.CreateLocation{
-						Latitude:  32.086880,
-						Longitude: 34.775759,
+						Latitude:  Ptr(32.086880),
+						Longitude: Ptr(34.775759),
 					},
 				)
 
@@ -230,6 +235,52 @@ func TestLocationAPI(t *testing.T) {
 
 			assert.Equal(t, locationHistory, len(locations))
 		})
+
+		t.Run("history limit concurrent", func(t *testing.T) {
+			count := 10 * locationHistory
+			device := createDevice("device-9-serial", "device-9-name")
+
+			// checked once every request is done, from the test goroutine
+			codes := make([]int, count)
+
+			var wg sync.WaitGroup
+			for i := range count {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					w := performRequest(
+						router,
+						"POST",
+						fmt.Sprintf("/api/devices/%s/locations/", device.ID.Hex()),
+						validAPIKey,
+						api_model.CreateLocation{
+							Latitude:  Ptr(32.086880),
+							Longitude: Ptr(34.775759),
+						},
+					)
+
+					codes[i] = w.Code
+				}()
+			}
+
+			wg.Wait()
+
+			for _, code := range codes {
+				assert.Equal(t, http.StatusOK, code)
+			}
+
+			locations := PerformOKRequest[[]model.Location](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s/locations/", device.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+
+			assert.Equal(t, locationHistory, len(locations))
+		})
 	})
 
 	t.Run("Delete Locations", func(t *testing.T) {
@@ -241,8 +292,8 @@ func TestLocationAPI(t *testing.T) {
 				operation := createLocation(
 					device.ID.Hex(),
 					api_model.CreateLocation{
-						Latitude:  32.086880,
-						Longitude: 34.775759,
+						Latitude:  Ptr(32.086880),
+						Longitude: Ptr(34.775759),
 					},
 				)
 
@@ -306,15 +357,15 @@ func TestLocationAPI(t *testing.T) {
 				operation := createLocation(
 					device.ID.Hex(),
 					api_model.CreateLocation{
-						Latitude:  32.086880,
-						Longitude: 34.775759,
+						Latitude:  Ptr(32.086880),
+						Longitude: Ptr(34.775759),
 					},
 				)
 
 				assert.True(t, operation.Success)
 			}
 
-			operation := PerformOKRequest[api_model.Operation](
+			result := PerformOKRequest[api_model.DeleteDeviceResult](
 				t,
 				router,
 				"DELETE",
@@ -323,7 +374,8 @@ func TestLocationAPI(t *testing.T) {
 				nil,
 			)
 
-			assert.True(t, operation.Success)
+			assert.True(t, result.Success)
+			assert.Equal(t, int64(count), result.DeletedLocations, "Deleted locations mismatch")
 
 			errRes := PerformFailedRequest(
 				t,
@@ -346,8 +398,8 @@ func TestLocationAPI(t *testing.T) {
 			operation := createLocation(
 				device.ID.Hex(),
 				api_model.CreateLocation{
-					Latitude:  32.086880,
-					Longitude: 34.775759,
+					Latitude:  Ptr(32.086880),
+					Longitude: Ptr(34.775759),
 				},
 			)
 
@@ -389,4 +441,640 @@ func TestLocationAPI(t *testing.T) {
 			assert.Nil(t, response.Error, "Error is not nil")
 		})
 	})
+
+	t.Run("Device Last Location", func(t *testing.T) {
+		getDevice := func(deviceID string) model.Device {
+			return PerformOKRequest[model.Device](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s", deviceID),
+				validAPIKey,
+				nil,
+			)
+		}
+
+		t.Run("valid", func(t *testing.T) {
+			device := createDevice("device-10-serial", "device-10-name")
+			assert.Nil(t, getDevice(device.ID.Hex()).LastLocation, "LastLocation is not nil")
+
+			payloads := []api_model.CreateLocation{
+				{Latitude: Ptr(32.086880), Longitude: Ptr(34.775759)},
+				{Latitude: Ptr(32.179111), Longitude: Ptr(34.916111)},
+			}
+
+			for _, payload := range payloads {
+				operation := createLocation(device.ID.Hex(), payload)
+				assert.True(t, operation.Success)
+			}
+
+			latest := PerformOKRequest[model.Location](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s/locations/latest", device.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+
+			fetched := getDevice(device.ID.Hex())
+			if assert.NotNil(t, fetched.LastLocation, "LastLocation is nil") {
+				assert.Equal(t, latest.ID, fetched.LastLocation.ID, "ID mismatch")
+				assert.Equal(t, device.ID, fetched.LastLocation.DeviceID, "DeviceID mismatch")
+				assert.Equal(t, *payloads[1].Latitude, fetched.LastLocation.Latitude, "Latitude mismatch")
+				assert.Equal(t, *payloads[1].Longitude, fetched.LastLocation.Longitude, "Longitude mismatch")
+			}
+
+			devices := PerformOKRequest[[]model.Device](
+				t,
+				router,
+				"GET",
+				"/api/devices/",
+				validAPIKey,
+				nil,
+			)
+
+			for _, listed := range devices {
+				if listed.ID == device.ID && assert.NotNil(t, listed.LastLocation, "LastLocation is nil") {
+					assert.Equal(t, latest.ID, listed.LastLocation.ID, "ID mismatch")
+				}
+			}
+		})
+
+		t.Run("delete latest", func(t *testing.T) {
+			device := createDevice("device-11-serial", "device-11-name")
+
+			payloads := []api_model.CreateLocation{
+				{Latitude: Ptr(32.086880), Longitude: Ptr(34.775759)},
+				{Latitude: Ptr(32.179111), Longitude: Ptr(34.916111)},
+			}
+
+			for _, payload := range payloads {
+				operation := createLocation(device.ID.Hex(), payload)
+				assert.True(t, operation.Success)
+			}
+
+			deleteLatest := func() {
+				lastLocation := getDevice(device.ID.Hex()).LastLocation
+				if !assert.NotNil(t, lastLocation, "LastLocation is nil") {
+					return
+				}
+
+				operation := PerformOKRequest[api_model.Operation](
+					t,
+					router,
+					"DELETE",
+					fmt.Sprintf("/api/devices/%s/locations/%s", device.ID.Hex(), lastLocation.ID.Hex()),
+					validAPIKey,
+					nil,
+				)
+
+				assert.True(t, operation.Success)
+			}
+
+			// recomputed from the remaining history
+			deleteLatest()
+
+			fetched := getDevice(device.ID.Hex())
+			if assert.NotNil(t, fetched.LastLocation, "LastLocation is nil") {
+				assert.Equal(t, *payloads[0].Latitude, fetched.LastLocation.Latitude, "Latitude mismatch")
+				assert.Equal(t, *payloads[0].Longitude, fetched.LastLocation.Longitude, "Longitude mismatch")
+			}
+
+			deleteLatest()
+
+			assert.Nil(t, getDevice(device.ID.Hex()).LastLocation, "LastLocation is not nil")
+		})
+
+		t.Run("delete all", func(t *testing.T) {
+			device := createDevice("device-12-serial", "device-12-name")
+
+			operation := createLocation(device.ID.Hex(), api_model.CreateLocation{
+				Latitude:  Ptr(32.086880),
+				Longitude: Ptr(34.775759),
+			})
+			assert.True(t, operation.Success)
+
+			operation = PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"DELETE",
+				fmt.Sprintf("/api/devices/%s/locations/", device.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			assert.True(t, operation.Success)
+
+			assert.Nil(t, getDevice(device.ID.Hex()).LastLocation, "LastLocation is not nil")
+		})
+	})
+
+	t.Run("Telemetry", func(t *testing.T) {
+		getDevice := func(deviceID string) model.Device {
+			return PerformOKRequest[model.Device](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s", deviceID),
+				validAPIKey,
+				nil,
+			)
+		}
+
+		t.Run("valid", func(t *testing.T) {
+			device := createDevice("device-13-serial", "device-13-name")
+
+			telemetry := model.Telemetry{
+				Accuracy: Ptr(12.5),
+				Altitude: Ptr(-3.2),
+				Speed:    Ptr(0.0),
+				Bearing:  Ptr(271.4),
+				Battery:  Ptr(87),
+				Provider: "gps",
+			}
+
+			operation := createLocation(device.ID.Hex(), api_model.CreateLocation{
+				Latitude:  Ptr(32.086880),
+				Longitude: Ptr(34.775759),
+				Telemetry: telemetry,
+			})
+			assert.True(t, operation.Success)
+
+			location := PerformOKRequest[model.Location](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s/locations/latest", device.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			assert.Equal(t, telemetry, location.Telemetry, "Telemetry mismatch")
+
+			lastLocation := getDevice(device.ID.Hex()).LastLocation
+			if assert.NotNil(t, lastLocation, "LastLocation is nil") {
+				assert.Equal(t, telemetry, lastLocation.Telemetry, "LastLocation telemetry mismatch")
+			}
+
+			// all optional
+			operation = createLocation(device.ID.Hex(), api_model.CreateLocation{
+				Latitude:  Ptr(32.086880),
+				Longitude: Ptr(34.775759),
+			})
+			assert.True(t, operation.Success)
+
+			locations := PerformOKRequest[[]model.Location](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s/locations/", device.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			if assert.Len(t, locations, 2) {
+				assert.Equal(t, telemetry, locations[0].Telemetry, "Telemetry mismatch")
+				assert.Equal(t, model.Telemetry{}, locations[1].Telemetry, "Telemetry should be empty")
+			}
+		})
+
+		t.Run("ingest", func(t *testing.T) {
+			device := PerformOKRequest[model.Device](
+				t,
+				router,
+				"POST",
+				"/api/ingest",
+				validAPIKey,
+				api_model.IngestLocation{
+					Serial:    "device-14-serial",
+					Name:      "device-14-name",
+					Latitude:  Ptr(32.086880),
+					Longitude: Ptr(34.775759),
+					Telemetry: model.Telemetry{Battery: Ptr(5), Provider: "network"},
+				},
+			)
+
+			if assert.NotNil(t, device.LastLocation, "LastLocation is nil") {
+				assert.Equal(t, 5, *device.LastLocation.Battery, "Battery mismatch")
+				assert.Equal(t, "network", device.LastLocation.Provider, "Provider mismatch")
+			}
+		})
+
+		t.Run("invalid params", func(t *testing.T) {
+			device := createDevice("device-15-serial", "device-15-name")
+
+			for _, telemetry := range []model.Telemetry{
+				{Accuracy: Ptr(-1.0)},
+				{Speed: Ptr(-0.5)},
+				{Bearing: Ptr(360.0)},
+				{Bearing: Ptr(-1.0)},
+				{Battery: Ptr(101)},
+				{Battery: Ptr(-1)},
+				{Provider: strings.Repeat("a", 33)},
+			} {
+				errRes := PerformFailedRequest(
+					t,
+					router,
+					"POST",
+					fmt.Sprintf("/api/devices/%s/locations/", device.ID.Hex()),
+					validAPIKey,
+					api_model.CreateLocation{
+						Latitude:  Ptr(32.086880),
+						Longitude: Ptr(34.775759),
+						Telemetry: telemetry,
+					},
+					http.StatusBadRequest,
+				)
+
+				assert.Equal(t, "Bad request", errRes.Message, "Error message mismatch")
+			}
+
+			errRes := PerformFailedRequest(
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s/locations/latest?max_accuracy=0", device.ID.Hex()),
+				validAPIKey,
+				nil,
+				http.StatusBadRequest,
+			)
+
+			assert.Equal(t, "Bad request", errRes.Message, "Error message mismatch")
+		})
+
+		t.Run("max accuracy", func(t *testing.T) {
+			device := createDevice("device-16-serial", "device-16-name")
+
+			for _, location := range []api_model.CreateLocation{
+				{Latitude: Ptr(32.1), Longitude: Ptr(34.7), Telemetry: model.Telemetry{Accuracy: Ptr(8.0)}},
+				{Latitude: Ptr(32.2), Longitude: Ptr(34.7)},
+				{Latitude: Ptr(32.3), Longitude: Ptr(34.7), Telemetry: model.Telemetry{Accuracy: Ptr(30.0)}},
+				{Latitude: Ptr(32.4), Longitude: Ptr(34.7), Telemetry: model.Telemetry{Accuracy: Ptr(1200.0)}},
+			} {
+				assert.True(t, createLocation(device.ID.Hex(), location).Success)
+			}
+
+			latest := PerformOKRequest[model.Location](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s/locations/latest", device.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			assert.Equal(t, 32.4, latest.Latitude, "Latest location mismatch")
+
+			latest = PerformOKRequest[model.Location](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s/locations/latest?max_accuracy=50", device.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			assert.Equal(t, 32.3, latest.Latitude, "Latest accurate location mismatch")
+
+			// fixes without an accuracy are kept
+			locations := PerformOKRequest[[]model.Location](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s/locations/?max_accuracy=10", device.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			if assert.Len(t, locations, 2) {
+				assert.Equal(t, 32.1, locations[0].Latitude, "Latitude mismatch")
+				assert.Equal(t, 32.2, locations[1].Latitude, "Latitude mismatch")
+			}
+
+			// nothing accurate enough
+			other := createDevice("device-17-serial", "device-17-name")
+			assert.True(t, createLocation(other.ID.Hex(), api_model.CreateLocation{
+				Latitude:  Ptr(32.086880),
+				Longitude: Ptr(34.775759),
+				Telemetry: model.Telemetry{Accuracy: Ptr(100.0)},
+			}).Success)
+
+			response := PerformOKRequestNoValidateResponse(
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s/locations/latest?max_accuracy=50", other.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			assert.Nil(t, response.Data, "Location is not nil")
+			assert.Nil(t, response.Error, "Error is not nil")
+		})
+	})
+
+	t.Run("Recorded At", func(t *testing.T) {
+		ago := func(d time.Duration) *time.Time {
+			at := time.Now().UTC().Add(-d).Truncate(time.Millisecond)
+			return &at
+		}
+
+		getLocations := func(deviceID string) []model.Location {
+			return PerformOKRequest[[]model.Location](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+				validAPIKey,
+				nil,
+			)
+		}
+
+		t.Run("delayed", func(t *testing.T) {
+			device := createDevice("device-18-serial", "device-18-name")
+
+			recordedAt := ago(time.Minute)
+			assert.True(t, createLocation(device.ID.Hex(), api_model.CreateLocation{
+				Latitude:   Ptr(32.1),
+				Longitude:  Ptr(34.7),
+				RecordedAt: recordedAt,
+			}).Success)
+
+			// queued while offline, posted after a newer one
+			delayedAt := ago(time.Hour)
+			assert.True(t, createLocation(device.ID.Hex(), api_model.CreateLocation{
+				Latitude:   Ptr(32.2),
+				Longitude:  Ptr(34.7),
+				RecordedAt: delayedAt,
+			}).Success)
+
+			latest := PerformOKRequest[model.Location](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s/locations/latest", device.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			assert.Equal(t, 32.1, latest.Latitude, "Latest location mismatch")
+			assert.Equal(t, *recordedAt, latest.RecordedAt, "RecordedAt mismatch")
+
+			lastLocation := PerformOKRequest[model.Device](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s", device.ID.Hex()),
+				validAPIKey,
+				nil,
+			).LastLocation
+			if assert.NotNil(t, lastLocation, "LastLocation is nil") {
+				assert.Equal(t, 32.1, lastLocation.Latitude, "LastLocation mismatch")
+			}
+
+			// the history goes by the recorded time, the time posted is kept apart
+			locations := getLocations(device.ID.Hex())
+			if assert.Len(t, locations, 2) {
+				assert.Equal(t, 32.2, locations[0].Latitude, "Latitude mismatch")
+				assert.Equal(t, *delayedAt, locations[0].RecordedAt, "RecordedAt mismatch")
+				assert.False(t, locations[0].CreatedAt.Before(locations[1].CreatedAt), "CreatedAt should be the time posted")
+				assert.Equal(t, 32.1, locations[1].Latitude, "Latitude mismatch")
+			}
+
+			// recorded when posted without a recorded time
+			assert.True(t, createLocation(device.ID.Hex(), api_model.CreateLocation{
+				Latitude:  Ptr(32.3),
+				Longitude: Ptr(34.7),
+			}).Success)
+
+			locations = getLocations(device.ID.Hex())
+			if assert.Len(t, locations, 3) {
+				assert.Equal(t, 32.3, locations[2].Latitude, "Latitude mismatch")
+				assert.Equal(t, locations[2].CreatedAt, locations[2].RecordedAt, "RecordedAt mismatch")
+			}
+		})
+
+		t.Run("history limit", func(t *testing.T) {
+			device := createDevice("device-19-serial", "device-19-name")
+
+			for i := range locationHistory {
+				assert.True(t, createLocation(device.ID.Hex(), api_model.CreateLocation{
+					Latitude:   Ptr(32.1 + float64(i)/10),
+					Longitude:  Ptr(34.7),
+					RecordedAt: ago(time.Duration(locationHistory-i) * time.Minute),
+				}).Success)
+			}
+
+			// older than the whole history, trimmed right away
+			assert.True(t, createLocation(device.ID.Hex(), api_model.CreateLocation{
+				Latitude:   Ptr(31.9),
+				Longitude:  Ptr(34.7),
+				RecordedAt: ago(time.Hour),
+			}).Success)
+
+			locations := getLocations(device.ID.Hex())
+			if assert.Len(t, locations, locationHistory) {
+				assert.Equal(t, 32.1, locations[0].Latitude, "Oldest location mismatch")
+			}
+
+			// the oldest recorded one is trimmed, not the first posted one
+			assert.True(t, createLocation(device.ID.Hex(), api_model.CreateLocation{
+				Latitude:   Ptr(32.0),
+				Longitude:  Ptr(34.7),
+				RecordedAt: ago(time.Duration(locationHistory)*time.Minute - time.Second),
+			}).Success)
+
+			locations = getLocations(device.ID.Hex())
+			if assert.Len(t, locations, locationHistory) {
+				assert.Equal(t, 32.0, locations[0].Latitude, "Oldest location mismatch")
+				assert.Equal(t, 32.2, locations[1].Latitude, "Latitude mismatch")
+			}
+		})
+
+		t.Run("invalid params", func(t *testing.T) {
+			device := createDevice("device-20-serial", "device-20-name")
+
+			for _, recordedAt := range []*time.Time{
+				ago(-time.Hour),
+				ago(recordedAtMaxSkew + time.Minute),
+			} {
+				errRes := PerformFailedRequest(
+					t,
+					router,
+					"POST",
+					fmt.Sprintf("/api/devices/%s/locations/", device.ID.Hex()),
+					validAPIKey,
+					api_model.CreateLocation{
+						Latitude:   Ptr(32.086880),
+						Longitude:  Ptr(34.775759),
+						RecordedAt: recordedAt,
+					},
+					http.StatusBadRequest,
+				)
+
+				assert.Equal(t, "Bad request", errRes.Message, "Error message mismatch")
+			}
+
+			assert.Empty(t, getLocations(device.ID.Hex()))
+
+			// a slightly ahead device clock is tolerated
+			assert.True(t, createLocation(device.ID.Hex(), api_model.CreateLocation{
+				Latitude:   Ptr(32.086880),
+				Longitude:  Ptr(34.775759),
+				RecordedAt: ago(-time.Minute),
+			}).Success)
+		})
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		createLocations := func(deviceID string, payload any) []api_model.CreateLocationResult {
+			return PerformOKRequest[[]api_model.CreateLocationResult](
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/locations/batch", deviceID),
+				validAPIKey,
+				payload,
+			)
+		}
+
+		getLocations := func(deviceID string) []model.Location {
+			return PerformOKRequest[[]model.Location](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+				validAPIKey,
+				nil,
+			)
+		}
+
+		t.Run("valid", func(t *testing.T) {
+			device := createDevice("device-21-serial", "device-21-name")
+			recordedAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Millisecond)
+
+			results := createLocations(device.ID.Hex(), []api_model.CreateLocation{
+				{Latitude: Ptr(32.1), Longitude: Ptr(34.7), RecordedAt: &recordedAt},
+				{Latitude: Ptr(32.2), Longitude: Ptr(34.7), Telemetry: model.Telemetry{Provider: "gps"}},
+			})
+
+			locations := getLocations(device.ID.Hex())
+			if assert.Len(t, results, 2) && assert.Len(t, locations, 2) {
+				for i, result := range results {
+					assert.True(t, result.Success, "Success mismatch")
+					assert.Nil(t, result.Error, "Error is not nil")
+					assert.Equal(t, locations[i].ID.Hex(), result.ID, "ID mismatch")
+				}
+
+				assert.Equal(t, recordedAt, locations[0].RecordedAt, "RecordedAt mismatch")
+				assert.Equal(t, "gps", locations[1].Provider, "Provider mismatch")
+			}
+
+			lastLocation := PerformOKRequest[model.Device](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s", device.ID.Hex()),
+				validAPIKey,
+				nil,
+			).LastLocation
+			if assert.NotNil(t, lastLocation, "LastLocation is nil") {
+				assert.Equal(t, 32.2, lastLocation.Latitude, "LastLocation mismatch")
+			}
+		})
+
+		t.Run("partial failure", func(t *testing.T) {
+			device := createDevice("device-22-serial", "device-22-name")
+			future := time.Now().UTC().Add(time.Hour)
+
+			results := createLocations(device.ID.Hex(), []any{
+				api_model.CreateLocation{Latitude: Ptr(32.1), Longitude: Ptr(34.7)},
+				api_model.CreateLocation{Latitude: Ptr(132.1), Longitude: Ptr(34.7)},
+				api_model.CreateLocation{Latitude: Ptr(32.3), Longitude: Ptr(34.7), RecordedAt: &future},
+				"not a location",
+				api_model.CreateLocation{Latitude: Ptr(32.5), Longitude: Ptr(34.7)},
+			})
+
+			if assert.Len(t, results, 5) {
+				for _, i := range []int{0, 4} {
+					assert.True(t, results[i].Success, "Success mismatch")
+					assert.NotEmpty(t, results[i].ID, "ID is empty")
+				}
+
+				// the validation failure and the one the single location endpoint would respond with
+				for i, message := range map[int]string{
+					1: "Field validation for 'Latitude' failed",
+					2: "Bad request",
+					3: "cannot unmarshal string",
+				} {
+					assert.False(t, results[i].Success, "Success mismatch")
+					assert.Empty(t, results[i].ID, "ID is not empty")
+					if assert.NotNil(t, results[i].Error, "Error is nil") {
+						assert.Contains(t, results[i].Error.Message, message, "Error message mismatch")
+					}
+				}
+			}
+
+			locations := getLocations(device.ID.Hex())
+			if assert.Len(t, locations, 2) {
+				assert.Equal(t, 32.1, locations[0].Latitude, "Latitude mismatch")
+				assert.Equal(t, 32.5, locations[1].Latitude, "Latitude mismatch")
+			}
+		})
+
+		t.Run("history limit", func(t *testing.T) {
+			device := createDevice("device-23-serial", "device-23-name")
+
+			payload := []api_model.CreateLocation{}
+			for i := range 3 * locationHistory {
+				payload = append(payload, api_model.CreateLocation{
+					Latitude:  Ptr(30 + float64(i)/10),
+					Longitude: Ptr(34.7),
+				})
+			}
+
+			results := createLocations(device.ID.Hex(), payload)
+			assert.Len(t, results, 3*locationHistory)
+
+			// the newest ones are kept
+			locations := getLocations(device.ID.Hex())
+			if assert.Len(t, locations, locationHistory) {
+				assert.Equal(t, *payload[2*locationHistory].Latitude, locations[0].Latitude, "Latitude mismatch")
+			}
+		})
+
+		t.Run("invalid params", func(t *testing.T) {
+			device := createDevice("device-24-serial", "device-24-name")
+
+			tooMany := make([]api_model.CreateLocation, 1001)
+			for i := range tooMany {
+				tooMany[i] = api_model.CreateLocation{Latitude: Ptr(32.1), Longitude: Ptr(34.7)}
+			}
+
+			for _, payload := range []any{
+				[]api_model.CreateLocation{},
+				api_model.CreateLocation{Latitude: Ptr(32.1), Longitude: Ptr(34.7)},
+				tooMany,
+			} {
+				errRes := PerformFailedRequest(
+					t,
+					router,
+					"POST",
+					fmt.Sprintf("/api/devices/%s/locations/batch", device.ID.Hex()),
+					validAPIKey,
+					payload,
+					http.StatusBadRequest,
+				)
+
+				assert.Equal(t, "Bad request", errRes.Message, "Error message mismatch")
+			}
+
+			assert.Empty(t, getLocations(device.ID.Hex()))
+
+			errRes := PerformFailedRequest(
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/locations/batch", bson.NewObjectID().Hex()),
+				validAPIKey,
+				[]api_model.CreateLocation{{Latitude: Ptr(32.1), Longitude: Ptr(34.7)}},
+				http.StatusNotFound,
+			)
+
+			assert.Equal(t, "Not found", errRes.Message, "Error message mismatch")
+		})
+	})
 }
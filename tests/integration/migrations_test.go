@@ -0,0 +1,56 @@
+package integration
+
+import (
+	"context"
+	"dwimc/internal/database"
+	"dwimc/internal/migrations"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigrations(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := database.InitializeDatabase(setupDatabaseURI(t), "dwimc_test")
+	require.NoError(t, err, "Failed to initialize database")
+
+	t.Cleanup(func() {
+		err := db.Close(ctx)
+		require.NoError(t, err, "Failed to close database")
+	})
+
+	var pending []migrations.Migration
+
+	t.Run("dry run", func(t *testing.T) {
+		pending, err = migrations.Run(ctx, db, true)
+		require.NoError(t, err)
+
+		again, err := migrations.Pending(ctx, db)
+		require.NoError(t, err)
+
+		assert.Equal(t, pending, again, "Dry run should not apply migrations")
+	})
+
+	t.Run("run", func(t *testing.T) {
+		applied, err := migrations.Run(ctx, db, false)
+		require.NoError(t, err)
+
+		assert.Equal(t, pending, applied, "Applied migrations mismatch")
+
+		for i := 1; i < len(applied); i++ {
+			assert.Less(t, applied[i-1].Version, applied[i].Version, "Migrations should be ordered")
+		}
+	})
+
+	t.Run("up to date", func(t *testing.T) {
+		applied, err := migrations.Run(ctx, db, false)
+		require.NoError(t, err)
+		assert.Empty(t, applied)
+
+		pending, err := migrations.Pending(ctx, db)
+		require.NoError(t, err)
+		assert.Empty(t, pending)
+	})
+}
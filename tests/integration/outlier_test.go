@@ -0,0 +1,279 @@
+package integration
+
+import (
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
+	"dwimc/internal/services"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocationOutliers(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+
+	at := FromHourAgo()
+
+	getLatest := func(t *testing.T, router *gin.Engine, deviceID string) (model.Location, *model.Location) {
+		latest := PerformOKRequest[model.Location](
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/latest", deviceID),
+			validAPIKey,
+			nil,
+		)
+
+		device := PerformOKRequest[model.Device](t, router, "GET", "/api/devices/"+deviceID, validAPIKey, nil)
+
+		return latest, device.LastLocation
+	}
+
+	// Tel Aviv, a fix 1km away and one in Jerusalem, 54km away
+	plausible := api_model.CreateLocation{Latitude: Ptr(32.086880), Longitude: Ptr(34.775759), RecordedAt: at(0)}
+	nearby := api_model.CreateLocation{Latitude: Ptr(32.095880), Longitude: Ptr(34.775759)}
+	faraway := api_model.CreateLocation{Latitude: Ptr(31.778), Longitude: Ptr(35.235)}
+	// reported by a device without a fix
+	nullIsland := api_model.CreateLocation{Latitude: Ptr(0.0), Longitude: Ptr(0.0)}
+
+	policy := services.LocationPolicy{
+		MaxAccuracy: 100,
+		MaxSpeed:    70,
+		NullIsland:  true,
+	}
+
+	t.Run("Rejected", func(t *testing.T) {
+		router, _, deviceID := SetupDeviceTestEnv(t, validAPIKey, TestEnvParams{LocationPolicy: policy})
+
+		CreateLocation(t, router, validAPIKey, deviceID, plausible)
+
+		inaccurate := plausible
+		inaccurate.RecordedAt = at(time.Minute)
+		inaccurate.Accuracy = Ptr(1500.0)
+		CreateLocation(t, router, validAPIKey, deviceID, inaccurate)
+
+		noFix := nullIsland
+		noFix.RecordedAt = at(2 * time.Minute)
+		CreateLocation(t, router, validAPIKey, deviceID, noFix)
+
+		// over 400 m/s
+		tooFast := faraway
+		tooFast.RecordedAt = at(3 * time.Minute)
+		CreateLocation(t, router, validAPIKey, deviceID, tooFast)
+
+		// stored for auditing, along with the reason
+		locations := GetLocations(t, router, validAPIKey, deviceID)
+		require.Len(t, locations, 4)
+
+		assert.Equal(t, model.Screening{}, locations[0].Screening)
+		assert.Equal(t, model.Screening{Outlier: model.OutlierAccuracy, Rejected: true}, locations[1].Screening)
+		assert.Equal(t, model.Screening{Outlier: model.OutlierNullIsland, Rejected: true}, locations[2].Screening)
+		assert.Equal(t, model.Screening{Outlier: model.OutlierSpeed, Rejected: true}, locations[3].Screening)
+
+		// but never the latest location
+		latest, lastLocation := getLatest(t, router, deviceID)
+		assert.Equal(t, locations[0].ID, latest.ID)
+		if assert.NotNil(t, lastLocation, "LastLocation is nil") {
+			assert.Equal(t, locations[0].ID, lastLocation.ID)
+		}
+
+		// reachable at about 3 m/s from the latest location, not from the rejected one
+		reachable := nearby
+		reachable.RecordedAt = at(5 * time.Minute)
+		CreateLocation(t, router, validAPIKey, deviceID, reachable)
+
+		latest, lastLocation = getLatest(t, router, deviceID)
+		assert.Equal(t, model.Screening{}, latest.Screening)
+		assert.Equal(t, *reachable.Latitude, latest.Latitude)
+		if assert.NotNil(t, lastLocation, "LastLocation is nil") {
+			assert.Equal(t, latest.ID, lastLocation.ID)
+		}
+
+		// the far away fix is plausible given enough time
+		later := faraway
+		later.RecordedAt = at(50 * time.Minute)
+		CreateLocation(t, router, validAPIKey, deviceID, later)
+
+		latest, _ = getLatest(t, router, deviceID)
+		assert.Equal(t, model.Screening{}, latest.Screening)
+		assert.Equal(t, *later.Latitude, latest.Latitude)
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		router, _, deviceID := SetupDeviceTestEnv(t, validAPIKey, TestEnvParams{LocationPolicy: policy})
+
+		tooFast := faraway
+		tooFast.RecordedAt = at(time.Minute)
+		reachable := nearby
+		reachable.RecordedAt = at(5 * time.Minute)
+		inaccurate := nearby
+		inaccurate.RecordedAt = at(10 * time.Minute)
+		inaccurate.Accuracy = Ptr(1500.0)
+
+		// screened in the order they were recorded at, not posted in
+		results := PerformOKRequest[[]api_model.CreateLocationResult](
+			t,
+			router,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/locations/batch", deviceID),
+			validAPIKey,
+			[]api_model.CreateLocation{inaccurate, reachable, tooFast, plausible},
+		)
+		require.Len(t, results, 4)
+		for _, result := range results {
+			assert.True(t, result.Success)
+		}
+
+		locations := GetLocations(t, router, validAPIKey, deviceID)
+		require.Len(t, locations, 4)
+
+		assert.Equal(t, model.Screening{}, locations[0].Screening)
+		assert.Equal(t, model.Screening{Outlier: model.OutlierSpeed, Rejected: true}, locations[1].Screening)
+		assert.Equal(t, model.Screening{}, locations[2].Screening)
+		assert.Equal(t, model.Screening{Outlier: model.OutlierAccuracy, Rejected: true}, locations[3].Screening)
+
+		latest, lastLocation := getLatest(t, router, deviceID)
+		assert.Equal(t, locations[2].ID, latest.ID)
+		if assert.NotNil(t, lastLocation, "LastLocation is nil") {
+			assert.Equal(t, locations[2].ID, lastLocation.ID)
+		}
+	})
+
+	t.Run("History limit", func(t *testing.T) {
+		const historyLimit = 3
+
+		router, _, deviceID := SetupDeviceTestEnv(t, validAPIKey, TestEnvParams{
+			LocationPolicy:       policy,
+			LocationHistoryLimit: historyLimit,
+		})
+
+		CreateLocation(t, router, validAPIKey, deviceID, plausible)
+
+		for i := range historyLimit {
+			noFix := nullIsland
+			noFix.RecordedAt = at(time.Duration(i+1) * time.Minute)
+			CreateLocation(t, router, validAPIKey, deviceID, noFix)
+		}
+
+		// the rejected locations fill the history, but the latest location is kept
+		locations := GetLocations(t, router, validAPIKey, deviceID)
+		require.Len(t, locations, historyLimit+1)
+		assert.Equal(t, model.Screening{}, locations[0].Screening)
+
+		latest, lastLocation := getLatest(t, router, deviceID)
+		assert.Equal(t, locations[0].ID, latest.ID)
+		if assert.NotNil(t, lastLocation, "LastLocation is nil") {
+			assert.Equal(t, locations[0].ID, lastLocation.ID)
+		}
+	})
+
+	t.Run("Flagged", func(t *testing.T) {
+		flagging := policy
+		flagging.FlagOnly = true
+
+		router, _, deviceID := SetupDeviceTestEnv(t, validAPIKey, TestEnvParams{LocationPolicy: flagging})
+
+		CreateLocation(t, router, validAPIKey, deviceID, plausible)
+
+		inaccurate := plausible
+		inaccurate.RecordedAt = at(time.Minute)
+		inaccurate.Accuracy = Ptr(1500.0)
+		CreateLocation(t, router, validAPIKey, deviceID, inaccurate)
+
+		// flagged outliers still become the latest location
+		latest, lastLocation := getLatest(t, router, deviceID)
+		assert.Equal(t, model.Screening{Outlier: model.OutlierAccuracy}, latest.Screening)
+		if assert.NotNil(t, lastLocation, "LastLocation is nil") {
+			assert.Equal(t, latest.ID, lastLocation.ID)
+			assert.Equal(t, model.OutlierAccuracy, lastLocation.Outlier)
+		}
+	})
+
+	t.Run("Only rejected", func(t *testing.T) {
+		router, _, deviceID := SetupDeviceTestEnv(t, validAPIKey, TestEnvParams{LocationPolicy: policy})
+
+		CreateLocation(t, router, validAPIKey, deviceID, nullIsland)
+
+		assert.Len(t, GetLocations(t, router, validAPIKey, deviceID), 1)
+
+		response := PerformOKRequestNoValidateResponse(
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/latest", deviceID),
+			validAPIKey,
+			nil,
+		)
+		assert.Nil(t, response.Data, "Latest location should be empty")
+
+		device := PerformOKRequest[model.Device](t, router, "GET", "/api/devices/"+deviceID, validAPIKey, nil)
+		assert.Nil(t, device.LastLocation)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		router, _, deviceID := SetupDeviceTestEnv(t, validAPIKey, TestEnvParams{LocationPolicy: services.LocationPolicy{}})
+
+		inaccurate := plausible
+		inaccurate.Accuracy = Ptr(1500.0)
+		CreateLocation(t, router, validAPIKey, deviceID, inaccurate)
+
+		tooFast := faraway
+		tooFast.RecordedAt = at(time.Minute)
+		CreateLocation(t, router, validAPIKey, deviceID, tooFast)
+
+		for _, location := range GetLocations(t, router, validAPIKey, deviceID) {
+			assert.Equal(t, model.Screening{}, location.Screening)
+		}
+
+		// (0,0) is refused as missing coordinates
+		PerformFailedRequest(
+			t,
+			router,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+			validAPIKey,
+			nullIsland,
+			http.StatusBadRequest,
+		)
+	})
+
+	t.Run("Missing coordinates", func(t *testing.T) {
+		router, _, deviceID := SetupDeviceTestEnv(t, validAPIKey, TestEnvParams{LocationPolicy: policy})
+
+		// told apart from (0,0) though screened as an outlier
+		for _, payload := range []api_model.CreateLocation{
+			{},
+			{Latitude: Ptr(0.0)},
+			{Longitude: Ptr(0.0)},
+		} {
+			PerformFailedRequest(
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+				validAPIKey,
+				payload,
+				http.StatusBadRequest,
+			)
+		}
+
+		results := PerformOKRequest[[]api_model.CreateLocationResult](
+			t,
+			router,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/locations/batch", deviceID),
+			validAPIKey,
+			[]api_model.CreateLocation{{}, nullIsland},
+		)
+		require.Len(t, results, 2)
+		assert.False(t, results[0].Success)
+		assert.True(t, results[1].Success)
+
+		assert.Len(t, GetLocations(t, router, validAPIKey, deviceID), 1)
+	})
+}
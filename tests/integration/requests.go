@@ -3,15 +3,24 @@ package integration
 import (
 	"bytes"
 	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// RequestHeader is set on a request along with the API key, unless its value is empty
+type RequestHeader struct {
+	Name  string
+	Value string
+}
+
 type NoValidatedResponse struct {
 	Data  any                      `json:"data"`
 	Error *api_model.ErrorResponse `json:"error"`
@@ -24,8 +33,9 @@ func PerformOKRequest[T any](
 	url string,
 	apiKey string,
 	payload any,
+	headers ...RequestHeader,
 ) T {
-	w := performRequest(router, method, url, apiKey, payload)
+	w := performRequest(router, method, url, apiKey, payload, headers...)
 	assert.Equal(t, http.StatusOK, w.Code)
 
 	var response api_model.Response[T]
@@ -45,8 +55,9 @@ func PerformOKRequestNoValidateResponse(
 	url string,
 	apiKey string,
 	payload any,
+	headers ...RequestHeader,
 ) *NoValidatedResponse {
-	w := performRequest(router, method, url, apiKey, payload)
+	w := performRequest(router, method, url, apiKey, payload, headers...)
 	assert.Equal(t, http.StatusOK, w.Code)
 
 	var response NoValidatedResponse
@@ -65,8 +76,9 @@ func PerformFailedRequest(
 	apiKey string,
 	payload any,
 	expectedStatusCode int,
+	headers ...RequestHeader,
 ) *api_model.ErrorResponse {
-	w := performRequest(router, method, url, apiKey, payload)
+	w := performRequest(router, method, url, apiKey, payload, headers...)
 	assert.Equal(t, expectedStatusCode, w.Code)
 
 	var response api_model.Response[any]
@@ -79,12 +91,38 @@ func PerformFailedRequest(
 	return response.Error
 }
 
+// CreateLocation posts a location of the device, failing the test unless it is recorded
+func CreateLocation(t *testing.T, router *gin.Engine, apiKey string, deviceID string, payload api_model.CreateLocation) {
+	operation := PerformOKRequest[api_model.Operation](
+		t,
+		router,
+		"POST",
+		fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+		apiKey,
+		payload,
+	)
+	require.True(t, operation.Success)
+}
+
+// GetLocations returns the location history of the device
+func GetLocations(t *testing.T, router *gin.Engine, apiKey string, deviceID string) []model.Location {
+	return PerformOKRequest[[]model.Location](
+		t,
+		router,
+		"GET",
+		fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+		apiKey,
+		nil,
+	)
+}
+
 func performRequest(
-	router *gin.Engine,
+	router http.Handler,
 	method string,
 	url string,
 	apiKey string,
 	payload any,
+	headers ...RequestHeader,
 ) *httptest.ResponseRecorder {
 	body := []byte{}
 	if payload != nil {
@@ -94,7 +132,17 @@ func performRequest(
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest(method, url, bytes.NewBuffer(body))
 	req.Header.Set("X-API-Key", apiKey)
+	for _, header := range headers {
+		if header.Value != "" {
+			req.Header.Set(header.Name, header.Value)
+		}
+	}
 
 	router.ServeHTTP(w, req)
 	return w
 }
+
+// Ptr returns a pointer to the value, such as the coordinates of a posted location
+func Ptr[T any](value T) *T {
+	return &value
+}
@@ -0,0 +1,194 @@
+package integration
+
+import (
+	"context"
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestLocationRetention(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+	const count = 3
+
+	router, services := SetupTestEnvWithServices(t, TestEnvParams{
+		DatabaseName: "dwimc_test",
+		SecretAPIKey: validAPIKey,
+	})
+
+	createDeviceWithLocations := func(serial string) model.Device {
+		device := PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			"/api/devices/",
+			validAPIKey,
+			api_model.CreateDevice{
+				Serial: serial,
+				Name:   serial + "-name",
+			},
+		)
+
+		for range count {
+			operation := PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/locations/", device.ID.Hex()),
+				validAPIKey,
+				api_model.CreateLocation{
+					Latitude:  Ptr(32.086880),
+					Longitude: Ptr(34.775759),
+				},
+			)
+
+			assert.True(t, operation.Success)
+		}
+
+		return device
+	}
+
+	setRetention := func(deviceID string, retentionPeriod int64) model.Device {
+		return PerformOKRequest[model.Device](
+			t,
+			router,
+			"PUT",
+			fmt.Sprintf("/api/devices/%s/retention", deviceID),
+			validAPIKey,
+			api_model.UpdateDeviceRetention{
+				RetentionPeriod: &retentionPeriod,
+			},
+		)
+	}
+
+	getLocations := func(deviceID string) []model.Location {
+		return PerformOKRequest[[]model.Location](
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+			validAPIKey,
+			nil,
+		)
+	}
+
+	t.Run("Set Retention", func(t *testing.T) {
+		t.Run("valid", func(t *testing.T) {
+			device := createDeviceWithLocations("device-1-serial")
+
+			updated := setRetention(device.ID.Hex(), 3600)
+			assert.Equal(t, device.ID, updated.ID, "ID mismatch")
+			assert.Equal(t, int64(3600), updated.RetentionPeriod, "RetentionPeriod mismatch")
+
+			fetched := PerformOKRequest[model.Device](
+				t,
+				router,
+				"GET",
+				fmt.Sprintf("/api/devices/%s", device.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			assert.Equal(t, int64(3600), fetched.RetentionPeriod, "RetentionPeriod mismatch")
+
+			// upserting the device keeps its retention period
+			upserted := PerformOKRequest[model.Device](
+				t,
+				router,
+				"POST",
+				"/api/devices/",
+				validAPIKey,
+				api_model.CreateDevice{
+					Serial: device.Serial,
+					Name:   "renamed",
+				},
+			)
+			assert.Equal(t, int64(3600), upserted.RetentionPeriod, "RetentionPeriod mismatch")
+		})
+
+		t.Run("invalid params", func(t *testing.T) {
+			device := createDeviceWithLocations("device-2-serial")
+
+			errRes := PerformFailedRequest(
+				t,
+				router,
+				"PUT",
+				fmt.Sprintf("/api/devices/%s/retention", device.ID.Hex()),
+				validAPIKey,
+				map[string]any{},
+				http.StatusBadRequest,
+			)
+
+			assert.Equal(t, "Bad request", errRes.Message, "Error message mismatch")
+		})
+
+		t.Run("invalid no device", func(t *testing.T) {
+			retentionPeriod := int64(3600)
+
+			errRes := PerformFailedRequest(
+				t,
+				router,
+				"PUT",
+				fmt.Sprintf("/api/devices/%s/retention", bson.NewObjectID().Hex()),
+				validAPIKey,
+				api_model.UpdateDeviceRetention{
+					RetentionPeriod: &retentionPeriod,
+				},
+				http.StatusNotFound,
+			)
+
+			assert.Equal(t, "Not found", errRes.Message, "Error message mismatch")
+		})
+	})
+
+	t.Run("Delete Expired Locations", func(t *testing.T) {
+		ctx := context.Background()
+
+		overridden := createDeviceWithLocations("device-3-serial")
+		setRetention(overridden.ID.Hex(), 1)
+
+		kept := createDeviceWithLocations("device-4-serial")
+		setRetention(kept.ID.Hex(), -1)
+
+		defaulted := createDeviceWithLocations("device-5-serial")
+
+		// lets the locations expire, timestamps have milliseconds precision
+		time.Sleep(1100 * time.Millisecond)
+
+		t.Run("no default", func(t *testing.T) {
+			_, err := services.Device.DeleteExpiredLocations(ctx, 0)
+			require.NoError(t, err)
+
+			// the latest location is kept regardless of its age
+			locations := getLocations(overridden.ID.Hex())
+			assert.Equal(t, 1, len(locations))
+
+			assert.Equal(t, count, len(getLocations(kept.ID.Hex())))
+			assert.Equal(t, count, len(getLocations(defaulted.ID.Hex())))
+		})
+
+		t.Run("default", func(t *testing.T) {
+			_, err := services.Device.DeleteExpiredLocations(ctx, time.Millisecond)
+			require.NoError(t, err)
+
+			assert.Equal(t, 1, len(getLocations(overridden.ID.Hex())))
+			assert.Equal(t, count, len(getLocations(kept.ID.Hex())))
+			assert.Equal(t, 1, len(getLocations(defaulted.ID.Hex())))
+		})
+
+		t.Run("not expired", func(t *testing.T) {
+			device := createDeviceWithLocations("device-6-serial")
+
+			_, err := services.Device.DeleteExpiredLocations(ctx, time.Hour)
+			require.NoError(t, err)
+
+			assert.Equal(t, count, len(getLocations(device.ID.Hex())))
+		})
+	})
+}
@@ -0,0 +1,260 @@
+package integration
+
+import (
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSerialAPI(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+
+	router := SetupTestEnv(t, TestEnvParams{
+		DatabaseName:         "dwimc_test",
+		SecretAPIKey:         validAPIKey,
+		LocationHistoryLimit: 10,
+	})
+
+	createDevice := func(serial string) model.Device {
+		return PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			"/api/devices/",
+			validAPIKey,
+			api_model.CreateDevice{
+				Serial: serial,
+				Name:   serial + "-name",
+			},
+		)
+	}
+
+	t.Run("Device By Serial", func(t *testing.T) {
+		t.Run("valid", func(t *testing.T) {
+			device := createDevice("device-1-serial")
+
+			fetched := PerformOKRequest[model.Device](
+				t,
+				router,
+				"GET",
+				"/api/devices/by-serial/device-1-serial",
+				validAPIKey,
+				nil,
+			)
+
+			assert.Equal(t, device.ID, fetched.ID, "ID mismatch")
+			assert.Equal(t, device.Serial, fetched.Serial, "Serial mismatch")
+
+			retentionPeriod := int64(3600)
+			updated := PerformOKRequest[model.Device](
+				t,
+				router,
+				"PUT",
+				"/api/devices/by-serial/device-1-serial/retention",
+				validAPIKey,
+				api_model.UpdateDeviceRetention{
+					RetentionPeriod: &retentionPeriod,
+				},
+			)
+
+			assert.Equal(t, device.ID, updated.ID, "ID mismatch")
+			assert.Equal(t, retentionPeriod, updated.RetentionPeriod, "RetentionPeriod mismatch")
+
+			operation := PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"DELETE",
+				"/api/devices/by-serial/device-1-serial",
+				validAPIKey,
+				nil,
+			)
+
+			assert.True(t, operation.Success)
+
+			PerformFailedRequest(
+				t,
+				router,
+				"GET",
+				"/api/devices/by-serial/device-1-serial",
+				validAPIKey,
+				nil,
+				http.StatusNotFound,
+			)
+		})
+
+		t.Run("invalid no device", func(t *testing.T) {
+			for _, request := range []struct{ method, url string }{
+				{"GET", "/api/devices/by-serial/no-such-serial"},
+				{"DELETE", "/api/devices/by-serial/no-such-serial"},
+				{"GET", "/api/devices/by-serial/no-such-serial/locations/"},
+				{"GET", "/api/devices/by-serial/no-such-serial/locations/latest"},
+			} {
+				errRes := PerformFailedRequest(
+					t,
+					router,
+					request.method,
+					request.url,
+					validAPIKey,
+					nil,
+					http.StatusNotFound,
+				)
+
+				assert.Equal(t, "Not found", errRes.Message, "Error message mismatch")
+			}
+		})
+	})
+
+	t.Run("Locations By Serial", func(t *testing.T) {
+		device := createDevice("device-2-serial")
+
+		for _, latitude := range []float64{32.1, 32.2, 32.3} {
+			operation := PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"POST",
+				"/api/devices/by-serial/device-2-serial/locations/",
+				validAPIKey,
+				api_model.CreateLocation{
+					Latitude:  Ptr(latitude),
+					Longitude: Ptr(34.8),
+				},
+			)
+
+			assert.True(t, operation.Success)
+		}
+
+		locations := PerformOKRequest[[]model.Location](
+			t,
+			router,
+			"GET",
+			"/api/devices/by-serial/device-2-serial/locations/",
+			validAPIKey,
+			nil,
+		)
+
+		assert.Equal(t, 3, len(locations))
+
+		latest := PerformOKRequest[model.Location](
+			t,
+			router,
+			"GET",
+			"/api/devices/by-serial/device-2-serial/locations/latest",
+			validAPIKey,
+			nil,
+		)
+
+		assert.Equal(t, device.ID, latest.DeviceID, "DeviceID mismatch")
+		assert.Equal(t, 32.3, latest.Latitude, "Latitude mismatch")
+
+		operation := PerformOKRequest[api_model.Operation](
+			t,
+			router,
+			"DELETE",
+			"/api/devices/by-serial/device-2-serial/locations/"+latest.ID.Hex(),
+			validAPIKey,
+			nil,
+		)
+
+		assert.True(t, operation.Success)
+
+		operation = PerformOKRequest[api_model.Operation](
+			t,
+			router,
+			"DELETE",
+			"/api/devices/by-serial/device-2-serial/locations/",
+			validAPIKey,
+			nil,
+		)
+
+		assert.True(t, operation.Success)
+
+		locations = PerformOKRequest[[]model.Location](
+			t,
+			router,
+			"GET",
+			"/api/devices/by-serial/device-2-serial/locations/",
+			validAPIKey,
+			nil,
+		)
+
+		assert.Equal(t, 0, len(locations))
+	})
+
+	t.Run("Ingest", func(t *testing.T) {
+		t.Run("valid", func(t *testing.T) {
+			device := PerformOKRequest[model.Device](
+				t,
+				router,
+				"POST",
+				"/api/ingest",
+				validAPIKey,
+				api_model.IngestLocation{
+					Serial:    "device-3-serial",
+					Name:      "device-3-name",
+					Latitude:  Ptr(32.179111),
+					Longitude: Ptr(34.916111),
+				},
+			)
+
+			assert.Equal(t, "device-3-serial", device.Serial, "Serial mismatch")
+			assert.Equal(t, "device-3-name", device.Name, "Name mismatch")
+			if assert.NotNil(t, device.LastLocation, "LastLocation is nil") {
+				assert.Equal(t, 32.179111, device.LastLocation.Latitude, "Latitude mismatch")
+				assert.Equal(t, 34.916111, device.LastLocation.Longitude, "Longitude mismatch")
+			}
+
+			// ingesting again updates the same device
+			updated := PerformOKRequest[model.Device](
+				t,
+				router,
+				"POST",
+				"/api/ingest",
+				validAPIKey,
+				api_model.IngestLocation{
+					Serial:    "device-3-serial",
+					Name:      "renamed",
+					Latitude:  Ptr(32.086880),
+					Longitude: Ptr(34.775759),
+				},
+			)
+
+			assert.Equal(t, device.ID, updated.ID, "ID mismatch")
+			assert.Equal(t, "renamed", updated.Name, "Name mismatch")
+			if assert.NotNil(t, updated.LastLocation, "LastLocation is nil") {
+				assert.Equal(t, 32.086880, updated.LastLocation.Latitude, "Latitude mismatch")
+			}
+
+			locations := PerformOKRequest[[]model.Location](
+				t,
+				router,
+				"GET",
+				"/api/devices/by-serial/device-3-serial/locations/",
+				validAPIKey,
+				nil,
+			)
+
+			assert.Equal(t, 2, len(locations))
+		})
+
+		t.Run("invalid params", func(t *testing.T) {
+			errRes := PerformFailedRequest(
+				t,
+				router,
+				"POST",
+				"/api/ingest",
+				validAPIKey,
+				api_model.IngestLocation{
+					Serial:    "device-4-serial",
+					Latitude:  Ptr(91.0),
+					Longitude: Ptr(34.775759),
+				},
+				http.StatusBadRequest,
+			)
+
+			assert.Equal(t, "Bad request", errRes.Message, "Error message mismatch")
+		})
+	})
+}
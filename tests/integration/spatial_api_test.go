@@ -0,0 +1,192 @@
+package integration
+
+import (
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpatialAPI(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+
+	router := SetupTestEnv(t, TestEnvParams{
+		DatabaseName: "dwimc_test",
+		SecretAPIKey: validAPIKey,
+	})
+
+	createDeviceAt := func(serial string, payload api_model.CreateLocation) model.Device {
+		device := PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			"/api/devices/",
+			validAPIKey,
+			api_model.CreateDevice{
+				Serial: serial,
+				Name:   serial + "-name",
+			},
+		)
+
+		operation := PerformOKRequest[api_model.Operation](
+			t,
+			router,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/locations/", device.ID.Hex()),
+			validAPIKey,
+			payload,
+		)
+
+		assert.True(t, operation.Success)
+
+		return device
+	}
+
+	telAviv := createDeviceAt("device-1-serial", api_model.CreateLocation{
+		Latitude:  Ptr(32.085300),
+		Longitude: Ptr(34.781800),
+	})
+	jerusalem := createDeviceAt("device-2-serial", api_model.CreateLocation{
+		Latitude:  Ptr(31.768300),
+		Longitude: Ptr(35.213700),
+	})
+	createDeviceAt("device-3-serial", api_model.CreateLocation{
+		Latitude:  Ptr(32.794000),
+		Longitude: Ptr(34.989600),
+	})
+
+	t.Run("Get Near Locations", func(t *testing.T) {
+		t.Run("valid", func(t *testing.T) {
+			locations := PerformOKRequest[[]model.Location](
+				t,
+				router,
+				"GET",
+				"/api/locations/near?latitude=32.080000&longitude=34.780000&max_distance=10000",
+				validAPIKey,
+				nil,
+			)
+
+			assert.Equal(t, 1, len(locations))
+			assert.Equal(t, telAviv.ID, locations[0].DeviceID, "DeviceID mismatch")
+		})
+
+		t.Run("nearest first", func(t *testing.T) {
+			locations := PerformOKRequest[[]model.Location](
+				t,
+				router,
+				"GET",
+				"/api/locations/near?latitude=31.780000&longitude=35.200000&max_distance=60000",
+				validAPIKey,
+				nil,
+			)
+
+			assert.Equal(t, 2, len(locations))
+			assert.Equal(t, jerusalem.ID, locations[0].DeviceID, "DeviceID mismatch")
+			assert.Equal(t, telAviv.ID, locations[1].DeviceID, "DeviceID mismatch")
+		})
+
+		t.Run("nothing", func(t *testing.T) {
+			locations := PerformOKRequest[[]model.Location](
+				t,
+				router,
+				"GET",
+				"/api/locations/near?latitude=40.712800&longitude=-74.006000&max_distance=10000",
+				validAPIKey,
+				nil,
+			)
+
+			assert.Equal(t, 0, len(locations))
+		})
+
+		t.Run("invalid params", func(t *testing.T) {
+			queries := []string{
+				"",
+				"latitude=32.080000&longitude=34.780000",
+				"latitude=200.000000&longitude=34.780000&max_distance=10000",
+				"latitude=32.080000&longitude=34.780000&max_distance=-1",
+			}
+
+			for _, query := range queries {
+				errRes := PerformFailedRequest(
+					t,
+					router,
+					"GET",
+					"/api/locations/near?"+query,
+					validAPIKey,
+					nil,
+					http.StatusBadRequest,
+				)
+
+				assert.Equal(t, "Bad request", errRes.Message, "Error message mismatch")
+			}
+		})
+	})
+
+	t.Run("Get Locations Within", func(t *testing.T) {
+		t.Run("valid", func(t *testing.T) {
+			locations := PerformOKRequest[[]model.Location](
+				t,
+				router,
+				"POST",
+				"/api/locations/within",
+				validAPIKey,
+				api_model.WithinLocations{
+					Polygon: []model.Coordinates{
+						{Latitude: 32.000000, Longitude: 34.700000},
+						{Latitude: 32.000000, Longitude: 34.900000},
+						{Latitude: 32.200000, Longitude: 34.900000},
+						{Latitude: 32.200000, Longitude: 34.700000},
+					},
+				},
+			)
+
+			assert.Equal(t, 1, len(locations))
+			assert.Equal(t, telAviv.ID, locations[0].DeviceID, "DeviceID mismatch")
+			assert.Equal(t, 32.085300, locations[0].Latitude, "Latitude mismatch")
+			assert.Equal(t, 34.781800, locations[0].Longitude, "Longitude mismatch")
+		})
+
+		t.Run("invalid params", func(t *testing.T) {
+			payloads := []api_model.WithinLocations{
+				{},
+				{
+					Polygon: []model.Coordinates{
+						{Latitude: 32.000000, Longitude: 34.700000},
+						{Latitude: 32.000000, Longitude: 34.900000},
+					},
+				},
+				{
+					Polygon: []model.Coordinates{
+						{Latitude: 32.000000, Longitude: 34.700000},
+						{Latitude: 32.000000, Longitude: 34.900000},
+						{Latitude: 32.000000, Longitude: 34.700000},
+					},
+				},
+				{
+					Polygon: []model.Coordinates{
+						{Latitude: 132.000000, Longitude: 34.700000},
+						{Latitude: 32.000000, Longitude: 34.900000},
+						{Latitude: 32.200000, Longitude: 34.900000},
+					},
+				},
+			}
+
+			for _, payload := range payloads {
+				errRes := PerformFailedRequest(
+					t,
+					router,
+					"POST",
+					"/api/locations/within",
+					validAPIKey,
+					payload,
+					http.StatusBadRequest,
+				)
+
+				assert.Equal(t, "Bad request", errRes.Message, "Error message mismatch")
+			}
+		})
+	})
+}
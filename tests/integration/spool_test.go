@@ -0,0 +1,355 @@
+package integration
+
+import (
+	"context"
+	"dwimc/internal/api"
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
+	"dwimc/internal/services"
+	"dwimc/internal/spool"
+	"dwimc/internal/utils"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// unavailableDeviceService fails like an unavailable database while down is set
+type unavailableDeviceService struct {
+	services.DeviceService
+	down *atomic.Bool
+}
+
+func (s unavailableDeviceService) Exists(ctx context.Context, id string) (bool, error) {
+	if s.down.Load() {
+		return false, utils.AsError(model.ErrDatabase, "database is unavailable")
+	}
+
+	return s.DeviceService.Exists(ctx, id)
+}
+
+func (s unavailableDeviceService) GetBySerial(ctx context.Context, serial string) (*model.Device, error) {
+	if s.down.Load() {
+		return nil, utils.AsError(model.ErrDatabase, "database is unavailable")
+	}
+
+	return s.DeviceService.GetBySerial(ctx, serial)
+}
+
+// unavailableIdempotencyService fails like an unavailable database while down is set
+type unavailableIdempotencyService struct {
+	services.IdempotencyService
+	down *atomic.Bool
+}
+
+func (s unavailableIdempotencyService) Begin(ctx context.Context, key string, requestHash string) (*model.IdempotencyKey, error) {
+	if s.down.Load() {
+		return nil, utils.AsError(model.ErrDatabase, "database is unavailable")
+	}
+
+	return s.IdempotencyService.Begin(ctx, key, requestHash)
+}
+
+// unavailableLocationService fails like an unavailable database while down is set
+type unavailableLocationService struct {
+	services.LocationService
+	down *atomic.Bool
+}
+
+func (s unavailableLocationService) Create(
+	ctx context.Context,
+	deviceID string,
+	latitude float64,
+	longitude float64,
+	recordedAt *time.Time,
+	telemetry model.Telemetry,
+) (*model.Location, error) {
+	if s.down.Load() {
+		return nil, utils.AsError(model.ErrDatabase, "database is unavailable")
+	}
+
+	return s.LocationService.Create(ctx, deviceID, latitude, longitude, recordedAt, telemetry)
+}
+
+func TestLocationSpool(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+
+	_, testServices := SetupTestEnvWithServices(t, TestEnvParams{
+		DatabaseName: "dwimc_test",
+		SecretAPIKey: validAPIKey,
+	})
+
+	locationSpool, err := spool.Open(t.TempDir())
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, locationSpool.Close())
+	})
+
+	devicesDown := &atomic.Bool{}
+	locationsDown := &atomic.Bool{}
+
+	router := api.InitializeRouters(
+		false,
+		validAPIKey,
+		TEST_REQUEST_TIMEOUT,
+		TEST_IMPORT_TIMEOUT,
+		TEST_IMPORT_MAX_SIZE,
+		func() bool { return true },
+		unavailableDeviceService{DeviceService: testServices.Device, down: devicesDown},
+		unavailableLocationService{LocationService: testServices.Location, down: locationsDown},
+		locationSpool,
+		nil,
+	)
+
+	device := PerformOKRequest[model.Device](
+		t,
+		router,
+		"POST",
+		"/api/devices/",
+		validAPIKey,
+		api_model.CreateDevice{
+			Serial: "device-1-serial",
+			Name:   "device-1-name",
+		},
+	)
+	deviceID := device.ID.Hex()
+
+	postLocationAt := func(path string, latitude float64) int {
+		w := performRequest(
+			router,
+			"POST",
+			path,
+			validAPIKey,
+			api_model.CreateLocation{
+				Latitude:  Ptr(latitude),
+				Longitude: Ptr(34.775759),
+			},
+		)
+
+		return w.Code
+	}
+
+	postLocation := func(deviceID string, latitude float64) int {
+		return postLocationAt(fmt.Sprintf("/api/devices/%s/locations/", deviceID), latitude)
+	}
+
+	getLocations := func() []model.Location {
+		return PerformOKRequest[[]model.Location](
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+			validAPIKey,
+			nil,
+		)
+	}
+
+	t.Run("Spool", func(t *testing.T) {
+		devicesDown.Store(true)
+		locationsDown.Store(true)
+
+		// spooled before the device is verified
+		assert.Equal(t, http.StatusAccepted, postLocation(deviceID, 32.1))
+		assert.Equal(t, http.StatusAccepted, postLocation(bson.NewObjectID().Hex(), 32.2))
+
+		// spooled after the device is verified
+		devicesDown.Store(false)
+		assert.Equal(t, http.StatusAccepted, postLocation(deviceID, 32.3))
+
+		// invalid requests are never spooled
+		assert.Equal(t, http.StatusBadRequest, postLocation("invalid-id", 32.4))
+		devicesDown.Store(true)
+		w := performRequest(
+			router,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+			validAPIKey,
+			api_model.CreateLocation{Latitude: Ptr(0.0), Longitude: Ptr(0.0)},
+		)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		devicesDown.Store(false)
+
+		// by-serial posts are never spooled, resolved or not
+		bySerial := "/api/devices/by-serial/device-1-serial/locations/"
+		assert.Equal(t, http.StatusInternalServerError, postLocationAt(bySerial, 32.4))
+		devicesDown.Store(true)
+		assert.Equal(t, http.StatusInternalServerError, postLocationAt(bySerial, 32.4))
+		devicesDown.Store(false)
+
+		locationsDown.Store(false)
+		assert.Empty(t, getLocations())
+	})
+
+	t.Run("Replay", func(t *testing.T) {
+		// the database is still unavailable, nothing is lost
+		replayed, err := locationSpool.Replay(
+			context.Background(),
+			func(ctx context.Context, entry spool.Entry) error {
+				return utils.AsError(model.ErrDatabase, "database is unavailable")
+			},
+		)
+		assert.ErrorIs(t, err, model.ErrDatabase)
+		assert.Equal(t, 0, replayed)
+
+		replay := spool.Replayer(testServices.Location, nil)
+
+		spooled := []model.Location{}
+		replayed, err = locationSpool.Replay(
+			context.Background(),
+			func(ctx context.Context, entry spool.Entry) error {
+				spooled = append(spooled, entry.Location)
+				return replay(ctx, entry)
+			},
+		)
+		require.NoError(t, err)
+
+		// the location of the missing device is dropped
+		assert.Equal(t, 2, replayed)
+		require.Len(t, spooled, 3)
+
+		locations := getLocations()
+		require.Len(t, locations, 2)
+
+		// the order and time of the posts are kept
+		assert.Equal(t, 32.1, locations[0].Latitude)
+		assert.Equal(t, 32.3, locations[1].Latitude)
+		assert.Equal(t, spooled[0].CreatedAt, locations[0].CreatedAt)
+		assert.Equal(t, spooled[2].CreatedAt, locations[1].CreatedAt)
+
+		device := PerformOKRequest[model.Device](t, router, "GET", "/api/devices/"+deviceID, validAPIKey, nil)
+		require.NotNil(t, device.LastLocation)
+		assert.Equal(t, 32.3, device.LastLocation.Latitude)
+
+		// replaying again doesn't duplicate
+		require.NoError(t, testServices.Location.Replay(context.Background(), spooled[0]))
+		assert.Len(t, getLocations(), 2)
+
+		replayed, err = locationSpool.Replay(context.Background(), replay)
+		require.NoError(t, err)
+		assert.Equal(t, 0, replayed)
+
+		// validated as if created when it was spooled
+		noFix := spooled[0]
+		noFix.ID = bson.NewObjectID()
+		noFix.Latitude, noFix.Longitude = 0, 0
+		assert.ErrorIs(t, testServices.Location.Replay(context.Background(), noFix), model.ErrInvalidArgs)
+
+		ahead := spooled[0]
+		ahead.ID = bson.NewObjectID()
+		ahead.RecordedAt = ahead.CreatedAt.Add(time.Hour)
+		assert.ErrorIs(t, testServices.Location.Replay(context.Background(), ahead), model.ErrInvalidArgs)
+
+		assert.Len(t, getLocations(), 2)
+	})
+
+	t.Run("Not Spooled", func(t *testing.T) {
+		// location posts succeed while the database is available
+		assert.Equal(t, http.StatusOK, postLocation(deviceID, 32.5))
+		assert.Len(t, getLocations(), 3)
+
+		// a missing device is known while the database is available
+		assert.Equal(t, http.StatusNotFound, postLocation(bson.NewObjectID().Hex(), 32.6))
+	})
+}
+
+func TestLocationSpoolIdempotency(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+
+	_, testServices := SetupTestEnvWithServices(t, TestEnvParams{
+		DatabaseName:      "dwimc_test",
+		SecretAPIKey:      validAPIKey,
+		IdempotencyKeyTTL: time.Hour,
+	})
+
+	locationSpool, err := spool.Open(t.TempDir())
+	require.NoError(t, err)
+
+	t.Cleanup(func() {
+		require.NoError(t, locationSpool.Close())
+	})
+
+	down := &atomic.Bool{}
+
+	router := api.InitializeRouters(
+		false,
+		validAPIKey,
+		TEST_REQUEST_TIMEOUT,
+		TEST_IMPORT_TIMEOUT,
+		TEST_IMPORT_MAX_SIZE,
+		func() bool { return true },
+		testServices.Device,
+		unavailableLocationService{LocationService: testServices.Location, down: down},
+		locationSpool,
+		unavailableIdempotencyService{IdempotencyService: testServices.Idempotency, down: down},
+	)
+
+	device := PerformOKRequest[model.Device](
+		t,
+		router,
+		"POST",
+		"/api/devices/",
+		validAPIKey,
+		api_model.CreateDevice{
+			Serial: "device-1-serial",
+			Name:   "device-1-name",
+		},
+	)
+	deviceID := device.ID.Hex()
+
+	replay := spool.Replayer(testServices.Location, testServices.Idempotency)
+
+	postLocation := func(key string, latitude float64) *httptest.ResponseRecorder {
+		return performRequest(
+			router,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+			validAPIKey,
+			api_model.CreateLocation{
+				Latitude:  Ptr(latitude),
+				Longitude: Ptr(34.775759),
+			},
+			RequestHeader{"Idempotency-Key", key},
+		)
+	}
+
+	t.Run("Retried before replayed", func(t *testing.T) {
+		down.Store(true)
+		require.Equal(t, http.StatusAccepted, postLocation("location-key-1", 32.1).Code)
+		down.Store(false)
+
+		// the retry is recorded, the spooled post isn't recorded again
+		require.Equal(t, http.StatusOK, postLocation("location-key-1", 32.1).Code)
+
+		replayed, err := locationSpool.Replay(context.Background(), replay)
+		require.NoError(t, err)
+		assert.Equal(t, 1, replayed)
+
+		assert.Len(t, GetLocations(t, router, validAPIKey, deviceID), 1)
+	})
+
+	t.Run("Replayed before retried", func(t *testing.T) {
+		down.Store(true)
+		accepted := postLocation("location-key-2", 32.2)
+		require.Equal(t, http.StatusAccepted, accepted.Code)
+		down.Store(false)
+
+		replayed, err := locationSpool.Replay(context.Background(), replay)
+		require.NoError(t, err)
+		assert.Equal(t, 1, replayed)
+
+		// the retry gets the response the post was accepted with
+		retry := postLocation("location-key-2", 32.2)
+		require.Equal(t, http.StatusAccepted, retry.Code)
+		assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+		assert.Equal(t, accepted.Body.String(), retry.Body.String())
+
+		assert.Len(t, GetLocations(t, router, validAPIKey, deviceID), 2)
+	})
+}
@@ -0,0 +1,214 @@
+package integration
+
+import (
+	"context"
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+func TestStationaryLocations(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+
+	at := FromHourAgo()
+
+	getLastLocation := func(t *testing.T, router *gin.Engine, deviceID string) *model.Location {
+		device := PerformOKRequest[model.Device](t, router, "GET", "/api/devices/"+deviceID, validAPIKey, nil)
+		return device.LastLocation
+	}
+
+	// Tel Aviv, a fix 10m away and one 1km away
+	parked := api_model.CreateLocation{Latitude: Ptr(32.086880), Longitude: Ptr(34.775759)}
+	nearby := api_model.CreateLocation{Latitude: Ptr(32.086970), Longitude: Ptr(34.775759)}
+	faraway := api_model.CreateLocation{Latitude: Ptr(32.095880), Longitude: Ptr(34.775759)}
+
+	fix := func(location api_model.CreateLocation, offset time.Duration) api_model.CreateLocation {
+		location.RecordedAt = at(offset)
+		return location
+	}
+
+	t.Run("Refreshed", func(t *testing.T) {
+		router, _, deviceID := SetupDeviceTestEnv(t, validAPIKey, TestEnvParams{StationaryRadius: 50, LocationHistoryLimit: 2})
+
+		CreateLocation(t, router, validAPIKey, deviceID, fix(parked, 0))
+
+		// updated_at is kept in milliseconds precision
+		time.Sleep(5 * time.Millisecond)
+
+		CreateLocation(t, router, validAPIKey, deviceID, fix(nearby, time.Minute))
+		CreateLocation(t, router, validAPIKey, deviceID, fix(parked, 2*time.Minute))
+
+		locations := GetLocations(t, router, validAPIKey, deviceID)
+		require.Len(t, locations, 1)
+
+		refreshed := locations[0]
+		assert.Equal(t, int64(3), refreshed.SeenCount)
+		assert.Equal(t, *parked.Latitude, refreshed.Latitude)
+		assert.True(t, refreshed.UpdatedAt.After(refreshed.CreatedAt), "updated_at wasn't advanced")
+		// still the time it was first seen
+		assert.Equal(t, *at(0), refreshed.RecordedAt)
+
+		lastLocation := getLastLocation(t, router, deviceID)
+		if assert.NotNil(t, lastLocation, "LastLocation is nil") {
+			assert.Equal(t, refreshed.ID, lastLocation.ID)
+			assert.Equal(t, int64(3), lastLocation.SeenCount)
+		}
+
+		// a device on the move adds locations, the stationary ones didn't take up the history limit
+		CreateLocation(t, router, validAPIKey, deviceID, fix(faraway, 3*time.Minute))
+
+		locations = GetLocations(t, router, validAPIKey, deviceID)
+		require.Len(t, locations, 2)
+		assert.Equal(t, refreshed.ID, locations[0].ID)
+		assert.Equal(t, int64(1), locations[1].SeenCount)
+
+		lastLocation = getLastLocation(t, router, deviceID)
+		if assert.NotNil(t, lastLocation, "LastLocation is nil") {
+			assert.Equal(t, locations[1].ID, lastLocation.ID)
+		}
+	})
+
+	t.Run("Delayed", func(t *testing.T) {
+		router, _, deviceID := SetupDeviceTestEnv(t, validAPIKey, TestEnvParams{StationaryRadius: 50})
+
+		CreateLocation(t, router, validAPIKey, deviceID, fix(parked, time.Minute))
+
+		// recorded before the latest location, so it's added to the history
+		CreateLocation(t, router, validAPIKey, deviceID, fix(nearby, 0))
+
+		locations := GetLocations(t, router, validAPIKey, deviceID)
+		require.Len(t, locations, 2)
+		for _, location := range locations {
+			assert.Equal(t, int64(1), location.SeenCount)
+		}
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		router, _, deviceID := SetupDeviceTestEnv(t, validAPIKey, TestEnvParams{StationaryRadius: 50})
+
+		createBatch := func(batch []api_model.CreateLocation) []api_model.CreateLocationResult {
+			results := PerformOKRequest[[]api_model.CreateLocationResult](
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/locations/batch", deviceID),
+				validAPIKey,
+				batch,
+			)
+			require.Len(t, results, len(batch))
+			for _, result := range results {
+				require.True(t, result.Success)
+			}
+
+			return results
+		}
+
+		// folded in the order they were recorded at, not posted in
+		results := createBatch([]api_model.CreateLocation{
+			fix(nearby, 2*time.Minute),
+			fix(faraway, 3*time.Minute),
+			fix(parked, 0),
+			fix(nearby, time.Minute),
+		})
+
+		locations := GetLocations(t, router, validAPIKey, deviceID)
+		require.Len(t, locations, 2)
+
+		assert.Equal(t, int64(3), locations[0].SeenCount)
+		assert.Equal(t, int64(1), locations[1].SeenCount)
+
+		// the folded locations result in the one they refreshed
+		assert.Equal(t, locations[0].ID.Hex(), results[0].ID)
+		assert.Equal(t, locations[1].ID.Hex(), results[1].ID)
+		assert.Equal(t, locations[0].ID.Hex(), results[2].ID)
+		assert.Equal(t, locations[0].ID.Hex(), results[3].ID)
+
+		// the latest location is refreshed by a later batch
+		moved := faraway
+		moved.Longitude = Ptr(*faraway.Longitude + 0.0001)
+		results = createBatch([]api_model.CreateLocation{fix(moved, 4*time.Minute), fix(faraway, 5*time.Minute)})
+
+		locations = GetLocations(t, router, validAPIKey, deviceID)
+		require.Len(t, locations, 2)
+		assert.Equal(t, int64(3), locations[1].SeenCount)
+		assert.Equal(t, locations[1].ID.Hex(), results[0].ID)
+		assert.Equal(t, locations[1].ID.Hex(), results[1].ID)
+
+		lastLocation := getLastLocation(t, router, deviceID)
+		if assert.NotNil(t, lastLocation, "LastLocation is nil") {
+			assert.Equal(t, locations[1].ID, lastLocation.ID)
+			assert.Equal(t, int64(3), lastLocation.SeenCount)
+		}
+	})
+
+	t.Run("Replayed", func(t *testing.T) {
+		router, testServices, deviceID := SetupDeviceTestEnv(t, validAPIKey, TestEnvParams{StationaryRadius: 50})
+		objectID, err := bson.ObjectIDFromHex(deviceID)
+		require.NoError(t, err)
+
+		CreateLocation(t, router, validAPIKey, deviceID, fix(parked, 0))
+
+		// spooled the way the location router does, while the database was unavailable
+		spooled := func(location api_model.CreateLocation, offset time.Duration) model.Location {
+			receivedAt := time.Now().UTC().Add(time.Second).Truncate(time.Millisecond)
+
+			return model.Location{
+				ID:         bson.NewObjectIDFromTimestamp(receivedAt),
+				CreatedAt:  receivedAt,
+				UpdatedAt:  receivedAt,
+				RecordedAt: *at(offset),
+				DeviceID:   objectID,
+				Latitude:   *location.Latitude,
+				Longitude:  *location.Longitude,
+			}
+		}
+
+		stationary := spooled(nearby, time.Minute)
+		require.NoError(t, testServices.Location.Replay(context.Background(), stationary))
+
+		locations := GetLocations(t, router, validAPIKey, deviceID)
+		require.Len(t, locations, 1)
+		assert.Equal(t, int64(2), locations[0].SeenCount)
+		assert.Equal(t, stationary.CreatedAt, locations[0].UpdatedAt)
+
+		// replaying it again doesn't count it twice
+		require.NoError(t, testServices.Location.Replay(context.Background(), stationary))
+
+		locations = GetLocations(t, router, validAPIKey, deviceID)
+		require.Len(t, locations, 1)
+		assert.Equal(t, int64(2), locations[0].SeenCount)
+
+		// a device on the move adds the replayed location
+		moving := spooled(faraway, 2*time.Minute)
+		require.NoError(t, testServices.Location.Replay(context.Background(), moving))
+
+		locations = GetLocations(t, router, validAPIKey, deviceID)
+		require.Len(t, locations, 2)
+		assert.Equal(t, moving.ID, locations[1].ID)
+
+		lastLocation := getLastLocation(t, router, deviceID)
+		if assert.NotNil(t, lastLocation, "LastLocation is nil") {
+			assert.Equal(t, moving.ID, lastLocation.ID)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		router, _, deviceID := SetupDeviceTestEnv(t, validAPIKey, TestEnvParams{})
+
+		CreateLocation(t, router, validAPIKey, deviceID, fix(parked, 0))
+		CreateLocation(t, router, validAPIKey, deviceID, fix(parked, time.Minute))
+
+		locations := GetLocations(t, router, validAPIKey, deviceID)
+		require.Len(t, locations, 2)
+		for _, location := range locations {
+			assert.Equal(t, int64(1), location.SeenCount)
+		}
+	})
+}
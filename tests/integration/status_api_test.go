@@ -0,0 +1,53 @@
+package integration
+
+import (
+	"dwimc/internal/api"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatusAPI(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+
+	getStatus := func(router *gin.Engine, url string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", url, nil)
+
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("Not Ready", func(t *testing.T) {
+		router := api.InitializeStatusRouters(false, func() bool { return false })
+
+		assert.Equal(t, http.StatusOK, getStatus(router, "/healthz"))
+		assert.Equal(t, http.StatusOK, getStatus(router, "/livez"))
+		assert.Equal(t, http.StatusServiceUnavailable, getStatus(router, "/readyz"))
+
+		errRes := PerformFailedRequest(
+			t,
+			router,
+			"GET",
+			"/api/devices/",
+			validAPIKey,
+			nil,
+			http.StatusServiceUnavailable,
+		)
+
+		assert.Equal(t, "Service unavailable", errRes.Message, "Error message mismatch")
+	})
+
+	t.Run("Ready", func(t *testing.T) {
+		router := SetupTestEnv(t, TestEnvParams{
+			DatabaseName: "dwimc_test",
+			SecretAPIKey: validAPIKey,
+		})
+
+		assert.Equal(t, http.StatusOK, getStatus(router, "/livez"))
+		assert.Equal(t, http.StatusOK, getStatus(router, "/readyz"))
+	})
+}
@@ -0,0 +1,373 @@
+package integration
+
+import (
+	"context"
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrashAPI(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+	const count = 3
+
+	router, services := SetupTestEnvWithServices(t, TestEnvParams{
+		DatabaseName: "dwimc_test",
+		SecretAPIKey: validAPIKey,
+	})
+
+	createDevice := func(serial string) model.Device {
+		return PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			"/api/devices/",
+			validAPIKey,
+			api_model.CreateDevice{
+				Serial: serial,
+				Name:   serial + "-name",
+			},
+		)
+	}
+
+	createLocations := func(deviceID string) {
+		for i := range count {
+			operation := PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+				validAPIKey,
+				api_model.CreateLocation{
+					Latitude:  Ptr(32.086880 + float64(i)),
+					Longitude: Ptr(34.775759),
+				},
+			)
+
+			assert.True(t, operation.Success)
+		}
+	}
+
+	getLocations := func(deviceID string) []model.Location {
+		return PerformOKRequest[[]model.Location](
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+			validAPIKey,
+			nil,
+		)
+	}
+
+	getTrashedLocations := func(deviceID string) []model.Location {
+		return PerformOKRequest[[]model.Location](
+			t,
+			router,
+			"GET",
+			fmt.Sprintf("/api/devices/%s/locations/trash", deviceID),
+			validAPIKey,
+			nil,
+		)
+	}
+
+	getDevice := func(deviceID string) model.Device {
+		return PerformOKRequest[model.Device](
+			t,
+			router,
+			"GET",
+			"/api/devices/"+deviceID,
+			validAPIKey,
+			nil,
+		)
+	}
+
+	getTrashedDeviceIDs := func() []string {
+		devices := PerformOKRequest[[]model.Device](
+			t,
+			router,
+			"GET",
+			"/api/devices/trash",
+			validAPIKey,
+			nil,
+		)
+
+		ids := make([]string, 0, len(devices))
+		for _, device := range devices {
+			assert.NotNil(t, device.DeletedAt, "DeletedAt is nil")
+			ids = append(ids, device.ID.Hex())
+		}
+
+		return ids
+	}
+
+	deleteDevice := func(deviceID string) {
+		result := PerformOKRequest[api_model.DeleteDeviceResult](
+			t,
+			router,
+			"DELETE",
+			"/api/devices/"+deviceID,
+			validAPIKey,
+			nil,
+		)
+
+		assert.True(t, result.Success)
+		assert.Equal(t, int64(count), result.DeletedLocations)
+	}
+
+	t.Run("Device", func(t *testing.T) {
+		t.Run("delete and restore", func(t *testing.T) {
+			device := createDevice("device-1-serial")
+			deviceID := device.ID.Hex()
+			createLocations(deviceID)
+
+			deleteDevice(deviceID)
+
+			PerformFailedRequest(t, router, "GET", "/api/devices/"+deviceID, validAPIKey, nil, http.StatusNotFound)
+
+			devices := PerformOKRequest[[]model.Device](t, router, "GET", "/api/devices/", validAPIKey, nil)
+			for _, d := range devices {
+				assert.NotEqual(t, device.ID, d.ID, "Deleted device is listed")
+			}
+
+			assert.Contains(t, getTrashedDeviceIDs(), deviceID)
+
+			restored := PerformOKRequest[model.Device](
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/restore", deviceID),
+				validAPIKey,
+				nil,
+			)
+
+			assert.Equal(t, device.ID, restored.ID, "ID mismatch")
+			assert.Nil(t, restored.DeletedAt, "DeletedAt is not nil")
+			assert.NotContains(t, getTrashedDeviceIDs(), deviceID)
+			assert.Len(t, getLocations(deviceID), count)
+			assert.Empty(t, getTrashedLocations(deviceID))
+		})
+
+		t.Run("restore keeps locations deleted earlier in the trash", func(t *testing.T) {
+			device := createDevice("device-2-serial")
+			deviceID := device.ID.Hex()
+			createLocations(deviceID)
+
+			locations := getLocations(deviceID)
+			require.Len(t, locations, count)
+
+			operation := PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"DELETE",
+				fmt.Sprintf("/api/devices/%s/locations/%s", deviceID, locations[0].ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			assert.True(t, operation.Success)
+
+			// the deletion times of the location and the device must differ
+			time.Sleep(5 * time.Millisecond)
+
+			result := PerformOKRequest[api_model.DeleteDeviceResult](
+				t,
+				router,
+				"DELETE",
+				"/api/devices/"+deviceID,
+				validAPIKey,
+				nil,
+			)
+			assert.Equal(t, int64(count-1), result.DeletedLocations)
+
+			PerformOKRequest[model.Device](
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/restore", deviceID),
+				validAPIKey,
+				nil,
+			)
+
+			assert.Len(t, getLocations(deviceID), count-1)
+
+			trashed := getTrashedLocations(deviceID)
+			require.Len(t, trashed, 1)
+			assert.Equal(t, locations[0].ID, trashed[0].ID, "ID mismatch")
+		})
+
+		t.Run("create revives a deleted serial", func(t *testing.T) {
+			device := createDevice("device-3-serial")
+			deviceID := device.ID.Hex()
+			createLocations(deviceID)
+			deleteDevice(deviceID)
+
+			revived := createDevice("device-3-serial")
+
+			assert.Equal(t, device.ID, revived.ID, "ID mismatch")
+			assert.Nil(t, revived.DeletedAt, "DeletedAt is not nil")
+			assert.Nil(t, revived.LastLocation, "LastLocation is not nil")
+			assert.Empty(t, getLocations(deviceID))
+			assert.Len(t, getTrashedLocations(deviceID), count)
+		})
+
+		t.Run("not in trash", func(t *testing.T) {
+			device := createDevice("device-4-serial")
+
+			PerformFailedRequest(
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/restore", device.ID.Hex()),
+				validAPIKey,
+				nil,
+				http.StatusNotFound,
+			)
+		})
+	})
+
+	t.Run("Location", func(t *testing.T) {
+		t.Run("delete all and restore", func(t *testing.T) {
+			device := createDevice("device-5-serial")
+			deviceID := device.ID.Hex()
+			createLocations(deviceID)
+
+			latest := getDevice(deviceID).LastLocation
+			require.NotNil(t, latest)
+
+			operation := PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"DELETE",
+				fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+				validAPIKey,
+				nil,
+			)
+			assert.True(t, operation.Success)
+
+			assert.Empty(t, getLocations(deviceID))
+			assert.Len(t, getTrashedLocations(deviceID), count)
+			assert.Nil(t, getDevice(deviceID).LastLocation, "LastLocation is not nil")
+
+			operation = PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/locations/restore", deviceID),
+				validAPIKey,
+				nil,
+			)
+			assert.True(t, operation.Success)
+
+			assert.Len(t, getLocations(deviceID), count)
+			assert.Empty(t, getTrashedLocations(deviceID))
+
+			restoredLatest := getDevice(deviceID).LastLocation
+			require.NotNil(t, restoredLatest)
+			assert.Equal(t, latest.ID, restoredLatest.ID, "LastLocation mismatch")
+		})
+
+		t.Run("delete and restore latest", func(t *testing.T) {
+			device := createDevice("device-6-serial")
+			deviceID := device.ID.Hex()
+			createLocations(deviceID)
+
+			latest := getDevice(deviceID).LastLocation
+			require.NotNil(t, latest)
+
+			operation := PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"DELETE",
+				fmt.Sprintf("/api/devices/%s/locations/%s", deviceID, latest.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			assert.True(t, operation.Success)
+
+			current := getDevice(deviceID).LastLocation
+			require.NotNil(t, current)
+			assert.NotEqual(t, latest.ID, current.ID, "LastLocation was not recomputed")
+
+			operation = PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/locations/%s/restore", deviceID, latest.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			assert.True(t, operation.Success)
+
+			current = getDevice(deviceID).LastLocation
+			require.NotNil(t, current)
+			assert.Equal(t, latest.ID, current.ID, "LastLocation mismatch")
+
+			// restoring a location which is not in the trash does nothing
+			operation = PerformOKRequest[api_model.Operation](
+				t,
+				router,
+				"POST",
+				fmt.Sprintf("/api/devices/%s/locations/%s/restore", deviceID, latest.ID.Hex()),
+				validAPIKey,
+				nil,
+			)
+			assert.False(t, operation.Success)
+		})
+	})
+
+	t.Run("Purge", func(t *testing.T) {
+		ctx := context.Background()
+
+		device := createDevice("device-7-serial")
+		deviceID := device.ID.Hex()
+		createLocations(deviceID)
+
+		kept := createDevice("device-8-serial")
+		keptID := kept.ID.Hex()
+		createLocations(keptID)
+
+		keptLocations := getLocations(keptID)
+		require.Len(t, keptLocations, count)
+
+		deleteDevice(deviceID)
+
+		operation := PerformOKRequest[api_model.Operation](
+			t,
+			router,
+			"DELETE",
+			fmt.Sprintf("/api/devices/%s/locations/%s", keptID, keptLocations[0].ID.Hex()),
+			validAPIKey,
+			nil,
+		)
+		assert.True(t, operation.Success)
+
+		// nothing is purged while within the grace period
+		devices, locations, err := services.Device.PurgeDeleted(ctx, time.Now().UTC().Add(-time.Hour))
+		require.NoError(t, err)
+		assert.Zero(t, devices)
+		assert.Zero(t, locations)
+		assert.Contains(t, getTrashedDeviceIDs(), deviceID)
+
+		_, _, err = services.Device.PurgeDeleted(ctx, time.Now().UTC().Add(time.Second))
+		require.NoError(t, err)
+
+		assert.NotContains(t, getTrashedDeviceIDs(), deviceID)
+		assert.Empty(t, getTrashedLocations(keptID))
+		assert.Len(t, getLocations(keptID), count-1)
+
+		PerformFailedRequest(
+			t,
+			router,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/restore", deviceID),
+			validAPIKey,
+			nil,
+			http.StatusNotFound,
+		)
+	})
+}
@@ -0,0 +1,180 @@
+package integration
+
+import (
+	api_model "dwimc/internal/api/model"
+	"dwimc/internal/model"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVersionAPI(t *testing.T) {
+	const validAPIKey = "8ZZvULIqcPzxwsfnxbWoHUTh"
+
+	router := SetupTestEnv(t, TestEnvParams{
+		DatabaseName: "dwimc_test",
+		SecretAPIKey: validAPIKey,
+	})
+
+	performConditionalRequest := func(method string, url string, ifMatch string, payload any) *httptest.ResponseRecorder {
+		return performRequest(router, method, url, validAPIKey, payload, RequestHeader{"If-Match", ifMatch})
+	}
+
+	decodeDevice := func(w *httptest.ResponseRecorder) model.Device {
+		var response api_model.Response[model.Device]
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+		return response.Data
+	}
+
+	getDevice := func(deviceID string) (model.Device, string) {
+		w := performConditionalRequest("GET", "/api/devices/"+deviceID, "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		return decodeDevice(w), w.Header().Get("ETag")
+	}
+
+	device := PerformOKRequest[model.Device](
+		t,
+		router,
+		"POST",
+		"/api/devices/",
+		validAPIKey,
+		api_model.CreateDevice{
+			Serial: "device-1-serial",
+			Name:   "device-1-name",
+		},
+	)
+	deviceID := device.ID.Hex()
+
+	t.Run("ETag", func(t *testing.T) {
+		assert.Equal(t, int64(1), device.Version)
+
+		_, etag := getDevice(deviceID)
+		assert.Equal(t, `"1"`, etag)
+
+		// the same upsert and new locations leave the version as is
+		PerformOKRequest[model.Device](
+			t,
+			router,
+			"POST",
+			"/api/devices/",
+			validAPIKey,
+			api_model.CreateDevice{
+				Serial: "device-1-serial",
+				Name:   "device-1-name",
+			},
+		)
+
+		PerformOKRequest[api_model.Operation](
+			t,
+			router,
+			"POST",
+			fmt.Sprintf("/api/devices/%s/locations/", deviceID),
+			validAPIKey,
+			api_model.CreateLocation{
+				Latitude:  Ptr(32.086880),
+				Longitude: Ptr(34.775759),
+			},
+		)
+
+		// the entity tag covers the fields set through the API only, not the last location
+		current, etag := getDevice(deviceID)
+		assert.NotNil(t, current.LastLocation, "LastLocation is nil")
+		assert.Equal(t, int64(1), current.Version)
+		assert.Equal(t, `"1"`, etag)
+
+		// and by serial
+		w := performConditionalRequest("GET", "/api/devices/by-serial/device-1-serial", "", nil)
+		assert.Equal(t, `"1"`, w.Header().Get("ETag"))
+	})
+
+	t.Run("If-Match", func(t *testing.T) {
+		rename := func(name string, ifMatch string) *httptest.ResponseRecorder {
+			return performConditionalRequest("POST", "/api/devices/", ifMatch, api_model.CreateDevice{
+				Serial: "device-1-serial",
+				Name:   name,
+			})
+		}
+
+		_, etag := getDevice(deviceID)
+
+		// the first rename wins, the second one was made against the same version
+		w := rename("renamed-1", etag)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, int64(2), decodeDevice(w).Version)
+		assert.Equal(t, `"2"`, w.Header().Get("ETag"))
+
+		w = rename("renamed-2", etag)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+		current, _ := getDevice(deviceID)
+		assert.Equal(t, "renamed-1", current.Name)
+
+		// retention
+		w = performConditionalRequest(
+			"PUT",
+			fmt.Sprintf("/api/devices/%s/retention", deviceID),
+			etag,
+			map[string]any{"retention_period": 3600},
+		)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+		w = performConditionalRequest(
+			"PUT",
+			fmt.Sprintf("/api/devices/%s/retention", deviceID),
+			`"2"`,
+			map[string]any{"retention_period": 3600},
+		)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, int64(3), decodeDevice(w).Version)
+
+		// unsupported values never match
+		for _, ifMatch := range []string{`W/"3"`, `3`, `"3", "4"`, `"abc"`} {
+			w = rename("renamed-3", ifMatch)
+			assert.Equal(t, http.StatusPreconditionFailed, w.Code, ifMatch)
+		}
+
+		// any version matches
+		w = rename("renamed-3", "*")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, int64(4), decodeDevice(w).Version)
+
+		// a conditioned upsert never creates a device
+		w = performConditionalRequest("POST", "/api/devices/", `"1"`, api_model.CreateDevice{
+			Serial: "device-2-serial",
+			Name:   "device-2-name",
+		})
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+		w = performConditionalRequest(
+			"PUT",
+			"/api/devices/67e97602e9621df49430c290/retention",
+			`"1"`,
+			map[string]any{"retention_period": 3600},
+		)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Delete and Restore", func(t *testing.T) {
+		w := performConditionalRequest("DELETE", "/api/devices/"+deviceID, `"3"`, nil)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+
+		_, etag := getDevice(deviceID)
+
+		w = performConditionalRequest("DELETE", "/api/devices/"+deviceID, etag, nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = performConditionalRequest("POST", fmt.Sprintf("/api/devices/%s/restore", deviceID), "", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		restored := decodeDevice(w)
+		assert.Equal(t, int64(6), restored.Version)
+		assert.Equal(t, `"6"`, w.Header().Get("ETag"))
+	})
+}